@@ -33,6 +33,11 @@ func main() {
 		HideHelpCommand: true,
 		Action:          lfgw.Run,
 		Before: func(c *cli.Context) error {
+			// Commands (e.g. lint-acl) have their own settings
+			if c.Args().Present() && c.App.Command(c.Args().First()) != nil {
+				return nil
+			}
+
 			nonEmptyStrings := []string{"upstream-url", "oidc-realm-url", "oidc-client-id"}
 
 			for _, key := range nonEmptyStrings {
@@ -41,30 +46,387 @@ func main() {
 				}
 			}
 
-			if c.String("acl-path") == "" && !c.Bool("assumed-roles") {
-				return fmt.Errorf("the app cannot run without at least one configuration source: defined acl-path or assumed-roles set to true")
+			if c.String("acl-path") == "" && !c.Bool("assumed-roles") && c.String("claim-acl-claim") == "" {
+				return fmt.Errorf("the app cannot run without at least one configuration source: defined acl-path, claim-acl-claim or assumed-roles set to true")
 			}
 
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "lint-acl",
+				Usage:     "Checks ACL definitions and reports time-limited roles and grants, which have expired or are about to expire",
+				UsageText: "lfgw lint-acl [flags]",
+				Action:    lfgw.LintACL,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "acl-path",
+						Usage:    "path to a file with ACL definitions",
+						EnvVars:  []string{"ACL_PATH"},
+						Value:    "./acl.yaml",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "acl-expiry-warning",
+						Usage:    "time-limited roles and grants ending within this period are reported as expiring",
+						EnvVars:  []string{"ACL_EXPIRY_WARNING"},
+						Value:    72 * time.Hour,
+						Required: false,
+					},
+				},
+			},
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:     "upstream-url",
 				Usage:    "Prometheus URL, e.g. http://prometheus.localhost",
 				EnvVars:  []string{"UPSTREAM_URL"},
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "oidc-realm-url",
 				Usage:    "OIDC Realm URL, e.g. `https://keycloak.localhost/auth/realms/monitoring",
 				EnvVars:  []string{"OIDC_REALM_URL"},
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "oidc-client-id",
 				Usage:    "OIDC Client ID (used for token audience validation)",
 				EnvVars:  []string{"OIDC_CLIENT_ID"},
-				Required: true,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "oidc-userinfo-fallback",
+				Usage:    "whether to fetch roles from the OIDC userinfo endpoint when they are missing in the token",
+				EnvVars:  []string{"OIDC_USERINFO_FALLBACK"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "oidc-userinfo-cache-ttl",
+				Usage:    "how long to cache userinfo responses per token (never longer than the token lifetime)",
+				EnvVars:  []string{"OIDC_USERINFO_CACHE_TTL"},
+				Value:    5 * time.Minute,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "oidc-login",
+				Usage:    "whether to enable the built-in login flow (authorization code flow with PKCE) for direct browser access",
+				EnvVars:  []string{"OIDC_LOGIN"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "oidc-client-secret",
+				Usage:    "OIDC client secret used in the login flow (can be omitted for public clients)",
+				EnvVars:  []string{"OIDC_CLIENT_SECRET"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "oidc-redirect-url",
+				Usage:    "URL the IdP redirects to after login, e.g. https://lfgw.localhost/oauth2/callback",
+				EnvVars:  []string{"OIDC_REDIRECT_URL"},
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "oidc-scopes",
+				Usage:    "comma-separated list of scopes requested in the login flow",
+				EnvVars:  []string{"OIDC_SCOPES"},
+				Value:    cli.NewStringSlice("openid", "profile", "email"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "session-secret",
+				Usage:    "secret used to encrypt session cookies (at least 16 characters)",
+				EnvVars:  []string{"SESSION_SECRET"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "session-cookie-name",
+				Usage:    "name of the session cookie",
+				EnvVars:  []string{"SESSION_COOKIE_NAME"},
+				Value:    "lfgw_session",
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "session-max-age",
+				Usage:    "maximum lifetime of a session, after which a user has to log in again",
+				EnvVars:  []string{"SESSION_MAX_AGE"},
+				Value:    24 * time.Hour,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "introspection-url",
+				Usage:    "OAuth2 token introspection endpoint (RFC 7662) used for opaque access tokens, e.g. https://keycloak.localhost/auth/realms/monitoring/protocol/openid-connect/token/introspect, skipped if empty",
+				EnvVars:  []string{"INTROSPECTION_URL"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "introspection-client-id",
+				Usage:    "client ID used to authenticate against the introspection endpoint (defaults to oidc-client-id)",
+				EnvVars:  []string{"INTROSPECTION_CLIENT_ID"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "introspection-client-secret",
+				Usage:    "client secret used to authenticate against the introspection endpoint",
+				EnvVars:  []string{"INTROSPECTION_CLIENT_SECRET"},
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "introspection-cache-ttl",
+				Usage:    "how long to cache results for active tokens (never longer than the token lifetime)",
+				EnvVars:  []string{"INTROSPECTION_CACHE_TTL"},
+				Value:    5 * time.Minute,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "introspection-negative-cache-ttl",
+				Usage:    "how long to cache results for inactive tokens",
+				EnvVars:  []string{"INTROSPECTION_NEGATIVE_CACHE_TTL"},
+				Value:    30 * time.Second,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "api-keys-path",
+				Usage:    "path to a file with hashed static API keys for machine clients, skipped if empty",
+				EnvVars:  []string{"API_KEYS_PATH"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "tls-cert-path",
+				Usage:    "path to a TLS certificate, TLS is enabled if both tls-cert-path and tls-key-path are set",
+				EnvVars:  []string{"TLS_CERT_PATH"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "tls-key-path",
+				Usage:    "path to a TLS private key",
+				EnvVars:  []string{"TLS_KEY_PATH"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "tls-client-ca-path",
+				Usage:    "path to a CA bundle used to verify client certificates, skipped if empty",
+				EnvVars:  []string{"TLS_CLIENT_CA_PATH"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "client-cert-rules-path",
+				Usage:    "path to a file with rules mapping client certificate identities to roles, skipped if empty",
+				EnvVars:  []string{"CLIENT_CERT_RULES_PATH"},
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "trusted-headers-auth",
+				Usage:    "whether to trust identity headers set by an authenticating proxy (e.g. oauth2-proxy) for requests from trusted sources",
+				EnvVars:  []string{"TRUSTED_HEADERS_AUTH"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "trusted-headers-cidrs",
+				Usage:    "comma-separated list of source CIDRs, from which identity headers are trusted",
+				EnvVars:  []string{"TRUSTED_HEADERS_CIDRS"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "trusted-headers-secret-header",
+				Usage:    "name of a header with a shared secret, requests carrying the secret are trusted",
+				EnvVars:  []string{"TRUSTED_HEADERS_SECRET_HEADER"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "trusted-headers-secret",
+				Usage:    "shared secret expected in trusted-headers-secret-header",
+				EnvVars:  []string{"TRUSTED_HEADERS_SECRET"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "trusted-headers-user-header",
+				Usage:    "header with a user name",
+				EnvVars:  []string{"TRUSTED_HEADERS_USER_HEADER"},
+				Value:    "X-Auth-Request-User",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "trusted-headers-email-header",
+				Usage:    "header with a user email",
+				EnvVars:  []string{"TRUSTED_HEADERS_EMAIL_HEADER"},
+				Value:    "X-Auth-Request-Email",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "trusted-headers-groups-header",
+				Usage:    "header with a comma-separated list of groups (treated as roles)",
+				EnvVars:  []string{"TRUSTED_HEADERS_GROUPS_HEADER"},
+				Value:    "X-Auth-Request-Groups",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "token-sources",
+				Usage:    "comma-separated ordered list of token sources in the form of <header|cookie|query>:<name>[:scheme=<scheme>][:untrusted]",
+				EnvVars:  []string{"TOKEN_SOURCES"},
+				Value:    cli.NewStringSlice("header:Authorization:scheme=Basic", "header:Authorization:scheme=Bearer", "header:Authorization:scheme=DPoP", "header:X-Forwarded-Access-Token", "header:X-Auth-Request-Access-Token"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "token-sources-mode",
+				Usage:    "how to handle requests with several tokens: first-match (use the first found token) or reject-conflicting (reject requests with different tokens)",
+				EnvVars:  []string{"TOKEN_SOURCES_MODE"},
+				Value:    "first-match",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "kubernetes-auth",
+				Usage:    "whether to verify Kubernetes service account tokens through the TokenReview API",
+				EnvVars:  []string{"KUBERNETES_AUTH"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-api-url",
+				Usage:    "URL of the Kubernetes API (in-cluster settings are used if empty)",
+				EnvVars:  []string{"KUBERNETES_API_URL"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-token-path",
+				Usage:    "path to the token lfgw uses to call the Kubernetes API",
+				EnvVars:  []string{"KUBERNETES_TOKEN_PATH"},
+				Value:    "/var/run/secrets/kubernetes.io/serviceaccount/token",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-ca-path",
+				Usage:    "path to the CA bundle of the Kubernetes API, system roots are used if empty",
+				EnvVars:  []string{"KUBERNETES_CA_PATH"},
+				Value:    "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "kubernetes-audiences",
+				Usage:    "comma-separated list of audiences service account tokens must be issued for, the API server audience is used if empty",
+				EnvVars:  []string{"KUBERNETES_AUDIENCES"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-acl-mode",
+				Usage:    "how to derive ACLs for service accounts: namespace (the namespace of a service account) or sar (namespaces where SubjectAccessReview allows the configured action)",
+				EnvVars:  []string{"KUBERNETES_ACL_MODE"},
+				Value:    "namespace",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-acl-label",
+				Usage:    "label, to which namespaces of service accounts are applied",
+				EnvVars:  []string{"KUBERNETES_ACL_LABEL"},
+				Value:    "namespace",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "kubernetes-sar-namespaces",
+				Usage:    "comma-separated list of candidate namespaces checked through SubjectAccessReview",
+				EnvVars:  []string{"KUBERNETES_SAR_NAMESPACES"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-sar-verb",
+				Usage:    "verb checked through SubjectAccessReview",
+				EnvVars:  []string{"KUBERNETES_SAR_VERB"},
+				Value:    "get",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "kubernetes-sar-resource",
+				Usage:    "resource checked through SubjectAccessReview in the form of <resource>[.<group>]",
+				EnvVars:  []string{"KUBERNETES_SAR_RESOURCE"},
+				Value:    "pods",
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "kubernetes-cache-ttl",
+				Usage:    "for how long TokenReview and SubjectAccessReview results are cached (never longer than the token lives), rbac changes take up to this long to apply",
+				EnvVars:  []string{"KUBERNETES_CACHE_TTL"},
+				Value:    time.Minute,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "dpop-policies",
+				Usage:    "comma-separated list of DPoP policies in the form of <issuer>=<optional|required>, * matches all other issuers, DPoP is disabled if empty",
+				EnvVars:  []string{"DPOP_POLICIES"},
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "dpop-proof-max-age",
+				Usage:    "maximum age of DPoP proofs (also the allowed clock skew)",
+				EnvVars:  []string{"DPOP_PROOF_MAX_AGE"},
+				Value:    time.Minute,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     "dpop-replay-cache-size",
+				Usage:    "maximum number of DPoP proof identifiers kept for replay protection",
+				EnvVars:  []string{"DPOP_REPLAY_CACHE_SIZE"},
+				Value:    100000,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "denylist-path",
+				Usage:    "path to a file with revoked token IDs, subjects, emails, and roles, skipped if empty",
+				EnvVars:  []string{"DENYLIST_PATH"},
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "denylist-reload-interval",
+				Usage:    "how often to check the denylist file for changes (0 disables reloading)",
+				EnvVars:  []string{"DENYLIST_RELOAD_INTERVAL"},
+				Value:    30 * time.Second,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "denylist-admin-token",
+				Usage:    "bearer token for the denylist admin endpoint, the endpoint is disabled if empty",
+				EnvVars:  []string{"DENYLIST_ADMIN_TOKEN"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "claim-acl-claim",
+				Usage:    "name of a claim, values of which are turned into a label filter directly (e.g. namespaces)",
+				EnvVars:  []string{"CLAIM_ACL_CLAIM"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "claim-acl-label",
+				Usage:    "label, to which values of claim-acl-claim are applied",
+				EnvVars:  []string{"CLAIM_ACL_LABEL"},
+				Value:    "namespace",
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "acl-expiry-warning",
+				Usage:    "time-limited roles and grants ending within this period are reported as expiring",
+				EnvVars:  []string{"ACL_EXPIRY_WARNING"},
+				Value:    72 * time.Hour,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "default-acl-role",
+				Usage:    "role from acl-path, which is merged into the ACL of every authenticated user (e.g. a shared namespace), skipped if empty",
+				EnvVars:  []string{"DEFAULT_ACL_ROLE"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "anonymous-acl-role",
+				Usage:    "role from acl-path, which is applied to requests without a token coming from anonymous-cidrs, skipped if empty",
+				EnvVars:  []string{"ANONYMOUS_ACL_ROLE"},
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "anonymous-cidrs",
+				Usage:    "comma-separated list of source CIDRs, from which requests without a token get anonymous-acl-role",
+				EnvVars:  []string{"ANONYMOUS_CIDRS"},
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "acl-path",
@@ -80,6 +442,46 @@ func main() {
 				Value:    false,
 				Required: false,
 			},
+			&cli.StringSliceFlag{
+				Name:     "assumed-roles-template",
+				Usage:    "comma-separated list of <label>=<value template> pairs used to construct acls for assumed roles, {{.Role}} is replaced with a role name",
+				EnvVars:  []string{"ASSUMED_ROLES_TEMPLATE"},
+				Value:    cli.NewStringSlice("namespace={{.Role}}"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-pattern",
+				Usage:    "fully anchored regular expression, which assumed role names (without prefix) must match",
+				EnvVars:  []string{"ASSUMED_ROLES_PATTERN"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "assumed-roles-prefix",
+				Usage:    "prefix, which assumed role names must start with (stripped before a name is used as an acl definition)",
+				EnvVars:  []string{"ASSUMED_ROLES_PREFIX"},
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "assumed-roles-allow-regex",
+				Usage:    "whether assumed role names may contain regular expressions (full access through .* is never granted)",
+				EnvVars:  []string{"ASSUMED_ROLES_ALLOW_REGEX"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "assumed-roles-validate",
+				Usage:    "whether to accept only assumed role names matching namespaces known to the upstream",
+				EnvVars:  []string{"ASSUMED_ROLES_VALIDATE"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "assumed-roles-cache-ttl",
+				Usage:    "for how long the list of upstream namespaces is cached",
+				EnvVars:  []string{"ASSUMED_ROLES_CACHE_TTL"},
+				Value:    5 * time.Minute,
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "enable-deduplication",
 				Usage:    "whether to enable deduplication, which leaves some of the requests unmodified if they match the target policy",
@@ -94,6 +496,53 @@ func main() {
 				Value:    true,
 				Required: false,
 			},
+			&cli.IntFlag{
+				Name:     "max-query-length",
+				Usage:    "maximum length of a query in characters, 0 means no limit",
+				EnvVars:  []string{"MAX_QUERY_LENGTH"},
+				Value:    0,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     "max-query-depth",
+				Usage:    "maximum depth of the syntax tree of a query, 0 means no limit",
+				EnvVars:  []string{"MAX_QUERY_DEPTH"},
+				Value:    0,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     "max-selectors",
+				Usage:    "maximum number of series selectors in a query, 0 means no limit",
+				EnvVars:  []string{"MAX_SELECTORS"},
+				Value:    0,
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "require-metric-name",
+				Usage:    "whether to reject series selectors without a metric name (e.g. {__name__=~\".+\"})",
+				EnvVars:  []string{"REQUIRE_METRIC_NAME"},
+				Value:    false,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     "max-points-per-series",
+				Usage:    "maximum ratio of the time range of a query (or a subquery) to its step, 0 means no limit",
+				EnvVars:  []string{"MAX_POINTS_PER_SERIES"},
+				Value:    0,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "required-labels",
+				Usage:    "comma-separated list of labels, which must be present as a positive matcher in every selector, <label>=<default> fills in a default value instead of rejecting a query",
+				EnvVars:  []string{"REQUIRED_LABELS"},
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "exempt-metrics",
+				Usage:    "comma- or newline-separated list of metric name patterns, which are exempt from ACLs, <pattern>{<label filters>} applies the filters instead of an ACL (e.g. up{job=\"kubelet\",instance=\"x\"}), separators inside braces are ignored",
+				EnvVars:  []string{"EXEMPT_METRICS"},
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "safe-mode",
 				Usage:    "whether to block requests to sensitive endpoints (tsdb admin, insert)",
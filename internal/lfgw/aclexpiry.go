@@ -0,0 +1,114 @@
+package lfgw
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// aclExpiryCheckInterval defines how often states of time-limited roles and grants are re-evaluated
+const aclExpiryCheckInterval = time.Minute
+
+// aclGrants holds the number of time-limited roles and grants per state
+var aclGrants = map[string]*atomic.Uint64{
+	querymodifier.ValidityStatePending:  newACLGrantsGauge(querymodifier.ValidityStatePending),
+	querymodifier.ValidityStateActive:   newACLGrantsGauge(querymodifier.ValidityStateActive),
+	querymodifier.ValidityStateExpiring: newACLGrantsGauge(querymodifier.ValidityStateExpiring),
+	querymodifier.ValidityStateExpired:  newACLGrantsGauge(querymodifier.ValidityStateExpired),
+}
+
+// newACLGrantsGauge registers a gauge reporting the number of time-limited roles and grants in the state. The numbers go up and down, so they cannot be exported as counters.
+func newACLGrantsGauge(state string) *atomic.Uint64 {
+	var count atomic.Uint64
+	metrics.NewGauge(fmt.Sprintf(`acl_time_limited_grants{state=%q}`, state), func() float64 {
+		return float64(count.Load())
+	})
+
+	return &count
+}
+
+// aclExpiryReporter keeps track of time-limited roles and grants, so that changes of their states are logged once and exported as metrics.
+type aclExpiryReporter struct {
+	grants  []querymodifier.TimeLimitedGrant
+	warning time.Duration
+	// states holds the last reported state of every grant
+	states map[string]string
+}
+
+// newACLExpiryReporter returns an aclExpiryReporter for all time-limited roles and grants found in acls. Grants are considered expiring if they end within warning.
+func newACLExpiryReporter(acls querymodifier.ACLs, warning time.Duration) *aclExpiryReporter {
+	return &aclExpiryReporter{
+		grants:  acls.TimeLimitedGrants(),
+		warning: warning,
+		states:  make(map[string]string),
+	}
+}
+
+// check evaluates states of all grants, logs the changes and updates metrics.
+func (r *aclExpiryReporter) check(now time.Time, logger *zerolog.Logger) {
+	counts := make(map[string]uint64, len(aclGrants))
+
+	for _, grant := range r.grants {
+		state := grant.State(now, r.warning)
+		counts[state]++
+
+		key := grant.String()
+		if r.states[key] == state {
+			continue
+		}
+		r.states[key] = state
+
+		switch state {
+		case querymodifier.ValidityStateExpired:
+			logger.Warn().Caller().
+				Msgf("Time-limited %s has expired %s, consider removing it from ACL", grant, grant.Period())
+		case querymodifier.ValidityStateExpiring:
+			logger.Warn().Caller().
+				Msgf("Time-limited %s expires in %s %s", grant, grant.ValidUntil.Sub(now).Round(time.Minute), grant.Period())
+		default:
+			logger.Info().Caller().
+				Msgf("Time-limited %s is %s %s", grant, state, grant.Period())
+		}
+	}
+
+	for state, count := range aclGrants {
+		count.Store(counts[state])
+	}
+}
+
+// watch periodically re-evaluates states of all grants until done is closed.
+func (r *aclExpiryReporter) watch(interval time.Duration, logger *zerolog.Logger, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			r.check(now, logger)
+		}
+	}
+}
+
+// lintACLs returns a message for every time-limited role or grant, which has expired or expires within warning. The second value is true if any of them has expired.
+func lintACLs(acls querymodifier.ACLs, now time.Time, warning time.Duration) ([]string, bool) {
+	var messages []string
+	expired := false
+
+	for _, grant := range acls.TimeLimitedGrants() {
+		switch grant.State(now, warning) {
+		case querymodifier.ValidityStateExpired:
+			expired = true
+			messages = append(messages, fmt.Sprintf("ERROR: %s has expired %s", grant, grant.Period()))
+		case querymodifier.ValidityStateExpiring:
+			messages = append(messages, fmt.Sprintf("WARNING: %s expires in %s %s", grant, grant.ValidUntil.Sub(now).Round(time.Minute), grant.Period()))
+		}
+	}
+
+	return messages, expired
+}
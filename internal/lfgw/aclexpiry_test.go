@@ -0,0 +1,164 @@
+package lfgw
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// newTimeLimitedACLs returns ACLs with an expired role, an expiring grant and a pending grant relative to now
+func newTimeLimitedACLs(t *testing.T, now time.Time) querymodifier.ACLs {
+	t.Helper()
+
+	aclA, err := querymodifier.NewACL("metrics:\n  namespace: 'a'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclB, err := querymodifier.NewACL("metrics:\n  namespace: 'b'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := aclA
+	expired.Validity = querymodifier.Validity{ValidUntil: now.Add(-time.Hour)}
+
+	withGrants := aclA
+	withGrants.Grants = []querymodifier.Grant{
+		{Validity: querymodifier.Validity{ValidUntil: now.Add(time.Hour)}, ACL: aclB},
+		{Validity: querymodifier.Validity{ValidFrom: now.Add(time.Hour)}, ACL: aclB},
+	}
+
+	return querymodifier.ACLs{"incident": expired, "team-a": withGrants, "team-b": aclB}
+}
+
+func TestACLExpiryReporter_check(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	acls := newTimeLimitedACLs(t, now)
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+
+	r := newACLExpiryReporter(acls, 24*time.Hour)
+	assert.Len(t, r.grants, 3)
+
+	r.check(now, &logger)
+	assert.Equal(t, uint64(1), aclGrants[querymodifier.ValidityStateExpired].Load())
+	assert.Equal(t, uint64(1), aclGrants[querymodifier.ValidityStateExpiring].Load())
+	assert.Equal(t, uint64(1), aclGrants[querymodifier.ValidityStatePending].Load())
+	assert.Equal(t, uint64(0), aclGrants[querymodifier.ValidityStateActive].Load())
+	assert.Contains(t, buf.String(), "Time-limited role incident has expired")
+	assert.Contains(t, buf.String(), "Time-limited grant #0 of role team-a expires in 1h0m0s")
+
+	t.Run("Unchanged states are logged once", func(t *testing.T) {
+		buf.Reset()
+		r.check(now.Add(time.Minute), &logger)
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("Grants expire without a reload", func(t *testing.T) {
+		buf.Reset()
+		r.check(now.Add(2*time.Hour), &logger)
+		assert.Equal(t, uint64(2), aclGrants[querymodifier.ValidityStateExpired].Load())
+		assert.Equal(t, uint64(1), aclGrants[querymodifier.ValidityStateActive].Load())
+		assert.Contains(t, buf.String(), "Time-limited grant #0 of role team-a has expired")
+		assert.Contains(t, buf.String(), "Time-limited grant #1 of role team-a is active")
+
+		var exported bytes.Buffer
+		metrics.WritePrometheus(&exported, false)
+		assert.Contains(t, exported.String(), `acl_time_limited_grants{state="expired"} 2`)
+		assert.Contains(t, exported.String(), `acl_time_limited_grants{state="expiring"} 0`)
+	})
+}
+
+func Test_lintACLs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	acls := newTimeLimitedACLs(t, now)
+
+	messages, expired := lintACLs(acls, now, 24*time.Hour)
+	assert.True(t, expired)
+	assert.Len(t, messages, 2)
+	assert.True(t, strings.HasPrefix(messages[0], "ERROR: role incident has expired"))
+	assert.True(t, strings.HasPrefix(messages[1], "WARNING: grant #0 of role team-a expires in 1h0m0s"))
+
+	messages, expired = lintACLs(acls, now, 0)
+	assert.True(t, expired)
+	assert.Len(t, messages, 1)
+
+	messages, expired = lintACLs(querymodifier.ACLs{"team-b": acls["team-b"]}, now, 24*time.Hour)
+	assert.False(t, expired)
+	assert.Empty(t, messages)
+}
+
+func TestLintACL(t *testing.T) {
+	f, err := os.CreateTemp("", "acl-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tests := []struct {
+		name       string
+		content    string
+		wantErr    bool
+		wantOutput string
+	}{
+		{
+			name:       "No issues",
+			content:    "team-a: { metrics: { namespace: a }}",
+			wantOutput: "OK (1 roles)",
+		},
+		{
+			name:       "Expired grant",
+			content:    "team-a: { metrics: { namespace: a }, grants: [{ valid_until: 2020-01-01T00:00:00Z, metrics: { namespace: b }}]}",
+			wantErr:    true,
+			wantOutput: "ERROR: grant #0 of role team-a has expired",
+		},
+		{
+			name:    "Invalid ACL",
+			content: "team-a: { inherits: [team-a] }",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := f.WriteAt([]byte(tt.content), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(int64(len(tt.content))); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			app := cli.NewApp()
+			app.Writer = &buf
+
+			set := flag.NewFlagSet("test", 0)
+			set.String("acl-path", f.Name(), "doc")
+			set.Duration("acl-expiry-warning", 72*time.Hour, "doc")
+			c := cli.NewContext(app, set, nil)
+
+			err := LintACL(c)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Contains(t, buf.String(), tt.wantOutput)
+		})
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+package lfgw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weisdd/lfgw/internal/querymodifier"
+	"gopkg.in/yaml.v3"
+)
+
+// apiKeyDefinition describes a single entry in the API keys file.
+type apiKeyDefinition struct {
+	Name    string            `yaml:"name"`
+	Hash    string            `yaml:"hash"`
+	Roles   []string          `yaml:"roles"`
+	ACL     yaml.Node         `yaml:"acl"`
+	Expires time.Time         `yaml:"expires"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// apiKey is a static API key (service identity) for machine clients that do not have an OAuth token.
+type apiKey struct {
+	name    string
+	roles   []string
+	acl     *querymodifier.ACL
+	expires time.Time
+	labels  map[string]string
+}
+
+// apiKeys maps hex-encoded SHA-256 hashes of API keys to their definitions.
+type apiKeys map[string]apiKey
+
+// newAPIKeysFromFile loads hashed API keys from a file.
+func newAPIKeysFromFile(path string) (apiKeys, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Keys []apiKeyDefinition `yaml:"keys"`
+	}
+
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API keys: %w", err)
+	}
+
+	keys := make(apiKeys, len(file.Keys))
+	names := make(map[string]bool, len(file.Keys))
+
+	for i, def := range file.Keys {
+		if def.Name == "" {
+			return nil, fmt.Errorf("API key #%d has no name", i)
+		}
+
+		if names[def.Name] {
+			return nil, fmt.Errorf("API key %s is defined more than once", def.Name)
+		}
+		names[def.Name] = true
+
+		hash, err := normalizeAPIKeyHash(def.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("API key %s: %w", def.Name, err)
+		}
+
+		if _, exists := keys[hash]; exists {
+			return nil, fmt.Errorf("API key %s has the same hash as another key", def.Name)
+		}
+
+		key := apiKey{
+			name:    def.Name,
+			roles:   def.Roles,
+			expires: def.Expires,
+			labels:  def.Labels,
+		}
+
+		hasACL := !def.ACL.IsZero()
+		if hasACL == (len(def.Roles) > 0) {
+			return nil, fmt.Errorf("API key %s must have either roles or acl defined", def.Name)
+		}
+
+		if hasACL {
+			rawACL, err := yaml.Marshal(&def.ACL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal acl for API key %s: %w", def.Name, err)
+			}
+
+			acl, err := querymodifier.NewACL(string(rawACL))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create ACL for API key %s: %w", def.Name, err)
+			}
+
+			if len(acl.Metrics) == 0 && len(acl.Rules) == 0 {
+				return nil, fmt.Errorf("API key %s has an empty acl", def.Name)
+			}
+
+			key.acl = &acl
+		}
+
+		keys[hash] = key
+	}
+
+	return keys, nil
+}
+
+// normalizeAPIKeyHash validates a hash in the form of "sha256:<hex>" (the prefix is optional) and returns its lowercase hex part.
+func normalizeAPIKeyHash(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(hash, "sha256:")))
+
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("hash must be a hex-encoded SHA-256 digest")
+	}
+
+	return hash, nil
+}
+
+// lookup returns the API key matching the given raw key.
+func (keys apiKeys) lookup(rawKey string) (apiKey, bool) {
+	sum := sha256.Sum256([]byte(rawKey))
+	key, ok := keys[hex.EncodeToString(sum[:])]
+	return key, ok
+}
+
+// isExpired returns true if the key has an expiry date in the past.
+func (key apiKey) isExpired(now time.Time) bool {
+	return !key.expires.IsZero() && now.After(key.expires)
+}
+
+// labelsString returns key labels in a stable "k=v, k2=v2" form suitable for logging.
+func (key apiKey) labelsString() string {
+	labels := make([]string, 0, len(key.labels))
+	for k, v := range key.labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(labels)
+
+	return strings.Join(labels, ", ")
+}
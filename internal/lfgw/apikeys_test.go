@@ -0,0 +1,132 @@
+package lfgw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_newAPIKeysFromFile(t *testing.T) {
+	f, err := os.CreateTemp("", "api-keys-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	aclMonitoring, err := querymodifier.NewACL("metrics:\n  namespace: monitoring\n")
+	assert.Nil(t, err)
+
+	t.Run("Valid keys", func(t *testing.T) {
+		content := `
+keys:
+  - name: alerting
+    hash: sha256:` + testAPIKeyHash("alerting-key") + `
+    roles: [grafana-editor]
+    labels:
+      owner: sre
+  - name: capacity-scripts
+    hash: ` + testAPIKeyHash("capacity-key") + `
+    acl:
+      metrics:
+        namespace: monitoring
+    expires: 2020-01-01T00:00:00Z
+`
+		saveContentToFile(t, f, content)
+
+		keys, err := newAPIKeysFromFile(f.Name())
+		assert.Nil(t, err)
+		assert.Len(t, keys, 2)
+
+		key, ok := keys.lookup("alerting-key")
+		assert.True(t, ok)
+		assert.Equal(t, "alerting", key.name)
+		assert.Equal(t, []string{"grafana-editor"}, key.roles)
+		assert.Nil(t, key.acl)
+		assert.Equal(t, "owner=sre", key.labelsString())
+		assert.False(t, key.isExpired(time.Now()))
+
+		key, ok = keys.lookup("capacity-key")
+		assert.True(t, ok)
+		assert.Equal(t, &aclMonitoring, key.acl)
+		assert.True(t, key.isExpired(time.Now()))
+
+		_, ok = keys.lookup("unknown-key")
+		assert.False(t, ok)
+	})
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "no name",
+			content: "keys: [{hash: " + testAPIKeyHash("a") + ", roles: [a]}]",
+		},
+		{
+			name:    "invalid hash",
+			content: "keys: [{name: a, hash: 'not-a-hash', roles: [a]}]",
+		},
+		{
+			name:    "duplicate names",
+			content: "keys: [{name: a, hash: " + testAPIKeyHash("a") + ", roles: [a]}, {name: a, hash: " + testAPIKeyHash("b") + ", roles: [a]}]",
+		},
+		{
+			name:    "duplicate hashes",
+			content: "keys: [{name: a, hash: " + testAPIKeyHash("a") + ", roles: [a]}, {name: b, hash: " + testAPIKeyHash("a") + ", roles: [a]}]",
+		},
+		{
+			name:    "neither roles nor acl",
+			content: "keys: [{name: a, hash: " + testAPIKeyHash("a") + "}]",
+		},
+		{
+			name:    "both roles and acl",
+			content: "keys: [{name: a, hash: " + testAPIKeyHash("a") + ", roles: [a], acl: {metrics: {namespace: a}}}]",
+		},
+		{
+			name:    "incorrect acl",
+			content: "keys: [{name: a, hash: " + testAPIKeyHash("a") + ", acl: {metrics: {namespace: 'a b'}}}]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveContentToFile(t, f, tt.content)
+
+			_, err := newAPIKeysFromFile(f.Name())
+			assert.NotNil(t, err)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := newAPIKeysFromFile("/nonexistent/api-keys.yaml")
+		assert.NotNil(t, err)
+	})
+}
+
+// testAPIKeyHash returns a hex-encoded SHA-256 hash of the given key
+func testAPIKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// saveContentToFile writes given content to a file (existing data is deleted)
+func saveContentToFile(t testing.TB, f *os.File, content string) {
+	t.Helper()
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
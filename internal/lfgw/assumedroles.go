@@ -0,0 +1,238 @@
+package lfgw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// labelValuesCacheKey is the only key used in the cache of upstream label values
+const labelValuesCacheKey = "values"
+
+// labelValuesErrorTTL defines for how long a failure to fetch label values is cached, so that a cold cache or an unavailable upstream doesn't turn every request with an unknown role into an upstream request
+const labelValuesErrorTTL = 5 * time.Second
+
+// assumedRolesPolicy decides which unknown role names may be turned into ACLs in assumed roles mode.
+type assumedRolesPolicy struct {
+	// pattern is an optional fully anchored pattern, which role names (without prefix) must match.
+	pattern *regexp.Regexp
+	// prefix is an optional prefix, which role names must start with. It's stripped before the name is used as an ACL definition.
+	prefix string
+	// allowRegex permits role names with regular expressions (including the admin definition .*).
+	allowRegex bool
+	// template is used to render ACL definitions for validation.
+	template querymodifier.AssumedRolesTemplate
+	// labelValues is used to make sure that rendered ACL definitions match existing label values (nil if validation is disabled).
+	labelValues map[string]*labelValuesLister
+}
+
+// newAssumedRolesPolicy returns an assumedRolesPolicy. An empty pattern allows any name. If labelValues is not nil, ACL definitions rendered from template are validated against the values of the respective labels.
+func newAssumedRolesPolicy(pattern, prefix string, allowRegex bool, template querymodifier.AssumedRolesTemplate, labelValues map[string]*labelValuesLister) (*assumedRolesPolicy, error) {
+	policy := &assumedRolesPolicy{
+		prefix:      prefix,
+		allowRegex:  allowRegex,
+		template:    template,
+		labelValues: labelValues,
+	}
+
+	if pattern != "" {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid assumed roles pattern: %w", err)
+		}
+		policy.pattern = re
+	}
+
+	return policy, nil
+}
+
+// Check returns the ACL definition derived from a role name or an error explaining why the role is rejected.
+func (p *assumedRolesPolicy) Check(ctx context.Context, role string) (string, error) {
+	name, ok := strings.CutPrefix(role, p.prefix)
+	if !ok {
+		return "", fmt.Errorf("role does not start with the required prefix %q", p.prefix)
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("role name is empty")
+	}
+
+	if p.pattern != nil && !p.pattern.MatchString(name) {
+		return "", fmt.Errorf("role name %q does not match the allowed pattern", name)
+	}
+
+	if !p.allowRegex && strings.ContainsAny(name, querymodifier.RegexpSymbols) {
+		return "", fmt.Errorf("role name %q contains regex metacharacters", name)
+	}
+
+	// Full access is never granted through assumed roles, whatever the settings are
+	acl, err := p.template.NewACL(name)
+	if err != nil {
+		return "", err
+	}
+	for label, metadata := range acl.MetricsMeta {
+		if metadata.Fullaccess {
+			return "", fmt.Errorf("role name %q grants full access to the label %s", name, label)
+		}
+	}
+
+	if p.labelValues != nil {
+		values, err := p.template.Render(name)
+		if err != nil {
+			return "", err
+		}
+
+		for label, value := range values {
+			lister, ok := p.labelValues[label]
+			if !ok {
+				continue
+			}
+
+			exists, err := lister.Exists(ctx, value)
+			if err != nil {
+				return "", fmt.Errorf("failed to validate role name %q: %w", name, err)
+			}
+			if !exists {
+				return "", fmt.Errorf("%s %q does not exist", label, value)
+			}
+		}
+	}
+
+	return name, nil
+}
+
+// labelValuesLister fetches the values of a label known to the upstream and caches them. Concurrent fetches are combined, and failures are cached for labelValuesErrorTTL.
+type labelValuesLister struct {
+	url      string
+	cacheTTL time.Duration
+	client   *http.Client
+	cache    *ttlCache[map[string]struct{}]
+	failures *ttlCache[error]
+	fetches  callGroup[map[string]struct{}]
+}
+
+// newLabelValuesLister returns a labelValuesLister, which fetches values through the label values API of the upstream.
+func newLabelValuesLister(upstreamURL *url.URL, label string, cacheTTL time.Duration) *labelValuesLister {
+	return &labelValuesLister{
+		url:      upstreamURL.JoinPath("/api/v1/label", label, "values").String(),
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    newTTLCache[map[string]struct{}](1),
+		failures: newTTLCache[error](1),
+	}
+}
+
+// Exists returns true if the value is present in the upstream.
+func (lv *labelValuesLister) Exists(ctx context.Context, value string) (bool, error) {
+	if values, ok := lv.cache.Get(labelValuesCacheKey); ok {
+		_, exists := values[value]
+		return exists, nil
+	}
+
+	values, err := lv.fetches.do(labelValuesCacheKey, func() (map[string]struct{}, error) {
+		// The values might have been fetched by another request in the meantime
+		if values, ok := lv.cache.Get(labelValuesCacheKey); ok {
+			return values, nil
+		}
+
+		if err, ok := lv.failures.Get(labelValuesCacheKey); ok {
+			return nil, err
+		}
+
+		// The result is shared by all waiting requests, so the fetch is not cancelled along with the request, which has started it (the client has its own timeout)
+		values, err := lv.fetch(context.WithoutCancel(ctx))
+		if err != nil {
+			lv.failures.Set(labelValuesCacheKey, err, labelValuesErrorTTL)
+			return nil, err
+		}
+		lv.cache.Set(labelValuesCacheKey, values, lv.cacheTTL)
+
+		return values, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	_, exists := values[value]
+	return exists, nil
+}
+
+// fetch retrieves the values of the label from the upstream.
+func (lv *labelValuesLister) fetch(ctx context.Context) (map[string]struct{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lv.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := lv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", res.Status)
+	}
+
+	var response struct {
+		Status string   `json:"status"`
+		Data   []string `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode label values: %w", err)
+	}
+
+	if response.Status != "success" {
+		return nil, fmt.Errorf("upstream returned status %q", response.Status)
+	}
+
+	values := make(map[string]struct{}, len(response.Data))
+	for _, value := range response.Data {
+		values[value] = struct{}{}
+	}
+
+	return values, nil
+}
+
+// filterAssumedRoles returns the roles, from which an ACL is constructed: known roles are kept as is, unknown roles are checked against the assumed roles policy and replaced with the resulting ACL definitions. Rejected roles are logged and dropped.
+func (app *application) filterAssumedRoles(r *http.Request, roles []string) []string {
+	if !app.AssumedRolesEnabled || app.assumedRoles == nil {
+		return roles
+	}
+
+	filtered := make([]string, 0, len(roles))
+
+	for _, role := range roles {
+		if _, known := app.ACLs[role]; known {
+			filtered = append(filtered, role)
+			continue
+		}
+
+		name, err := app.assumedRoles.Check(r.Context(), role)
+		if err == nil {
+			// Otherwise, a stripped name might grant access defined for a known role
+			if _, known := app.ACLs[name]; known {
+				err = fmt.Errorf("role name %q matches a predefined role", name)
+			}
+		}
+
+		if err != nil {
+			hlog.FromRequest(r).Warn().Caller().
+				Str("role", role).Err(err).Msg("Rejected assumed role")
+			continue
+		}
+
+		filtered = append(filtered, name)
+	}
+
+	return filtered
+}
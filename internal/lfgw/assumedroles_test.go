@@ -0,0 +1,352 @@
+package lfgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// namespacesUpstream returns a test server exposing namespaces through the label values API along with a counter of requests.
+func namespacesUpstream(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if r.URL.Path != "/api/v1/label/namespace/values" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+
+	return ts, &requests
+}
+
+func Test_assumedRolesPolicy_Check(t *testing.T) {
+	ts, _ := namespacesUpstream(t, `{"status":"success","data":["team-a","team-b","monitoring"]}`)
+	defer ts.Close()
+
+	upstreamURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		pattern    string
+		prefix     string
+		allowRegex bool
+		validate   bool
+		role       string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "No restrictions",
+			allowRegex: true,
+			role:       "kube.*",
+			want:       "kube.*",
+		},
+		{
+			name:       "Full access is rejected even if regex is allowed",
+			allowRegex: true,
+			role:       ".*",
+			wantErr:    true,
+		},
+		{
+			name:       "Full access within a list is rejected",
+			allowRegex: true,
+			role:       "team-a, .*",
+			wantErr:    true,
+		},
+		{
+			name:    "Regex is banned",
+			role:    ".*",
+			wantErr: true,
+		},
+		{
+			name:    "Regex is banned (alternation)",
+			role:    "team-a|team-b",
+			wantErr: true,
+		},
+		{
+			name: "Plain name with regex banned",
+			role: "team-a",
+			want: "team-a",
+		},
+		{
+			name:   "Prefix is stripped",
+			prefix: "ns:",
+			role:   "ns:team-a",
+			want:   "team-a",
+		},
+		{
+			name:    "Prefix is missing",
+			prefix:  "ns:",
+			role:    "team-a",
+			wantErr: true,
+		},
+		{
+			name:    "Only prefix",
+			prefix:  "ns:",
+			role:    "ns:",
+			wantErr: true,
+		},
+		{
+			name:    "Pattern matches",
+			pattern: "team-[a-z]+",
+			role:    "team-a",
+			want:    "team-a",
+		},
+		{
+			name:    "Pattern is anchored",
+			pattern: "team-[a-z]+",
+			role:    "xteam-a",
+			wantErr: true,
+		},
+		{
+			name:    "Pattern is applied after stripping prefix",
+			pattern: "team-[a-z]+",
+			prefix:  "ns:",
+			role:    "ns:team-a",
+			want:    "team-a",
+		},
+		{
+			name:     "Namespace exists",
+			validate: true,
+			role:     "monitoring",
+			want:     "monitoring",
+		},
+		{
+			name:     "Namespace does not exist",
+			validate: true,
+			role:     "kube-system",
+			wantErr:  true,
+		},
+		{
+			name:       "Regex is not a namespace",
+			allowRegex: true,
+			validate:   true,
+			role:       ".*",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var labelValues map[string]*labelValuesLister
+			if tt.validate {
+				labelValues = map[string]*labelValuesLister{
+					"namespace": newLabelValuesLister(upstreamURL, "namespace", time.Minute),
+				}
+			}
+
+			policy, err := newAssumedRolesPolicy(tt.pattern, tt.prefix, tt.allowRegex, querymodifier.DefaultAssumedRolesTemplate, labelValues)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := policy.Check(context.Background(), tt.role)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("Invalid pattern", func(t *testing.T) {
+		_, err := newAssumedRolesPolicy("team-[", "", false, querymodifier.DefaultAssumedRolesTemplate, nil)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_labelValuesLister(t *testing.T) {
+	t.Run("Values are cached", func(t *testing.T) {
+		ts, requests := namespacesUpstream(t, `{"status":"success","data":["team-a"]}`)
+		defer ts.Close()
+
+		upstreamURL, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lv := newLabelValuesLister(upstreamURL, "namespace", time.Minute)
+
+		for _, namespace := range []string{"team-a", "team-b", "team-a"} {
+			_, err := lv.Exists(context.Background(), namespace)
+			assert.Nil(t, err)
+		}
+
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Upstream errors are cached briefly", func(t *testing.T) {
+		ts, requests := namespacesUpstream(t, `{"status":"error","data":[]}`)
+		defer ts.Close()
+
+		upstreamURL, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lv := newLabelValuesLister(upstreamURL, "namespace", time.Minute)
+
+		for i := 0; i < 2; i++ {
+			exists, err := lv.Exists(context.Background(), "team-a")
+			assert.NotNil(t, err)
+			assert.False(t, exists)
+		}
+		assert.Equal(t, int32(1), requests.Load())
+
+		// Once the error expires, the values are fetched again
+		lv.failures.Delete(labelValuesCacheKey)
+		_, err = lv.Exists(context.Background(), "team-a")
+		assert.NotNil(t, err)
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("Concurrent fetches are combined", func(t *testing.T) {
+		release := make(chan struct{})
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		upstreamURL, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lv := newLabelValuesLister(upstreamURL, "namespace", time.Minute)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := lv.Exists(context.Background(), "team-a")
+				assert.NotNil(t, err)
+			}()
+		}
+
+		// Let the goroutines pile up behind the first fetch
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Fetch is not cancelled along with the request", func(t *testing.T) {
+		ts, _ := namespacesUpstream(t, `{"status":"success","data":["team-a"]}`)
+		defer ts.Close()
+
+		upstreamURL, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lv := newLabelValuesLister(upstreamURL, "namespace", time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		exists, err := lv.Exists(ctx, "team-a")
+		assert.Nil(t, err)
+		assert.True(t, exists)
+	})
+}
+
+func TestApp_filterAssumedRoles(t *testing.T) {
+	aclAdmin, err := querymodifier.NewACL("metrics:\n  namespace: .*\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := newAssumedRolesPolicy("", "ns:", false, querymodifier.DefaultAssumedRolesTemplate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		AssumedRolesEnabled: true,
+		ACLs:                querymodifier.ACLs{"admin": aclAdmin},
+		assumedRoles:        policy,
+	}
+
+	tests := []struct {
+		name  string
+		roles []string
+		want  []string
+	}{
+		{
+			name:  "Known roles are kept as is",
+			roles: []string{"admin"},
+			want:  []string{"admin"},
+		},
+		{
+			name:  "Prefix is stripped",
+			roles: []string{"ns:team-a", "ns:team-b"},
+			want:  []string{"team-a", "team-b"},
+		},
+		{
+			name:  "Rejected roles are dropped",
+			roles: []string{"ns:.*", "team-a", "ns:team-b"},
+			want:  []string{"team-b"},
+		},
+		{
+			name:  "Stripped name cannot refer to a known role",
+			roles: []string{"ns:admin"},
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+			got := app.filterAssumedRoles(r, tt.roles)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("All assumed roles are rejected", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		_, err := app.getIdentityACL(r, identity{userClaims: userClaims{Roles: []string{"ns:.*"}}})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ACL is constructed through the template", func(t *testing.T) {
+		tmpl, err := querymodifier.NewAssumedRolesTemplate([]string{"tenant={{.Role}}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app := app
+		app.assumedRolesTemplate = tmpl
+
+		r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		acl, err := app.getIdentityACL(r, identity{userClaims: userClaims{Roles: []string{"ns:team-a"}}})
+		assert.Nil(t, err)
+		assert.Equal(t, "team-a", acl.Metrics["tenant"].Value)
+		assert.NotContains(t, acl.Metrics, "namespace")
+	})
+}
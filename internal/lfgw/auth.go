@@ -0,0 +1,261 @@
+package lfgw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// identity describes an authenticated caller.
+type identity struct {
+	userClaims
+	// apiKey holds the name of the API key used for authentication (empty for OIDC users).
+	apiKey string
+	// apiKeyLabels holds API key labels in a form suitable for logging.
+	apiKeyLabels string
+	// user holds a user name taken from trusted headers (empty for other authentication methods).
+	user string
+	// clientCert holds the identity taken from a client certificate (empty if the caller used a token).
+	clientCert string
+	// serviceAccount holds the name of a Kubernetes ServiceAccount in the form of namespace/name (empty for other authentication methods).
+	serviceAccount string
+	// anonymous is set for requests without a token that are allowed through anonymous CIDRs.
+	anonymous bool
+	// acl is set for callers bound directly to an ACL rather than through roles.
+	acl *querymodifier.ACL
+}
+
+// isIssuedToken returns true if the identity has been established through an access token issued by an authorization server (verified locally or through introspection) rather than through other authentication methods.
+func (id identity) isIssuedToken() bool {
+	return id.apiKey == "" && id.user == "" && id.clientCert == "" && id.serviceAccount == "" && !id.anonymous
+}
+
+// authenticateRequest returns the identity of the caller. Identities taken from trusted headers and verified client certificates matching the configured rules take precedence over access tokens.
+func (app *application) authenticateRequest(r *http.Request) (identity, error) {
+	if id, ok := r.Context().Value(contextKeyIdentity).(identity); ok {
+		return id, nil
+	}
+
+	if id, ok := app.authenticateClientCert(r); ok {
+		return id, nil
+	}
+
+	rawAccessToken, source, err := app.extractAccessToken(r)
+	if err != nil {
+		if id, ok := app.authenticateAnonymous(r, err); ok {
+			return id, nil
+		}
+		return identity{}, err
+	}
+	app.enrichLogContext(r, "token_source", source.String())
+
+	// Static API keys are long-lived, so they must not travel through sources that are easy to leak
+	if !source.Trusted {
+		if key, ok := app.apiKeys.lookup(rawAccessToken); ok {
+			return identity{}, fmt.Errorf("%w (%s, %s)", errAPIKeyUntrustedSource, key.name, source)
+		}
+	}
+
+	id, err := app.authenticate(r.Context(), rawAccessToken)
+	if err != nil {
+		return identity{}, err
+	}
+
+	// DPoP policies apply only to tokens issued by an authorization server (API keys, service account tokens, etc are skipped). Tokens without an issuer (e.g. introspection responses without iss) are subject to the default policy
+	if app.dpop != nil && id.isIssuedToken() {
+		dpopScheme := strings.EqualFold(source.Scheme, dpopScheme)
+		if err := app.dpop.Check(r, rawAccessToken, id.Issuer, id.Confirmation.JKT, dpopScheme); err != nil {
+			return identity{}, err
+		}
+
+		if id.Confirmation.JKT != "" {
+			app.enrichDebugLogContext(r, "dpop_jkt", id.Confirmation.JKT)
+		}
+	}
+
+	return id, nil
+}
+
+// authenticateAnonymous returns an identity bound to the anonymous ACL if a request carries no token and comes from one of the anonymous networks.
+func (app *application) authenticateAnonymous(r *http.Request, err error) (identity, bool) {
+	if app.anonymousACL == nil {
+		return identity{}, false
+	}
+
+	if !errors.Is(err, errNoToken) && !errors.Is(err, errNoTokenGrafana) {
+		return identity{}, false
+	}
+
+	if !remoteAddrInNets(r.RemoteAddr, app.anonymousNets) {
+		return identity{}, false
+	}
+
+	return identity{anonymous: true, acl: app.anonymousACL}, true
+}
+
+// logIdentity adds the identity of the caller to the log context.
+func (app *application) logIdentity(r *http.Request, id identity) {
+	switch {
+	case id.anonymous:
+		app.enrichLogContext(r, "anonymous", "true")
+	case id.apiKey != "":
+		app.enrichLogContext(r, "api_key", id.apiKey)
+		app.enrichDebugLogContext(r, "api_key_labels", id.apiKeyLabels)
+	case id.clientCert != "":
+		app.enrichLogContext(r, "client_cert", id.clientCert)
+	case id.serviceAccount != "":
+		app.enrichLogContext(r, "service_account", id.serviceAccount)
+	default:
+		app.enrichLogContext(r, "email", id.Email)
+		app.enrichLogContext(r, "user", id.user)
+	}
+
+	// NOTE: The field will contain all roles present in the token, not only those that are considered during ACL generation process
+	app.enrichDebugLogContext(r, "roles", strings.Join(id.Roles, ", "))
+}
+
+// authenticate verifies a raw access token and returns the identity used for ACL generation. Static API keys are checked first. If a token cannot be verified locally, it's checked through the Kubernetes TokenReview API (if enabled) and then against the introspection endpoint (if configured). If a verified token carries no roles and the userinfo fallback is enabled, the roles are taken from the userinfo endpoint.
+func (app *application) authenticate(ctx context.Context, rawAccessToken string) (identity, error) {
+	if key, ok := app.apiKeys.lookup(rawAccessToken); ok {
+		if key.isExpired(time.Now()) {
+			return identity{}, fmt.Errorf("%w (%s)", errAPIKeyExpired, key.name)
+		}
+
+		return identity{
+			userClaims:   userClaims{Roles: key.roles},
+			apiKey:       key.name,
+			apiKeyLabels: key.labelsString(),
+			acl:          key.acl,
+		}, nil
+	}
+
+	accessToken, err := app.verifier.Verify(ctx, rawAccessToken)
+	if err != nil {
+		// ServiceAccount tokens are always JWTs
+		if app.kubernetes != nil && strings.Count(rawAccessToken, ".") == 2 {
+			serviceAccount, acl, kubernetesErr := app.kubernetes.Authenticate(ctx, rawAccessToken)
+			if kubernetesErr == nil {
+				return identity{serviceAccount: serviceAccount, acl: &acl}, nil
+			}
+
+			err = fmt.Errorf("%w (kubernetes: %w)", err, kubernetesErr)
+		}
+
+		if app.introspector == nil {
+			return identity{}, err
+		}
+
+		claims, introspectionErr := app.introspector.Introspect(ctx, rawAccessToken)
+		if introspectionErr != nil {
+			return identity{}, fmt.Errorf("%w (introspection: %w)", err, introspectionErr)
+		}
+
+		return identity{userClaims: claims}, nil
+	}
+
+	var claims userClaims
+	if err := accessToken.Claims(&claims); err != nil {
+		// Claims property is not set / unmarshal errors, very unlikely to catch it
+		return identity{}, err
+	}
+	claims.Issuer = accessToken.Issuer
+	claims.Subject = accessToken.Subject
+
+	var ids tokenIDClaims
+	if err := accessToken.Claims(&ids); err != nil {
+		return identity{}, err
+	}
+	claims.TokenID = ids.JTI
+
+	if err := accessToken.Claims(&claims.Claims); err != nil {
+		return identity{}, err
+	}
+
+	// Some IdPs keep access tokens small and expose groups only via userinfo
+	if len(claims.Roles) == 0 && app.userInfo != nil {
+		extra, err := app.userInfo.Fetch(ctx, rawAccessToken, accessToken.Subject, accessToken.Expiry)
+		if err != nil {
+			return identity{}, err
+		}
+
+		claims = mergeUserClaims(claims, extra)
+	}
+
+	return identity{userClaims: claims}, nil
+}
+
+// getIdentityACL returns an ACL bound to the identity directly or constructs one based on its roles (and, if configured, on the default role and the claim mapped to a label filter).
+func (app *application) getIdentityACL(r *http.Request, id identity) (querymodifier.ACL, error) {
+	if id.acl != nil {
+		return *id.acl, nil
+	}
+
+	roles := app.filterAssumedRoles(r, id.Roles)
+
+	// The default role is merged into the ACL of every authenticated user, so a user without matching roles gets it alone
+	if app.DefaultACLRole != "" && !slices.Contains(roles, app.DefaultACLRole) {
+		roles = append(roles[:len(roles):len(roles)], app.DefaultACLRole)
+	}
+
+	acls, err := app.ACLs.RenderTemplates(roles, id.Claims)
+	if err != nil {
+		return querymodifier.ACL{}, err
+	}
+
+	var extra []querymodifier.ACL
+	if app.ClaimACLClaim != "" {
+		claimACL, ok, err := newClaimACL(id.Claims, app.ClaimACLClaim, app.ClaimACLLabel)
+		if err != nil {
+			return querymodifier.ACL{}, err
+		}
+		if ok {
+			extra = append(extra, claimACL)
+		}
+	}
+
+	assumedRoles := app.assumedRolesTemplate
+	if assumedRoles == nil && app.AssumedRolesEnabled {
+		assumedRoles = querymodifier.DefaultAssumedRolesTemplate
+	}
+
+	return acls.GetUserACLWithExtra(roles, assumedRoles, extra...)
+}
+
+// newClaimACL returns an ACL built from the values of the given claim. It returns false if the claim is missing or empty.
+func newClaimACL(claims map[string]interface{}, claim, label string) (querymodifier.ACL, bool, error) {
+	var values []string
+
+	switch v := claims[claim].(type) {
+	case nil:
+		return querymodifier.ACL{}, false, nil
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, elem := range v {
+			value, ok := elem.(string)
+			if !ok {
+				return querymodifier.ACL{}, false, fmt.Errorf("claim %s contains a non-string value", claim)
+			}
+			values = append(values, value)
+		}
+	default:
+		return querymodifier.ACL{}, false, fmt.Errorf("claim %s is neither a string nor an array of strings", claim)
+	}
+
+	if len(values) == 0 {
+		return querymodifier.ACL{}, false, nil
+	}
+
+	acl, err := querymodifier.NewClaimACL(label, values)
+	if err != nil {
+		return querymodifier.ACL{}, false, fmt.Errorf("failed to create ACL from claim %s: %w", claim, err)
+	}
+
+	return acl, true, nil
+}
@@ -0,0 +1,341 @@
+package lfgw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_newClaimACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		want    string
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			name:   "Array claim",
+			claims: map[string]interface{}{"namespaces": []interface{}{"a", "b"}},
+			want:   `namespace=~"a|b"`,
+			wantOK: true,
+		},
+		{
+			name:   "String claim",
+			claims: map[string]interface{}{"namespaces": "a"},
+			want:   `namespace="a"`,
+			wantOK: true,
+		},
+		{
+			name:   "Values are escaped",
+			claims: map[string]interface{}{"namespaces": []interface{}{".*"}},
+			want:   `namespace=~"\\.\\*"`,
+			wantOK: true,
+		},
+		{
+			name:   "Missing claim",
+			claims: map[string]interface{}{},
+		},
+		{
+			name:   "Empty claim",
+			claims: map[string]interface{}{"namespaces": []interface{}{}},
+		},
+		{
+			name:    "Non-string values",
+			claims:  map[string]interface{}{"namespaces": []interface{}{"a", 1.0}},
+			wantErr: true,
+		},
+		{
+			name:    "Object claim",
+			claims:  map[string]interface{}{"namespaces": map[string]interface{}{"a": "b"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := newClaimACL(tt.claims, "namespaces", "namespace")
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantOK, ok)
+			if tt.wantOK {
+				lf := got.Metrics["namespace"]
+				assert.Equal(t, tt.want, string(lf.AppendString(nil)))
+			}
+		})
+	}
+}
+
+func TestApp_getIdentityACL_claim(t *testing.T) {
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		ClaimACLClaim: "namespaces",
+		ClaimACLLabel: "namespace",
+		ACLs:          querymodifier.ACLs{"grafana-editor": aclEditor},
+	}
+
+	tests := []struct {
+		name    string
+		id      identity
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Claim is merged with roles",
+			id: identity{userClaims: userClaims{
+				Roles:  []string{"grafana-editor"},
+				Claims: map[string]interface{}{"namespaces": []interface{}{"a", "b"}},
+			}},
+			want: `namespace=~"monitoring|a|b"`,
+		},
+		{
+			name: "Claim without roles",
+			id: identity{userClaims: userClaims{
+				Claims: map[string]interface{}{"namespaces": []interface{}{"a"}},
+			}},
+			want: `namespace="a"`,
+		},
+		{
+			name: "Roles without claim",
+			id: identity{userClaims: userClaims{
+				Roles: []string{"grafana-editor"},
+			}},
+			want: `namespace="monitoring"`,
+		},
+		{
+			name:    "Neither roles nor claim",
+			id:      identity{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+
+			got, err := app.getIdentityACL(r, tt.id)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			lf := got.Metrics["namespace"]
+			assert.Equal(t, tt.want, string(lf.AppendString(nil)))
+		})
+	}
+}
+
+func TestApp_getIdentityACL_default(t *testing.T) {
+	aclPublic, err := querymodifier.NewACL("metrics:\n  namespace: 'public'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		DefaultACLRole: "public",
+		ACLs:           querymodifier.ACLs{"public": aclPublic, "grafana-editor": aclEditor},
+	}
+
+	tests := []struct {
+		name  string
+		roles []string
+		want  string
+	}{
+		{
+			name:  "Default role is merged with other roles",
+			roles: []string{"grafana-editor"},
+			want:  `namespace=~"monitoring|public"`,
+		},
+		{
+			name:  "Default role alone",
+			roles: []string{"unknown"},
+			want:  `namespace="public"`,
+		},
+		{
+			name:  "Default role is not duplicated",
+			roles: []string{"public"},
+			want:  `namespace="public"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+			roles := append([]string(nil), tt.roles...)
+
+			got, err := app.getIdentityACL(r, identity{userClaims: userClaims{Roles: roles}})
+			assert.Nil(t, err)
+			lf := got.Metrics["namespace"]
+			assert.Equal(t, tt.want, string(lf.AppendString(nil)))
+			// Roles of the identity are left intact
+			assert.Equal(t, tt.roles, roles)
+		})
+	}
+}
+
+func TestApp_authenticateRequest_anonymous(t *testing.T) {
+	aclStatus, err := querymodifier.NewACL("metrics:\n  namespace: 'status'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		anonymousNets: nets,
+		anonymousACL:  &aclStatus,
+	}
+
+	t.Run("Request without a token from an anonymous network", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		r.RemoteAddr = "10.1.2.3:1234"
+
+		id, err := app.authenticateRequest(r)
+		assert.Nil(t, err)
+		assert.True(t, id.anonymous)
+		assert.Equal(t, &aclStatus, id.acl)
+	})
+
+	t.Run("Request without a token from another network", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		r.RemoteAddr = "192.168.0.1:1234"
+
+		_, err := app.authenticateRequest(r)
+		assert.ErrorIs(t, err, errNoToken)
+	})
+
+	t.Run("Conflicting tokens are not treated as anonymous", func(t *testing.T) {
+		app := app
+		app.TokenSourcesMode = tokenSourcesModeRejectConflicting
+		app.tokenSources = []tokenSource{
+			mustParseTokenSource(t, "header:Authorization"),
+			mustParseTokenSource(t, "header:X-Token"),
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		r.RemoteAddr = "10.1.2.3:1234"
+		r.Header.Set("Authorization", "Bearer a")
+		r.Header.Set("X-Token", "b")
+
+		_, err := app.authenticateRequest(r)
+		assert.ErrorIs(t, err, errConflictingTokens)
+	})
+}
+
+func TestApp_configureDefaultACLs(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	aclStatus, err := querymodifier.NewACL("metrics:\n  namespace: 'status'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclAdmin, err := querymodifier.NewACL("metrics:\n  namespace: '.*'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclTemplate, err := querymodifier.NewACL("metrics:\n  namespace: '{{ .claims.team }}'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclLimited := aclStatus
+	aclLimited.Validity = querymodifier.Validity{ValidUntil: time.Now().Add(time.Hour)}
+
+	acls := querymodifier.ACLs{"status": aclStatus, "admin": aclAdmin, "team": aclTemplate, "limited": aclLimited}
+
+	tests := []struct {
+		name    string
+		app     application
+		wantErr bool
+	}{
+		{
+			name: "Disabled",
+			app:  application{},
+		},
+		{
+			name: "Default and anonymous roles",
+			app:  application{DefaultACLRole: "status", AnonymousACLRole: "status", AnonymousCIDRs: []string{"10.0.0.0/8"}},
+		},
+		{
+			name:    "Unknown default role",
+			app:     application{DefaultACLRole: "unknown"},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown anonymous role",
+			app:     application{AnonymousACLRole: "unknown", AnonymousCIDRs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+		{
+			name:    "Anonymous role without CIDRs",
+			app:     application{AnonymousACLRole: "status"},
+			wantErr: true,
+		},
+		{
+			name:    "Anonymous CIDRs without role",
+			app:     application{AnonymousCIDRs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid anonymous CIDRs",
+			app:     application{AnonymousACLRole: "status", AnonymousCIDRs: []string{"10.0.0.0/88"}},
+			wantErr: true,
+		},
+		{
+			name:    "Anonymous role with full access",
+			app:     application{AnonymousACLRole: "admin", AnonymousCIDRs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+		{
+			name:    "Time-limited anonymous role",
+			app:     application{AnonymousACLRole: "limited", AnonymousCIDRs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+		{
+			name:    "Anonymous role with templates",
+			app:     application{AnonymousACLRole: "team", AnonymousCIDRs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := tt.app
+			app.ACLs = acls
+			app.logger = &logger
+
+			err := app.configureDefaultACLs()
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, app.AnonymousACLRole != "", app.anonymousACL != nil)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package lfgw
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// cacheEntry holds a cached value along with its expiration time and its position in the expiry heap.
+type cacheEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+	index     int
+}
+
+// expiryHeap is a min-heap of cache entries ordered by their expiration time (implements heap.Interface).
+type expiryHeap[V any] []*cacheEntry[V]
+
+func (h expiryHeap[V]) Len() int { return len(h) }
+
+func (h expiryHeap[V]) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h expiryHeap[V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[V]) Push(x any) {
+	entry := x.(*cacheEntry[V])
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap[V]) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// ttlCache is a simple thread-safe in-memory cache with per-entry TTLs and an optional upper bound on the number of entries. Entries are kept in a heap ordered by their expiration time, so expired entries are dropped and a full cache makes room in O(log n) without scanning all entries.
+type ttlCache[V any] struct {
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry[V]
+	expiry     expiryHeap[V]
+	maxEntries int
+}
+
+// newTTLCache returns a ttlCache holding at most maxEntries entries (0 means unbounded).
+func newTTLCache[V any](maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		entries:    make(map[string]*cacheEntry[V]),
+		maxEntries: maxEntries,
+	}
+}
+
+// Get returns a cached value and true if the key is present and has not expired yet.
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		var empty V
+		return empty, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		c.remove(entry)
+		var empty V
+		return empty, false
+	}
+
+	return entry.value, true
+}
+
+// Set stores a value for the given duration. Non-positive TTLs are ignored. If the cache is full, the entry closest to its expiration is evicted.
+func (c *ttlCache[V]) Set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deleteExpired()
+
+	if c.isFull(key) {
+		c.remove(c.expiry[0])
+	}
+
+	c.set(key, value, ttl)
+}
+
+// SetIfRoom works the same way as Set, though it never evicts entries, which haven't expired yet. It returns false if the key is not present and the cache is full.
+func (c *ttlCache[V]) SetIfRoom(key string, value V, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deleteExpired()
+
+	if c.isFull(key) {
+		return false
+	}
+
+	c.set(key, value, ttl)
+
+	return true
+}
+
+// Add stores a value only if the key is not present yet, the check and the write happen atomically. Same as SetIfRoom, it never evicts entries, which haven't expired yet: errCacheKeyExists is returned if the key is present, errCacheFull if there's no room for it.
+func (c *ttlCache[V]) Add(key string, value V, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deleteExpired()
+
+	if _, exists := c.entries[key]; exists {
+		return errCacheKeyExists
+	}
+
+	if c.isFull(key) {
+		return errCacheFull
+	}
+
+	if ttl > 0 {
+		c.set(key, value, ttl)
+	}
+
+	return nil
+}
+
+// Delete removes a key from the cache.
+func (c *ttlCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		c.remove(entry)
+	}
+}
+
+// Len returns the number of entries currently stored in the cache (including the ones that have expired, but haven't been dropped yet).
+func (c *ttlCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// isFull returns true if the key is not present and there's no room for another entry. Must be called with the mutex held.
+func (c *ttlCache[V]) isFull(key string) bool {
+	_, exists := c.entries[key]
+	return !exists && c.maxEntries > 0 && len(c.entries) >= c.maxEntries
+}
+
+// set stores or updates an entry. Must be called with the mutex held.
+func (c *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	expiresAt := time.Now().Add(ttl)
+
+	if entry, ok := c.entries[key]; ok {
+		entry.value = value
+		entry.expiresAt = expiresAt
+		heap.Fix(&c.expiry, entry.index)
+		return
+	}
+
+	entry := &cacheEntry[V]{key: key, value: value, expiresAt: expiresAt}
+	heap.Push(&c.expiry, entry)
+	c.entries[key] = entry
+}
+
+// remove drops an entry. Must be called with the mutex held.
+func (c *ttlCache[V]) remove(entry *cacheEntry[V]) {
+	heap.Remove(&c.expiry, entry.index)
+	delete(c.entries, entry.key)
+}
+
+// deleteExpired drops expired entries, which are always at the top of the heap. Must be called with the mutex held.
+func (c *ttlCache[V]) deleteExpired() {
+	now := time.Now()
+
+	for len(c.expiry) > 0 && now.After(c.expiry[0].expiresAt) {
+		c.remove(c.expiry[0])
+	}
+}
+
+// tokenCacheKey returns a hash of a raw token, so that caches never hold tokens in plain text.
+func tokenCacheKey(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,171 @@
+package lfgw
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ttlCache(t *testing.T) {
+	t.Run("Get returns stored values", func(t *testing.T) {
+		c := newTTLCache[string](0)
+		c.Set("key", "value", time.Minute)
+
+		got, ok := c.Get("key")
+		assert.True(t, ok)
+		assert.Equal(t, "value", got)
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		c := newTTLCache[string](0)
+
+		_, ok := c.Get("key")
+		assert.False(t, ok)
+	})
+
+	t.Run("Expired entries are not returned", func(t *testing.T) {
+		c := newTTLCache[string](0)
+		c.Set("key", "value", time.Nanosecond)
+		time.Sleep(time.Millisecond)
+
+		_, ok := c.Get("key")
+		assert.False(t, ok)
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		c := newTTLCache[string](0)
+		c.Set("key", "value", time.Minute)
+		c.Delete("key")
+
+		_, ok := c.Get("key")
+		assert.False(t, ok)
+	})
+
+	t.Run("Non-positive TTL is ignored", func(t *testing.T) {
+		c := newTTLCache[string](0)
+		c.Set("key", "value", 0)
+
+		_, ok := c.Get("key")
+		assert.False(t, ok)
+	})
+
+	t.Run("Size is bounded", func(t *testing.T) {
+		c := newTTLCache[int](2)
+		c.Set("a", 1, time.Minute)
+		c.Set("b", 2, time.Hour)
+		c.Set("c", 3, time.Hour)
+
+		assert.Equal(t, 2, c.Len())
+
+		// The entry closest to its expiration is evicted first
+		_, ok := c.Get("a")
+		assert.False(t, ok)
+
+		_, ok = c.Get("c")
+		assert.True(t, ok)
+	})
+
+	t.Run("Expired entries are dropped on writes", func(t *testing.T) {
+		c := newTTLCache[int](0)
+		c.Set("a", 1, time.Nanosecond)
+		time.Sleep(time.Millisecond)
+
+		c.Set("b", 2, time.Minute)
+		assert.Equal(t, 1, c.Len())
+
+		_, ok := c.Get("b")
+		assert.True(t, ok)
+	})
+
+	t.Run("Updated entries are reordered", func(t *testing.T) {
+		c := newTTLCache[int](2)
+		c.Set("a", 1, time.Minute)
+		c.Set("b", 2, time.Hour)
+		// "a" now expires later than "b", so "b" is evicted first
+		c.Set("a", 3, 2*time.Hour)
+		c.Set("c", 4, time.Hour)
+
+		_, ok := c.Get("b")
+		assert.False(t, ok)
+
+		got, ok := c.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, 3, got)
+	})
+
+	t.Run("Deleted entries free up room", func(t *testing.T) {
+		c := newTTLCache[int](1)
+		assert.True(t, c.SetIfRoom("a", 1, time.Hour))
+		c.Delete("a")
+		assert.True(t, c.SetIfRoom("b", 2, time.Hour))
+		assert.Equal(t, 1, c.Len())
+	})
+
+	t.Run("SetIfRoom never evicts live entries", func(t *testing.T) {
+		c := newTTLCache[int](2)
+		assert.True(t, c.SetIfRoom("a", 1, time.Nanosecond))
+		assert.True(t, c.SetIfRoom("b", 2, time.Hour))
+		time.Sleep(time.Millisecond)
+
+		// Expired entries make room
+		assert.True(t, c.SetIfRoom("c", 3, time.Hour))
+		assert.False(t, c.SetIfRoom("d", 4, time.Hour))
+
+		// Present keys can be updated
+		assert.True(t, c.SetIfRoom("b", 5, time.Hour))
+
+		for key, want := range map[string]int{"b": 5, "c": 3} {
+			got, ok := c.Get(key)
+			assert.True(t, ok)
+			assert.Equal(t, want, got)
+		}
+
+		_, ok := c.Get("d")
+		assert.False(t, ok)
+	})
+}
+
+func Test_ttlCache_Add(t *testing.T) {
+	c := newTTLCache[int](2)
+	assert.Nil(t, c.Add("a", 1, time.Nanosecond))
+	assert.Nil(t, c.Add("b", 2, time.Hour))
+	assert.ErrorIs(t, c.Add("b", 3, time.Hour), errCacheKeyExists)
+	time.Sleep(time.Millisecond)
+
+	// Expired entries make room, live ones are never evicted
+	assert.Nil(t, c.Add("c", 4, time.Hour))
+	assert.ErrorIs(t, c.Add("d", 5, time.Hour), errCacheFull)
+
+	got, ok := c.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, got)
+
+	t.Run("Concurrent writes", func(t *testing.T) {
+		c := newTTLCache[struct{}](0)
+
+		var added atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if c.Add("key", struct{}{}, time.Minute) == nil {
+					added.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), added.Load())
+	})
+}
+
+func Test_tokenCacheKey(t *testing.T) {
+	assert.Equal(t, tokenCacheKey("token"), tokenCacheKey("token"))
+	assert.NotEqual(t, tokenCacheKey("token"), tokenCacheKey("token2"))
+	assert.NotContains(t, tokenCacheKey("token"), "token")
+}
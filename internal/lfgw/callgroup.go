@@ -0,0 +1,42 @@
+package lfgw
+
+import "sync"
+
+// callGroup makes sure a function is called only once at a time per key: concurrent callers wait for the ongoing call and share its result (e.g. a session is refreshed once, so that IdPs rotating refresh tokens don't invalidate it, or an upstream is queried once for all waiting requests).
+type callGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall[V]
+}
+
+// groupCall is an ongoing or completed call.
+type groupCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// do calls fn unless there's an ongoing call for the same key, in which case its result is returned instead.
+func (g *callGroup[V]) do(key string, fn func() (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall[V])
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+
+	call := &groupCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.value, call.err = fn()
+	close(call.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.value, call.err
+}
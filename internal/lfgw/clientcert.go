@@ -0,0 +1,168 @@
+package lfgw
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported certificate fields for client certificate rules
+const (
+	certFieldCN  = "cn"
+	certFieldOU  = "ou"
+	certFieldURI = "uri"
+	certFieldDNS = "dns"
+)
+
+// certRule maps client certificate identities matching a regular expression to roles. Roles may reference capture groups (e.g. $1).
+type certRule struct {
+	Field string   `yaml:"field"`
+	Match string   `yaml:"match"`
+	Roles []string `yaml:"roles"`
+	re    *regexp.Regexp
+}
+
+// certRules is an ordered list of client certificate rules.
+type certRules []certRule
+
+// newCertRulesFromFile loads client certificate rules from a file.
+func newCertRulesFromFile(path string) (certRules, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules certRules `yaml:"rules"`
+	}
+
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client certificate rules: %w", err)
+	}
+
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("no client certificate rules defined")
+	}
+
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+
+		switch rule.Field {
+		case certFieldCN, certFieldOU, certFieldURI, certFieldDNS:
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown field %q (expected one of: cn, ou, uri, dns)", i, rule.Field)
+		}
+
+		if len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("rule #%d: no roles defined", i)
+		}
+
+		rule.re, err = regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: invalid regex: %w", i, err)
+		}
+	}
+
+	return file.Rules, nil
+}
+
+// certFieldValues returns the values of the given certificate field.
+func certFieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case certFieldCN:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	case certFieldOU:
+		return cert.Subject.OrganizationalUnit
+	case certFieldURI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+		return values
+	case certFieldDNS:
+		return cert.DNSNames
+	}
+
+	return nil
+}
+
+// roles returns the identity (the first matched value) and roles derived from a client certificate. All matching rules are considered.
+func (rules certRules) roles(cert *x509.Certificate) (string, []string) {
+	var subject string
+	var roles []string
+	seen := make(map[string]bool)
+
+	for _, rule := range rules {
+		for _, value := range certFieldValues(cert, rule.Field) {
+			match := rule.re.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+
+			if subject == "" {
+				subject = value
+			}
+
+			for _, template := range rule.Roles {
+				role := string(rule.re.ExpandString(nil, template, value, match))
+				if role != "" && !seen[role] {
+					seen[role] = true
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+
+	return subject, roles
+}
+
+// authenticateClientCert returns an identity derived from a verified client certificate. The second value is false if the request doesn't carry a verified certificate or the certificate matches no rules.
+func (app *application) authenticateClientCert(r *http.Request) (identity, bool) {
+	if app.certRules == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return identity{}, false
+	}
+
+	subject, roles := app.certRules.roles(r.TLS.VerifiedChains[0][0])
+	if len(roles) == 0 {
+		return identity{}, false
+	}
+
+	return identity{
+		userClaims: userClaims{Roles: roles},
+		clientCert: subject,
+	}, true
+}
+
+// newServerTLSConfig returns a TLS config for the web server. If clientCAPath is set, client certificates are verified against the CA bundle (though not required, so that bearer tokens keep working).
+func newServerTLSConfig(clientCAPath string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if clientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	caBundle, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return tlsConfig, nil
+}
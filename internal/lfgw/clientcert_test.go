@@ -0,0 +1,324 @@
+package lfgw
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_newCertRulesFromFile(t *testing.T) {
+	f, err := os.CreateTemp("", "client-cert-rules-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	t.Run("Valid rules", func(t *testing.T) {
+		saveContentToFile(t, f, `
+rules:
+  - field: uri
+    match: '^spiffe://cluster\.local/ns/([^/]+)/sa/.+$'
+    roles: ['$1']
+  - field: cn
+    match: '^vmalert$'
+    roles: [grafana-editor]
+`)
+		rules, err := newCertRulesFromFile(f.Name())
+		assert.Nil(t, err)
+		assert.Len(t, rules, 2)
+	})
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "no rules",
+			content: "rules: []",
+		},
+		{
+			name:    "unknown field",
+			content: "rules: [{field: email, match: '.*', roles: [a]}]",
+		},
+		{
+			name:    "no roles",
+			content: "rules: [{field: cn, match: '.*'}]",
+		},
+		{
+			name:    "invalid regex",
+			content: "rules: [{field: cn, match: '(', roles: [a]}]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveContentToFile(t, f, tt.content)
+			_, err := newCertRulesFromFile(f.Name())
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func Test_certRules_roles(t *testing.T) {
+	rules := testCertRules(t)
+
+	spiffeURI, err := url.Parse("spiffe://cluster.local/ns/payments/sa/autoscaler")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		cert        *x509.Certificate
+		wantSubject string
+		wantRoles   []string
+	}{
+		{
+			name:        "URI SAN",
+			cert:        &x509.Certificate{URIs: []*url.URL{spiffeURI}},
+			wantSubject: "spiffe://cluster.local/ns/payments/sa/autoscaler",
+			wantRoles:   []string{"payments"},
+		},
+		{
+			name:        "CN and OU",
+			cert:        &x509.Certificate{Subject: pkix.Name{CommonName: "vmalert", OrganizationalUnit: []string{"sre"}}},
+			wantSubject: "vmalert",
+			wantRoles:   []string{"grafana-editor", "team-sre"},
+		},
+		{
+			name:        "DNS SAN",
+			cert:        &x509.Certificate{DNSNames: []string{"collector.monitoring.svc"}},
+			wantSubject: "collector.monitoring.svc",
+			wantRoles:   []string{"monitoring"},
+		},
+		{
+			name:        "No matching rules",
+			cert:        &x509.Certificate{Subject: pkix.Name{CommonName: "random"}},
+			wantSubject: "",
+			wantRoles:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSubject, gotRoles := rules.roles(tt.cert)
+			assert.Equal(t, tt.wantSubject, gotSubject)
+			assert.Equal(t, tt.wantRoles, gotRoles)
+		})
+	}
+}
+
+func Test_oidcMiddleware_clientCert(t *testing.T) {
+	// Prepare a test server with mocked IDP, the verifier is still needed for requests without certificates
+	idp := oidcIDPServer(t)
+	defer idp.Close()
+
+	logger := zerolog.New(nil)
+
+	appHelper := application{
+		OIDCRealmURL: idp.URL,
+		OIDCClientID: "grafana",
+		logger:       &logger,
+	}
+
+	if err := appHelper.configureOIDCVerifier(); err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, caKey, caPEM := testCertificateAuthority(t)
+
+	caFile, err := os.CreateTemp("", "ca-*.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	defer caFile.Close()
+	saveContentToFile(t, caFile, string(caPEM))
+
+	tlsConfig, err := newServerTLSConfig(caFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclMonitoring, err := querymodifier.NewACL("metrics:\n  namespace: monitoring\n")
+	assert.Nil(t, err)
+
+	app := application{
+		logger:    &logger,
+		ACLs:      querymodifier.ACLs{"team-sre": aclMonitoring},
+		verifier:  appHelper.verifier,
+		certRules: testCertRules(t),
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+		assert.True(t, ok, errACLNotSetInContext)
+		assert.Equal(t, aclMonitoring, acl)
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	ts := httptest.NewUnstartedServer(app.oidcMiddleware(next))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	t.Run("Trusted client certificate", func(t *testing.T) {
+		client := testTLSClient(ts, []tls.Certificate{
+			testClientCertificate(t, caCert, caKey, pkix.Name{CommonName: "capacity", OrganizationalUnit: []string{"sre"}}),
+		})
+
+		rs, err := client.Get(ts.URL + "/api/v1/query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+	})
+
+	t.Run("No client certificate, no token", func(t *testing.T) {
+		client := testTLSClient(ts, nil)
+
+		rs, err := client.Get(ts.URL + "/api/v1/query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, rs.StatusCode)
+	})
+
+	t.Run("Certificate from an unknown CA is rejected during handshake", func(t *testing.T) {
+		otherCACert, otherCAKey, _ := testCertificateAuthority(t)
+
+		client := testTLSClient(ts, []tls.Certificate{
+			testClientCertificate(t, otherCACert, otherCAKey, pkix.Name{CommonName: "capacity", OrganizationalUnit: []string{"sre"}}),
+		})
+
+		rs, err := client.Get(ts.URL + "/api/v1/query")
+		if err == nil {
+			defer rs.Body.Close()
+		}
+		assert.NotNil(t, err)
+	})
+}
+
+// testTLSClient returns a client with its own connection pool that trusts the test server and presents the given certificates
+func testTLSClient(ts *httptest.Server, certificates []tls.Certificate) *http.Client {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+
+	return &http.Client{Transport: transport}
+}
+
+// testCertRules returns client certificate rules used in tests
+func testCertRules(t *testing.T) certRules {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "client-cert-rules-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	saveContentToFile(t, f, `
+rules:
+  - field: uri
+    match: '^spiffe://cluster\.local/ns/([^/]+)/sa/.+$'
+    roles: ['$1']
+  - field: cn
+    match: '^vmalert$'
+    roles: [grafana-editor]
+  - field: ou
+    match: '^(.+)$'
+    roles: ['team-$1']
+  - field: dns
+    match: '^[^.]+\.([^.]+)\.svc$'
+    roles: ['$1']
+`)
+
+	rules, err := newCertRulesFromFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+// testCertificateAuthority generates a self-signed CA and returns it along with its key and PEM encoding
+func testCertificateAuthority(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// testClientCertificate issues a client certificate signed by the given CA
+func testClientCertificate(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, subject pkix.Name) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
@@ -0,0 +1,283 @@
+package lfgw
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"gopkg.in/yaml.v3"
+)
+
+// denylistPath is the admin endpoint used to add entries to the denylist at runtime
+const denylistPath = "/lfgw/admin/denylist"
+
+// denylistMaxRuntimeEntries limits the number of entries added through the admin endpoint. Unlike caches, the denylist never evicts entries before they expire, new entries are rejected instead
+const denylistMaxRuntimeEntries = 100000
+
+// Types of denylist entries
+const (
+	denylistJTI   = "jti"
+	denylistSub   = "sub"
+	denylistEmail = "email"
+	denylistRole  = "role"
+)
+
+// denylistHits counts requests rejected due to denylist entries of each type
+var denylistHits = map[string]*metrics.Counter{
+	denylistJTI:   metrics.NewCounter(`denylist_hits_total{type="jti"}`),
+	denylistSub:   metrics.NewCounter(`denylist_hits_total{type="sub"}`),
+	denylistEmail: metrics.NewCounter(`denylist_hits_total{type="email"}`),
+	denylistRole:  metrics.NewCounter(`denylist_hits_total{type="role"}`),
+}
+
+// denylistFile describes the content of a denylist file.
+type denylistFile struct {
+	JTI   []string `yaml:"jti"`
+	Sub   []string `yaml:"sub"`
+	Email []string `yaml:"email"`
+	Role  []string `yaml:"role"`
+}
+
+// denylistEntry is an entry added through the admin endpoint.
+type denylistEntry struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+// denylist holds revoked token IDs, subjects, emails, and roles. Entries come from a file, which is reloaded once it's changed, and from the admin endpoint (those expire after the given TTL).
+type denylist struct {
+	path    string
+	mu      sync.RWMutex
+	static  map[string]struct{}
+	modTime time.Time
+	runtime *ttlCache[struct{}]
+}
+
+// newDenylist returns a denylist with entries loaded from path (if it's not empty).
+func newDenylist(path string) (*denylist, error) {
+	d := &denylist{
+		path:    path,
+		static:  make(map[string]struct{}),
+		runtime: newTTLCache[struct{}](denylistMaxRuntimeEntries),
+	}
+
+	if path != "" {
+		if _, err := d.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// denylistKey returns a key used to store an entry. Emails are case-insensitive.
+func denylistKey(entryType, value string) string {
+	if entryType == denylistEmail {
+		value = strings.ToLower(value)
+	}
+
+	return entryType + ":" + value
+}
+
+// isValidDenylistType returns true if entries of the given type are supported.
+func isValidDenylistType(entryType string) bool {
+	_, ok := denylistHits[entryType]
+	return ok
+}
+
+// reload reads the denylist file if it has been modified since the last load. It returns true if the file was reloaded. In case of an error, the previously loaded entries are kept.
+func (d *denylist) reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.RLock()
+	unchanged := info.ModTime().Equal(d.modTime)
+	d.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+
+	var file denylistFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return false, fmt.Errorf("failed to unmarshal denylist: %w", err)
+	}
+
+	static := make(map[string]struct{})
+	for entryType, values := range map[string][]string{
+		denylistJTI:   file.JTI,
+		denylistSub:   file.Sub,
+		denylistEmail: file.Email,
+		denylistRole:  file.Role,
+	} {
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			static[denylistKey(entryType, value)] = struct{}{}
+		}
+	}
+
+	d.mu.Lock()
+	d.static = static
+	d.modTime = info.ModTime()
+	d.mu.Unlock()
+
+	return true, nil
+}
+
+// watch periodically reloads the denylist file until done is closed.
+func (d *denylist) watch(interval time.Duration, logger *zerolog.Logger, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := d.reload()
+			if err != nil {
+				logger.Error().Caller().
+					Err(err).Msg("Failed to reload denylist, keeping the previous version")
+				continue
+			}
+
+			if reloaded {
+				logger.Info().Caller().
+					Msgf("Reloaded denylist from %s (%d entries)", d.path, d.len())
+			}
+		}
+	}
+}
+
+// len returns the number of entries loaded from the file.
+func (d *denylist) len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.static)
+}
+
+// Add denies a value for the given duration.
+func (d *denylist) Add(entryType, value string, ttl time.Duration) error {
+	if !isValidDenylistType(entryType) {
+		return fmt.Errorf("unknown denylist entry type %q (expected one of: %s, %s, %s, %s)", entryType, denylistJTI, denylistSub, denylistEmail, denylistRole)
+	}
+
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("denylist entry value cannot be empty")
+	}
+
+	if ttl <= 0 {
+		return fmt.Errorf("denylist entry TTL must be positive")
+	}
+
+	if !d.runtime.SetIfRoom(denylistKey(entryType, strings.TrimSpace(value)), struct{}{}, ttl) {
+		return errDenylistFull
+	}
+
+	return nil
+}
+
+// contains returns true if the value is denied.
+func (d *denylist) contains(entryType, value string) bool {
+	if value == "" {
+		return false
+	}
+
+	key := denylistKey(entryType, value)
+
+	d.mu.RLock()
+	_, ok := d.static[key]
+	d.mu.RUnlock()
+	if ok {
+		return true
+	}
+
+	_, ok = d.runtime.Get(key)
+	return ok
+}
+
+// Match returns the type of the first denylist entry matching the identity.
+func (d *denylist) Match(id identity) (string, bool) {
+	switch {
+	case d.contains(denylistJTI, id.TokenID):
+		return denylistJTI, true
+	case d.contains(denylistSub, id.Subject):
+		return denylistSub, true
+	case d.contains(denylistEmail, id.Email):
+		return denylistEmail, true
+	}
+
+	for _, role := range id.Roles {
+		if d.contains(denylistRole, role) {
+			return denylistRole, true
+		}
+	}
+
+	return "", false
+}
+
+// denylistHandler lets administrators add entries to the denylist at runtime.
+func (app *application) denylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		app.clientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if app.DenylistAdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(app.DenylistAdminToken)) != 1 {
+		hlog.FromRequest(r).Error().Caller().
+			Msg("Unauthorized request to the denylist admin endpoint")
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	var entry denylistEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		app.clientErrorMessage(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ttl, err := time.ParseDuration(entry.TTL)
+	if err != nil {
+		app.clientErrorMessage(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := app.denylist.Add(entry.Type, entry.Value, ttl); err != nil {
+		if errors.Is(err, errDenylistFull) {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msgf("Failed to add %s %q to the denylist", entry.Type, entry.Value)
+			app.clientErrorMessage(w, http.StatusInsufficientStorage, err)
+			return
+		}
+
+		app.clientErrorMessage(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hlog.FromRequest(r).Info().Caller().
+		Msgf("Added %s %q to the denylist for %s", entry.Type, entry.Value, ttl)
+
+	w.WriteHeader(http.StatusCreated)
+}
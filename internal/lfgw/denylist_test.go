@@ -0,0 +1,363 @@
+package lfgw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_denylist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.yaml")
+	writeDenylist(t, path, "jti: [revoked-jti]\nsub: [revoked-sub]\nemail: [Leaver@localhost]\nrole: [contractors]\n", time.Now().Add(-time.Hour))
+
+	d, err := newDenylist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		id       identity
+		wantType string
+		want     bool
+	}{
+		{
+			name:     "jti",
+			id:       identity{userClaims: userClaims{TokenID: "revoked-jti"}},
+			wantType: denylistJTI,
+			want:     true,
+		},
+		{
+			name:     "sub",
+			id:       identity{userClaims: userClaims{Subject: "revoked-sub"}},
+			wantType: denylistSub,
+			want:     true,
+		},
+		{
+			name:     "email is case-insensitive",
+			id:       identity{userClaims: userClaims{Email: "leaver@LOCALHOST"}},
+			wantType: denylistEmail,
+			want:     true,
+		},
+		{
+			name:     "role",
+			id:       identity{userClaims: userClaims{Roles: []string{"grafana-editor", "contractors"}}},
+			wantType: denylistRole,
+			want:     true,
+		},
+		{
+			name: "not denied",
+			id: identity{userClaims: userClaims{
+				TokenID: "jti",
+				Subject: "sub",
+				Email:   "user@localhost",
+				Roles:   []string{"grafana-editor"},
+			}},
+			want: false,
+		},
+		{
+			name: "empty identity",
+			id:   identity{},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, got := d.Match(tt.id)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantType, gotType)
+		})
+	}
+
+	t.Run("Unchanged file is not reloaded", func(t *testing.T) {
+		reloaded, err := d.reload()
+		assert.Nil(t, err)
+		assert.False(t, reloaded)
+	})
+
+	t.Run("Changed file is reloaded", func(t *testing.T) {
+		writeDenylist(t, path, "sub: [another-sub]\n", time.Now())
+
+		reloaded, err := d.reload()
+		assert.Nil(t, err)
+		assert.True(t, reloaded)
+
+		_, denied := d.Match(identity{userClaims: userClaims{Subject: "revoked-sub"}})
+		assert.False(t, denied)
+
+		_, denied = d.Match(identity{userClaims: userClaims{Subject: "another-sub"}})
+		assert.True(t, denied)
+	})
+
+	t.Run("Invalid file keeps the previous version", func(t *testing.T) {
+		writeDenylist(t, path, "sub: {", time.Now().Add(time.Hour))
+
+		_, err := d.reload()
+		assert.NotNil(t, err)
+
+		_, denied := d.Match(identity{userClaims: userClaims{Subject: "another-sub"}})
+		assert.True(t, denied)
+	})
+
+	t.Run("Runtime entries expire", func(t *testing.T) {
+		d, err := newDenylist("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Nil(t, d.Add(denylistSub, "temporary-sub", 50*time.Millisecond))
+
+		_, denied := d.Match(identity{userClaims: userClaims{Subject: "temporary-sub"}})
+		assert.True(t, denied)
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, denied = d.Match(identity{userClaims: userClaims{Subject: "temporary-sub"}})
+		assert.False(t, denied)
+	})
+
+	t.Run("Invalid runtime entries", func(t *testing.T) {
+		d, err := newDenylist("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NotNil(t, d.Add("random", "value", time.Minute))
+		assert.NotNil(t, d.Add(denylistSub, " ", time.Minute))
+		assert.NotNil(t, d.Add(denylistSub, "value", 0))
+	})
+
+	t.Run("Runtime entries are never evicted", func(t *testing.T) {
+		d, err := newDenylist("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.runtime = newTTLCache[struct{}](1)
+
+		assert.Nil(t, d.Add(denylistSub, "revoked-sub", time.Hour))
+		assert.ErrorIs(t, d.Add(denylistSub, "another-sub", time.Minute), errDenylistFull)
+
+		_, denied := d.Match(identity{userClaims: userClaims{Subject: "revoked-sub"}})
+		assert.True(t, denied)
+
+		// The TTL of an existing entry can still be updated
+		assert.Nil(t, d.Add(denylistSub, "revoked-sub", 2*time.Hour))
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := newDenylist(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.NotNil(t, err)
+	})
+}
+
+func TestApp_denylistHandler(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	d, err := newDenylist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		DenylistAdminToken: "admin-token",
+		denylist:           d,
+		logger:             &logger,
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{
+			name:   "Valid entry",
+			method: http.MethodPost,
+			token:  "admin-token",
+			body:   `{"type": "email", "value": "leaver@localhost", "ttl": "1h"}`,
+			want:   http.StatusCreated,
+		},
+		{
+			name:   "Wrong token",
+			method: http.MethodPost,
+			token:  "random",
+			body:   `{"type": "email", "value": "leaver@localhost", "ttl": "1h"}`,
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "Wrong method",
+			method: http.MethodGet,
+			token:  "admin-token",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "Unknown type",
+			method: http.MethodPost,
+			token:  "admin-token",
+			body:   `{"type": "random", "value": "leaver@localhost", "ttl": "1h"}`,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "No TTL",
+			method: http.MethodPost,
+			token:  "admin-token",
+			body:   `{"type": "email", "value": "leaver@localhost"}`,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "Invalid JSON",
+			method: http.MethodPost,
+			token:  "admin-token",
+			body:   `{`,
+			want:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, denylistPath, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			rr := httptest.NewRecorder()
+			app.denylistHandler(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.want, rs.StatusCode)
+		})
+	}
+
+	_, denied := d.Match(identity{userClaims: userClaims{Email: "leaver@localhost"}})
+	assert.True(t, denied)
+
+	t.Run("Full denylist", func(t *testing.T) {
+		d.runtime = newTTLCache[struct{}](1)
+		d.runtime.Set(denylistKey(denylistSub, "revoked-sub"), struct{}{}, time.Hour)
+
+		r := httptest.NewRequest(http.MethodPost, denylistPath, strings.NewReader(`{"type": "sub", "value": "another-sub", "ttl": "1h"}`))
+		r.Header.Set("Authorization", "Bearer admin-token")
+
+		rr := httptest.NewRecorder()
+		app.denylistHandler(rr, r)
+		rs := rr.Result()
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusInsufficientStorage, rs.StatusCode)
+	})
+}
+
+func TestApp_oidcMiddleware_denylist(t *testing.T) {
+	// Prepare a test server with mocked IDP
+	ts := oidcIDPServer(t)
+	defer ts.Close()
+
+	logger := zerolog.New(nil)
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "denylist.yaml")
+	writeDenylist(t, path, "jti: [revoked-jti]\nsub: [revoked-sub]\n", time.Now())
+
+	app := application{
+		OIDCRealmURL: ts.URL,
+		OIDCClientID: "grafana",
+		DenylistPath: path,
+		ACLs:         querymodifier.ACLs{"grafana-editor": aclEditor},
+		logger:       &logger,
+	}
+
+	if err := app.configureOIDCVerifier(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.configureDenylist(); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenClaims := func(jti, sub string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"aud":   "grafana",
+			"iss":   ts.URL,
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"jti":   jti,
+			"sub":   sub,
+			"roles": []string{"grafana-editor"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantType string
+		want     int
+	}{
+		{
+			name:  "Valid token",
+			token: oidcGenerateToken(t, tokenClaims("jti", "sub")),
+			want:  http.StatusOK,
+		},
+		{
+			name:     "Revoked jti",
+			token:    oidcGenerateToken(t, tokenClaims("revoked-jti", "sub")),
+			wantType: denylistJTI,
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "Revoked sub",
+			token:    oidcGenerateToken(t, tokenClaims("jti", "revoked-sub")),
+			wantType: denylistSub,
+			want:     http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hitsBefore uint64
+			if tt.wantType != "" {
+				hitsBefore = denylistHits[tt.wantType].Get()
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?query=up", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.want, rs.StatusCode)
+			if tt.wantType != "" {
+				assert.Equal(t, hitsBefore+1, denylistHits[tt.wantType].Get())
+			}
+		})
+	}
+}
+
+// writeDenylist writes a denylist file and sets its modification time
+func writeDenylist(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
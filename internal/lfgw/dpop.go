@@ -0,0 +1,219 @@
+package lfgw
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// DPoP modes (RFC 9449)
+const (
+	// dpopModeOptional requires a valid proof only for DPoP-bound tokens.
+	dpopModeOptional = "optional"
+	// dpopModeRequired rejects tokens that are not DPoP-bound.
+	dpopModeRequired = "required"
+)
+
+// dpopDefaultIssuer is used in DPoP policies to define the mode for all issuers without an explicit policy.
+const dpopDefaultIssuer = "*"
+
+// dpopScheme is the authentication scheme used to present DPoP-bound access tokens
+const dpopScheme = "DPoP"
+
+// dpopProofType is the expected typ header of DPoP proofs
+const dpopProofType = "dpop+jwt"
+
+// dpopAlgorithms lists the signature algorithms accepted in DPoP proofs (only asymmetric ones make sense)
+var dpopAlgorithms = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.RS384): true,
+	string(jose.RS512): true,
+	string(jose.PS256): true,
+	string(jose.PS384): true,
+	string(jose.PS512): true,
+	string(jose.ES256): true,
+	string(jose.ES384): true,
+	string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// dpopProofClaims holds the claims of a DPoP proof.
+type dpopProofClaims struct {
+	JTI string `json:"jti"`
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	IAT int64  `json:"iat"`
+	ATH string `json:"ath"`
+}
+
+// dpopVerifier verifies DPoP proofs presented along with sender-constrained access tokens.
+type dpopVerifier struct {
+	// policies maps issuers to DPoP modes, dpopDefaultIssuer applies to the rest.
+	policies map[string]string
+	// maxAge is the maximum difference between the issuance time of a proof and the current time.
+	maxAge time.Duration
+	// seen holds jti values of recently accepted proofs to prevent replay attacks.
+	seen *ttlCache[struct{}]
+}
+
+// newDPoPVerifier returns a dpopVerifier built from policies in the form of <issuer>=<optional|required>.
+func newDPoPVerifier(policies []string, maxAge time.Duration, replayCacheSize int) (*dpopVerifier, error) {
+	dv := &dpopVerifier{
+		policies: make(map[string]string, len(policies)),
+		maxAge:   maxAge,
+		seen:     newTTLCache[struct{}](replayCacheSize),
+	}
+
+	for _, policy := range policies {
+		policy = strings.TrimSpace(policy)
+		if policy == "" {
+			continue
+		}
+
+		i := strings.LastIndex(policy, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid DPoP policy %q, expected <issuer>=<%s|%s>", policy, dpopModeOptional, dpopModeRequired)
+		}
+
+		issuer, mode := policy[:i], policy[i+1:]
+		if mode != dpopModeOptional && mode != dpopModeRequired {
+			return nil, fmt.Errorf("invalid DPoP policy %q, unknown mode %q", policy, mode)
+		}
+
+		dv.policies[issuer] = mode
+	}
+
+	return dv, nil
+}
+
+// modeFor returns the DPoP mode for the issuer or an empty string if DPoP is not enabled for it.
+func (dv *dpopVerifier) modeFor(issuer string) string {
+	if mode, ok := dv.policies[issuer]; ok {
+		return mode
+	}
+
+	return dv.policies[dpopDefaultIssuer]
+}
+
+// Check enforces the DPoP policy of the token issuer. jkt is the thumbprint from the cnf claim of the access token (empty for tokens that are not DPoP-bound), dpopScheme is true if the token was presented with the DPoP authentication scheme.
+func (dv *dpopVerifier) Check(r *http.Request, rawAccessToken, issuer, jkt string, dpopScheme bool) error {
+	mode := dv.modeFor(issuer)
+	if mode == "" {
+		return nil
+	}
+
+	if jkt == "" {
+		if mode == dpopModeRequired || dpopScheme {
+			return errDPoPTokenNotBound
+		}
+
+		return nil
+	}
+
+	proofs := r.Header.Values("DPoP")
+	switch len(proofs) {
+	case 0:
+		return errDPoPProofMissing
+	case 1:
+	default:
+		return fmt.Errorf("%w: several proofs", errDPoPProofInvalid)
+	}
+
+	return dv.verifyProof(r, proofs[0], rawAccessToken, jkt, time.Now())
+}
+
+// verifyProof verifies the signature of a proof, its binding to the request and to the access token, and makes sure it's not replayed.
+func (dv *dpopVerifier) verifyProof(r *http.Request, proof, rawAccessToken, jkt string, now time.Time) error {
+	jws, err := jose.ParseSigned(proof)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errDPoPProofInvalid, err)
+	}
+
+	if len(jws.Signatures) != 1 {
+		return fmt.Errorf("%w: expected exactly one signature", errDPoPProofInvalid)
+	}
+	header := jws.Signatures[0].Protected
+
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return fmt.Errorf("%w: unexpected typ %q", errDPoPProofInvalid, typ)
+	}
+
+	if !dpopAlgorithms[header.Algorithm] {
+		return fmt.Errorf("%w: unsupported algorithm %q", errDPoPProofInvalid, header.Algorithm)
+	}
+
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.IsPublic() {
+		return fmt.Errorf("%w: proof must contain a public key", errDPoPProofInvalid)
+	}
+
+	payload, err := jws.Verify(jwk)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errDPoPProofInvalid, err)
+	}
+
+	var claims dpopProofClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("%w: %s", errDPoPProofInvalid, err)
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errDPoPProofInvalid, err)
+	}
+	if base64.RawURLEncoding.EncodeToString(thumbprint) != jkt {
+		return fmt.Errorf("%w: proof key does not match the token binding", errDPoPProofInvalid)
+	}
+
+	ath := sha256.Sum256([]byte(rawAccessToken))
+	if claims.ATH != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		return fmt.Errorf("%w: ath does not match the access token", errDPoPProofInvalid)
+	}
+
+	if claims.HTM != r.Method {
+		return fmt.Errorf("%w: htm does not match the request method", errDPoPProofInvalid)
+	}
+
+	if !dpopHTUMatches(claims.HTU, r) {
+		return fmt.Errorf("%w: htu does not match the request URL", errDPoPProofInvalid)
+	}
+
+	iat := time.Unix(claims.IAT, 0)
+	if claims.IAT == 0 || now.Sub(iat) > dv.maxAge || iat.Sub(now) > dv.maxAge {
+		return fmt.Errorf("%w: proof is not fresh", errDPoPProofInvalid)
+	}
+
+	if claims.JTI == "" {
+		return fmt.Errorf("%w: jti is missing", errDPoPProofInvalid)
+	}
+
+	// Proofs outside of the freshness window are rejected anyway, so jti values don't need to be kept for longer than that. The check and the write are atomic, so concurrent requests with the same proof cannot both pass. Seen values are never evicted: once the cache is full, proofs are rejected until older ones expire.
+	key := tokenCacheKey(jkt + ":" + claims.JTI)
+	switch err := dv.seen.Add(key, struct{}{}, 2*dv.maxAge); {
+	case errors.Is(err, errCacheKeyExists):
+		return fmt.Errorf("%w: proof has already been used", errDPoPProofInvalid)
+	case err != nil:
+		return fmt.Errorf("%w: replay cache is full", errDPoPProofInvalid)
+	}
+
+	return nil
+}
+
+// dpopHTUMatches compares the htu claim with the URL of the request, ignoring query and fragment parts. Since lfgw usually runs behind a reverse proxy, only the host (taken from the Host header) and the path are compared.
+func dpopHTUMatches(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host) && u.EscapedPath() == r.URL.EscapedPath()
+}
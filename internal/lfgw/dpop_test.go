@@ -0,0 +1,548 @@
+package lfgw
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_newDPoPVerifier(t *testing.T) {
+	t.Run("Valid policies", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"https://idp.localhost/realms/a=required", " *=optional "}, time.Minute, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, dpopModeRequired, dv.modeFor("https://idp.localhost/realms/a"))
+		assert.Equal(t, dpopModeOptional, dv.modeFor("https://idp.localhost/realms/b"))
+	})
+
+	t.Run("No default policy", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"https://idp.localhost/realms/a=optional"}, time.Minute, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, "", dv.modeFor("https://idp.localhost/realms/b"))
+	})
+
+	t.Run("Unknown mode", func(t *testing.T) {
+		_, err := newDPoPVerifier([]string{"*=random"}, time.Minute, 10)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("No issuer", func(t *testing.T) {
+		_, err := newDPoPVerifier([]string{"=required"}, time.Minute, 10)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_dpopVerifier_verifyProof(t *testing.T) {
+	key := testDPoPKey(t)
+	jkt := testDPoPThumbprint(t, key)
+	now := time.Now()
+	rawAccessToken := "access-token"
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"jti": fmt.Sprintf("jti-%d", time.Now().UnixNano()),
+			"htm": http.MethodGet,
+			"htu": "https://lfgw.localhost/api/v1/query",
+			"iat": now.Unix(),
+			"ath": testDPoPATH(rawAccessToken),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]interface{})
+		typ     string
+		jkt     string
+		wantErr bool
+	}{
+		{
+			name:   "Valid proof",
+			modify: func(claims map[string]interface{}) {},
+		},
+		{
+			name: "htu with a query is accepted",
+			modify: func(claims map[string]interface{}) {
+				claims["htu"] = "https://LFGW.localhost/api/v1/query?query=up"
+			},
+		},
+		{
+			name:    "Wrong typ",
+			typ:     "JWT",
+			modify:  func(claims map[string]interface{}) {},
+			wantErr: true,
+		},
+		{
+			name:    "Wrong binding",
+			jkt:     "random",
+			modify:  func(claims map[string]interface{}) {},
+			wantErr: true,
+		},
+		{
+			name: "Wrong htm",
+			modify: func(claims map[string]interface{}) {
+				claims["htm"] = http.MethodPost
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wrong htu host",
+			modify: func(claims map[string]interface{}) {
+				claims["htu"] = "https://evil.localhost/api/v1/query"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wrong htu path",
+			modify: func(claims map[string]interface{}) {
+				claims["htu"] = "https://lfgw.localhost/api/v1/query_range"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Stale proof",
+			modify: func(claims map[string]interface{}) {
+				claims["iat"] = now.Add(-2 * time.Minute).Unix()
+			},
+			wantErr: true,
+		},
+		{
+			name: "Proof from the future",
+			modify: func(claims map[string]interface{}) {
+				claims["iat"] = now.Add(2 * time.Minute).Unix()
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wrong ath",
+			modify: func(claims map[string]interface{}) {
+				claims["ath"] = testDPoPATH("another-token")
+			},
+			wantErr: true,
+		},
+		{
+			name: "No jti",
+			modify: func(claims map[string]interface{}) {
+				delete(claims, "jti")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dv, err := newDPoPVerifier([]string{"*=optional"}, time.Minute, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims := validClaims()
+			tt.modify(claims)
+
+			typ := tt.typ
+			if typ == "" {
+				typ = dpopProofType
+			}
+
+			wantJKT := tt.jkt
+			if wantJKT == "" {
+				wantJKT = jkt
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query?query=up", nil)
+			proof := testDPoPProof(t, key, typ, claims)
+
+			err = dv.verifyProof(r, proof, rawAccessToken, wantJKT, now)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errDPoPProofInvalid)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+
+	t.Run("Replayed proof", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"*=optional"}, time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query", nil)
+		proof := testDPoPProof(t, key, dpopProofType, validClaims())
+
+		assert.Nil(t, dv.verifyProof(r, proof, rawAccessToken, jkt, now))
+		assert.ErrorIs(t, dv.verifyProof(r, proof, rawAccessToken, jkt, now), errDPoPProofInvalid)
+	})
+
+	t.Run("Proof sent twice at the same time", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"*=optional"}, time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proof := testDPoPProof(t, key, dpopProofType, validClaims())
+
+		var accepted atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query", nil)
+				<-start
+				if dv.verifyProof(r, proof, rawAccessToken, jkt, now) == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), accepted.Load())
+	})
+
+	t.Run("Replay cache is full", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"*=optional"}, time.Minute, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query", nil)
+		first := testDPoPProof(t, key, dpopProofType, validClaims())
+
+		assert.Nil(t, dv.verifyProof(r, first, rawAccessToken, jkt, now))
+		// Fresh proofs cannot push seen ones out of the cache
+		assert.ErrorIs(t, dv.verifyProof(r, testDPoPProof(t, key, dpopProofType, validClaims()), rawAccessToken, jkt, now), errDPoPProofInvalid)
+		assert.ErrorIs(t, dv.verifyProof(r, first, rawAccessToken, jkt, now), errDPoPProofInvalid)
+	})
+
+	t.Run("Proof signed by another key", func(t *testing.T) {
+		dv, err := newDPoPVerifier([]string{"*=optional"}, time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query", nil)
+		proof := testDPoPProof(t, testDPoPKey(t), dpopProofType, validClaims())
+
+		assert.ErrorIs(t, dv.verifyProof(r, proof, rawAccessToken, jkt, now), errDPoPProofInvalid)
+	})
+}
+
+func Test_dpopVerifier_Check(t *testing.T) {
+	dv, err := newDPoPVerifier([]string{"https://strict.localhost=required", "https://relaxed.localhost=optional"}, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		issuer     string
+		jkt        string
+		dpopScheme bool
+		wantErr    error
+	}{
+		{
+			name:   "Issuer without a policy",
+			issuer: "https://random.localhost",
+			jkt:    "thumbprint",
+		},
+		{
+			name:   "Optional, bearer token",
+			issuer: "https://relaxed.localhost",
+		},
+		{
+			name:       "Optional, unbound token with the DPoP scheme",
+			issuer:     "https://relaxed.localhost",
+			dpopScheme: true,
+			wantErr:    errDPoPTokenNotBound,
+		},
+		{
+			name:    "Optional, bound token without a proof",
+			issuer:  "https://relaxed.localhost",
+			jkt:     "thumbprint",
+			wantErr: errDPoPProofMissing,
+		},
+		{
+			name:    "Required, bearer token",
+			issuer:  "https://strict.localhost",
+			wantErr: errDPoPTokenNotBound,
+		},
+		{
+			name:    "Required, bound token without a proof",
+			issuer:  "https://strict.localhost",
+			jkt:     "thumbprint",
+			wantErr: errDPoPProofMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://lfgw.localhost/api/v1/query", nil)
+			err := dv.Check(r, "access-token", tt.issuer, tt.jkt, tt.dpopScheme)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestApp_oidcMiddleware_dpop(t *testing.T) {
+	// Prepare a test server with mocked IDP
+	ts := oidcIDPServer(t)
+	defer ts.Close()
+
+	logger := zerolog.New(nil)
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	assert.Nil(t, err)
+
+	app := application{
+		OIDCRealmURL: ts.URL,
+		OIDCClientID: "grafana",
+		DPoPPolicies: []string{ts.URL + "=required"},
+		ACLs:         querymodifier.ACLs{"grafana-editor": aclEditor},
+		logger:       &logger,
+	}
+
+	if err := app.configureOIDCVerifier(); err != nil {
+		t.Fatal(err)
+	}
+
+	app.DPoPProofMaxAge = time.Minute
+	if err := app.configureDPoP(); err != nil {
+		t.Fatal(err)
+	}
+
+	key := testDPoPKey(t)
+	jkt := testDPoPThumbprint(t, key)
+
+	tokenClaims := func(jkt string) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"aud":   "grafana",
+			"iss":   ts.URL,
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"roles": []string{"grafana-editor"},
+		}
+		if jkt != "" {
+			claims["cnf"] = map[string]string{"jkt": jkt}
+		}
+		return claims
+	}
+
+	boundToken := oidcGenerateToken(t, tokenClaims(jkt))
+	bearerToken := oidcGenerateToken(t, tokenClaims(""))
+
+	proofClaims := func(rawAccessToken string) map[string]interface{} {
+		return map[string]interface{}{
+			"jti": fmt.Sprintf("jti-%d", time.Now().UnixNano()),
+			"htm": http.MethodGet,
+			"htu": "http://lfgw.localhost/api/v1/query",
+			"iat": time.Now().Unix(),
+			"ath": testDPoPATH(rawAccessToken),
+		}
+	}
+
+	validProof := testDPoPProof(t, key, dpopProofType, proofClaims(boundToken))
+
+	tests := []struct {
+		name          string
+		authorization string
+		proof         string
+		want          int
+	}{
+		{
+			name:          "Bound token with a valid proof",
+			authorization: "DPoP " + boundToken,
+			proof:         validProof,
+			want:          http.StatusOK,
+		},
+		{
+			name:          "Replayed proof",
+			authorization: "DPoP " + boundToken,
+			proof:         validProof,
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:          "Bound token without a proof",
+			authorization: "DPoP " + boundToken,
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:          "Bound token presented as a bearer token",
+			authorization: "Bearer " + boundToken,
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:          "Proof made by another key",
+			authorization: "DPoP " + boundToken,
+			proof:         testDPoPProof(t, testDPoPKey(t), dpopProofType, proofClaims(boundToken)),
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:          "Unbound token when DPoP is required",
+			authorization: "Bearer " + bearerToken,
+			want:          http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw.localhost/api/v1/query?query=up", nil)
+			r.Header.Set("Authorization", tt.authorization)
+			if tt.proof != "" {
+				r.Header.Set("DPoP", tt.proof)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.want, rs.StatusCode)
+		})
+	}
+}
+
+func TestApp_oidcMiddleware_dpopWithoutIssuer(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	var calls atomic.Int32
+	its := introspectionServer(t, "lfgw", "secret", &calls)
+	defer its.Close()
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		DPoPPolicies:    []string{dpopDefaultIssuer + "=" + dpopModeRequired},
+		DPoPProofMaxAge: time.Minute,
+		ACLs:            querymodifier.ACLs{"grafana-editor": aclEditor},
+		logger:          &logger,
+		verifier:        testDummyVerifier(t),
+		introspector:    newTokenIntrospector(its.URL, "lfgw", "secret", "lfgw", time.Minute, time.Minute),
+		apiKeys: apiKeys{
+			testAPIKeyHash("editor-key"): apiKey{
+				name:  "alerting",
+				roles: []string{"grafana-editor"},
+			},
+		},
+	}
+
+	if err := app.configureDPoP(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{
+			name:  "Introspected token without an issuer is subject to the default policy",
+			token: "active-token",
+			want:  http.StatusUnauthorized,
+		},
+		{
+			name:  "API keys are not subject to DPoP policies",
+			token: "editor-key",
+			want:  http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://lfgw.localhost/api/v1/query?query=up", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.want, rs.StatusCode)
+		})
+	}
+}
+
+// testDPoPKey generates a key pair for signing DPoP proofs
+func testDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// testDPoPThumbprint returns the JWK thumbprint of a public key (the value of cnf.jkt)
+func testDPoPThumbprint(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+// testDPoPATH returns the value of the ath claim for an access token
+func testDPoPATH(rawAccessToken string) string {
+	sum := sha256.Sum256([]byte(rawAccessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// testDPoPProof returns a DPoP proof with the given claims, signed by the key, which is embedded into the header
+func testDPoPProof(t *testing.T, key *ecdsa.PrivateKey, typ string, claims map[string]interface{}) string {
+	t.Helper()
+
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ))
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proof
+}
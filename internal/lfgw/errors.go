@@ -3,9 +3,26 @@ package lfgw
 import "errors"
 
 var (
-	errNoToken                = errors.New("no bearer token found")
-	errNoTokenGrafana         = errors.New("no bearer token found, possible causes: grafana data source is not configured with Forward Oauth Identity option; grafana user sessions are not tuned to live shorter than IDP sessions; malicious requests")
-	errUpstreamNotInitialized = errors.New("UpstreamURL is not initialized")
-	errVerifierNotInitialized = errors.New("OIDC verifier is not initialized")
-	errACLNotSetInContext     = errors.New("ACL is not set in the context")
+	errNoToken                        = errors.New("no bearer token found")
+	errNoTokenGrafana                 = errors.New("no bearer token found, possible causes: grafana data source is not configured with Forward Oauth Identity option; grafana user sessions are not tuned to live shorter than IDP sessions; malicious requests")
+	errUpstreamNotInitialized         = errors.New("UpstreamURL is not initialized")
+	errVerifierNotInitialized         = errors.New("OIDC verifier is not initialized")
+	errACLNotSetInContext             = errors.New("ACL is not set in the context")
+	errTokenInactive                  = errors.New("token is not active")
+	errUserInfoSubject                = errors.New("userinfo subject does not match the token subject")
+	errTokenAudience                  = errors.New("token is not issued for lfgw (neither aud nor client_id match)")
+	errAPIKeyExpired                  = errors.New("API key has expired")
+	errLoginStateMissing              = errors.New("login state is missing or has expired, please, try to log in again")
+	errLoginStateMismatch             = errors.New("login state does not match")
+	errConflictingTokens              = errors.New("request contains several different tokens")
+	errAPIKeyUntrustedSource          = errors.New("API keys are not accepted from untrusted token sources")
+	errServiceAccountNotAuthenticated = errors.New("service account token is not authenticated")
+	errDPoPProofMissing               = errors.New("DPoP proof is missing")
+	errDPoPProofInvalid               = errors.New("DPoP proof is invalid")
+	errDPoPTokenNotBound              = errors.New("access token is not DPoP-bound")
+	errDenied                         = errors.New("access has been revoked")
+	errDenylistFull                   = errors.New("denylist is full, entries have to be added to the denylist file instead")
+	errCacheKeyExists                 = errors.New("key is already present in the cache")
+	errCacheFull                      = errors.New("cache is full")
+	errNotServiceAccount              = errors.New("token does not belong to a service account")
 )
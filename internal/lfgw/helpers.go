@@ -1,12 +1,14 @@
 package lfgw
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"github.com/rs/zerolog/hlog"
+	"github.com/weisdd/lfgw/internal/querymodifier"
 )
 
 // serverError sends a generic 500 Internal Server Error response to the user.
@@ -27,33 +29,28 @@ func (app *application) clientErrorMessage(w http.ResponseWriter, status int, er
 	fmt.Fprintf(w, "%s", err)
 }
 
+// prometheusError sends an error response in the format of Prometheus API (e.g. {"status":"error","errorType":"bad_data","error":"..."}), so that clients like Grafana can show the message to the user.
+func (app *application) prometheusError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	// Encoding of a struct with string fields cannot fail, and there's nothing to do about write errors
+	_ = json.NewEncoder(w).Encode(struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
 // getRawAccessToken returns a raw access token
 func (app *application) getRawAccessToken(r *http.Request) (string, error) {
-	headers := []string{"Authorization", "X-Forwarded-Access-Token", "X-Auth-Request-Access-Token"}
-
-	for _, h := range headers {
-		t := r.Header.Get(h)
-
-		if h == "Authorization" {
-			// Consider only Bearer tokens
-			if !strings.HasPrefix(t, "Bearer ") {
-				continue
-			}
-
-			t = strings.TrimPrefix(t, "Bearer ")
-		}
-
-		if t != "" {
-			return t, nil
-		}
-	}
-
-	isGrafanaRequest := strings.Contains(strings.ToLower(r.UserAgent()), "grafana")
-	if isGrafanaRequest {
-		return "", errNoTokenGrafana
-	}
-
-	return "", errNoToken
+	t, _, err := app.extractAccessToken(r)
+	return t, err
 }
 
 // isNotAPIRequest returns true if the requested path does not target API or federate endpoints.
@@ -68,6 +65,29 @@ func (app *application) isUnsafePath(path string) bool {
 	return strings.Contains(path, "/admin/tsdb") || strings.Contains(path, "/api/v1/write")
 }
 
+// checkAggregationOnlyPath returns an error if the requested path exposes data, which cannot be aggregated: values of hidden labels, exemplars of individual series or TSDB stats (the latter include the top values of every label).
+func (app *application) checkAggregationOnlyPath(path string, ap querymodifier.AggregationPolicy) error {
+	if strings.Contains(path, "/query_exemplars") {
+		return fmt.Errorf("exemplars are not available with aggregation-only access")
+	}
+
+	if strings.Contains(path, "/api/v1/status/tsdb") {
+		return fmt.Errorf("TSDB stats are not available with aggregation-only access")
+	}
+
+	_, rest, found := strings.Cut(path, "/api/v1/label/")
+	if !found {
+		return nil
+	}
+
+	label, _, _ := strings.Cut(rest, "/")
+	if ap.IsHiddenLabel(label) {
+		return fmt.Errorf("values of the label %s are not available with aggregation-only access", label)
+	}
+
+	return nil
+}
+
 // unescapedURLQuery returns unescaped query string
 func (app *application) unescapedURLQuery(s string) string {
 	// We should never hit an error as we encoded query string ourselves. The undelying library returns an empty string in case of an error, error handling is left only for clarity.
@@ -6,6 +6,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
 )
 
 func TestGetRawAccessToken(t *testing.T) {
@@ -93,6 +94,23 @@ func TestGetRawAccessToken(t *testing.T) {
 			assert.Equal(t, tt.want, got)
 		})
 	}
+
+	t.Run("API key in basic auth", func(t *testing.T) {
+		app := &application{
+			logger:  &logger,
+			apiKeys: apiKeys{},
+		}
+
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetBasicAuth("alerting", "FAKE_KEY")
+
+		got, err := app.getRawAccessToken(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "FAKE_KEY", got)
+	})
 }
 
 func TestIsUnsafePath(t *testing.T) {
@@ -170,3 +188,58 @@ func TestIsNotAPIRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckAggregationOnlyPath(t *testing.T) {
+	logger := zerolog.New(nil)
+	app := &application{
+		logger: &logger,
+	}
+
+	ap := querymodifier.AggregationPolicy{Labels: []string{"pod", "user_id"}}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name:    "query",
+			path:    "/api/v1/query",
+			wantErr: false,
+		},
+		{
+			name:    "values of a visible label",
+			path:    "/api/v1/label/namespace/values",
+			wantErr: false,
+		},
+		{
+			name:    "values of a hidden label",
+			path:    "/api/v1/label/pod/values",
+			wantErr: true,
+		},
+		{
+			name:    "values of a hidden label with a prefix",
+			path:    "/select/0/prometheus/api/v1/label/user_id/values",
+			wantErr: true,
+		},
+		{
+			name:    "exemplars",
+			path:    "/api/v1/query_exemplars",
+			wantErr: true,
+		},
+		{
+			name:    "TSDB stats",
+			path:    "/api/v1/status/tsdb",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := app.checkAggregationOnlyPath(tt.path, ap)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("want error %t; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
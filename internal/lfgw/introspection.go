@@ -0,0 +1,181 @@
+package lfgw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// introspectionResponse holds the fields of an RFC 7662 introspection response that are relevant to lfgw.
+type introspectionResponse struct {
+	Active bool     `json:"active"`
+	Exp    int64    `json:"exp"`
+	Roles  []string `json:"roles"`
+	Email  string   `json:"email"`
+	Iss    string   `json:"iss"`
+	Sub    string   `json:"sub"`
+	Jti    string   `json:"jti"`
+	// Aud and ClientID are checked against the expected audience, so that tokens issued to other clients are not accepted
+	Aud      audienceClaim `json:"aud"`
+	ClientID string        `json:"client_id"`
+	// Sender-constrained tokens (RFC 9449)
+	Cnf confirmationClaim `json:"cnf"`
+	// claims holds the whole response, which is referenced by ACL templates
+	claims map[string]interface{}
+}
+
+// audienceClaim holds the aud claim, which might be either a string or an array of strings.
+type audienceClaim []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *audienceClaim) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audienceClaim{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("aud has to be either a string or an array of strings: %w", err)
+	}
+	*a = multiple
+
+	return nil
+}
+
+// issuedFor returns true if the token is meant for the given audience: it's either listed in aud, or the token was requested by the client itself (some IdPs, e.g. Keycloak, omit the client from aud by default).
+func (resp introspectionResponse) issuedFor(audience string) bool {
+	return slices.Contains(resp.Aud, audience) || resp.ClientID == audience
+}
+
+// introspectionMaxCachedTokens limits the number of tokens cached by each of the introspection caches.
+const introspectionMaxCachedTokens = 10000
+
+// tokenIntrospector validates opaque access tokens through an OAuth2 token introspection endpoint (RFC 7662).
+type tokenIntrospector struct {
+	url              string
+	clientID         string
+	audience         string
+	clientSecret     string
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	client           *http.Client
+	cache            *ttlCache[userClaims]
+	// negativeCache holds the reasons, for which tokens were rejected. It's kept separately, so that rejected tokens (e.g. random strings sent by anyone) never evict active ones.
+	negativeCache *ttlCache[error]
+}
+
+// newTokenIntrospector returns a tokenIntrospector that authenticates against the introspection endpoint with the given client credentials. Only tokens issued for the audience are accepted (the check is skipped if it's empty).
+func newTokenIntrospector(introspectionURL, clientID, clientSecret, audience string, cacheTTL, negativeCacheTTL time.Duration) *tokenIntrospector {
+	return &tokenIntrospector{
+		url:              introspectionURL,
+		clientID:         clientID,
+		audience:         audience,
+		clientSecret:     clientSecret,
+		cacheTTL:         cacheTTL,
+		negativeCacheTTL: negativeCacheTTL,
+		client:           &http.Client{Timeout: 10 * time.Second},
+		cache:            newTTLCache[userClaims](introspectionMaxCachedTokens),
+		negativeCache:    newTTLCache[error](introspectionMaxCachedTokens),
+	}
+}
+
+// Introspect returns claims of an active token or an error if the token is inactive or cannot be introspected.
+func (ti *tokenIntrospector) Introspect(ctx context.Context, rawAccessToken string) (userClaims, error) {
+	key := tokenCacheKey(rawAccessToken)
+
+	if claims, ok := ti.cache.Get(key); ok {
+		return claims, nil
+	}
+
+	if err, ok := ti.negativeCache.Get(key); ok {
+		return userClaims{}, err
+	}
+
+	resp, err := ti.request(ctx, rawAccessToken)
+	if err != nil {
+		// Transient errors are not cached
+		return userClaims{}, err
+	}
+
+	now := time.Now()
+	if !resp.Active || (resp.Exp != 0 && now.Unix() >= resp.Exp) {
+		ti.negativeCache.Set(key, errTokenInactive, ti.negativeCacheTTL)
+		return userClaims{}, errTokenInactive
+	}
+
+	if ti.audience != "" && !resp.issuedFor(ti.audience) {
+		ti.negativeCache.Set(key, errTokenAudience, ti.negativeCacheTTL)
+		return userClaims{}, errTokenAudience
+	}
+
+	claims := userClaims{
+		Claims:       resp.claims,
+		Roles:        resp.Roles,
+		Email:        resp.Email,
+		Issuer:       resp.Iss,
+		Confirmation: resp.Cnf,
+		Subject:      resp.Sub,
+		TokenID:      resp.Jti,
+	}
+
+	// A cached entry must never outlive the token itself
+	ttl := ti.cacheTTL
+	if resp.Exp != 0 {
+		if untilExpiry := time.Unix(resp.Exp, 0).Sub(now); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	ti.cache.Set(key, claims, ttl)
+
+	return claims, nil
+}
+
+// request sends a token to the introspection endpoint and decodes the response.
+func (ti *tokenIntrospector) request(ctx context.Context, rawAccessToken string) (introspectionResponse, error) {
+	form := url.Values{
+		"token":           {rawAccessToken},
+		"token_type_hint": {"access_token"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ti.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResponse{}, fmt.Errorf("failed to create introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(ti.clientID), url.QueryEscape(ti.clientSecret))
+
+	res, err := ti.client.Do(req)
+	if err != nil {
+		return introspectionResponse{}, fmt.Errorf("introspection request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return introspectionResponse{}, fmt.Errorf("introspection endpoint returned %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return introspectionResponse{}, fmt.Errorf("failed to read introspection response: %w", err)
+	}
+
+	var resp introspectionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return introspectionResponse{}, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	if err := json.Unmarshal(body, &resp.claims); err != nil {
+		return introspectionResponse{}, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,190 @@
+package lfgw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tokenIntrospector_Introspect(t *testing.T) {
+	clientID := "lfgw"
+	clientSecret := "secret"
+
+	var calls atomic.Int32
+	ts := introspectionServer(t, clientID, clientSecret, &calls)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("Active token", func(t *testing.T) {
+		calls.Store(0)
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+
+		want := userClaims{
+			Roles: []string{"grafana-editor"},
+			Email: "service@localhost",
+		}
+
+		got, err := ti.Introspect(ctx, "active-token")
+		assert.Nil(t, err)
+		// The whole response is kept for ACL templates
+		assert.Equal(t, "service@localhost", got.Claims["email"])
+		got.Claims = nil
+		assert.Equal(t, want, got)
+
+		// The second call is served from cache
+		got, err = ti.Introspect(ctx, "active-token")
+		assert.Nil(t, err)
+		got.Claims = nil
+		assert.Equal(t, want, got)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Inactive token (negative caching)", func(t *testing.T) {
+		calls.Store(0)
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+
+		_, err := ti.Introspect(ctx, "inactive-token")
+		assert.ErrorIs(t, err, errTokenInactive)
+
+		_, err = ti.Introspect(ctx, "inactive-token")
+		assert.ErrorIs(t, err, errTokenInactive)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+
+		_, err := ti.Introspect(ctx, "expired-token")
+		assert.ErrorIs(t, err, errTokenInactive)
+	})
+
+	t.Run("Token requested by the client itself", func(t *testing.T) {
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+
+		got, err := ti.Introspect(ctx, "client-token")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"grafana-editor"}, got.Roles)
+	})
+
+	t.Run("Token issued to another client", func(t *testing.T) {
+		calls.Store(0)
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+
+		_, err := ti.Introspect(ctx, "foreign-token")
+		assert.ErrorIs(t, err, errTokenAudience)
+
+		_, err = ti.Introspect(ctx, "foreign-token")
+		assert.ErrorIs(t, err, errTokenAudience)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Rejected tokens never evict active ones", func(t *testing.T) {
+		calls.Store(0)
+		ti := newTokenIntrospector(ts.URL, clientID, clientSecret, clientID, time.Minute, time.Minute)
+		ti.cache = newTTLCache[userClaims](1)
+		ti.negativeCache = newTTLCache[error](1)
+
+		_, err := ti.Introspect(ctx, "active-token")
+		assert.Nil(t, err)
+
+		for _, token := range []string{"inactive-token", "foreign-token", "expired-token"} {
+			_, err = ti.Introspect(ctx, token)
+			assert.NotNil(t, err)
+		}
+
+		_, err = ti.Introspect(ctx, "active-token")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("Incorrect client credentials", func(t *testing.T) {
+		calls.Store(0)
+		ti := newTokenIntrospector(ts.URL, clientID, "wrong-secret", clientID, time.Minute, time.Minute)
+
+		_, err := ti.Introspect(ctx, "active-token")
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, errTokenInactive)
+
+		// Errors are not cached
+		_, err = ti.Introspect(ctx, "active-token")
+		assert.NotNil(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
+
+func Test_audienceClaim_UnmarshalJSON(t *testing.T) {
+	var resp introspectionResponse
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"aud": "lfgw"}`), &resp))
+	assert.Equal(t, audienceClaim{"lfgw"}, resp.Aud)
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"aud": ["account", "lfgw"]}`), &resp))
+	assert.Equal(t, audienceClaim{"account", "lfgw"}, resp.Aud)
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"aud": 1}`), &resp))
+}
+
+// introspectionServer sets up a stand-in for an RFC 7662 introspection endpoint
+func introspectionServer(t *testing.T, clientID, clientSecret string, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != clientID || secret != clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var resp introspectionResponse
+		switch r.PostForm.Get("token") {
+		case "active-token":
+			resp = introspectionResponse{
+				Active: true,
+				Exp:    time.Now().Add(time.Hour).Unix(),
+				Roles:  []string{"grafana-editor"},
+				Email:  "service@localhost",
+				Aud:    audienceClaim{"account", clientID},
+			}
+		case "client-token":
+			resp = introspectionResponse{
+				Active:   true,
+				Exp:      time.Now().Add(time.Hour).Unix(),
+				Roles:    []string{"grafana-editor"},
+				ClientID: clientID,
+			}
+		case "foreign-token":
+			resp = introspectionResponse{
+				Active:   true,
+				Exp:      time.Now().Add(time.Hour).Unix(),
+				Roles:    []string{"admin"},
+				Aud:      audienceClaim{"another-client"},
+				ClientID: "another-client",
+			}
+		case "expired-token":
+			resp = introspectionResponse{
+				Active: true,
+				Exp:    time.Now().Add(-time.Hour).Unix(),
+			}
+		default:
+			resp = introspectionResponse{Active: false}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
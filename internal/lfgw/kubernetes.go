@@ -0,0 +1,302 @@
+package lfgw
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+// Kubernetes ACL modes
+const (
+	// kubernetesACLModeNamespace grants access to the namespace of a ServiceAccount.
+	kubernetesACLModeNamespace = "namespace"
+	// kubernetesACLModeSAR grants access to the candidate namespaces, in which a ServiceAccount is allowed to perform the configured action (SubjectAccessReview).
+	kubernetesACLModeSAR = "sar"
+)
+
+// serviceAccountPrefix is the prefix of ServiceAccount user names (system:serviceaccount:<namespace>:<name>)
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// namespaceRe matches valid Kubernetes namespace names (RFC 1123 labels)
+var namespaceRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// kubernetesUserInfo holds the fields of a TokenReview user that are relevant to lfgw.
+type kubernetesUserInfo struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid"`
+	Groups   []string `json:"groups"`
+}
+
+// kubernetesMaxCachedTokens limits the number of tokens kept by each of the Kubernetes caches.
+const kubernetesMaxCachedTokens = 10000
+
+// kubernetesResult is what gets cached for an authenticated token.
+type kubernetesResult struct {
+	serviceAccount string
+	acl            querymodifier.ACL
+}
+
+// kubernetesAuthenticator verifies Kubernetes ServiceAccount tokens through the TokenReview API and derives ACLs either from the namespace of a ServiceAccount or from SubjectAccessReview checks.
+type kubernetesAuthenticator struct {
+	apiURL    string
+	tokenPath string
+	audiences []string
+	aclMode   string
+	aclLabel  string
+	// Candidate namespaces and the resource attributes checked through SubjectAccessReview
+	sarNamespaces []string
+	sarVerb       string
+	sarResource   string
+	sarGroup      string
+	cacheTTL      time.Duration
+	client        *http.Client
+	cache         *ttlCache[kubernetesResult]
+	// negativeCache holds unauthenticated tokens. It's kept separately, so that random tokens sent by anyone never evict authenticated ones.
+	negativeCache *ttlCache[struct{}]
+}
+
+// newKubernetesHTTPClient returns an HTTP client for the Kubernetes API, which trusts the CA bundle at caPath (system roots are used if caPath is empty).
+func newKubernetesHTTPClient(caPath string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caPath != "" {
+		caBundle, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// Authenticate returns the name of a ServiceAccount (namespace/name) along with the derived ACL or an error if the token cannot be authenticated.
+func (ka *kubernetesAuthenticator) Authenticate(ctx context.Context, rawAccessToken string) (string, querymodifier.ACL, error) {
+	key := tokenCacheKey(rawAccessToken)
+
+	if result, ok := ka.cache.Get(key); ok {
+		return result.serviceAccount, result.acl, nil
+	}
+
+	if _, ok := ka.negativeCache.Get(key); ok {
+		return "", querymodifier.ACL{}, errServiceAccountNotAuthenticated
+	}
+
+	user, authenticated, err := ka.tokenReview(ctx, rawAccessToken)
+	if err != nil {
+		// Transient errors are not cached
+		return "", querymodifier.ACL{}, err
+	}
+
+	if !authenticated {
+		ka.negativeCache.Set(key, struct{}{}, ka.cacheTTL)
+		return "", querymodifier.ACL{}, errServiceAccountNotAuthenticated
+	}
+
+	namespace, name, ok := parseServiceAccountUsername(user.Username)
+	if !ok {
+		return "", querymodifier.ACL{}, fmt.Errorf("%w (%s)", errNotServiceAccount, user.Username)
+	}
+
+	var namespaces []string
+	switch ka.aclMode {
+	case kubernetesACLModeSAR:
+		for _, candidate := range ka.sarNamespaces {
+			allowed, err := ka.subjectAccessReview(ctx, user, candidate)
+			if err != nil {
+				return "", querymodifier.ACL{}, err
+			}
+
+			if allowed {
+				namespaces = append(namespaces, candidate)
+			}
+		}
+	default:
+		namespaces = []string{namespace}
+	}
+
+	serviceAccount := namespace + "/" + name
+
+	if len(namespaces) == 0 {
+		return "", querymodifier.ACL{}, fmt.Errorf("service account %s is not allowed to access any namespace", serviceAccount)
+	}
+
+	// Namespaces come from the API, so the ACL is constructed directly and names are always matched literally
+	acl, err := querymodifier.NewClaimACL(ka.aclLabel, namespaces)
+	if err != nil {
+		return "", querymodifier.ACL{}, fmt.Errorf("failed to create ACL for service account %s: %w", serviceAccount, err)
+	}
+
+	// A cached entry must never outlive the token itself. RBAC changes, however, are picked up only once the entry expires.
+	ttl := ka.cacheTTL
+	if expiry, ok := jwtExpiry(rawAccessToken); ok {
+		if untilExpiry := time.Until(expiry); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	ka.cache.Set(key, kubernetesResult{serviceAccount: serviceAccount, acl: acl}, ttl)
+
+	return serviceAccount, acl, nil
+}
+
+// jwtExpiry returns the expiration time (exp) of a JWT. The signature is not verified, so it must be called only for tokens, which have been verified otherwise (e.g. through TokenReview). False is returned if the token has no expiration time (e.g. legacy ServiceAccount tokens).
+func jwtExpiry(rawToken string) (time.Time, bool) {
+	jws, err := jose.ParseSigned(rawToken)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Exp, 0), true
+}
+
+// parseServiceAccountUsername splits a ServiceAccount user name (system:serviceaccount:<namespace>:<name>) into a namespace and a name.
+func parseServiceAccountUsername(username string) (string, string, bool) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", "", false
+	}
+
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if !ok || name == "" || !namespaceRe.MatchString(namespace) {
+		return "", "", false
+	}
+
+	return namespace, name, true
+}
+
+// tokenReview sends a token to the TokenReview API and returns the user it belongs to.
+func (ka *kubernetesAuthenticator) tokenReview(ctx context.Context, rawAccessToken string) (kubernetesUserInfo, bool, error) {
+	review := map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec": map[string]interface{}{
+			"token":     rawAccessToken,
+			"audiences": ka.audiences,
+		},
+	}
+
+	var resp struct {
+		Status struct {
+			Authenticated bool               `json:"authenticated"`
+			User          kubernetesUserInfo `json:"user"`
+			Audiences     []string           `json:"audiences"`
+		} `json:"status"`
+	}
+
+	if err := ka.post(ctx, "/apis/authentication.k8s.io/v1/tokenreviews", review, &resp); err != nil {
+		return kubernetesUserInfo{}, false, fmt.Errorf("token review failed: %w", err)
+	}
+
+	// Authenticators that are not audience-aware might ignore spec.audiences, so the token is only accepted if it's valid for at least one of the requested audiences
+	if resp.Status.Authenticated && len(ka.audiences) > 0 && !containsAny(resp.Status.Audiences, ka.audiences) {
+		return kubernetesUserInfo{}, false, nil
+	}
+
+	return resp.Status.User, resp.Status.Authenticated, nil
+}
+
+// containsAny returns true if values contain at least one of candidates.
+func containsAny(values []string, candidates []string) bool {
+	for _, candidate := range candidates {
+		if slices.Contains(values, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subjectAccessReview checks whether the user is allowed to perform the configured action in the namespace.
+func (ka *kubernetesAuthenticator) subjectAccessReview(ctx context.Context, user kubernetesUserInfo, namespace string) (bool, error) {
+	review := map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SubjectAccessReview",
+		"spec": map[string]interface{}{
+			"user":   user.Username,
+			"uid":    user.UID,
+			"groups": user.Groups,
+			"resourceAttributes": map[string]string{
+				"namespace": namespace,
+				"verb":      ka.sarVerb,
+				"group":     ka.sarGroup,
+				"resource":  ka.sarResource,
+			},
+		},
+	}
+
+	var resp struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}
+
+	if err := ka.post(ctx, "/apis/authorization.k8s.io/v1/subjectaccessreviews", review, &resp); err != nil {
+		return false, fmt.Errorf("subject access review failed: %w", err)
+	}
+
+	return resp.Status.Allowed, nil
+}
+
+// post sends an object to the Kubernetes API on behalf of lfgw's own ServiceAccount and decodes the response.
+func (ka *kubernetesAuthenticator) post(ctx context.Context, path string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(ka.apiURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	// Projected tokens are rotated by kubelet, so the token is re-read on every request
+	token, err := os.ReadFile(ka.tokenPath)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	res, err := ka.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes API returned %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,541 @@
+package lfgw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_kubernetesAuthenticator_Authenticate(t *testing.T) {
+	var calls atomic.Int32
+	ts := kubernetesAPIServer(t, "lfgw-token", &calls)
+	defer ts.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("lfgw-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newAuthenticator := func(aclMode string, tokenPath string) *kubernetesAuthenticator {
+		return &kubernetesAuthenticator{
+			apiURL:        ts.URL,
+			tokenPath:     tokenPath,
+			aclMode:       aclMode,
+			aclLabel:      "namespace",
+			sarNamespaces: []string{"monitoring", "apps", "kube-system"},
+			sarVerb:       "get",
+			sarResource:   "pods",
+			cacheTTL:      time.Minute,
+			client:        ts.Client(),
+			cache:         newTTLCache[kubernetesResult](0),
+			negativeCache: newTTLCache[struct{}](0),
+		}
+	}
+
+	t.Run("Namespace of a service account", func(t *testing.T) {
+		calls.Store(0)
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+
+		want, err := querymodifier.NewACL("metrics:\n  namespace: monitoring")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serviceAccount, acl, err := ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+		assert.Equal(t, "monitoring/autoscaler", serviceAccount)
+		assert.Equal(t, want, acl)
+
+		// The second call is served from cache
+		_, _, err = ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("SubjectAccessReview", func(t *testing.T) {
+		calls.Store(0)
+		ka := newAuthenticator(kubernetesACLModeSAR, tokenPath)
+
+		want, err := querymodifier.NewACL("metrics:\n  namespace: monitoring, apps")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serviceAccount, acl, err := ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+		assert.Equal(t, "monitoring/autoscaler", serviceAccount)
+		assert.Equal(t, want, acl)
+		// TokenReview + one SubjectAccessReview per candidate namespace
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("SubjectAccessReview, no namespaces allowed", func(t *testing.T) {
+		ka := newAuthenticator(kubernetesACLModeSAR, tokenPath)
+
+		_, _, err := ka.Authenticate(ctx, "sa.default.builder")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Unauthenticated token (negative caching)", func(t *testing.T) {
+		calls.Store(0)
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+
+		_, _, err := ka.Authenticate(ctx, "sa.invalid.token")
+		assert.ErrorIs(t, err, errServiceAccountNotAuthenticated)
+
+		_, _, err = ka.Authenticate(ctx, "sa.invalid.token")
+		assert.ErrorIs(t, err, errServiceAccountNotAuthenticated)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Token for a different audience", func(t *testing.T) {
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+		ka.audiences = []string{"other"}
+
+		_, _, err := ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.ErrorIs(t, err, errServiceAccountNotAuthenticated)
+
+		ka = newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+		ka.audiences = []string{"other", "lfgw"}
+
+		_, _, err = ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+	})
+
+	t.Run("Cached entries never outlive the token", func(t *testing.T) {
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+
+		exp := time.Now().Add(30 * time.Second).Truncate(time.Second)
+		token := testServiceAccountToken(t, "system:serviceaccount:monitoring:autoscaler", exp)
+
+		serviceAccount, _, err := ka.Authenticate(ctx, token)
+		assert.Nil(t, err)
+		assert.Equal(t, "monitoring/autoscaler", serviceAccount)
+
+		entry, ok := ka.cache.entries[tokenCacheKey(token)]
+		if assert.True(t, ok) {
+			assert.WithinDuration(t, exp, entry.expiresAt, time.Second)
+		}
+
+		// Expired tokens are not cached at all
+		token = testServiceAccountToken(t, "system:serviceaccount:monitoring:autoscaler", time.Now().Add(-time.Minute))
+		_, _, err = ka.Authenticate(ctx, token)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, ka.cache.Len())
+	})
+
+	t.Run("Unauthenticated tokens never evict authenticated ones", func(t *testing.T) {
+		calls.Store(0)
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+		ka.cache = newTTLCache[kubernetesResult](1)
+		ka.negativeCache = newTTLCache[struct{}](1)
+
+		_, _, err := ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+
+		for _, token := range []string{"sa.invalid.a", "sa.invalid.b", "sa.invalid.c"} {
+			_, _, err = ka.Authenticate(ctx, token)
+			assert.ErrorIs(t, err, errServiceAccountNotAuthenticated)
+		}
+
+		_, _, err = ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("Not a service account", func(t *testing.T) {
+		ka := newAuthenticator(kubernetesACLModeNamespace, tokenPath)
+
+		_, _, err := ka.Authenticate(ctx, "user.jane.token")
+		assert.ErrorIs(t, err, errNotServiceAccount)
+	})
+
+	t.Run("lfgw is not authorized to call the API", func(t *testing.T) {
+		calls.Store(0)
+
+		wrongTokenPath := filepath.Join(t.TempDir(), "token")
+		if err := os.WriteFile(wrongTokenPath, []byte("wrong-token"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ka := newAuthenticator(kubernetesACLModeNamespace, wrongTokenPath)
+
+		_, _, err := ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, errServiceAccountNotAuthenticated)
+
+		// Errors are not cached
+		_, _, err = ka.Authenticate(ctx, "sa.monitoring.autoscaler")
+		assert.NotNil(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
+
+func TestApp_oidcMiddleware_kubernetes(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	var calls atomic.Int32
+	ts := kubernetesAPIServer(t, "lfgw-token", &calls)
+	defer ts.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("lfgw-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		logger:   &logger,
+		verifier: testDummyVerifier(t),
+		kubernetes: &kubernetesAuthenticator{
+			apiURL:        ts.URL,
+			tokenPath:     tokenPath,
+			aclMode:       kubernetesACLModeNamespace,
+			aclLabel:      "namespace",
+			cacheTTL:      time.Minute,
+			client:        ts.Client(),
+			cache:         newTTLCache[kubernetesResult](0),
+			negativeCache: newTTLCache[struct{}](0),
+		},
+	}
+
+	want, err := querymodifier.NewACL("metrics:\n  namespace: monitoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{
+			name:  "Service account",
+			token: "sa.monitoring.autoscaler",
+			want:  http.StatusOK,
+		},
+		{
+			name:  "Unauthenticated service account",
+			token: "sa.invalid.autoscaler",
+			want:  http.StatusUnauthorized,
+		},
+		{
+			name:  "Not a service account",
+			token: "user.jane.token",
+			want:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+				assert.True(t, ok, errACLNotSetInContext)
+				assert.Equal(t, want, acl)
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, tt.want, rs.StatusCode)
+		})
+	}
+}
+
+func Test_parseServiceAccountUsername(t *testing.T) {
+	tests := []struct {
+		username      string
+		wantNamespace string
+		wantName      string
+		wantOK        bool
+	}{
+		{
+			username:      "system:serviceaccount:monitoring:autoscaler",
+			wantNamespace: "monitoring",
+			wantName:      "autoscaler",
+			wantOK:        true,
+		},
+		{
+			username: "jane",
+			wantOK:   false,
+		},
+		{
+			username: "system:serviceaccount:monitoring",
+			wantOK:   false,
+		},
+		{
+			username: "system:serviceaccount:.*:autoscaler",
+			wantOK:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			namespace, name, ok := parseServiceAccountUsername(tt.username)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantNamespace, namespace)
+			assert.Equal(t, tt.wantName, name)
+		})
+	}
+}
+
+func TestApp_configureKubernetesAuth(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	tests := []struct {
+		name    string
+		app     application
+		wantErr bool
+	}{
+		{
+			name: "Disabled",
+			app:  application{},
+		},
+		{
+			name: "Namespace mode",
+			app: application{
+				KubernetesAuth:     true,
+				KubernetesAPIURL:   "https://kubernetes.localhost",
+				KubernetesACLMode:  kubernetesACLModeNamespace,
+				KubernetesCacheTTL: time.Minute,
+			},
+		},
+		{
+			name: "SAR mode without namespaces",
+			app: application{
+				KubernetesAuth:        true,
+				KubernetesAPIURL:      "https://kubernetes.localhost",
+				KubernetesACLMode:     kubernetesACLModeSAR,
+				KubernetesSARVerb:     "get",
+				KubernetesSARResource: "pods",
+			},
+			wantErr: true,
+		},
+		{
+			name: "SAR mode with an invalid namespace",
+			app: application{
+				KubernetesAuth:          true,
+				KubernetesAPIURL:        "https://kubernetes.localhost",
+				KubernetesACLMode:       kubernetesACLModeSAR,
+				KubernetesSARNamespaces: []string{".*"},
+				KubernetesSARVerb:       "get",
+				KubernetesSARResource:   "pods",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown mode",
+			app: application{
+				KubernetesAuth:    true,
+				KubernetesAPIURL:  "https://kubernetes.localhost",
+				KubernetesACLMode: "random",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Missing CA bundle",
+			app: application{
+				KubernetesAuth:   true,
+				KubernetesAPIURL: "https://kubernetes.localhost",
+				KubernetesCAPath: "test/missing-ca.crt",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := tt.app
+			app.logger = &logger
+
+			err := app.configureKubernetesAuth()
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.app.KubernetesAuth, app.kubernetes != nil)
+		})
+	}
+
+	t.Run("Resource with a group", func(t *testing.T) {
+		app := application{
+			KubernetesAuth:          true,
+			KubernetesAPIURL:        "https://kubernetes.localhost",
+			KubernetesACLMode:       kubernetesACLModeSAR,
+			KubernetesSARNamespaces: []string{"monitoring"},
+			KubernetesSARVerb:       "get",
+			KubernetesSARResource:   "pods.metrics.k8s.io",
+			logger:                  &logger,
+		}
+
+		assert.Nil(t, app.configureKubernetesAuth())
+		assert.Equal(t, "pods", app.kubernetes.sarResource)
+		assert.Equal(t, "metrics.k8s.io", app.kubernetes.sarGroup)
+	})
+}
+
+// testServiceAccountToken returns a signed ServiceAccount token for the subject, which expires at exp
+func testServiceAccountToken(t *testing.T, subject string, exp time.Time) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: testDPoPKey(t)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"sub": subject, "exp": exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// kubernetesAPIServer sets up a stand-in for the TokenReview and SubjectAccessReview APIs. Tokens are in the form of <kind>.<namespace or user>.<name>, only "sa" tokens are authenticated (except for the "invalid" namespace). The monitoring/autoscaler service account is allowed to access the monitoring and apps namespaces.
+func kubernetesAPIServer(t *testing.T, lfgwToken string, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/apis/authentication.k8s.io/v1/tokenreviews", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		if r.Header.Get("Authorization") != "Bearer "+lfgwToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var review struct {
+			Spec struct {
+				Token     string   `json:"token"`
+				Audiences []string `json:"audiences"`
+			} `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		status := map[string]interface{}{"authenticated": false}
+
+		var kind, namespace, name string
+		if parts := strings.Split(review.Spec.Token, "."); len(parts) == 3 {
+			kind, namespace, name = parts[0], parts[1], parts[2]
+		}
+
+		// Signed tokens are issued for service accounts, the subject is taken as is
+		if jws, err := jose.ParseSigned(review.Spec.Token); err == nil {
+			var claims struct {
+				Sub string `json:"sub"`
+			}
+			_ = json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims)
+			if ns, n, ok := parseServiceAccountUsername(claims.Sub); ok {
+				kind, namespace, name = "sa", ns, n
+			}
+		}
+
+		// Tokens are issued for the default audience of the API server and for lfgw; the audiences are not validated, as by an authenticator that is not audience-aware
+		audiences := []string{}
+		for _, audience := range review.Spec.Audiences {
+			if audience == "lfgw" {
+				audiences = append(audiences, audience)
+			}
+		}
+		if len(review.Spec.Audiences) == 0 {
+			audiences = []string{"https://kubernetes.default.svc"}
+		}
+
+		switch {
+		case kind == "sa" && namespace != "invalid":
+			status = map[string]interface{}{
+				"authenticated": true,
+				"audiences":     audiences,
+				"user": map[string]interface{}{
+					"username": "system:serviceaccount:" + namespace + ":" + name,
+					"uid":      "uid",
+					"groups":   []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace},
+				},
+			}
+		case kind == "user":
+			status = map[string]interface{}{
+				"authenticated": true,
+				"user": map[string]interface{}{
+					"username": namespace,
+				},
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status})
+	})
+
+	mux.HandleFunc("/apis/authorization.k8s.io/v1/subjectaccessreviews", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		if r.Header.Get("Authorization") != "Bearer "+lfgwToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var review struct {
+			Spec struct {
+				User               string `json:"user"`
+				ResourceAttributes struct {
+					Namespace string `json:"namespace"`
+					Verb      string `json:"verb"`
+					Resource  string `json:"resource"`
+				} `json:"resourceAttributes"`
+			} `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		attrs := review.Spec.ResourceAttributes
+		allowed := review.Spec.User == "system:serviceaccount:monitoring:autoscaler" &&
+			(attrs.Namespace == "monitoring" || attrs.Namespace == "apps") &&
+			attrs.Verb == "get" && attrs.Resource == "pods"
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{"allowed": allowed}})
+	})
+
+	return httptest.NewServer(mux)
+}
@@ -2,11 +2,15 @@ package lfgw
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	oidc "github.com/coreos/go-oidc/v3/oidc"
@@ -14,34 +18,123 @@ import (
 	"github.com/urfave/cli/v2"
 	"github.com/weisdd/lfgw/internal/querymodifier"
 	"go.uber.org/automaxprocs/maxprocs"
+	"golang.org/x/oauth2"
 )
 
 // Define an application struct to hold the application-wide dependencies for the
 // web application.
 type application struct {
-	UpstreamURL             *url.URL
-	OIDCRealmURL            string
-	OIDCClientID            string
-	ACLPath                 string
-	AssumedRolesEnabled     bool
-	EnableDeduplication     bool
-	OptimizeExpressions     bool
-	SafeMode                bool
-	SetProxyHeaders         bool
-	SetGomaxProcs           bool
-	Debug                   bool
-	LogFormat               string
-	LogNoColor              bool
-	LogRequests             bool
-	Port                    int
-	ReadTimeout             time.Duration
-	WriteTimeout            time.Duration
-	GracefulShutdownTimeout time.Duration
-	errorLog                *log.Logger
-	ACLs                    querymodifier.ACLs
-	proxy                   *httputil.ReverseProxy
-	verifier                *oidc.IDTokenVerifier
-	logger                  *zerolog.Logger
+	UpstreamURL                   *url.URL
+	OIDCRealmURL                  string
+	OIDCClientID                  string
+	OIDCUserInfoFallback          bool
+	OIDCLogin                     bool
+	OIDCClientSecret              string
+	OIDCRedirectURL               string
+	OIDCScopes                    []string
+	SessionSecret                 string
+	SessionCookieName             string
+	SessionMaxAge                 time.Duration
+	OIDCUserInfoCacheTTL          time.Duration
+	IntrospectionURL              string
+	IntrospectionClientID         string
+	IntrospectionClientSecret     string
+	IntrospectionCacheTTL         time.Duration
+	IntrospectionNegativeCacheTTL time.Duration
+	APIKeysPath                   string
+	TLSCertPath                   string
+	TLSKeyPath                    string
+	TLSClientCAPath               string
+	ClientCertRulesPath           string
+	TrustedHeadersAuth            bool
+	TrustedHeadersCIDRs           []string
+	TrustedHeadersSecretHeader    string
+	TrustedHeadersSecret          string
+	TrustedHeadersUserHeader      string
+	TrustedHeadersEmailHeader     string
+	TrustedHeadersGroupsHeader    string
+	TokenSources                  []string
+	TokenSourcesMode              string
+	KubernetesAuth                bool
+	KubernetesAPIURL              string
+	KubernetesTokenPath           string
+	KubernetesCAPath              string
+	KubernetesAudiences           []string
+	KubernetesACLMode             string
+	KubernetesACLLabel            string
+	KubernetesSARNamespaces       []string
+	KubernetesSARVerb             string
+	KubernetesSARResource         string
+	KubernetesCacheTTL            time.Duration
+	DPoPPolicies                  []string
+	DPoPProofMaxAge               time.Duration
+	DPoPReplayCacheSize           int
+	DenylistPath                  string
+	DenylistReloadInterval        time.Duration
+	DenylistAdminToken            string
+	ClaimACLClaim                 string
+	ClaimACLLabel                 string
+	ACLExpiryWarning              time.Duration
+	DefaultACLRole                string
+	AnonymousACLRole              string
+	AnonymousCIDRs                []string
+	ACLPath                       string
+	AssumedRolesEnabled           bool
+	AssumedRolesTemplate          []string
+	AssumedRolesPattern           string
+	AssumedRolesPrefix            string
+	AssumedRolesAllowRegex        bool
+	AssumedRolesValidate          bool
+	AssumedRolesCacheTTL          time.Duration
+	EnableDeduplication           bool
+	OptimizeExpressions           bool
+	MaxQueryLength                int
+	MaxQueryDepth                 int
+	MaxSelectors                  int
+	RequireMetricName             bool
+	MaxPointsPerSeries            int
+	RequiredLabels                []string
+	ExemptMetrics                 string
+	SafeMode                      bool
+	SetProxyHeaders               bool
+	SetGomaxProcs                 bool
+	Debug                         bool
+	LogFormat                     string
+	LogNoColor                    bool
+	LogRequests                   bool
+	Port                          int
+	ReadTimeout                   time.Duration
+	WriteTimeout                  time.Duration
+	GracefulShutdownTimeout       time.Duration
+	errorLog                      *log.Logger
+	ACLs                          querymodifier.ACLs
+	proxy                         *httputil.ReverseProxy
+	provider                      *oidc.Provider
+	verifier                      *oidc.IDTokenVerifier
+	userInfo                      *userInfoFetcher
+	introspector                  *tokenIntrospector
+	apiKeys                       apiKeys
+	tlsConfig                     *tls.Config
+	certRules                     certRules
+	trustedHeadersNets            []*net.IPNet
+	anonymousNets                 []*net.IPNet
+	anonymousACL                  *querymodifier.ACL
+	requiredLabels                querymodifier.RequiredLabels
+	exemptMetrics                 querymodifier.MetricExemptions
+	tokenSources                  []tokenSource
+	kubernetes                    *kubernetesAuthenticator
+	dpop                          *dpopVerifier
+	denylist                      *denylist
+	assumedRoles                  *assumedRolesPolicy
+	assumedRolesTemplate          querymodifier.AssumedRolesTemplate
+	oauth2Config                  *oauth2.Config
+	sessionCodec                  *sessionCodec
+	sessionTokens                 *ttlCache[*oauth2.Token]
+	endSessionURL                 string
+	revocationURL                 string
+	revokedSessions               *ttlCache[struct{}]
+	sessionRefreshes              *callGroup[*oauth2.Token]
+	logger                        *zerolog.Logger
 }
 
 // Run is used as an entrypoint for cli
@@ -64,39 +157,194 @@ func newApplication(c *cli.Context) (application, error) {
 	}
 
 	app := application{
-		UpstreamURL:             upstreamURL,
-		OIDCRealmURL:            c.String("oidc-realm-url"),
-		OIDCClientID:            c.String("oidc-client-id"),
-		ACLPath:                 c.String("acl-path"),
-		AssumedRolesEnabled:     c.Bool("assumed-roles"),
-		EnableDeduplication:     c.Bool("enable-deduplication"),
-		OptimizeExpressions:     c.Bool("optimize-expressions"),
-		SafeMode:                c.Bool("safe-mode"),
-		SetProxyHeaders:         c.Bool("set-proxy-headers"),
-		SetGomaxProcs:           c.Bool("set-gomax-procs"),
-		Debug:                   c.Bool("debug"),
-		LogFormat:               c.String("log-format"),
-		LogNoColor:              c.Bool("log-no-color"),
-		LogRequests:             c.Bool("log-requests"),
-		Port:                    c.Int("port"),
-		ReadTimeout:             c.Duration("read-timeout"),
-		WriteTimeout:            c.Duration("write-timeout"),
-		GracefulShutdownTimeout: c.Duration("graceful-shutdown-timeout"),
+		UpstreamURL:                   upstreamURL,
+		OIDCRealmURL:                  c.String("oidc-realm-url"),
+		OIDCClientID:                  c.String("oidc-client-id"),
+		OIDCUserInfoFallback:          c.Bool("oidc-userinfo-fallback"),
+		OIDCUserInfoCacheTTL:          c.Duration("oidc-userinfo-cache-ttl"),
+		OIDCLogin:                     c.Bool("oidc-login"),
+		OIDCClientSecret:              c.String("oidc-client-secret"),
+		OIDCRedirectURL:               c.String("oidc-redirect-url"),
+		OIDCScopes:                    c.StringSlice("oidc-scopes"),
+		SessionSecret:                 c.String("session-secret"),
+		SessionCookieName:             c.String("session-cookie-name"),
+		SessionMaxAge:                 c.Duration("session-max-age"),
+		IntrospectionURL:              c.String("introspection-url"),
+		IntrospectionClientID:         c.String("introspection-client-id"),
+		IntrospectionClientSecret:     c.String("introspection-client-secret"),
+		IntrospectionCacheTTL:         c.Duration("introspection-cache-ttl"),
+		IntrospectionNegativeCacheTTL: c.Duration("introspection-negative-cache-ttl"),
+		APIKeysPath:                   c.String("api-keys-path"),
+		TLSCertPath:                   c.String("tls-cert-path"),
+		TLSKeyPath:                    c.String("tls-key-path"),
+		TLSClientCAPath:               c.String("tls-client-ca-path"),
+		ClientCertRulesPath:           c.String("client-cert-rules-path"),
+		TrustedHeadersAuth:            c.Bool("trusted-headers-auth"),
+		TrustedHeadersCIDRs:           c.StringSlice("trusted-headers-cidrs"),
+		TrustedHeadersSecretHeader:    c.String("trusted-headers-secret-header"),
+		TrustedHeadersSecret:          c.String("trusted-headers-secret"),
+		TrustedHeadersUserHeader:      c.String("trusted-headers-user-header"),
+		TrustedHeadersEmailHeader:     c.String("trusted-headers-email-header"),
+		TrustedHeadersGroupsHeader:    c.String("trusted-headers-groups-header"),
+		TokenSources:                  c.StringSlice("token-sources"),
+		TokenSourcesMode:              c.String("token-sources-mode"),
+		KubernetesAuth:                c.Bool("kubernetes-auth"),
+		KubernetesAPIURL:              c.String("kubernetes-api-url"),
+		KubernetesTokenPath:           c.String("kubernetes-token-path"),
+		KubernetesCAPath:              c.String("kubernetes-ca-path"),
+		KubernetesAudiences:           c.StringSlice("kubernetes-audiences"),
+		KubernetesACLMode:             c.String("kubernetes-acl-mode"),
+		KubernetesACLLabel:            c.String("kubernetes-acl-label"),
+		KubernetesSARNamespaces:       c.StringSlice("kubernetes-sar-namespaces"),
+		KubernetesSARVerb:             c.String("kubernetes-sar-verb"),
+		KubernetesSARResource:         c.String("kubernetes-sar-resource"),
+		KubernetesCacheTTL:            c.Duration("kubernetes-cache-ttl"),
+		DPoPPolicies:                  c.StringSlice("dpop-policies"),
+		DPoPProofMaxAge:               c.Duration("dpop-proof-max-age"),
+		DPoPReplayCacheSize:           c.Int("dpop-replay-cache-size"),
+		DenylistPath:                  c.String("denylist-path"),
+		DenylistReloadInterval:        c.Duration("denylist-reload-interval"),
+		DenylistAdminToken:            c.String("denylist-admin-token"),
+		ClaimACLClaim:                 c.String("claim-acl-claim"),
+		ClaimACLLabel:                 c.String("claim-acl-label"),
+		ACLExpiryWarning:              c.Duration("acl-expiry-warning"),
+		DefaultACLRole:                c.String("default-acl-role"),
+		AnonymousACLRole:              c.String("anonymous-acl-role"),
+		AnonymousCIDRs:                c.StringSlice("anonymous-cidrs"),
+		ACLPath:                       c.String("acl-path"),
+		AssumedRolesEnabled:           c.Bool("assumed-roles"),
+		AssumedRolesTemplate:          c.StringSlice("assumed-roles-template"),
+		AssumedRolesPattern:           c.String("assumed-roles-pattern"),
+		AssumedRolesPrefix:            c.String("assumed-roles-prefix"),
+		AssumedRolesAllowRegex:        c.Bool("assumed-roles-allow-regex"),
+		AssumedRolesValidate:          c.Bool("assumed-roles-validate"),
+		AssumedRolesCacheTTL:          c.Duration("assumed-roles-cache-ttl"),
+		EnableDeduplication:           c.Bool("enable-deduplication"),
+		OptimizeExpressions:           c.Bool("optimize-expressions"),
+		MaxQueryLength:                c.Int("max-query-length"),
+		MaxQueryDepth:                 c.Int("max-query-depth"),
+		MaxSelectors:                  c.Int("max-selectors"),
+		RequireMetricName:             c.Bool("require-metric-name"),
+		MaxPointsPerSeries:            c.Int("max-points-per-series"),
+		RequiredLabels:                c.StringSlice("required-labels"),
+		ExemptMetrics:                 c.String("exempt-metrics"),
+		SafeMode:                      c.Bool("safe-mode"),
+		SetProxyHeaders:               c.Bool("set-proxy-headers"),
+		SetGomaxProcs:                 c.Bool("set-gomax-procs"),
+		Debug:                         c.Bool("debug"),
+		LogFormat:                     c.String("log-format"),
+		LogNoColor:                    c.Bool("log-no-color"),
+		LogRequests:                   c.Bool("log-requests"),
+		Port:                          c.Int("port"),
+		ReadTimeout:                   c.Duration("read-timeout"),
+		WriteTimeout:                  c.Duration("write-timeout"),
+		GracefulShutdownTimeout:       c.Duration("graceful-shutdown-timeout"),
 	}
 
 	return app, nil
 }
 
+// LintACL is used as an entrypoint for the lint-acl command of cli. It loads ACL definitions and reports time-limited roles and grants, which have expired or are about to expire. Expired ones result in a non-zero exit code.
+func LintACL(c *cli.Context) error {
+	path := c.String("acl-path")
+
+	acls, err := querymodifier.NewACLsFromFile(path)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Failed to load ACL: %s", err), 1)
+	}
+
+	messages, expired := lintACLs(acls, time.Now(), c.Duration("acl-expiry-warning"))
+	for _, msg := range messages {
+		fmt.Fprintln(c.App.Writer, msg)
+	}
+
+	if expired {
+		return cli.Exit(fmt.Sprintf("%s contains expired grants", path), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "%s: OK (%d roles)\n", path, len(acls))
+
+	return nil
+}
+
 // Run starts lfgw (main-like function)
 func (app *application) Run() {
 	app.configureLogging()
 	app.configureACLs()
 
+	if err := app.configureAssumedRoles(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureDefaultACLs(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureACLExpiry(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureQueryLimits(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureRequiredLabels(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureExemptMetrics(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
 	if err := app.configureOIDCVerifier(); err != nil {
 		app.logger.Fatal().Caller().
 			Err(err).Msg("")
 	}
 
+	if err := app.configureLogin(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureKubernetesAuth(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	app.configureIntrospection()
+	app.configureAPIKeys()
+
+	if err := app.configureTLS(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureTrustedHeaders(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureTokenSources(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureDPoP(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
+	if err := app.configureDenylist(); err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msg("")
+	}
+
 	// TODO: expose undo and move to another function?
 	if app.SetGomaxProcs {
 		undo, err := maxprocs.Set()
@@ -131,11 +379,16 @@ func (app *application) configureACLs() {
 			Msg("Assumed roles mode is off")
 	}
 
+	if app.ClaimACLClaim != "" {
+		app.logger.Info().Caller().
+			Msgf("Values of the %s claim are mapped to the %s label", app.ClaimACLClaim, app.ClaimACLLabel)
+	}
+
 	if app.ACLPath == "" {
 		// NOTE: the condition should never happen as it's filtered out by "Before" functionality of cli, though left just in case
-		if !app.AssumedRolesEnabled {
+		if !app.AssumedRolesEnabled && app.ClaimACLClaim == "" {
 			app.logger.Fatal().Caller().
-				Msgf("The app cannot run without at least one source of configuration (Non-empty ACL_PATH and/or ASSUMED_ROLES set to true)")
+				Msgf("The app cannot run without at least one source of configuration (Non-empty ACL_PATH, CLAIM_ACL_CLAIM and/or ASSUMED_ROLES set to true)")
 		}
 
 		app.logger.Info().Caller().
@@ -157,10 +410,18 @@ func (app *application) configureACLs() {
 			app.logger.Info().Caller().
 				Msgf("Loaded role definition for %s: %q (converted to %s)", role, acl.MetricsMeta[label].RawACL, filter.AppendString(nil))
 		}
+		for _, rule := range acl.Rules {
+			app.logger.Info().Caller().
+				Msgf("Loaded role definition for %s: rule %s", role, rule)
+		}
+		for label, tmpl := range acl.Templates {
+			app.logger.Info().Caller().
+				Msgf("Loaded role definition for %s: %s=%q (rendered against token claims)", role, label, tmpl.Root.String())
+		}
 	}
 }
 
-// configureOIDCVerifier sets up OIDC token verifier by using app.OIDCRealmURL and app.OIDCClientID
+// configureOIDCVerifier sets up OIDC token verifier (and, optionally, userinfo fallback) by using app.OIDCRealmURL and app.OIDCClientID
 func (app *application) configureOIDCVerifier() error {
 	// Just to make sure our logging calls are always safe
 	if app.logger == nil {
@@ -180,7 +441,589 @@ func (app *application) configureOIDCVerifier() error {
 	oidcConfig := &oidc.Config{
 		ClientID: app.OIDCClientID,
 	}
+	app.provider = provider
 	app.verifier = provider.Verifier(oidcConfig)
 
+	if app.OIDCUserInfoFallback {
+		app.logger.Info().Caller().
+			Msg("Userinfo fallback is enabled for tokens without roles")
+		app.userInfo = newUserInfoFetcher(provider, app.OIDCUserInfoCacheTTL)
+	}
+
+	return nil
+}
+
+// configureIntrospection sets up an introspection client for opaque access tokens if app.IntrospectionURL is set
+func (app *application) configureIntrospection() {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.IntrospectionURL == "" {
+		return
+	}
+
+	clientID := app.IntrospectionClientID
+	if clientID == "" {
+		clientID = app.OIDCClientID
+	}
+
+	app.logger.Info().Caller().
+		Msgf("Token introspection is enabled (%q)", app.IntrospectionURL)
+
+	app.introspector = newTokenIntrospector(app.IntrospectionURL, clientID, app.IntrospectionClientSecret, app.OIDCClientID, app.IntrospectionCacheTTL, app.IntrospectionNegativeCacheTTL)
+}
+
+// configureKubernetesAuth sets up verification of Kubernetes ServiceAccount tokens through the TokenReview API if app.KubernetesAuth is enabled
+func (app *application) configureKubernetesAuth() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if !app.KubernetesAuth {
+		return nil
+	}
+
+	apiURL := app.KubernetesAPIURL
+	if apiURL == "" {
+		// In-cluster configuration
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("kubernetes authentication requires KUBERNETES_API_URL to be set when lfgw runs outside of a cluster")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+
+	aclLabel := app.KubernetesACLLabel
+	if aclLabel == "" {
+		aclLabel = "namespace"
+	}
+
+	switch app.KubernetesACLMode {
+	case "", kubernetesACLModeNamespace:
+	case kubernetesACLModeSAR:
+		if len(app.KubernetesSARNamespaces) == 0 || app.KubernetesSARVerb == "" || app.KubernetesSARResource == "" {
+			return fmt.Errorf("kubernetes ACL mode %q requires KUBERNETES_SAR_NAMESPACES, KUBERNETES_SAR_VERB, and KUBERNETES_SAR_RESOURCE to be set", kubernetesACLModeSAR)
+		}
+
+		for _, namespace := range app.KubernetesSARNamespaces {
+			if !namespaceRe.MatchString(namespace) {
+				return fmt.Errorf("invalid namespace in KUBERNETES_SAR_NAMESPACES: %q", namespace)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown kubernetes ACL mode %q (expected %s or %s)", app.KubernetesACLMode, kubernetesACLModeNamespace, kubernetesACLModeSAR)
+	}
+
+	client, err := newKubernetesHTTPClient(app.KubernetesCAPath)
+	if err != nil {
+		return fmt.Errorf("failed to configure kubernetes client: %w", err)
+	}
+
+	// Resources are defined as in kubectl: <resource>[.<group>]
+	sarResource, sarGroup, _ := strings.Cut(app.KubernetesSARResource, ".")
+
+	app.kubernetes = &kubernetesAuthenticator{
+		apiURL:        apiURL,
+		tokenPath:     app.KubernetesTokenPath,
+		audiences:     app.KubernetesAudiences,
+		aclMode:       app.KubernetesACLMode,
+		aclLabel:      aclLabel,
+		sarNamespaces: app.KubernetesSARNamespaces,
+		sarVerb:       app.KubernetesSARVerb,
+		sarResource:   sarResource,
+		sarGroup:      sarGroup,
+		cacheTTL:      app.KubernetesCacheTTL,
+		client:        client,
+		cache:         newTTLCache[kubernetesResult](kubernetesMaxCachedTokens),
+		negativeCache: newTTLCache[struct{}](kubernetesMaxCachedTokens),
+	}
+
+	app.logger.Info().Caller().
+		Msgf("Kubernetes service account authentication is enabled (%q, ACL mode: %q)", apiURL, app.KubernetesACLMode)
+
+	return nil
+}
+
+// configureAPIKeys loads static API keys from app.APIKeysPath if it's set
+func (app *application) configureAPIKeys() {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.APIKeysPath == "" {
+		return
+	}
+
+	var err error
+
+	app.apiKeys, err = newAPIKeysFromFile(app.APIKeysPath)
+	if err != nil {
+		app.logger.Fatal().Caller().
+			Err(err).Msgf("Failed to load API keys")
+	}
+
+	for _, key := range app.apiKeys {
+		if key.isExpired(time.Now()) {
+			app.logger.Warn().Caller().
+				Msgf("Loaded API key %s, which has already expired (%s)", key.name, key.expires)
+			continue
+		}
+
+		app.logger.Info().Caller().
+			Msgf("Loaded API key %s", key.name)
+	}
+}
+
+// configureTLS prepares TLS settings for the web server and loads client certificate rules if TLS is enabled
+func (app *application) configureTLS() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.TLSCertPath == "" && app.TLSKeyPath == "" {
+		if app.TLSClientCAPath != "" || app.ClientCertRulesPath != "" {
+			return fmt.Errorf("client certificate authentication requires TLS_CERT_PATH and TLS_KEY_PATH to be set")
+		}
+		return nil
+	}
+
+	if app.TLSCertPath == "" || app.TLSKeyPath == "" {
+		return fmt.Errorf("both TLS_CERT_PATH and TLS_KEY_PATH have to be set to enable TLS")
+	}
+
+	if (app.TLSClientCAPath == "") != (app.ClientCertRulesPath == "") {
+		return fmt.Errorf("client certificate authentication requires both TLS_CLIENT_CA_PATH and CLIENT_CERT_RULES_PATH to be set")
+	}
+
+	var err error
+
+	app.tlsConfig, err = newServerTLSConfig(app.TLSClientCAPath)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+
+	app.logger.Info().Caller().
+		Msg("TLS is enabled")
+
+	if app.ClientCertRulesPath == "" {
+		return nil
+	}
+
+	app.certRules, err = newCertRulesFromFile(app.ClientCertRulesPath)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate rules: %w", err)
+	}
+
+	for _, rule := range app.certRules {
+		app.logger.Info().Caller().
+			Msgf("Loaded client certificate rule: %s =~ %q -> %v", rule.Field, rule.Match, rule.Roles)
+	}
+
+	return nil
+}
+
+// configureDefaultACLs verifies that the default and anonymous roles are defined in ACL_PATH and prepares the anonymous ACL
+func (app *application) configureDefaultACLs() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.DefaultACLRole != "" {
+		if _, ok := app.ACLs[app.DefaultACLRole]; !ok {
+			return fmt.Errorf("default ACL role %s is not defined in ACL_PATH", app.DefaultACLRole)
+		}
+
+		app.logger.Info().Caller().
+			Msgf("Role %s is merged into the ACL of every authenticated user", app.DefaultACLRole)
+	}
+
+	if app.AnonymousACLRole == "" {
+		if len(app.AnonymousCIDRs) > 0 {
+			return fmt.Errorf("ANONYMOUS_CIDRS requires ANONYMOUS_ACL_ROLE to be set")
+		}
+		return nil
+	}
+
+	var err error
+
+	app.anonymousNets, err = parseCIDRs(app.AnonymousCIDRs)
+	if err != nil {
+		return fmt.Errorf("failed to parse anonymous CIDRs: %w", err)
+	}
+
+	if len(app.anonymousNets) == 0 {
+		return fmt.Errorf("ANONYMOUS_ACL_ROLE requires ANONYMOUS_CIDRS to be set")
+	}
+
+	acl, ok := app.ACLs[app.AnonymousACLRole]
+	if !ok {
+		return fmt.Errorf("anonymous ACL role %s is not defined in ACL_PATH", app.AnonymousACLRole)
+	}
+
+	// Anonymous requests carry no claims
+	if len(acl.Templates) > 0 {
+		return fmt.Errorf("anonymous ACL role %s cannot reference token claims", app.AnonymousACLRole)
+	}
+
+	// The anonymous ACL is bound directly, so validity periods would be ignored
+	if acl.IsLimited() || len(acl.Grants) > 0 {
+		return fmt.Errorf("anonymous ACL role %s cannot be time-limited", app.AnonymousACLRole)
+	}
+
+	for _, metadata := range acl.MetricsMeta {
+		if metadata.Fullaccess {
+			return fmt.Errorf("anonymous ACL role %s cannot grant full access", app.AnonymousACLRole)
+		}
+	}
+
+	app.anonymousACL = &acl
+
+	app.logger.Info().Caller().
+		Msgf("Requests without a token from %v get the ACL of role %s", app.anonymousNets, app.AnonymousACLRole)
+
+	return nil
+}
+
+// configureACLExpiry logs states of time-limited roles and grants and keeps track of them in the background
+func (app *application) configureACLExpiry() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.ACLExpiryWarning < 0 {
+		return fmt.Errorf("ACL_EXPIRY_WARNING cannot be negative")
+	}
+
+	reporter := newACLExpiryReporter(app.ACLs, app.ACLExpiryWarning)
+	if len(reporter.grants) == 0 {
+		return nil
+	}
+
+	reporter.check(time.Now(), app.logger)
+
+	// The watcher lives as long as the application
+	go reporter.watch(aclExpiryCheckInterval, app.logger, nil)
+
+	return nil
+}
+
+// configureQueryLimits verifies global query limits
+func (app *application) configureQueryLimits() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	ql := app.queryLimits()
+	if err := ql.Validate(); err != nil {
+		return fmt.Errorf("invalid query limits: %w", err)
+	}
+
+	if !ql.IsZero() {
+		app.logger.Info().Caller().
+			Msgf("Global query limits: %+v", ql)
+	}
+
+	return nil
+}
+
+// queryLimits returns global query limits
+func (app *application) queryLimits() querymodifier.QueryLimits {
+	return querymodifier.QueryLimits{
+		MaxLength:          app.MaxQueryLength,
+		MaxDepth:           app.MaxQueryDepth,
+		MaxSelectors:       app.MaxSelectors,
+		RequireMetricName:  app.RequireMetricName,
+		MaxPointsPerSeries: app.MaxPointsPerSeries,
+	}
+}
+
+// configureRequiredLabels parses global required labels
+func (app *application) configureRequiredLabels() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	var err error
+
+	app.requiredLabels, err = querymodifier.NewRequiredLabels(app.RequiredLabels)
+	if err != nil {
+		return fmt.Errorf("invalid REQUIRED_LABELS: %w", err)
+	}
+
+	if len(app.requiredLabels) > 0 {
+		app.logger.Info().Caller().
+			Msgf("Required labels: %v", app.RequiredLabels)
+	}
+
+	return nil
+}
+
+// configureExemptMetrics parses global metric exemptions
+func (app *application) configureExemptMetrics() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	var err error
+
+	app.exemptMetrics, err = querymodifier.NewMetricExemptions(querymodifier.SplitMetricExemptions(app.ExemptMetrics))
+	if err != nil {
+		return fmt.Errorf("invalid EXEMPT_METRICS: %w", err)
+	}
+
+	if len(app.exemptMetrics) > 0 {
+		app.logger.Info().Caller().
+			Msgf("Exempt metrics: %v", app.exemptMetrics)
+	}
+
+	return nil
+}
+
+// configureTrustedHeaders verifies trusted headers settings and parses the list of trusted networks
+func (app *application) configureTrustedHeaders() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if !app.TrustedHeadersAuth {
+		return nil
+	}
+
+	var err error
+
+	app.trustedHeadersNets, err = parseCIDRs(app.TrustedHeadersCIDRs)
+	if err != nil {
+		return fmt.Errorf("failed to parse trusted headers CIDRs: %w", err)
+	}
+
+	hasSecret := app.TrustedHeadersSecretHeader != "" && app.TrustedHeadersSecret != ""
+	if len(app.trustedHeadersNets) == 0 && !hasSecret {
+		return fmt.Errorf("trusted headers authentication requires TRUSTED_HEADERS_CIDRS and/or TRUSTED_HEADERS_SECRET_HEADER with TRUSTED_HEADERS_SECRET to be set")
+	}
+
+	app.logger.Info().Caller().
+		Msgf("Trusted headers authentication is enabled (trusted networks: %v, shared secret: %t)", app.trustedHeadersNets, hasSecret)
+
+	return nil
+}
+
+// configureTokenSources parses the list of token sources (the default list is used if it's empty) and verifies the token sources mode
+func (app *application) configureTokenSources() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	switch app.TokenSourcesMode {
+	case "":
+		app.TokenSourcesMode = tokenSourcesModeFirstMatch
+	case tokenSourcesModeFirstMatch, tokenSourcesModeRejectConflicting:
+	default:
+		return fmt.Errorf("unknown token sources mode %q (expected %s or %s)", app.TokenSourcesMode, tokenSourcesModeFirstMatch, tokenSourcesModeRejectConflicting)
+	}
+
+	sources, err := parseTokenSources(app.TokenSources)
+	if err != nil {
+		return fmt.Errorf("failed to parse token sources: %w", err)
+	}
+
+	if len(sources) == 0 {
+		sources = defaultTokenSources
+	}
+	app.tokenSources = sources
+
+	app.logger.Info().Caller().
+		Msgf("Token sources (%s): %v", app.TokenSourcesMode, app.tokenSources)
+
+	return nil
+}
+
+// configureDPoP sets up verification of DPoP proofs if any DPoP policies are defined
+func (app *application) configureDPoP() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if len(app.DPoPPolicies) == 0 {
+		return nil
+	}
+
+	if app.DPoPProofMaxAge <= 0 {
+		return fmt.Errorf("DPOP_PROOF_MAX_AGE must be positive")
+	}
+
+	var err error
+
+	app.dpop, err = newDPoPVerifier(app.DPoPPolicies, app.DPoPProofMaxAge, app.DPoPReplayCacheSize)
+	if err != nil {
+		return fmt.Errorf("failed to configure DPoP: %w", err)
+	}
+
+	for issuer, mode := range app.dpop.policies {
+		app.logger.Info().Caller().
+			Msgf("DPoP is %s for issuer %q", mode, issuer)
+	}
+
+	return nil
+}
+
+// configureAssumedRoles sets up the template, through which ACLs for assumed roles are constructed, and the policy, which unknown role names are checked against.
+func (app *application) configureAssumedRoles() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if !app.AssumedRolesEnabled {
+		return nil
+	}
+
+	app.assumedRolesTemplate = querymodifier.DefaultAssumedRolesTemplate
+	if len(app.AssumedRolesTemplate) > 0 {
+		var err error
+
+		app.assumedRolesTemplate, err = querymodifier.NewAssumedRolesTemplate(app.AssumedRolesTemplate)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.logger.Info().Caller().
+		Msgf("Assumed roles are applied to labels: %s", strings.Join(app.assumedRolesTemplate.Labels(), ", "))
+
+	var labelValues map[string]*labelValuesLister
+	if app.AssumedRolesValidate {
+		if app.UpstreamURL == nil {
+			return errUpstreamNotInitialized
+		}
+
+		labelValues = make(map[string]*labelValuesLister, len(app.assumedRolesTemplate))
+		for _, label := range app.assumedRolesTemplate.Labels() {
+			labelValues[label] = newLabelValuesLister(app.UpstreamURL, label, app.AssumedRolesCacheTTL)
+		}
+	}
+
+	var err error
+
+	app.assumedRoles, err = newAssumedRolesPolicy(app.AssumedRolesPattern, app.AssumedRolesPrefix, app.AssumedRolesAllowRegex, app.assumedRolesTemplate, labelValues)
+	if err != nil {
+		return err
+	}
+
+	if app.AssumedRolesAllowRegex {
+		app.logger.Warn().Caller().
+			Msg("Assumed roles may contain regular expressions, anyone who can create an IDP role named .* gets full access")
+	}
+
+	if labelValues != nil {
+		app.logger.Info().Caller().
+			Msgf("Assumed roles are validated against the label values known to the upstream (cached for %s)", app.AssumedRolesCacheTTL)
+	}
+
+	return nil
+}
+
+// configureDenylist loads the denylist from app.DenylistPath and starts watching it for changes. The denylist is also enabled if only the admin endpoint is configured.
+func (app *application) configureDenylist() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if app.DenylistPath == "" && app.DenylistAdminToken == "" {
+		return nil
+	}
+
+	var err error
+
+	app.denylist, err = newDenylist(app.DenylistPath)
+	if err != nil {
+		return fmt.Errorf("failed to load denylist: %w", err)
+	}
+
+	if app.DenylistPath != "" {
+		app.logger.Info().Caller().
+			Msgf("Loaded denylist from %s (%d entries)", app.DenylistPath, app.denylist.len())
+
+		if app.DenylistReloadInterval > 0 {
+			// The watcher lives as long as the application
+			go app.denylist.watch(app.DenylistReloadInterval, app.logger, nil)
+		}
+	}
+
+	if app.DenylistAdminToken != "" {
+		app.logger.Info().Caller().
+			Msgf("Denylist admin endpoint is enabled (%s)", denylistPath)
+	}
+
+	return nil
+}
+
+// configureLogin sets up the built-in OIDC login flow (authorization code flow with PKCE) and session handling. Must be called after configureOIDCVerifier.
+func (app *application) configureLogin() error {
+	// Just to make sure our logging calls are always safe
+	if app.logger == nil {
+		app.configureLogging()
+	}
+
+	if !app.OIDCLogin {
+		return nil
+	}
+
+	if app.provider == nil {
+		return errVerifierNotInitialized
+	}
+
+	if app.OIDCRedirectURL == "" {
+		return fmt.Errorf("OIDC login requires OIDC_REDIRECT_URL to be set")
+	}
+
+	if app.SessionCookieName == "" {
+		return fmt.Errorf("OIDC login requires SESSION_COOKIE_NAME to be set")
+	}
+
+	var err error
+
+	app.sessionCodec, err = newSessionCodec(app.SessionSecret)
+	if err != nil {
+		return fmt.Errorf("failed to configure sessions: %w", err)
+	}
+
+	app.oauth2Config = &oauth2.Config{
+		ClientID:     app.OIDCClientID,
+		ClientSecret: app.OIDCClientSecret,
+		Endpoint:     app.provider.Endpoint(),
+		RedirectURL:  app.OIDCRedirectURL,
+		Scopes:       app.OIDCScopes,
+	}
+
+	app.sessionTokens = newTTLCache[*oauth2.Token](10000)
+	app.revokedSessions = newTTLCache[struct{}](maxRevokedSessions)
+	app.sessionRefreshes = &callGroup[*oauth2.Token]{}
+
+	var providerClaims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+		RevocationEndpoint string `json:"revocation_endpoint"`
+	}
+	if err := app.provider.Claims(&providerClaims); err == nil {
+		app.endSessionURL = providerClaims.EndSessionEndpoint
+		app.revocationURL = providerClaims.RevocationEndpoint
+	}
+
+	app.logger.Info().Caller().
+		Msgf("OIDC login flow is enabled (redirect URL: %q)", app.OIDCRedirectURL)
+
 	return nil
 }
@@ -39,6 +39,10 @@ func Test_newApplication(t *testing.T) {
 			name: "enable-deduplication",
 			want: application{EnableDeduplication: true},
 		},
+		{
+			name: "require-metric-name",
+			want: application{RequireMetricName: true},
+		},
 		{
 			name: "safe-mode",
 			want: application{SafeMode: true},
@@ -55,6 +59,30 @@ func Test_newApplication(t *testing.T) {
 			name: "assumed-roles",
 			want: application{AssumedRolesEnabled: true},
 		},
+		{
+			name: "assumed-roles-allow-regex",
+			want: application{AssumedRolesAllowRegex: true},
+		},
+		{
+			name: "assumed-roles-validate",
+			want: application{AssumedRolesValidate: true},
+		},
+		{
+			name: "oidc-userinfo-fallback",
+			want: application{OIDCUserInfoFallback: true},
+		},
+		{
+			name: "oidc-login",
+			want: application{OIDCLogin: true},
+		},
+		{
+			name: "trusted-headers-auth",
+			want: application{TrustedHeadersAuth: true},
+		},
+		{
+			name: "kubernetes-auth",
+			want: application{KubernetesAuth: true},
+		},
 	}
 
 	for _, tt := range tests {
@@ -76,10 +104,74 @@ func Test_newApplication(t *testing.T) {
 		upstreamURL := "http://localhost"
 		oidcRealmURL := "http://localhost2"
 		oidcClientID := "grafana"
+		oidcUserInfoFallback := true
+		oidcUserInfoCacheTTL := 3 * time.Minute
+		oidcLogin := true
+		oidcClientSecret := "client-secret"
+		oidcRedirectURL := "https://lfgw.localhost/oauth2/callback"
+		oidcScopes := []string{"openid", "email"}
+		sessionSecret := "session-secret-0123456789"
+		sessionCookieName := "session"
+		sessionMaxAge := 2 * time.Hour
+		introspectionURL := "http://localhost3"
+		introspectionClientID := "lfgw"
+		introspectionClientSecret := "secret"
+		introspectionCacheTTL := 4 * time.Minute
+		introspectionNegativeCacheTTL := 5 * time.Second
+		apiKeysPath := "api-keys.yaml"
+		tlsCertPath := "tls.crt"
+		tlsKeyPath := "tls.key"
+		tlsClientCAPath := "ca.crt"
+		clientCertRulesPath := "client-cert-rules.yaml"
+		trustedHeadersAuth := true
+		trustedHeadersCIDRs := []string{"10.0.0.0/8", "192.168.0.1"}
+		trustedHeadersSecretHeader := "X-Proxy-Secret"
+		trustedHeadersSecret := "secret"
+		trustedHeadersUserHeader := "X-User"
+		trustedHeadersEmailHeader := "X-Email"
+		trustedHeadersGroupsHeader := "X-Groups"
+		tokenSources := []string{"header:Authorization:scheme=Bearer", "query:access_token:untrusted"}
+		tokenSourcesMode := "reject-conflicting"
+		kubernetesAuth := true
+		kubernetesAPIURL := "https://kubernetes.localhost"
+		kubernetesTokenPath := "token"
+		kubernetesCAPath := "kubernetes-ca.crt"
+		kubernetesAudiences := []string{"lfgw"}
+		kubernetesACLMode := "sar"
+		kubernetesACLLabel := "kubernetes_namespace"
+		kubernetesSARNamespaces := []string{"default", "monitoring"}
+		kubernetesSARVerb := "list"
+		kubernetesSARResource := "pods.metrics.k8s.io"
+		kubernetesCacheTTL := 2 * time.Minute
+		dpopPolicies := []string{"*=optional", "http://localhost2=required"}
+		dpopProofMaxAge := 30 * time.Second
+		dpopReplayCacheSize := 1000
+		denylistPath := "denylist.yaml"
+		denylistReloadInterval := 10 * time.Second
+		denylistAdminToken := "admin-token"
 		aclPath := "ACL.yaml"
+		claimACLClaim := "namespaces"
+		claimACLLabel := "tenant"
+		aclExpiryWarning := 24 * time.Hour
+		defaultACLRole := "public"
+		anonymousACLRole := "status-page"
+		anonymousCIDRs := []string{"10.0.0.0/8"}
 		assumedRoles := true
+		assumedRolesTemplate := []string{"tenant={{.Role}}", "team=team-{{.Role}}"}
+		assumedRolesPattern := "team-[a-z]+"
+		assumedRolesPrefix := "ns:"
+		assumedRolesAllowRegex := false
+		assumedRolesValidate := true
+		assumedRolesCacheTTL := 10 * time.Minute
 		enableDeduplication := true
 		optimizeExpression := true
+		maxQueryLength := 4096
+		maxQueryDepth := 10
+		maxSelectors := 20
+		requireMetricName := true
+		maxPointsPerSeries := 11000
+		requiredLabels := []string{"cluster=eu-west-1", "env"}
+		exemptMetrics := `node_.*, up{job="kubelet",instance="x"}`
 		safeMode := true
 		setProxyHeaders := true
 		setGomaxProcs := true
@@ -96,10 +188,74 @@ func Test_newApplication(t *testing.T) {
 		set.String("upstream-url", upstreamURL, "doc")
 		set.String("oidc-realm-url", oidcRealmURL, "doc")
 		set.String("oidc-client-id", oidcClientID, "doc")
+		set.Bool("oidc-userinfo-fallback", oidcUserInfoFallback, "doc")
+		set.Duration("oidc-userinfo-cache-ttl", oidcUserInfoCacheTTL, "doc")
+		set.Bool("oidc-login", oidcLogin, "doc")
+		set.String("oidc-client-secret", oidcClientSecret, "doc")
+		set.String("oidc-redirect-url", oidcRedirectURL, "doc")
+		set.Var(cli.NewStringSlice(oidcScopes...), "oidc-scopes", "doc")
+		set.String("session-secret", sessionSecret, "doc")
+		set.String("session-cookie-name", sessionCookieName, "doc")
+		set.Duration("session-max-age", sessionMaxAge, "doc")
+		set.String("introspection-url", introspectionURL, "doc")
+		set.String("introspection-client-id", introspectionClientID, "doc")
+		set.String("introspection-client-secret", introspectionClientSecret, "doc")
+		set.Duration("introspection-cache-ttl", introspectionCacheTTL, "doc")
+		set.Duration("introspection-negative-cache-ttl", introspectionNegativeCacheTTL, "doc")
+		set.String("api-keys-path", apiKeysPath, "doc")
+		set.String("tls-cert-path", tlsCertPath, "doc")
+		set.String("tls-key-path", tlsKeyPath, "doc")
+		set.String("tls-client-ca-path", tlsClientCAPath, "doc")
+		set.String("client-cert-rules-path", clientCertRulesPath, "doc")
+		set.Bool("trusted-headers-auth", trustedHeadersAuth, "doc")
+		set.Var(cli.NewStringSlice(trustedHeadersCIDRs...), "trusted-headers-cidrs", "doc")
+		set.String("trusted-headers-secret-header", trustedHeadersSecretHeader, "doc")
+		set.String("trusted-headers-secret", trustedHeadersSecret, "doc")
+		set.String("trusted-headers-user-header", trustedHeadersUserHeader, "doc")
+		set.String("trusted-headers-email-header", trustedHeadersEmailHeader, "doc")
+		set.String("trusted-headers-groups-header", trustedHeadersGroupsHeader, "doc")
+		set.Var(cli.NewStringSlice(tokenSources...), "token-sources", "doc")
+		set.String("token-sources-mode", tokenSourcesMode, "doc")
+		set.Bool("kubernetes-auth", kubernetesAuth, "doc")
+		set.String("kubernetes-api-url", kubernetesAPIURL, "doc")
+		set.String("kubernetes-token-path", kubernetesTokenPath, "doc")
+		set.String("kubernetes-ca-path", kubernetesCAPath, "doc")
+		set.Var(cli.NewStringSlice(kubernetesAudiences...), "kubernetes-audiences", "doc")
+		set.String("kubernetes-acl-mode", kubernetesACLMode, "doc")
+		set.String("kubernetes-acl-label", kubernetesACLLabel, "doc")
+		set.Var(cli.NewStringSlice(kubernetesSARNamespaces...), "kubernetes-sar-namespaces", "doc")
+		set.String("kubernetes-sar-verb", kubernetesSARVerb, "doc")
+		set.String("kubernetes-sar-resource", kubernetesSARResource, "doc")
+		set.Duration("kubernetes-cache-ttl", kubernetesCacheTTL, "doc")
+		set.Var(cli.NewStringSlice(dpopPolicies...), "dpop-policies", "doc")
+		set.Duration("dpop-proof-max-age", dpopProofMaxAge, "doc")
+		set.Int("dpop-replay-cache-size", dpopReplayCacheSize, "doc")
+		set.String("denylist-path", denylistPath, "doc")
+		set.Duration("denylist-reload-interval", denylistReloadInterval, "doc")
+		set.String("denylist-admin-token", denylistAdminToken, "doc")
 		set.String("acl-path", aclPath, "doc")
+		set.String("claim-acl-claim", claimACLClaim, "doc")
+		set.String("claim-acl-label", claimACLLabel, "doc")
+		set.Duration("acl-expiry-warning", aclExpiryWarning, "doc")
+		set.String("default-acl-role", defaultACLRole, "doc")
+		set.String("anonymous-acl-role", anonymousACLRole, "doc")
+		set.Var(cli.NewStringSlice(anonymousCIDRs...), "anonymous-cidrs", "doc")
 		set.Bool("assumed-roles", assumedRoles, "doc")
+		set.Var(cli.NewStringSlice(assumedRolesTemplate...), "assumed-roles-template", "doc")
+		set.String("assumed-roles-pattern", assumedRolesPattern, "doc")
+		set.String("assumed-roles-prefix", assumedRolesPrefix, "doc")
+		set.Bool("assumed-roles-allow-regex", assumedRolesAllowRegex, "doc")
+		set.Bool("assumed-roles-validate", assumedRolesValidate, "doc")
+		set.Duration("assumed-roles-cache-ttl", assumedRolesCacheTTL, "doc")
 		set.Bool("enable-deduplication", enableDeduplication, "doc")
 		set.Bool("optimize-expressions", optimizeExpression, "doc")
+		set.Int("max-query-length", maxQueryLength, "doc")
+		set.Int("max-query-depth", maxQueryDepth, "doc")
+		set.Int("max-selectors", maxSelectors, "doc")
+		set.Bool("require-metric-name", requireMetricName, "doc")
+		set.Int("max-points-per-series", maxPointsPerSeries, "doc")
+		set.Var(cli.NewStringSlice(requiredLabels...), "required-labels", "doc")
+		set.String("exempt-metrics", exemptMetrics, "doc")
 		set.Bool("safe-mode", safeMode, "doc")
 		set.Bool("set-proxy-headers", setProxyHeaders, "doc")
 		set.Bool("set-gomax-procs", setGomaxProcs, "doc")
@@ -117,24 +273,88 @@ func Test_newApplication(t *testing.T) {
 		assert.Nil(t, err)
 
 		want := application{
-			UpstreamURL:             appUpstreamURL,
-			OIDCRealmURL:            oidcRealmURL,
-			OIDCClientID:            oidcClientID,
-			ACLPath:                 aclPath,
-			AssumedRolesEnabled:     assumedRoles,
-			OptimizeExpressions:     optimizeExpression,
-			EnableDeduplication:     enableDeduplication,
-			SafeMode:                safeMode,
-			SetProxyHeaders:         setProxyHeaders,
-			SetGomaxProcs:           setGomaxProcs,
-			Debug:                   debug,
-			LogFormat:               logFormat,
-			LogNoColor:              logNoColor,
-			LogRequests:             logRequests,
-			Port:                    port,
-			ReadTimeout:             readTimeout,
-			WriteTimeout:            writeTimeout,
-			GracefulShutdownTimeout: gracefulShutdownTimeout,
+			UpstreamURL:                   appUpstreamURL,
+			OIDCRealmURL:                  oidcRealmURL,
+			OIDCClientID:                  oidcClientID,
+			OIDCUserInfoFallback:          oidcUserInfoFallback,
+			OIDCUserInfoCacheTTL:          oidcUserInfoCacheTTL,
+			OIDCLogin:                     oidcLogin,
+			OIDCClientSecret:              oidcClientSecret,
+			OIDCRedirectURL:               oidcRedirectURL,
+			OIDCScopes:                    oidcScopes,
+			SessionSecret:                 sessionSecret,
+			SessionCookieName:             sessionCookieName,
+			SessionMaxAge:                 sessionMaxAge,
+			IntrospectionURL:              introspectionURL,
+			IntrospectionClientID:         introspectionClientID,
+			IntrospectionClientSecret:     introspectionClientSecret,
+			IntrospectionCacheTTL:         introspectionCacheTTL,
+			IntrospectionNegativeCacheTTL: introspectionNegativeCacheTTL,
+			APIKeysPath:                   apiKeysPath,
+			TLSCertPath:                   tlsCertPath,
+			TLSKeyPath:                    tlsKeyPath,
+			TLSClientCAPath:               tlsClientCAPath,
+			ClientCertRulesPath:           clientCertRulesPath,
+			TrustedHeadersAuth:            trustedHeadersAuth,
+			TrustedHeadersCIDRs:           trustedHeadersCIDRs,
+			TrustedHeadersSecretHeader:    trustedHeadersSecretHeader,
+			TrustedHeadersSecret:          trustedHeadersSecret,
+			TrustedHeadersUserHeader:      trustedHeadersUserHeader,
+			TrustedHeadersEmailHeader:     trustedHeadersEmailHeader,
+			TrustedHeadersGroupsHeader:    trustedHeadersGroupsHeader,
+			TokenSources:                  tokenSources,
+			TokenSourcesMode:              tokenSourcesMode,
+			KubernetesAuth:                kubernetesAuth,
+			KubernetesAPIURL:              kubernetesAPIURL,
+			KubernetesTokenPath:           kubernetesTokenPath,
+			KubernetesCAPath:              kubernetesCAPath,
+			KubernetesAudiences:           kubernetesAudiences,
+			KubernetesACLMode:             kubernetesACLMode,
+			KubernetesACLLabel:            kubernetesACLLabel,
+			KubernetesSARNamespaces:       kubernetesSARNamespaces,
+			KubernetesSARVerb:             kubernetesSARVerb,
+			KubernetesSARResource:         kubernetesSARResource,
+			KubernetesCacheTTL:            kubernetesCacheTTL,
+			DPoPPolicies:                  dpopPolicies,
+			DPoPProofMaxAge:               dpopProofMaxAge,
+			DPoPReplayCacheSize:           dpopReplayCacheSize,
+			DenylistPath:                  denylistPath,
+			DenylistReloadInterval:        denylistReloadInterval,
+			DenylistAdminToken:            denylistAdminToken,
+			ACLPath:                       aclPath,
+			ClaimACLClaim:                 claimACLClaim,
+			ClaimACLLabel:                 claimACLLabel,
+			ACLExpiryWarning:              aclExpiryWarning,
+			DefaultACLRole:                defaultACLRole,
+			AnonymousACLRole:              anonymousACLRole,
+			AnonymousCIDRs:                anonymousCIDRs,
+			AssumedRolesEnabled:           assumedRoles,
+			AssumedRolesTemplate:          assumedRolesTemplate,
+			AssumedRolesPattern:           assumedRolesPattern,
+			AssumedRolesPrefix:            assumedRolesPrefix,
+			AssumedRolesAllowRegex:        assumedRolesAllowRegex,
+			AssumedRolesValidate:          assumedRolesValidate,
+			AssumedRolesCacheTTL:          assumedRolesCacheTTL,
+			OptimizeExpressions:           optimizeExpression,
+			MaxQueryLength:                maxQueryLength,
+			MaxQueryDepth:                 maxQueryDepth,
+			MaxSelectors:                  maxSelectors,
+			RequireMetricName:             requireMetricName,
+			MaxPointsPerSeries:            maxPointsPerSeries,
+			RequiredLabels:                requiredLabels,
+			ExemptMetrics:                 exemptMetrics,
+			EnableDeduplication:           enableDeduplication,
+			SafeMode:                      safeMode,
+			SetProxyHeaders:               setProxyHeaders,
+			SetGomaxProcs:                 setGomaxProcs,
+			Debug:                         debug,
+			LogFormat:                     logFormat,
+			LogNoColor:                    logNoColor,
+			LogRequests:                   logRequests,
+			Port:                          port,
+			ReadTimeout:                   readTimeout,
+			WriteTimeout:                  writeTimeout,
+			GracefulShutdownTimeout:       gracefulShutdownTimeout,
 		}
 
 		got, err := newApplication(c)
@@ -2,8 +2,10 @@ package lfgw
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -19,6 +21,24 @@ const contextKeyACL = contextKey("acl")
 type userClaims struct {
 	Roles []string `json:"roles"`
 	Email string   `json:"email"`
+	// Issuer and Confirmation are used to enforce DPoP policies. Issuer is set explicitly from a verified token.
+	Issuer       string            `json:"-"`
+	Confirmation confirmationClaim `json:"cnf"`
+	// Subject and TokenID are checked against the denylist, set explicitly from a verified token.
+	Subject string `json:"-"`
+	TokenID string `json:"-"`
+	// Claims holds all claims of a verified token, those are referenced by ACL templates.
+	Claims map[string]interface{} `json:"-"`
+}
+
+// tokenIDClaims holds registered claims that are not exposed by oidc.IDToken.
+type tokenIDClaims struct {
+	JTI string `json:"jti"`
+}
+
+// confirmationClaim holds the confirmation method of a sender-constrained token (RFC 7800, RFC 9449).
+type confirmationClaim struct {
+	JKT string `json:"jkt"`
 }
 
 var (
@@ -130,7 +150,7 @@ func (app *application) proxyHeadersMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// oidcMiddleware verifies a jwt token, and, if valid and authorized, adds a respective label filter to the request context.
+// oidcMiddleware verifies a jwt token (or an opaque token through introspection, a static API key, a client certificate), and, if valid and authorized, adds a respective label filter to the request context.
 func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.verifier == nil {
@@ -138,7 +158,7 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		rawAccessToken, err := app.getRawAccessToken(r)
+		id, err := app.authenticateRequest(r)
 		if err != nil {
 			// Might produce plenty of error messages, though it will make it much easier to understand why requests are failing
 			hlog.FromRequest(r).Error().Caller().
@@ -148,30 +168,21 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		ctx := r.Context()
-		accessToken, err := app.verifier.Verify(ctx, rawAccessToken)
-		if err != nil {
-			// Better to log to see token verification errors
-			hlog.FromRequest(r).Error().Caller().
-				Err(err).Msg("")
-			app.clientErrorMessage(w, http.StatusUnauthorized, err)
-			return
-		}
+		app.logIdentity(r, id)
+		app.stripQueryTokens(r)
 
-		var claims userClaims
-		if err := accessToken.Claims(&claims); err != nil {
-			// Claims property is not set / unmarshal errors, very unlikely to catch it
-			hlog.FromRequest(r).Error().Caller().
-				Err(err).Msg("")
-			app.clientErrorMessage(w, http.StatusUnauthorized, err)
-			return
+		if app.denylist != nil {
+			if entryType, denied := app.denylist.Match(id); denied {
+				denylistHits[entryType].Inc()
+				err := fmt.Errorf("%w (%s)", errDenied, entryType)
+				hlog.FromRequest(r).Error().Caller().
+					Err(err).Msg("")
+				app.clientErrorMessage(w, http.StatusUnauthorized, err)
+				return
+			}
 		}
 
-		app.enrichLogContext(r, "email", claims.Email)
-		// NOTE: The field will contain all roles present in the token, not only those that are considered during ACL generation process
-		app.enrichDebugLogContext(r, "roles", strings.Join(claims.Roles, ", "))
-
-		acl, err := app.ACLs.GetUserACL(claims.Roles, app.AssumedRolesEnabled)
+		acl, err := app.getIdentityACL(r, id)
 		if err != nil {
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
@@ -181,7 +192,10 @@ func (app *application) oidcMiddleware(next http.Handler) http.Handler {
 		for _, filter := range acl.Metrics {
 			app.enrichDebugLogContext(r, "label_filter", string(filter.AppendString(nil)))
 		}
-		ctx = context.WithValue(ctx, contextKeyACL, acl)
+		for _, rule := range acl.Rules {
+			app.enrichDebugLogContext(r, "rule", rule.String())
+		}
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
@@ -214,44 +228,105 @@ func (app *application) rewriteRequestMiddleware(next http.Handler) http.Handler
 			return
 		}
 
+		fullaccess := false
 		for _, metadata := range acl.MetricsMeta {
 			if metadata.Fullaccess {
-				hlog.FromRequest(r).Debug().Caller().
-					Msg("User has full access, request is not modified")
-				next.ServeHTTP(w, r)
+				fullaccess = true
+			}
+		}
+
+		qm := querymodifier.QueryModifier{
+			ACL:                 acl,
+			EnableDeduplication: app.EnableDeduplication,
+			OptimizeExpressions: app.OptimizeExpressions,
+			QueryLimits:         app.queryLimits().Merge(acl.QueryLimits),
+			Functions:           acl.Functions,
+			RequiredLabels:      app.requiredLabels.Merge(acl.RequiredLabels),
+			Aggregation:         acl.Aggregation,
+			ExemptMetrics:       app.exemptMetrics.Merge(acl.ExemptMetrics),
+		}
+
+		if !qm.Aggregation.IsZero() {
+			if err := app.checkAggregationOnlyPath(r.URL.Path, qm.Aggregation); err != nil {
+				hlog.FromRequest(r).Error().Caller().
+					Err(err).Msg("")
+				app.prometheusError(w, http.StatusForbidden, "bad_data", err)
 				return
 			}
 		}
 
+		if fullaccess && acl.TimeLimits.IsZero() && qm.QueryLimits.IsZero() && qm.Functions.IsZero() && len(qm.RequiredLabels) == 0 && qm.Aggregation.IsZero() {
+			hlog.FromRequest(r).Debug().Caller().
+				Msg("User has full access, request is not modified")
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
 			app.clientError(w, http.StatusBadRequest)
 			return
 		}
 
-		qm := querymodifier.QueryModifier{
-			ACL:                 acl,
-			EnableDeduplication: app.EnableDeduplication,
-			OptimizeExpressions: app.OptimizeExpressions,
+		getParams := r.URL.Query()
+		postParams := r.PostForm
+
+		err = querymodifier.ApplyTimeLimits(acl.TimeLimits, getParams, postParams, time.Now())
+		if err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msg("")
+			app.prometheusError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+
+		// Queries might be wrapped into an aggregation, so it goes before checks of limits
+		err = qm.ApplyAggregationPolicy(getParams, postParams)
+		if err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msg("")
+			app.prometheusError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+
+		// Checked after time limits, since those might narrow down the time range
+		err = qm.CheckQueries(getParams, postParams)
+		if err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msg("")
+			app.prometheusError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+
+		modify := func(params url.Values) (string, error) {
+			// Full access users are subject to time limits, query limits, function and aggregation policies, and required labels only
+			if fullaccess {
+				if len(qm.RequiredLabels) == 0 {
+					return params.Encode(), nil
+				}
+
+				return qm.AddRequiredLabels(params)
+			}
+
+			return qm.GetModifiedEncodedURLValues(params)
 		}
 
 		// Adjust GET params
-		newGetParams, err := qm.GetModifiedEncodedURLValues(r.URL.Query())
+		newGetParams, err := modify(getParams)
 		if err != nil {
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
-			app.clientError(w, http.StatusBadRequest)
+			app.prometheusError(w, http.StatusBadRequest, "bad_data", err)
 			return
 		}
 		r.URL.RawQuery = newGetParams
 		app.enrichDebugLogContext(r, "new_get_params", app.unescapedURLQuery(newGetParams))
 
 		// For PATCH, POST, and PUT requests
-		newPostParams, err := qm.GetModifiedEncodedURLValues(r.PostForm)
+		newPostParams, err := modify(postParams)
 		if err != nil {
 			hlog.FromRequest(r).Error().Caller().
 				Err(err).Msg("")
-			app.clientError(w, http.StatusBadRequest)
+			app.prometheusError(w, http.StatusBadRequest, "bad_data", err)
 			return
 		}
 		newBody := strings.NewReader(newPostParams)
@@ -2,16 +2,22 @@ package lfgw
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	oidc "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
@@ -473,6 +479,290 @@ func Test_oidcMiddleware(t *testing.T) {
 
 		defer rs.Body.Close()
 	})
+
+	t.Run("Roles are fetched from userinfo if missing in the token", func(t *testing.T) {
+		claims := testClaims{
+			userClaims{
+				Email: "user@localhost",
+			},
+			jwt.StandardClaims{
+				Audience:  clientID,
+				ExpiresAt: time.Now().Add(time.Minute * 5).Unix(),
+				Issuer:    issuerURL,
+				Subject:   "user",
+			},
+		}
+		rawAccessToken := oidcGenerateToken(t, claims)
+
+		tests := []struct {
+			name     string
+			userInfo *userInfoFetcher
+			want     int
+		}{
+			{
+				name:     "fallback disabled",
+				userInfo: nil,
+				want:     http.StatusUnauthorized,
+			},
+			{
+				name:     "fallback enabled",
+				userInfo: newUserInfoFetcher(appHelper.provider, time.Minute),
+				want:     http.StatusOK,
+			},
+		}
+
+		for _, tt := range tests {
+			app := application{
+				logger:   &logger,
+				ACLs:     acls,
+				verifier: verifier,
+				userInfo: tt.userInfo,
+			}
+
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/federate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", rawAccessToken))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+				assert.True(t, ok, errACLNotSetInContext)
+				assert.Equal(t, acl, aclEditor)
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, tt.want, rs.StatusCode, tt.name)
+
+			defer rs.Body.Close()
+		}
+	})
+
+	t.Run("API keys", func(t *testing.T) {
+		keys := apiKeys{
+			testAPIKeyHash("editor-key"): apiKey{
+				name:  "alerting",
+				roles: []string{"grafana-editor"},
+			},
+			testAPIKeyHash("acl-key"): apiKey{
+				name: "capacity-scripts",
+				acl:  &aclEditor,
+			},
+			testAPIKeyHash("expired-key"): apiKey{
+				name:    "expired",
+				roles:   []string{"grafana-editor"},
+				expires: time.Now().Add(-time.Hour),
+			},
+		}
+
+		app := application{
+			logger:   &logger,
+			ACLs:     acls,
+			verifier: verifier,
+			apiKeys:  keys,
+		}
+
+		tests := []struct {
+			name      string
+			basicAuth bool
+			key       string
+			want      int
+		}{
+			{
+				name: "bearer, roles",
+				key:  "editor-key",
+				want: http.StatusOK,
+			},
+			{
+				name:      "basic auth, roles",
+				basicAuth: true,
+				key:       "editor-key",
+				want:      http.StatusOK,
+			},
+			{
+				name: "bearer, acl",
+				key:  "acl-key",
+				want: http.StatusOK,
+			},
+			{
+				name: "expired key",
+				key:  "expired-key",
+				want: http.StatusUnauthorized,
+			},
+			{
+				name: "unknown key",
+				key:  "unknown-key",
+				want: http.StatusUnauthorized,
+			},
+		}
+
+		for _, tt := range tests {
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/federate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.basicAuth {
+				r.SetBasicAuth("alerting", tt.key)
+			} else {
+				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tt.key))
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+				assert.True(t, ok, errACLNotSetInContext)
+				assert.Equal(t, acl, aclEditor)
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, tt.want, rs.StatusCode, tt.name)
+
+			defer rs.Body.Close()
+		}
+
+		t.Run("API keys are not accepted from untrusted sources", func(t *testing.T) {
+			app := app
+			app.tokenSources = []tokenSource{{Kind: tokenSourceQuery, Name: "access_token"}}
+
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/federate?access_token=editor-key", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, http.StatusUnauthorized, rs.StatusCode)
+		})
+	})
+
+	t.Run("Opaque token is checked through introspection", func(t *testing.T) {
+		var calls atomic.Int32
+		its := introspectionServer(t, clientID, "secret", &calls)
+		defer its.Close()
+
+		app := application{
+			logger:       &logger,
+			ACLs:         acls,
+			verifier:     verifier,
+			introspector: newTokenIntrospector(its.URL, clientID, "secret", clientID, time.Minute, time.Minute),
+		}
+
+		for token, want := range map[string]int{
+			"active-token":   http.StatusOK,
+			"inactive-token": http.StatusUnauthorized,
+		} {
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/federate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+				assert.True(t, ok, errACLNotSetInContext)
+				assert.Equal(t, acl, aclEditor)
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.oidcMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+
+			assert.Equal(t, want, rs.StatusCode, token)
+
+			defer rs.Body.Close()
+		}
+	})
+
+	t.Run("ACL templates are rendered against token claims", func(t *testing.T) {
+		aclTeam, err := querymodifier.NewACL("metrics:\n  namespace: '{{ .claims.team }}-.*'\n")
+		assert.Nil(t, err)
+
+		app := application{
+			logger:   &logger,
+			ACLs:     querymodifier.ACLs{"team-member": aclTeam},
+			verifier: verifier,
+		}
+
+		tests := []struct {
+			name   string
+			claims jwt.MapClaims
+			want   int
+			wantLF string
+		}{
+			{
+				name: "Claim is present",
+				claims: jwt.MapClaims{
+					"aud":   clientID,
+					"iss":   issuerURL,
+					"exp":   time.Now().Add(5 * time.Minute).Unix(),
+					"roles": []string{"team-member"},
+					"team":  "payments",
+				},
+				want:   http.StatusOK,
+				wantLF: `namespace=~"payments-.*"`,
+			},
+			{
+				name: "Claim is escaped",
+				claims: jwt.MapClaims{
+					"aud":   clientID,
+					"iss":   issuerURL,
+					"exp":   time.Now().Add(5 * time.Minute).Unix(),
+					"roles": []string{"team-member"},
+					"team":  ".*",
+				},
+				want:   http.StatusOK,
+				wantLF: `namespace=~"\\.\\*-.*"`,
+			},
+			{
+				name: "Claim is missing",
+				claims: jwt.MapClaims{
+					"aud":   clientID,
+					"iss":   issuerURL,
+					"exp":   time.Now().Add(5 * time.Minute).Unix(),
+					"roles": []string{"team-member"},
+				},
+				want: http.StatusUnauthorized,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?query=up", nil)
+				r.Header.Set("Authorization", "Bearer "+oidcGenerateToken(t, tt.claims))
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+					assert.True(t, ok, errACLNotSetInContext)
+					lf := acl.Metrics["namespace"]
+					assert.Equal(t, tt.wantLF, string(lf.AppendString(nil)))
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				rr := httptest.NewRecorder()
+				app.oidcMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+				defer rs.Body.Close()
+
+				assert.Equal(t, tt.want, rs.StatusCode)
+			})
+		}
+	})
 }
 
 func Test_rewriteRequestMiddleware(t *testing.T) {
@@ -705,6 +995,424 @@ func Test_rewriteRequestMiddleware(t *testing.T) {
 		defer rs.Body.Close()
 	})
 
+	t.Run("Time limits apply to users with full access", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?query=rate(kube_pod_info[60d])", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("metrics:\n  namespace: '.*'\nmax_lookback: 30d")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request should not be proxied")
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+		assert.Equal(t, "application/json", rs.Header.Get("Content-Type"))
+		assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"the query looks back 60d, which exceeds the allowed lookback of 30d"}`, rr.Body.String())
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Start is clamped according to time limits (POST)", func(t *testing.T) {
+		body := io.NopCloser(strings.NewReader("query=kube_pod_info&start=0&step=60"))
+
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/query_range", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		acl, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\nmax_lookback: 30d")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		minStart := float64(time.Now().Add(-30*24*time.Hour).Unix()) - 1
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := r.ParseForm()
+			assert.Nil(t, err)
+
+			assert.Equal(t, `kube_pod_info{namespace="monitoring"}`, r.PostForm.Get("query"))
+
+			start, err := strconv.ParseFloat(r.PostForm.Get("start"), 64)
+			assert.Nil(t, err)
+			assert.Greater(t, start, minStart)
+
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Query limits apply to users with full access", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, `http://lfgw/api/v1/query?query=count%20by%20(__name__)%20({__name__=~".%2B"})`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("metrics:\n  namespace: '.*'")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request should not be proxied")
+		})
+
+		app := *app
+		app.RequireMetricName = true
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+		assert.Equal(t, "application/json", rs.Header.Get("Content-Type"))
+		assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"the selector {__name__=~\".+\"} has no metric name"}`, rr.Body.String())
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Per-role query limits are merged with global ones", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query_range?query=kube_pod_info&start=0&end=86400&step=60", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\nmax_points_per_series: 1000")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request should not be proxied")
+		})
+
+		app := *app
+		app.MaxPointsPerSeries = 11000
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+		assert.Contains(t, rr.Body.String(), "the query returns 1441 points per series, which exceeds the limit of 1000")
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Function policies apply to users with full access", func(t *testing.T) {
+		body := io.NopCloser(strings.NewReader(`query=count_values("version", kube_pod_info)`))
+
+		r, err := http.NewRequest(http.MethodPost, "http://lfgw/api/v1/query", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		acl, err := querymodifier.NewACL("metrics:\n  namespace: '.*'\nfunctions:\n  deny: [count_values]")
+		assert.Nil(t, err)
+
+		ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+		r = r.WithContext(ctx)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("The request should not be proxied")
+		})
+
+		rr := httptest.NewRecorder()
+		app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+		assert.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"the aggregation count_values is not allowed"}`, rr.Body.String())
+
+		defer rs.Body.Close()
+	})
+
+	t.Run("Required labels", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			rawACL    string
+			query     string
+			want      int
+			wantQuery string
+			wantBody  string
+		}{
+			{
+				name:      "Default value is filled in",
+				rawACL:    "metrics:\n  namespace: 'monitoring'",
+				query:     `kube_pod_info{env="prod"}`,
+				want:      http.StatusOK,
+				wantQuery: `kube_pod_info{env="prod", cluster="eu-west-1", namespace="monitoring"}`,
+			},
+			{
+				name:      "Default value is filled in for users with full access",
+				rawACL:    "metrics:\n  namespace: '.*'",
+				query:     `kube_pod_info{env="prod"}`,
+				want:      http.StatusOK,
+				wantQuery: `kube_pod_info{env="prod", cluster="eu-west-1"}`,
+			},
+			{
+				name:     "Query without a required label is rejected",
+				rawACL:   "metrics:\n  namespace: 'monitoring'",
+				query:    `kube_pod_info`,
+				want:     http.StatusBadRequest,
+				wantBody: `{"status":"error","errorType":"bad_data","error":"the selector kube_pod_info has to contain a positive matcher for the label env"}`,
+			},
+			{
+				name:     "Per-role required labels",
+				rawACL:   "metrics:\n  namespace: '.*'\nrequired_labels: [job]",
+				query:    `kube_pod_info{env="prod"}`,
+				want:     http.StatusBadRequest,
+				wantBody: `{"status":"error","errorType":"bad_data","error":"the selector kube_pod_info{env=\"prod\"} has to contain a positive matcher for the label job"}`,
+			},
+		}
+
+		app := *app
+		app.requiredLabels = querymodifier.RequiredLabels{"cluster": "eu-west-1", "env": ""}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?"+url.Values{"query": {tt.query}}.Encode(), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				acl, err := querymodifier.NewACL(tt.rawACL)
+				assert.Nil(t, err)
+
+				ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+				r = r.WithContext(ctx)
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tt.wantQuery, r.URL.Query().Get("query"))
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				rr := httptest.NewRecorder()
+				app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+
+				assert.Equal(t, tt.want, rs.StatusCode)
+				if tt.wantBody != "" {
+					assert.JSONEq(t, tt.wantBody, rr.Body.String())
+				}
+
+				defer rs.Body.Close()
+			})
+		}
+	})
+
+	t.Run("Aggregation-only access", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			rawACL    string
+			path      string
+			query     string
+			want      int
+			wantQuery string
+		}{
+			{
+				name:      "Aggregated query is modified according to the ACL",
+				rawACL:    "metrics:\n  namespace: 'monitoring'\naggregation_only:\n  labels: [pod]",
+				path:      "/api/v1/query",
+				query:     `sum by (namespace) (kube_pod_info)`,
+				want:      http.StatusOK,
+				wantQuery: `sum(kube_pod_info{namespace="monitoring"}) by (namespace)`,
+			},
+			{
+				name:   "Query without aggregation is rejected",
+				rawACL: "metrics:\n  namespace: 'monitoring'\naggregation_only:\n  labels: [pod]",
+				path:   "/api/v1/query",
+				query:  `kube_pod_info`,
+				want:   http.StatusBadRequest,
+			},
+			{
+				name:      "Query without aggregation is wrapped for users with full access",
+				rawACL:    "metrics:\n  namespace: '.*'\naggregation_only:\n  labels: [pod]\n  wrap: true",
+				path:      "/api/v1/query",
+				query:     `kube_pod_info`,
+				want:      http.StatusOK,
+				wantQuery: `sum(kube_pod_info) without (pod)`,
+			},
+			{
+				name:   "Values of hidden labels are not available",
+				rawACL: "metrics:\n  namespace: '.*'\naggregation_only:\n  labels: [pod]",
+				path:   "/api/v1/label/pod/values",
+				want:   http.StatusForbidden,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				target := "http://lfgw" + tt.path
+				if tt.query != "" {
+					target += "?" + url.Values{"query": {tt.query}}.Encode()
+				}
+
+				r, err := http.NewRequest(http.MethodGet, target, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				acl, err := querymodifier.NewACL(tt.rawACL)
+				assert.Nil(t, err)
+
+				ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+				r = r.WithContext(ctx)
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tt.wantQuery, r.URL.Query().Get("query"))
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				rr := httptest.NewRecorder()
+				app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+
+				assert.Equal(t, tt.want, rs.StatusCode)
+
+				defer rs.Body.Close()
+			})
+		}
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			query     string
+			want      int
+			wantQuery string
+		}{
+			{
+				name:      "Selector is rewritten into a union",
+				query:     `sum(up) by (namespace)`,
+				want:      http.StatusOK,
+				wantQuery: `sum(up{cluster="eu1", namespace="payments"} or up{cluster="us2", namespace="billing"}) by (namespace)`,
+			},
+			{
+				name:  "Range selector outside of a rollup function is rejected",
+				query: `up[5m]`,
+				want:  http.StatusBadRequest,
+			},
+		}
+
+		acl, err := querymodifier.NewACL("rules:\n  - namespace: payments\n    cluster: eu1\n  - namespace: billing\n    cluster: us2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				target := "http://lfgw/api/v1/query?" + url.Values{"query": {tt.query}}.Encode()
+
+				r, err := http.NewRequest(http.MethodGet, target, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+				r = r.WithContext(ctx)
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tt.wantQuery, r.URL.Query().Get("query"))
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				rr := httptest.NewRecorder()
+				app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+
+				assert.Equal(t, tt.want, rs.StatusCode)
+
+				defer rs.Body.Close()
+			})
+		}
+	})
+
+	t.Run("Exempt metrics", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			rawACL    string
+			query     string
+			wantQuery string
+		}{
+			{
+				name:      "Global exemption",
+				rawACL:    "metrics:\n  namespace: 'team-a'",
+				query:     `node_load1 or up`,
+				wantQuery: `node_load1 or up{job="kubelet"}`,
+			},
+			{
+				name:      "Per-role exemption",
+				rawACL:    "metrics:\n  namespace: 'team-a'\nexempt_metrics: [kube_node_.*]",
+				query:     `kube_node_info`,
+				wantQuery: `kube_node_info`,
+			},
+			{
+				name:      "Regexp matching the metric name is not exempt",
+				rawACL:    "metrics:\n  namespace: 'team-a'",
+				query:     `{__name__=~"node_.*"}`,
+				wantQuery: `{__name__=~"node_.*", namespace="team-a"}`,
+			},
+		}
+
+		app := *app
+		exemptMetrics, err := querymodifier.NewMetricExemptions([]string{"node_.*", `up{job="kubelet"}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.exemptMetrics = exemptMetrics
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query?"+url.Values{"query": {tt.query}}.Encode(), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				acl, err := querymodifier.NewACL(tt.rawACL)
+				assert.Nil(t, err)
+
+				ctx := context.WithValue(r.Context(), contextKeyACL, acl)
+				r = r.WithContext(ctx)
+
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tt.wantQuery, r.URL.Query().Get("query"))
+					_, _ = w.Write([]byte("OK"))
+				})
+
+				rr := httptest.NewRecorder()
+				app.rewriteRequestMiddleware(next).ServeHTTP(rr, r)
+				rs := rr.Result()
+
+				assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+				defer rs.Body.Close()
+			})
+		}
+	})
+
 	// TODO: log fields are added (both get / post)
 }
 
@@ -719,6 +1427,7 @@ func oidcWellKnownContent(t *testing.T, url string) string {
 		"introspection_endpoint": "%[1]s/protocol/openid-connect/token/introspect",
 		"userinfo_endpoint": "%[1]s/protocol/openid-connect/userinfo",
 		"end_session_endpoint": "%[1]s/protocol/openid-connect/logout",
+		"revocation_endpoint": "%[1]s/protocol/openid-connect/revoke",
 		"jwks_uri": "%[1]s/protocol/openid-connect/certs",
 		"id_token_signing_alg_values_supported": [
 			"RS256"
@@ -781,5 +1490,123 @@ func oidcIDPServer(t *testing.T) *httptest.Server {
 		_, _ = w.Write(oidcCertsContent(t))
 	})
 
+	// Authorization code flow with PKCE: authorization codes are mapped to code challenges
+	var mu sync.Mutex
+	challenges := make(map[string]string)
+
+	// Refresh tokens are rotated, each of them can be used only once (unless it's revoked earlier)
+	var refreshTokens int
+	validRefreshTokens := make(map[string]bool)
+
+	router.HandleFunc("/protocol/openid-connect/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+		mu.Lock()
+		challenges[code] = q.Get("code_challenge")
+		mu.Unlock()
+
+		redirectURL, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		redirectURL.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+
+		http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+	})
+
+	// The second token endpoint stands in for IdPs, which don't report the lifetime of access tokens (no expires_in)
+	tokenHandler := func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var refreshToken string
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			mu.Lock()
+			challenge, ok := challenges[r.PostForm.Get("code")]
+			delete(challenges, r.PostForm.Get("code"))
+			mu.Unlock()
+
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_grant"}`)
+				return
+			}
+		case "refresh_token":
+			mu.Lock()
+			valid := validRefreshTokens[r.PostForm.Get("refresh_token")]
+			delete(validRefreshTokens, r.PostForm.Get("refresh_token"))
+			mu.Unlock()
+
+			if !valid {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_grant"}`)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		refreshTokens++
+		refreshToken = fmt.Sprintf("refresh-%d", refreshTokens)
+		validRefreshTokens[refreshToken] = true
+		mu.Unlock()
+
+		accessToken := oidcGenerateToken(t, jwt.MapClaims{
+			"aud":   "grafana",
+			"iss":   ts.URL,
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"email": "browser-user@localhost",
+			"roles": []string{"grafana-editor"},
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/protocol/openid-connect/token-without-expiry" {
+			fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "refresh_token": %q}`, accessToken, refreshToken)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 300, "refresh_token": %q}`, accessToken, refreshToken)
+	}
+	router.HandleFunc("/protocol/openid-connect/token", tokenHandler)
+	router.HandleFunc("/protocol/openid-connect/token-without-expiry", tokenHandler)
+
+	router.HandleFunc("/protocol/openid-connect/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		delete(validRefreshTokens, r.PostForm.Get("token"))
+		mu.Unlock()
+	})
+
+	router.HandleFunc("/protocol/openid-connect/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"sub": "user", "email": "userinfo@localhost", "roles": ["grafana-editor"]}`)
+	})
+
 	return ts
 }
+
+// testDummyVerifier returns a verifier that rejects all tokens, useful for tests where the token path is not expected to be reached
+func testDummyVerifier(t *testing.T) *oidc.IDTokenVerifier {
+	t.Helper()
+
+	return oidc.NewVerifier("http://dummy-issuer.localhost", &oidc.StaticKeySet{}, &oidc.Config{ClientID: "dummy"})
+}
@@ -11,11 +11,26 @@ func (app *application) routes() *mux.Router {
 	r.Use(app.nonProxiedEndpointsMiddleware)
 	r.Use(hlog.NewHandler(*app.logger))
 	r.Use(app.logAndMetricsMiddleware)
-	r.Use(app.oidcMiddleware)
+
+	// Login flow endpoints have to be handled before the proxy, they must not require a token
+	if app.OIDCLogin {
+		r.HandleFunc(loginPath, app.loginHandler)
+		r.HandleFunc(callbackPath, app.callbackHandler)
+		r.HandleFunc(logoutPath, app.logoutHandler)
+	}
+
+	if app.DenylistAdminToken != "" {
+		r.HandleFunc(denylistPath, app.denylistHandler)
+	}
+
+	proxied := r.PathPrefix("/").Subrouter()
+	proxied.Use(app.trustedHeadersMiddleware)
+	proxied.Use(app.sessionMiddleware)
+	proxied.Use(app.oidcMiddleware)
 	// Better to keep it here to see user email in logs (for unsafe paths)
-	r.Use(app.safeModeMiddleware)
-	r.Use(app.proxyHeadersMiddleware)
-	r.Use(app.rewriteRequestMiddleware)
-	r.PathPrefix("/").Handler(app.proxy)
+	proxied.Use(app.safeModeMiddleware)
+	proxied.Use(app.proxyHeadersMiddleware)
+	proxied.Use(app.rewriteRequestMiddleware)
+	proxied.PathPrefix("/").Handler(app.proxy)
 	return r
 }
@@ -33,6 +33,7 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  app.ReadTimeout,
 		WriteTimeout: app.WriteTimeout,
+		TLSConfig:    app.tlsConfig,
 	}
 
 	shutdownError := make(chan error)
@@ -59,7 +60,12 @@ func (app *application) serve() error {
 	app.logger.Info().Caller().
 		Msgf("Starting server on %d", app.Port)
 
-	err := srv.ListenAndServe()
+	var err error
+	if app.tlsConfig != nil {
+		err = srv.ListenAndServeTLS(app.TLSCertPath, app.TLSKeyPath)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,509 @@
+package lfgw
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/oauth2"
+)
+
+// Paths used by the built-in login flow
+const (
+	loginPath    = "/oauth2/login"
+	callbackPath = "/oauth2/callback"
+	logoutPath   = "/oauth2/logout"
+)
+
+// loginStateTTL is how long a user has to complete authentication at the IdP
+const loginStateTTL = 10 * time.Minute
+
+// maxRevokedSessions limits the number of sessions revoked through logout. Revocations are never evicted before the respective sessions expire
+const maxRevokedSessions = 100000
+
+// sessionRefreshTimeout limits the time spent on refreshing an access token. A refresh is shared by all requests of a session, so it doesn't depend on any of them
+const sessionRefreshTimeout = 10 * time.Second
+
+// sessionTokenDefaultTTL is how long access tokens are cached if the IdP doesn't report their lifetime (expires_in)
+const sessionTokenDefaultTTL = 5 * time.Minute
+
+// sessionData is stored in an encrypted session cookie.
+type sessionData struct {
+	ID           string    `json:"id"`
+	RefreshToken string    `json:"rt"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// loginState is stored in an encrypted short-lived cookie while a user authenticates at the IdP.
+type loginState struct {
+	State        string    `json:"state"`
+	CodeVerifier string    `json:"code_verifier"`
+	RedirectTo   string    `json:"redirect_to"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// sessionCodec encrypts and authenticates cookie values with AES-GCM.
+type sessionCodec struct {
+	aead cipher.AEAD
+}
+
+// newSessionCodec returns a sessionCodec with a key derived from the given secret.
+func newSessionCodec(secret string) (*sessionCodec, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("session secret must be at least 16 characters long")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionCodec{aead: aead}, nil
+}
+
+// encode serializes, encrypts and encodes the given value for use in a cookie. The cookie name is bound to the value, so values cannot be swapped between cookies.
+func (sc *sessionCodec) encode(name string, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, sc.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := sc.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// decode reverses encode.
+func (sc *sessionCodec) decode(name, value string, v interface{}) error {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+
+	nonceSize := sc.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return fmt.Errorf("cookie value is too short")
+	}
+
+	plaintext, err := sc.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(name))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
+
+// randomString returns a URL-safe random string based on n random bytes.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge returns an S256 code challenge for the given verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// safeRedirectTarget returns the given path if it's local to lfgw, otherwise "/". It prevents open redirects.
+func safeRedirectTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return "/"
+	}
+
+	return u.RequestURI()
+}
+
+// isBrowserNavigation returns true for requests that are likely made by a browser navigating to a page.
+func isBrowserNavigation(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// isSameOriginRequest returns false if a browser reports that the request was initiated by another site (through Sec-Fetch-Site or Origin), which protects state-changing endpoints against cross-site requests.
+func (app *application) isSameOriginRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(app.OIDCRedirectURL)
+		if err != nil || origin != u.Scheme+"://"+u.Host {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removeCookies removes cookies with the given names from a request, other cookies are kept.
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	for _, c := range cookies {
+		if !slices.Contains(names, c.Name) {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// setCookie sets a cookie with the settings shared by all lfgw cookies.
+func (app *application) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.OIDCRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearCookie removes a cookie.
+func (app *application) clearCookie(w http.ResponseWriter, name string) {
+	app.setCookie(w, name, "", -time.Second)
+}
+
+// loginCookieName returns the name of the cookie that holds the login state.
+func (app *application) loginCookieName() string {
+	return app.SessionCookieName + "_login"
+}
+
+// loginHandler starts the authorization code flow with PKCE.
+func (app *application) loginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randomString(32)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	ls := loginState{
+		State:        state,
+		CodeVerifier: verifier,
+		RedirectTo:   safeRedirectTarget(r.URL.Query().Get("rd")),
+		CreatedAt:    time.Now(),
+	}
+
+	value, err := app.sessionCodec.encode(app.loginCookieName(), ls)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.setCookie(w, app.loginCookieName(), value, loginStateTTL)
+
+	authURL := app.oauth2Config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// callbackHandler completes the authorization code flow and creates a session.
+func (app *application) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		err := fmt.Errorf("login failed: %s (%s)", errParam, r.URL.Query().Get("error_description"))
+		hlog.FromRequest(r).Error().Caller().
+			Err(err).Msg("")
+		app.clientErrorMessage(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	cookie, err := r.Cookie(app.loginCookieName())
+	if err != nil {
+		app.clientErrorMessage(w, http.StatusBadRequest, errLoginStateMissing)
+		return
+	}
+	app.clearCookie(w, app.loginCookieName())
+
+	var ls loginState
+	if err := app.sessionCodec.decode(app.loginCookieName(), cookie.Value, &ls); err != nil || time.Since(ls.CreatedAt) > loginStateTTL {
+		app.clientErrorMessage(w, http.StatusBadRequest, errLoginStateMissing)
+		return
+	}
+
+	if ls.State == "" || r.URL.Query().Get("state") != ls.State {
+		app.clientErrorMessage(w, http.StatusBadRequest, errLoginStateMismatch)
+		return
+	}
+
+	token, err := app.oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", ls.CodeVerifier),
+	)
+	if err != nil {
+		hlog.FromRequest(r).Error().Caller().
+			Err(err).Msg("")
+		app.clientErrorMessage(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if token.RefreshToken == "" {
+		err := fmt.Errorf("IdP did not return a refresh token")
+		hlog.FromRequest(r).Error().Caller().
+			Err(err).Msg("")
+		app.clientErrorMessage(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	sessionID, err := randomString(32)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	session := sessionData{
+		ID:           sessionID,
+		RefreshToken: token.RefreshToken,
+		CreatedAt:    time.Now(),
+	}
+
+	if err := app.saveSession(w, session); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionTokens.Set(session.ID, token, sessionTokenTTL(token))
+
+	http.Redirect(w, r, ls.RedirectTo, http.StatusFound)
+}
+
+// logoutHandler revokes the session and, if supported by the IdP, revokes the refresh token and ends the session there as well. Only same-origin POST requests are accepted, so that a user cannot be logged out by another site.
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		app.clientError(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.isSameOriginRequest(r) {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	if session, ok := app.loadSession(r); ok {
+		app.sessionTokens.Delete(session.ID)
+
+		// The cookie stays valid until it expires, so the session has to be revoked on the server side as well
+		if !app.revokedSessions.SetIfRoom(session.ID, struct{}{}, app.SessionMaxAge-time.Since(session.CreatedAt)) {
+			hlog.FromRequest(r).Error().Caller().
+				Msg("Failed to revoke the session, too many sessions have been revoked")
+		}
+
+		if err := app.revokeRefreshToken(r.Context(), session.RefreshToken); err != nil {
+			hlog.FromRequest(r).Error().Caller().
+				Err(err).Msg("")
+		}
+	}
+	app.clearCookie(w, app.SessionCookieName)
+
+	target := "/"
+	if app.endSessionURL != "" {
+		target = app.endSessionURL
+	}
+
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// revokeRefreshToken revokes a refresh token at the IdP (RFC 7009), if it advertises revocation_endpoint.
+func (app *application) revokeRefreshToken(ctx context.Context, refreshToken string) error {
+	if app.revocationURL == "" {
+		return nil
+	}
+
+	form := url.Values{
+		"token":           {refreshToken},
+		"token_type_hint": {"refresh_token"},
+	}
+	// Public clients identify themselves through the form
+	if app.OIDCClientSecret == "" {
+		form.Set("client_id", app.OIDCClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.revocationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create revocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if app.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(app.OIDCClientID), url.QueryEscape(app.OIDCClientSecret))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("revocation request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation endpoint returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// saveSession stores the session in an encrypted cookie.
+func (app *application) saveSession(w http.ResponseWriter, session sessionData) error {
+	value, err := app.sessionCodec.encode(app.SessionCookieName, session)
+	if err != nil {
+		return err
+	}
+
+	app.setCookie(w, app.SessionCookieName, value, app.SessionMaxAge-time.Since(session.CreatedAt))
+
+	return nil
+}
+
+// loadSession returns a valid session stored in the request cookies.
+func (app *application) loadSession(r *http.Request) (sessionData, bool) {
+	cookie, err := r.Cookie(app.SessionCookieName)
+	if err != nil {
+		return sessionData{}, false
+	}
+
+	var session sessionData
+	if err := app.sessionCodec.decode(app.SessionCookieName, cookie.Value, &session); err != nil {
+		return sessionData{}, false
+	}
+
+	if session.ID == "" || session.RefreshToken == "" || time.Since(session.CreatedAt) > app.SessionMaxAge {
+		return sessionData{}, false
+	}
+
+	if _, revoked := app.revokedSessions.Get(session.ID); revoked {
+		return sessionData{}, false
+	}
+
+	return session, true
+}
+
+// sessionAccessToken returns a valid access token for the session, transparently refreshing it if needed. Concurrent refreshes of the same session are serialized. The session cookie is updated if the IdP rotates refresh tokens.
+func (app *application) sessionAccessToken(w http.ResponseWriter, r *http.Request, session sessionData) (string, error) {
+	cachedToken := func() (*oauth2.Token, bool) {
+		token, ok := app.sessionTokens.Get(session.ID)
+		return token, ok && token != nil && token.Valid()
+	}
+
+	token, ok := cachedToken()
+	if !ok {
+		var err error
+		token, err = app.sessionRefreshes.do(session.ID, func() (*oauth2.Token, error) {
+			// The session might have been refreshed by another request in the meantime
+			if token, ok := cachedToken(); ok {
+				return token, nil
+			}
+
+			// Other requests might be waiting for the refresh, so it's not cancelled along with the request, which has started it
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), sessionRefreshTimeout)
+			defer cancel()
+
+			token, err := app.oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: session.RefreshToken}).Token()
+			if err != nil {
+				return nil, fmt.Errorf("failed to refresh session: %w", err)
+			}
+			app.sessionTokens.Set(session.ID, token, sessionTokenTTL(token))
+
+			return token, nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Requests, which still carry the previous refresh token, get the rotated one as well
+	if token.RefreshToken != "" && token.RefreshToken != session.RefreshToken {
+		session.RefreshToken = token.RefreshToken
+		if err := app.saveSession(w, session); err != nil {
+			return "", err
+		}
+	}
+
+	return token.AccessToken, nil
+}
+
+// sessionTokenTTL returns how long an access token can be cached: until it expires or, if the IdP doesn't report its lifetime, for sessionTokenDefaultTTL.
+func sessionTokenTTL(token *oauth2.Token) time.Duration {
+	if token.Expiry.IsZero() {
+		return sessionTokenDefaultTTL
+	}
+
+	return time.Until(token.Expiry)
+}
+
+// sessionMiddleware injects an access token from the user's session into requests that don't carry any other credentials. Browsers without a session are redirected to the login page, so that web UIs can be accessed directly. Session cookies are never passed to the upstream.
+func (app *application) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.sessionCodec == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, hasSession := app.loadSession(r)
+		removeCookies(r, app.SessionCookieName, app.loginCookieName())
+
+		// Requests with their own credentials are handled by oidcMiddleware as usual
+		if _, ok := r.Context().Value(contextKeyIdentity).(identity); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := app.getRawAccessToken(r); err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if hasSession {
+			accessToken, err := app.sessionAccessToken(w, r, session)
+			if err == nil {
+				r.Header.Set("Authorization", "Bearer "+accessToken)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hlog.FromRequest(r).Warn().Caller().
+				Err(err).Msg("")
+			app.clearCookie(w, app.SessionCookieName)
+		}
+
+		if isBrowserNavigation(r) {
+			http.Redirect(w, r, loginPath+"?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
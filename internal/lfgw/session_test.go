@@ -0,0 +1,410 @@
+package lfgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+	"golang.org/x/oauth2"
+)
+
+func Test_sessionCodec(t *testing.T) {
+	t.Run("Short secret", func(t *testing.T) {
+		_, err := newSessionCodec("short")
+		assert.NotNil(t, err)
+	})
+
+	sc, err := newSessionCodec("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sessionData{ID: "id", RefreshToken: "refresh-token"}
+
+	value, err := sc.encode("session", want)
+	assert.Nil(t, err)
+	assert.NotContains(t, value, "refresh-token")
+
+	t.Run("Round trip", func(t *testing.T) {
+		var got sessionData
+		err := sc.decode("session", value, &got)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Value is bound to the cookie name", func(t *testing.T) {
+		var got sessionData
+		err := sc.decode("another-cookie", value, &got)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Tampered value", func(t *testing.T) {
+		var got sessionData
+		tampered := []byte(value)
+		tampered[len(tampered)-1] ^= 1
+		err := sc.decode("session", string(tampered), &got)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Different secret", func(t *testing.T) {
+		sc2, err := newSessionCodec("fedcba9876543210")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got sessionData
+		err = sc2.decode("session", value, &got)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_pkceChallenge(t *testing.T) {
+	// Test vector from RFC 7636, Appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func Test_safeRedirectTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "/graph?g0.expr=up", want: "/graph?g0.expr=up"},
+		{target: "", want: "/"},
+		{target: "https://evil.localhost/", want: "/"},
+		{target: "//evil.localhost/", want: "/"},
+		{target: "/\\evil.localhost/", want: "/"},
+		{target: "graph", want: "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			assert.Equal(t, tt.want, safeRedirectTarget(tt.target))
+		})
+	}
+}
+
+func Test_removeCookies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Cookie", "lfgw_session=secret; grafana_session=abc; lfgw_session_login=state")
+
+	removeCookies(r, "lfgw_session", "lfgw_session_login")
+	assert.Equal(t, "grafana_session=abc", r.Header.Get("Cookie"))
+
+	removeCookies(r, "grafana_session")
+	assert.Empty(t, r.Header.Values("Cookie"))
+}
+
+func Test_loginFlow(t *testing.T) {
+	// Prepare a test server with mocked IDP
+	idp := oidcIDPServer(t)
+	defer idp.Close()
+
+	// Upstream receives requests only with tokens obtained through the login flow
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "Bearer ")
+		// Session cookies are not passed to the upstream
+		assert.NotContains(t, r.Header.Get("Cookie"), "lfgw_session")
+		if r.URL.Path == "/api/v1/query" {
+			assert.Equal(t, `up{namespace="monitoring"}`, r.URL.Query().Get("query"))
+		}
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	assert.Nil(t, err)
+
+	// lfgw URL has to be known before the app is configured (redirect URL)
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	logger := zerolog.New(nil)
+	app := &application{
+		UpstreamURL:       upstreamURL,
+		OIDCRealmURL:      idp.URL,
+		OIDCClientID:      "grafana",
+		OIDCLogin:         true,
+		OIDCRedirectURL:   ts.URL + callbackPath,
+		OIDCScopes:        []string{"openid", "email"},
+		SessionSecret:     "0123456789abcdef",
+		SessionCookieName: "lfgw_session",
+		SessionMaxAge:     time.Hour,
+		ACLs:              querymodifier.ACLs{"grafana-editor": aclEditor},
+		logger:            &logger,
+	}
+
+	if err := app.configureOIDCVerifier(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.configureLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	app.proxy = httputil.NewSingleHostReverseProxy(app.UpstreamURL)
+	handler = app.routes()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+
+	t.Run("Browser is redirected through the login flow", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/graph", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "text/html")
+
+		rs, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+		// The user lands on the originally requested page
+		assert.Equal(t, "/graph", rs.Request.URL.Path)
+	})
+
+	t.Run("API requests use the session", func(t *testing.T) {
+		rs, err := client.Get(ts.URL + "/api/v1/query?query=up")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+	})
+
+	t.Run("Access token is transparently refreshed", func(t *testing.T) {
+		// Forget all access tokens, so that the refresh token has to be used
+		app.sessionTokens = newTTLCache[*oauth2.Token](10)
+
+		rs, err := client.Get(ts.URL + "/api/v1/query?query=up")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+		assert.Equal(t, 1, app.sessionTokens.Len())
+
+		// The rotated refresh token is saved in the cookie
+		var session sessionData
+		for _, c := range jar.Cookies(mustParseURL(t, ts.URL)) {
+			if c.Name == app.SessionCookieName {
+				assert.Nil(t, app.sessionCodec.decode(c.Name, c.Value, &session))
+			}
+		}
+		assert.Equal(t, "refresh-2", session.RefreshToken)
+	})
+
+	t.Run("Concurrent refreshes of the same session", func(t *testing.T) {
+		// Forget all access tokens, so that the refresh token has to be used. Each refresh token can be used only once, so concurrent refreshes would fail unless they're serialized
+		app.sessionTokens = newTTLCache[*oauth2.Token](10)
+
+		var wg sync.WaitGroup
+		statuses := make([]int, 10)
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				rs, err := client.Get(ts.URL + "/api/v1/query?query=up")
+				if err != nil {
+					return
+				}
+				defer rs.Body.Close()
+				statuses[i] = rs.StatusCode
+			}(i)
+		}
+		wg.Wait()
+
+		for _, status := range statuses {
+			assert.Equal(t, http.StatusOK, status)
+		}
+	})
+
+	t.Run("Refresh is not cancelled along with the request", func(t *testing.T) {
+		app.sessionTokens = newTTLCache[*oauth2.Token](10)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := httptest.NewRequest(http.MethodGet, ts.URL+"/api/v1/query", nil).WithContext(ctx)
+		for _, c := range jar.Cookies(mustParseURL(t, ts.URL)) {
+			r.AddCookie(c)
+		}
+
+		session, ok := app.loadSession(r)
+		if assert.True(t, ok) {
+			rr := httptest.NewRecorder()
+			_, err := app.sessionAccessToken(rr, r, session)
+			assert.Nil(t, err)
+			// The cookie jar has to keep up with the rotated refresh token
+			jar.SetCookies(mustParseURL(t, ts.URL), rr.Result().Cookies())
+		}
+	})
+
+	t.Run("Access tokens without expires_in are cached", func(t *testing.T) {
+		tokenURL := app.oauth2Config.Endpoint.TokenURL
+		app.oauth2Config.Endpoint.TokenURL = idp.URL + "/protocol/openid-connect/token-without-expiry"
+		defer func() { app.oauth2Config.Endpoint.TokenURL = tokenURL }()
+
+		app.sessionTokens = newTTLCache[*oauth2.Token](10)
+
+		refreshToken := func() string {
+			var session sessionData
+			for _, c := range jar.Cookies(mustParseURL(t, ts.URL)) {
+				if c.Name == app.SessionCookieName {
+					assert.Nil(t, app.sessionCodec.decode(c.Name, c.Value, &session))
+				}
+			}
+			return session.RefreshToken
+		}
+
+		var refreshTokens []string
+		for i := 0; i < 2; i++ {
+			rs, err := client.Get(ts.URL + "/api/v1/query?query=up")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+
+			assert.Equal(t, http.StatusOK, rs.StatusCode)
+			refreshTokens = append(refreshTokens, refreshToken())
+		}
+
+		// Only the first request refreshes the session
+		assert.Equal(t, 1, app.sessionTokens.Len())
+		assert.Equal(t, refreshTokens[0], refreshTokens[1])
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		noRedirectClient := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		var sessionCookie *http.Cookie
+		for _, c := range jar.Cookies(mustParseURL(t, ts.URL)) {
+			if c.Name == app.SessionCookieName {
+				sessionCookie = c
+			}
+		}
+		if sessionCookie == nil {
+			t.Fatal("session cookie is missing")
+		}
+
+		// Logout cannot be triggered through GET requests
+		rs, err := noRedirectClient.Get(ts.URL + logoutPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, rs.StatusCode)
+
+		// Nor by other sites
+		req, err := http.NewRequest(http.MethodPost, ts.URL+logoutPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "https://evil.localhost")
+
+		rs, err = noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		assert.Equal(t, http.StatusForbidden, rs.StatusCode)
+
+		req, err = http.NewRequest(http.MethodPost, ts.URL+logoutPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", ts.URL)
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+
+		rs, err = noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusSeeOther, rs.StatusCode)
+		assert.Equal(t, idp.URL+"/protocol/openid-connect/logout", rs.Header.Get("Location"))
+
+		rs, err = noRedirectClient.Get(ts.URL + "/api/v1/query?query=up")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, rs.StatusCode)
+
+		// The session cookie cannot be reused after logout
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/v1/query?query=up", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: sessionCookie.Name, Value: sessionCookie.Value})
+
+		rs, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, rs.StatusCode)
+
+		// Neither can the refresh token, which has been revoked at the IdP
+		var session sessionData
+		assert.Nil(t, app.sessionCodec.decode(sessionCookie.Name, sessionCookie.Value, &session))
+
+		_, err = app.oauth2Config.TokenSource(context.Background(), &oauth2.Token{RefreshToken: session.RefreshToken}).Token()
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Callback with a wrong state", func(t *testing.T) {
+		rs, err := client.Get(ts.URL + callbackPath + "?code=random&state=random")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, rs.StatusCode)
+	})
+}
+
+// mustParseURL parses a URL or fails the test
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
@@ -0,0 +1,217 @@
+package lfgw
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Kinds of token sources
+const (
+	tokenSourceHeader = "header"
+	tokenSourceCookie = "cookie"
+	tokenSourceQuery  = "query"
+)
+
+// Token sources modes
+const (
+	// tokenSourcesModeFirstMatch makes lfgw use the token from the first source that has one.
+	tokenSourcesModeFirstMatch = "first-match"
+	// tokenSourcesModeRejectConflicting makes lfgw reject requests that carry several different tokens.
+	tokenSourcesModeRejectConflicting = "reject-conflicting"
+)
+
+// tokenSource describes a place in a request, from which an access token can be extracted.
+type tokenSource struct {
+	// Kind is one of header, cookie, query.
+	Kind string
+	// Name is the name of a header, cookie, or query parameter.
+	Name string
+	// Scheme is an optional authentication scheme expected in a header value (e.g. Bearer). The Basic scheme is special: the password is used as a token, and only if static API keys are configured.
+	Scheme string
+	// Trusted is false for sources that are easy to leak (e.g. query parameters end up in access logs and browser history). Static API keys are never accepted from untrusted sources.
+	Trusted bool
+}
+
+// defaultTokenSources reproduces the list of sources used when TOKEN_SOURCES is not set.
+var defaultTokenSources = []tokenSource{
+	{Kind: tokenSourceHeader, Name: "Authorization", Scheme: "Basic", Trusted: true},
+	{Kind: tokenSourceHeader, Name: "Authorization", Scheme: "Bearer", Trusted: true},
+	{Kind: tokenSourceHeader, Name: "Authorization", Scheme: "DPoP", Trusted: true},
+	{Kind: tokenSourceHeader, Name: "X-Forwarded-Access-Token", Trusted: true},
+	{Kind: tokenSourceHeader, Name: "X-Auth-Request-Access-Token", Trusted: true},
+}
+
+// parseTokenSource parses a token source definition in the form of <kind>:<name>[:scheme=<scheme>][:untrusted].
+func parseTokenSource(def string) (tokenSource, error) {
+	parts := strings.Split(strings.TrimSpace(def), ":")
+	if len(parts) < 2 || parts[1] == "" {
+		return tokenSource{}, fmt.Errorf("invalid token source %q, expected <kind>:<name>[:scheme=<scheme>][:untrusted]", def)
+	}
+
+	source := tokenSource{
+		Kind:    parts[0],
+		Name:    parts[1],
+		Trusted: true,
+	}
+
+	switch source.Kind {
+	case tokenSourceHeader, tokenSourceCookie, tokenSourceQuery:
+	default:
+		return tokenSource{}, fmt.Errorf("invalid token source %q, unknown kind %q (expected one of: %s, %s, %s)", def, source.Kind, tokenSourceHeader, tokenSourceCookie, tokenSourceQuery)
+	}
+
+	for _, option := range parts[2:] {
+		switch {
+		case option == "untrusted":
+			source.Trusted = false
+		case strings.HasPrefix(option, "scheme="):
+			if source.Kind != tokenSourceHeader {
+				return tokenSource{}, fmt.Errorf("invalid token source %q, scheme is supported only for headers", def)
+			}
+			source.Scheme = strings.TrimPrefix(option, "scheme=")
+		default:
+			return tokenSource{}, fmt.Errorf("invalid token source %q, unknown option %q", def, option)
+		}
+	}
+
+	return source, nil
+}
+
+// parseTokenSources parses a list of token source definitions.
+func parseTokenSources(defs []string) ([]tokenSource, error) {
+	sources := make([]tokenSource, 0, len(defs))
+
+	for _, def := range defs {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+
+		source, err := parseTokenSource(def)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// String returns the source in the same form as it's defined.
+func (source tokenSource) String() string {
+	s := source.Kind + ":" + source.Name
+	if source.Scheme != "" {
+		s += ":scheme=" + source.Scheme
+	}
+	if !source.Trusted {
+		s += ":untrusted"
+	}
+
+	return s
+}
+
+// extract returns a token from the request or an empty string if the source holds none.
+func (source tokenSource) extract(r *http.Request, allowBasicAuth bool) string {
+	switch source.Kind {
+	case tokenSourceHeader:
+		value := r.Header.Get(source.Name)
+		if source.Scheme == "" {
+			return strings.TrimSpace(value)
+		}
+
+		// Authentication schemes are case-insensitive (RFC 7235)
+		scheme, credentials, ok := strings.Cut(value, " ")
+		if !ok || !strings.EqualFold(scheme, source.Scheme) {
+			return ""
+		}
+
+		if strings.EqualFold(source.Scheme, "Basic") {
+			// API keys might also be supplied through basic auth (the password is used as the key)
+			if !allowBasicAuth {
+				return ""
+			}
+
+			r := &http.Request{Header: http.Header{"Authorization": {value}}}
+			_, password, ok := r.BasicAuth()
+			if !ok {
+				return ""
+			}
+
+			return password
+		}
+
+		return strings.TrimSpace(credentials)
+	case tokenSourceCookie:
+		cookie, err := r.Cookie(source.Name)
+		if err != nil {
+			return ""
+		}
+
+		return cookie.Value
+	case tokenSourceQuery:
+		return r.URL.Query().Get(source.Name)
+	}
+
+	return ""
+}
+
+// extractAccessToken returns a raw access token along with the source it was taken from. Depending on app.TokenSourcesMode, either the first found token is returned, or all sources are checked, and requests with several different tokens are rejected.
+func (app *application) extractAccessToken(r *http.Request) (string, tokenSource, error) {
+	sources := app.tokenSources
+	if sources == nil {
+		sources = defaultTokenSources
+	}
+
+	var token string
+	var tokenSrc tokenSource
+
+	for _, source := range sources {
+		t := source.extract(r, app.apiKeys != nil)
+		if t == "" {
+			continue
+		}
+
+		if app.TokenSourcesMode != tokenSourcesModeRejectConflicting {
+			return t, source, nil
+		}
+
+		if token == "" {
+			token = t
+			tokenSrc = source
+			continue
+		}
+
+		if t != token {
+			return "", tokenSource{}, fmt.Errorf("%w (%s, %s)", errConflictingTokens, tokenSrc, source)
+		}
+	}
+
+	if token != "" {
+		return token, tokenSrc, nil
+	}
+
+	isGrafanaRequest := strings.Contains(strings.ToLower(r.UserAgent()), "grafana")
+	if isGrafanaRequest {
+		return "", tokenSource{}, errNoTokenGrafana
+	}
+
+	return "", tokenSource{}, errNoToken
+}
+
+// stripQueryTokens removes tokens passed through query parameters, so that they are not forwarded to (and logged by) the upstream.
+func (app *application) stripQueryTokens(r *http.Request) {
+	query := r.URL.Query()
+	modified := false
+
+	for _, source := range app.tokenSources {
+		if source.Kind == tokenSourceQuery && query.Has(source.Name) {
+			query.Del(source.Name)
+			modified = true
+		}
+	}
+
+	if modified {
+		r.URL.RawQuery = query.Encode()
+	}
+}
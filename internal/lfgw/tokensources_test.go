@@ -0,0 +1,245 @@
+package lfgw
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseTokenSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     string
+		want    tokenSource
+		wantErr bool
+	}{
+		{
+			name: "Header with scheme",
+			def:  "header:Authorization:scheme=Bearer",
+			want: tokenSource{Kind: tokenSourceHeader, Name: "Authorization", Scheme: "Bearer", Trusted: true},
+		},
+		{
+			name: "Header without scheme",
+			def:  "header:X-Forwarded-Access-Token",
+			want: tokenSource{Kind: tokenSourceHeader, Name: "X-Forwarded-Access-Token", Trusted: true},
+		},
+		{
+			name: "Untrusted cookie",
+			def:  "cookie:access_token:untrusted",
+			want: tokenSource{Kind: tokenSourceCookie, Name: "access_token", Trusted: false},
+		},
+		{
+			name: "Untrusted query parameter",
+			def:  " query:access_token:untrusted ",
+			want: tokenSource{Kind: tokenSourceQuery, Name: "access_token", Trusted: false},
+		},
+		{
+			name:    "Unknown kind",
+			def:     "body:token",
+			wantErr: true,
+		},
+		{
+			name:    "No name",
+			def:     "header:",
+			wantErr: true,
+		},
+		{
+			name:    "Scheme for a cookie",
+			def:     "cookie:token:scheme=Bearer",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown option",
+			def:     "header:Authorization:trusted",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTokenSource(tt.def)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			// Definitions survive a round trip
+			assert.Equal(t, tt.want, mustParseTokenSource(t, got.String()))
+		})
+	}
+}
+
+func TestApp_extractAccessToken(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	sources, err := parseTokenSources([]string{
+		"header:Authorization:scheme=Bearer",
+		"header:X-Token",
+		"cookie:access_token:untrusted",
+		"query:access_token:untrusted",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		prepare    func(r *http.Request)
+		want       string
+		wantSource string
+		wantErr    error
+	}{
+		{
+			name: "Scheme is case-insensitive",
+			mode: tokenSourcesModeFirstMatch,
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "bearer FAKE_TOKEN")
+			},
+			want:       "FAKE_TOKEN",
+			wantSource: "header:Authorization:scheme=Bearer",
+		},
+		{
+			name: "Wrong scheme",
+			mode: tokenSourcesModeFirstMatch,
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Token FAKE_TOKEN")
+			},
+			wantErr: errNoToken,
+		},
+		{
+			name: "Cookie",
+			mode: tokenSourcesModeFirstMatch,
+			prepare: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: "FAKE_TOKEN"})
+			},
+			want:       "FAKE_TOKEN",
+			wantSource: "cookie:access_token:untrusted",
+		},
+		{
+			name: "Query parameter",
+			mode: tokenSourcesModeFirstMatch,
+			prepare: func(r *http.Request) {
+				r.URL.RawQuery = "query=up&access_token=FAKE_TOKEN"
+			},
+			want:       "FAKE_TOKEN",
+			wantSource: "query:access_token:untrusted",
+		},
+		{
+			name: "First match wins",
+			mode: tokenSourcesModeFirstMatch,
+			prepare: func(r *http.Request) {
+				r.Header.Set("X-Token", "FAKE_TOKEN2")
+				r.URL.RawQuery = "access_token=FAKE_TOKEN3"
+				r.Header.Set("Authorization", "Bearer FAKE_TOKEN")
+			},
+			want:       "FAKE_TOKEN",
+			wantSource: "header:Authorization:scheme=Bearer",
+		},
+		{
+			name: "Reject conflicting: same tokens",
+			mode: tokenSourcesModeRejectConflicting,
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer FAKE_TOKEN")
+				r.Header.Set("X-Token", "FAKE_TOKEN")
+			},
+			want:       "FAKE_TOKEN",
+			wantSource: "header:Authorization:scheme=Bearer",
+		},
+		{
+			name: "Reject conflicting: different tokens",
+			mode: tokenSourcesModeRejectConflicting,
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer FAKE_TOKEN")
+				r.URL.RawQuery = "access_token=FAKE_TOKEN2"
+			},
+			wantErr: errConflictingTokens,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				TokenSourcesMode: tt.mode,
+				tokenSources:     sources,
+				logger:           &logger,
+			}
+
+			r, err := http.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.prepare(r)
+
+			got, source, err := app.extractAccessToken(r)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.wantSource, source.String())
+			}
+		})
+	}
+
+	t.Run("Query tokens are not forwarded", func(t *testing.T) {
+		app := &application{
+			tokenSources: sources,
+			logger:       &logger,
+		}
+
+		r, err := http.NewRequest(http.MethodGet, "/api/v1/query?query=up&access_token=FAKE_TOKEN", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app.stripQueryTokens(r)
+		assert.Equal(t, "query=up", r.URL.RawQuery)
+	})
+}
+
+func TestApp_configureTokenSources(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	t.Run("Defaults", func(t *testing.T) {
+		app := &application{
+			logger: &logger,
+		}
+
+		assert.Nil(t, app.configureTokenSources())
+		assert.Equal(t, defaultTokenSources, app.tokenSources)
+		assert.Equal(t, tokenSourcesModeFirstMatch, app.TokenSourcesMode)
+	})
+
+	t.Run("Unknown mode", func(t *testing.T) {
+		app := &application{
+			TokenSourcesMode: "random",
+			logger:           &logger,
+		}
+
+		assert.NotNil(t, app.configureTokenSources())
+	})
+
+	t.Run("Invalid source", func(t *testing.T) {
+		app := &application{
+			TokenSources: []string{"random"},
+			logger:       &logger,
+		}
+
+		assert.NotNil(t, app.configureTokenSources())
+	})
+}
+
+// mustParseTokenSource parses a token source definition or fails the test
+func mustParseTokenSource(t *testing.T, def string) tokenSource {
+	t.Helper()
+
+	source, err := parseTokenSource(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return source
+}
@@ -0,0 +1,147 @@
+package lfgw
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const contextKeyIdentity = contextKey("identity")
+
+// parseCIDRs parses a list of CIDRs (plain IP addresses are treated as single-host networks).
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", cidr)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// remoteAddrInNets returns true if the address (host:port) of a remote peer belongs to any of the networks.
+func remoteAddrInNets(remoteAddr string, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTrustedHeadersSource returns true if identity headers of the request can be trusted, i.e. it comes from one of the trusted networks or carries the shared secret.
+func (app *application) isTrustedHeadersSource(r *http.Request) bool {
+	if remoteAddrInNets(r.RemoteAddr, app.trustedHeadersNets) {
+		return true
+	}
+
+	if app.TrustedHeadersSecretHeader != "" && app.TrustedHeadersSecret != "" {
+		secret := r.Header.Get(app.TrustedHeadersSecretHeader)
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(app.TrustedHeadersSecret)) == 1
+	}
+
+	return false
+}
+
+// parseGroupsHeader splits a comma-separated list of groups into roles.
+func parseGroupsHeader(value string) []string {
+	var roles []string
+
+	for _, group := range strings.Split(value, ",") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			roles = append(roles, group)
+		}
+	}
+
+	return roles
+}
+
+// trustedHeadersMiddleware takes the identity of a caller from headers set by an authenticating proxy (e.g. oauth2-proxy). The headers are considered only for requests coming from trusted sources, for all others they are stripped.
+func (app *application) trustedHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.TrustedHeadersAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identityHeaders := []string{app.TrustedHeadersUserHeader, app.TrustedHeadersEmailHeader, app.TrustedHeadersGroupsHeader}
+		trusted := app.isTrustedHeadersSource(r)
+
+		// The secret should never reach the upstream
+		if app.TrustedHeadersSecretHeader != "" {
+			r.Header.Del(app.TrustedHeadersSecretHeader)
+		}
+
+		if !trusted {
+			for _, h := range identityHeaders {
+				if r.Header.Get(h) != "" {
+					hlog.FromRequest(r).Warn().Caller().
+						Msgf("Stripped %s header received from an untrusted source (%s)", h, r.RemoteAddr)
+					r.Header.Del(h)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := r.Header.Get(app.TrustedHeadersUserHeader)
+		email := r.Header.Get(app.TrustedHeadersEmailHeader)
+		if user == "" && email == "" {
+			// Nothing to trust, the request will go through the other authentication methods
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := identity{
+			userClaims: userClaims{
+				Roles: parseGroupsHeader(r.Header.Get(app.TrustedHeadersGroupsHeader)),
+				Email: email,
+			},
+			user: user,
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyIdentity, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,185 @@
+package lfgw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/weisdd/lfgw/internal/querymodifier"
+)
+
+func Test_parseCIDRs(t *testing.T) {
+	t.Run("Valid CIDRs and IPs", func(t *testing.T) {
+		nets, err := parseCIDRs([]string{"10.0.0.0/8", " 192.168.0.1 ", "", "::1"})
+		assert.Nil(t, err)
+		assert.Len(t, nets, 3)
+
+		assert.True(t, remoteAddrInNets("10.1.2.3:5555", nets))
+		assert.True(t, remoteAddrInNets("192.168.0.1:5555", nets))
+		assert.True(t, remoteAddrInNets("[::1]:5555", nets))
+		assert.False(t, remoteAddrInNets("192.168.0.2:5555", nets))
+		assert.False(t, remoteAddrInNets("invalid", nets))
+	})
+
+	t.Run("Invalid CIDR", func(t *testing.T) {
+		_, err := parseCIDRs([]string{"10.0.0.0/33"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Invalid IP", func(t *testing.T) {
+		_, err := parseCIDRs([]string{"10.0.0"})
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_parseGroupsHeader(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, parseGroupsHeader("a, ,b"))
+	assert.Nil(t, parseGroupsHeader(""))
+}
+
+func Test_trustedHeadersMiddleware(t *testing.T) {
+	logger := zerolog.New(nil)
+
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclEditor, err := querymodifier.NewACL("metrics:\n  namespace: 'monitoring'\n")
+	assert.Nil(t, err)
+
+	app := application{
+		logger:                     &logger,
+		ACLs:                       querymodifier.ACLs{"grafana-editor": aclEditor},
+		TrustedHeadersAuth:         true,
+		TrustedHeadersSecretHeader: "X-Proxy-Secret",
+		TrustedHeadersSecret:       "secret",
+		TrustedHeadersUserHeader:   "X-Auth-Request-User",
+		TrustedHeadersEmailHeader:  "X-Auth-Request-Email",
+		TrustedHeadersGroupsHeader: "X-Auth-Request-Groups",
+		trustedHeadersNets:         nets,
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		secret       string
+		wantIdentity bool
+	}{
+		{
+			name:         "trusted network",
+			remoteAddr:   "10.1.2.3:5555",
+			wantIdentity: true,
+		},
+		{
+			name:         "shared secret",
+			remoteAddr:   "192.168.0.1:5555",
+			secret:       "secret",
+			wantIdentity: true,
+		},
+		{
+			name:         "untrusted source",
+			remoteAddr:   "192.168.0.1:5555",
+			wantIdentity: false,
+		},
+		{
+			name:         "untrusted source, incorrect secret",
+			remoteAddr:   "192.168.0.1:5555",
+			secret:       "random",
+			wantIdentity: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Auth-Request-User", "john")
+			r.Header.Set("X-Auth-Request-Email", "john@localhost")
+			r.Header.Set("X-Auth-Request-Groups", "grafana-editor,random")
+			if tt.secret != "" {
+				r.Header.Set("X-Proxy-Secret", tt.secret)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Empty(t, r.Header.Get("X-Proxy-Secret"), "the secret must never be forwarded")
+
+				id, ok := r.Context().Value(contextKeyIdentity).(identity)
+				assert.Equal(t, tt.wantIdentity, ok)
+
+				if tt.wantIdentity {
+					assert.Equal(t, "john", id.user)
+					assert.Equal(t, "john@localhost", id.Email)
+					assert.Equal(t, []string{"grafana-editor", "random"}, id.Roles)
+				} else {
+					for _, h := range []string{"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Groups"} {
+						assert.Empty(t, r.Header.Get(h), "%s must be stripped", h)
+					}
+				}
+
+				_, _ = w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.trustedHeadersMiddleware(next).ServeHTTP(rr, r)
+			rs := rr.Result()
+			defer rs.Body.Close()
+
+			assert.Equal(t, http.StatusOK, rs.StatusCode)
+		})
+	}
+
+	t.Run("Identity from trusted headers is used by oidcMiddleware", func(t *testing.T) {
+		// Verifier is only checked for presence, the token path is never reached
+		appHelper := app
+		appHelper.verifier = testDummyVerifier(t)
+
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "10.1.2.3:5555"
+		r.Header.Set("X-Auth-Request-Email", "john@localhost")
+		r.Header.Set("X-Auth-Request-Groups", "grafana-editor")
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acl, ok := r.Context().Value(contextKeyACL).(querymodifier.ACL)
+			assert.True(t, ok, errACLNotSetInContext)
+			assert.Equal(t, aclEditor, acl)
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		appHelper.trustedHeadersMiddleware(appHelper.oidcMiddleware(next)).ServeHTTP(rr, r)
+		rs := rr.Result()
+		defer rs.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		app := application{logger: &logger}
+
+		r, err := http.NewRequest(http.MethodGet, "http://lfgw/api/v1/query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Auth-Request-User", "john")
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := r.Context().Value(contextKeyIdentity).(identity)
+			assert.False(t, ok)
+			_, _ = w.Write([]byte("OK"))
+		})
+
+		rr := httptest.NewRecorder()
+		app.trustedHeadersMiddleware(next).ServeHTTP(rr, r)
+		rs := rr.Result()
+		defer rs.Body.Close()
+	})
+}
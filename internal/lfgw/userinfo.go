@@ -0,0 +1,94 @@
+package lfgw
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	oidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// userInfoFetcher retrieves claims from the OIDC userinfo endpoint for tokens that do not carry roles themselves.
+type userInfoFetcher struct {
+	provider *oidc.Provider
+	cacheTTL time.Duration
+	cache    *ttlCache[userClaims]
+}
+
+// userInfoMaxCachedTokens limits the number of tokens, for which userinfo claims are cached.
+const userInfoMaxCachedTokens = 10000
+
+// newUserInfoFetcher returns a userInfoFetcher that caches results for cacheTTL (never longer than the token lifetime).
+func newUserInfoFetcher(provider *oidc.Provider, cacheTTL time.Duration) *userInfoFetcher {
+	return &userInfoFetcher{
+		provider: provider,
+		cacheTTL: cacheTTL,
+		cache:    newTTLCache[userClaims](userInfoMaxCachedTokens),
+	}
+}
+
+// Fetch returns claims exposed by the userinfo endpoint for the given access token. The claims are only accepted if they belong to subject, the subject of the token (OIDC Core 5.3.2), so a response for a different user cannot be merged into the token.
+func (uf *userInfoFetcher) Fetch(ctx context.Context, rawAccessToken, subject string, expiry time.Time) (userClaims, error) {
+	key := tokenCacheKey(rawAccessToken)
+
+	if claims, ok := uf.cache.Get(key); ok {
+		return claims, nil
+	}
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: rawAccessToken,
+		TokenType:   "Bearer",
+	})
+
+	userInfo, err := uf.provider.UserInfo(ctx, tokenSource)
+	if err != nil {
+		return userClaims{}, fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+
+	if subject == "" || userInfo.Subject != subject {
+		return userClaims{}, fmt.Errorf("%w (token: %q, userinfo: %q)", errUserInfoSubject, subject, userInfo.Subject)
+	}
+
+	var claims userClaims
+	if err := userInfo.Claims(&claims); err != nil {
+		return userClaims{}, fmt.Errorf("failed to decode userinfo claims: %w", err)
+	}
+
+	if err := userInfo.Claims(&claims.Claims); err != nil {
+		return userClaims{}, fmt.Errorf("failed to decode userinfo claims: %w", err)
+	}
+
+	ttl := uf.cacheTTL
+	if !expiry.IsZero() {
+		if untilExpiry := time.Until(expiry); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	uf.cache.Set(key, claims, ttl)
+
+	return claims, nil
+}
+
+// mergeUserClaims fills in the fields missing in claims with the values from extra. Values present in the token always take precedence.
+func mergeUserClaims(claims, extra userClaims) userClaims {
+	if len(claims.Roles) == 0 {
+		claims.Roles = extra.Roles
+	}
+
+	if claims.Email == "" {
+		claims.Email = extra.Email
+	}
+
+	for name, value := range extra.Claims {
+		if _, ok := claims.Claims[name]; ok {
+			continue
+		}
+		if claims.Claims == nil {
+			claims.Claims = make(map[string]interface{})
+		}
+		claims.Claims[name] = value
+	}
+
+	return claims
+}
@@ -0,0 +1,91 @@
+package lfgw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_userInfoFetcher_Fetch(t *testing.T) {
+	// Prepare a test server with mocked IDP
+	ts := oidcIDPServer(t)
+	defer ts.Close()
+
+	app := application{
+		OIDCRealmURL: ts.URL,
+		OIDCClientID: "grafana",
+	}
+
+	if err := app.configureOIDCVerifier(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	uf := newUserInfoFetcher(app.provider, time.Minute)
+
+	want := userClaims{
+		Roles: []string{"grafana-editor"},
+		Email: "userinfo@localhost",
+		Claims: map[string]interface{}{
+			"sub":   "user",
+			"email": "userinfo@localhost",
+			"roles": []interface{}{"grafana-editor"},
+		},
+	}
+
+	got, err := uf.Fetch(ctx, "token", "user", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, want, got)
+	assert.Equal(t, 1, uf.cache.Len())
+
+	// Expired tokens are not cached
+	_, err = uf.Fetch(ctx, "expired-token", "user", time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, uf.cache.Len())
+
+	// Claims of a different user (or of a token without a subject) are not accepted and not cached
+	for _, subject := range []string{"another-user", ""} {
+		_, err = uf.Fetch(ctx, "another-token", subject, time.Now().Add(time.Hour))
+		assert.ErrorIs(t, err, errUserInfoSubject)
+	}
+	assert.Equal(t, 1, uf.cache.Len())
+}
+
+func Test_mergeUserClaims(t *testing.T) {
+	extra := userClaims{
+		Roles: []string{"userinfo-role"},
+		Email: "userinfo@localhost",
+	}
+
+	t.Run("Missing fields are filled in", func(t *testing.T) {
+		got := mergeUserClaims(userClaims{}, extra)
+		assert.Equal(t, extra, got)
+	})
+
+	t.Run("Token values take precedence", func(t *testing.T) {
+		claims := userClaims{
+			Roles: []string{"token-role"},
+			Email: "token@localhost",
+		}
+
+		got := mergeUserClaims(claims, extra)
+		assert.Equal(t, claims, got)
+	})
+
+	t.Run("Claims are merged", func(t *testing.T) {
+		claims := userClaims{
+			Claims: map[string]interface{}{"team": "token-team"},
+		}
+
+		extra := userClaims{
+			Claims: map[string]interface{}{"team": "userinfo-team", "org_id": "1"},
+		}
+
+		got := mergeUserClaims(claims, extra)
+		assert.Equal(t, map[string]interface{}{"team": "token-team", "org_id": "1"}, got.Claims)
+	})
+}
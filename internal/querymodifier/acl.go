@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/VictoriaMetrics/metricsql"
 	"gopkg.in/yaml.v3"
@@ -23,12 +25,40 @@ type ACL struct {
 	Metrics     map[string]metricsql.LabelFilter `json:"metrics"`
 	MetricsMeta map[string]LabelFilterData
 	// RawACL      string
+	// Rules holds tuples of label filters, a series is visible if it matches any of them. An ACL consists either of metrics or of rules.
+	Rules []Rule
+	// Templates holds definitions referencing token claims, those are turned into label filters by Render.
+	Templates map[string]*template.Template
+	// Validity limits the period, during which the role is applied.
+	Validity
+	// Grants holds time-limited definitions, which are merged into the ACL while they're valid.
+	Grants []Grant
+	// TimeLimits restricts the time range of requests.
+	TimeLimits TimeLimits
+	// QueryLimits restricts the complexity of queries.
+	QueryLimits QueryLimits
+	// Functions restricts functions and aggregations available in queries.
+	Functions FunctionPolicy
+	// RequiredLabels must be present as a positive matcher in every series selector.
+	RequiredLabels RequiredLabels
+	// Aggregation restricts queries to aggregated data.
+	Aggregation AggregationPolicy
+	// ExemptMetrics lists metrics, which are exempt from the ACL or get different filters instead.
+	ExemptMetrics MetricExemptions
 }
 
 // NewACL returns an ACL based on a YAML definition
 func NewACL(rawACL string) (ACL, error) {
 	var aclDef struct {
-		Metrics map[string]string `yaml:"metrics"`
+		Metrics        map[string]string   `yaml:"metrics"`
+		Rules          []map[string]string `yaml:"rules"`
+		MaxLookback    limitDuration       `yaml:"max_lookback"`
+		MaxRange       limitDuration       `yaml:"max_range"`
+		QueryLimits    `yaml:",inline"`
+		Functions      FunctionPolicy    `yaml:"functions"`
+		RequiredLabels RequiredLabels    `yaml:"required_labels"`
+		Aggregation    AggregationPolicy `yaml:"aggregation_only"`
+		ExemptMetrics  MetricExemptions  `yaml:"exempt_metrics"`
 	}
 
 	err := yaml.Unmarshal([]byte(rawACL), &aclDef)
@@ -36,78 +66,142 @@ func NewACL(rawACL string) (ACL, error) {
 		return ACL{}, fmt.Errorf("failed to unmarshal ACL: %w", err)
 	}
 
+	if err := aclDef.QueryLimits.Validate(); err != nil {
+		return ACL{}, err
+	}
+
+	functions, err := aclDef.Functions.normalize()
+	if err != nil {
+		return ACL{}, err
+	}
+
+	aggregation, err := aclDef.Aggregation.normalize()
+	if err != nil {
+		return ACL{}, err
+	}
+
+	if len(aclDef.Metrics) > 0 && len(aclDef.Rules) > 0 {
+		return ACL{}, errMetricsAndRules
+	}
+
+	rules, err := newRules(aclDef.Rules)
+	if err != nil {
+		return ACL{}, err
+	}
+
+	acl, err := newACLFromDefinitions(aclDef.Metrics)
+	if err != nil {
+		return ACL{}, err
+	}
+
+	acl.Rules = rules
+	acl.TimeLimits = TimeLimits{
+		MaxLookback: time.Duration(aclDef.MaxLookback),
+		MaxRange:    time.Duration(aclDef.MaxRange),
+	}
+	acl.QueryLimits = aclDef.QueryLimits
+	acl.Functions = functions
+	acl.RequiredLabels = aclDef.RequiredLabels
+	acl.Aggregation = aggregation
+	acl.ExemptMetrics = aclDef.ExemptMetrics
+
+	return acl, nil
+}
+
+// newACLFromDefinitions returns an ACL based on definitions of label values (e.g. namespace: "minio, kube.*").
+func newACLFromDefinitions(defs map[string]string) (ACL, error) {
 	acl := ACL{
 		Metrics:     make(map[string]metricsql.LabelFilter),
 		MetricsMeta: make(map[string]LabelFilterData),
 	}
 
-	for label, value := range aclDef.Metrics {
-		buffer, err := toSlice(value)
-		lf := metricsql.LabelFilter{
-			Label:      label,
-			Value:      value,
-			IsRegexp:   strings.ContainsAny(value, RegexpSymbols),
-			IsNegative: false,
+	for label, value := range defs {
+		if isClaimTemplate(value) {
+			tmpl, err := newClaimTemplate(label, value)
+			if err != nil {
+				return ACL{}, err
+			}
+			if acl.Templates == nil {
+				acl.Templates = make(map[string]*template.Template)
+			}
+			acl.Templates[label] = tmpl
+			continue
 		}
 
+		lf, metadata, err := newLabelFilter(label, value)
 		if err != nil {
 			return ACL{}, err
 		}
-		fullaccess := false
-		// If .* is in the slice, then we can omit any other value
-		for _, v := range buffer {
-			// TODO: move to a helper?
-			if v == ".*" {
-				// Note: with this approach, we intentionally omit other values in the resulting ACL
-				lf.Value = v
-				fullaccess = true
-			}
-		}
-		if fullaccess {
-			acl.Metrics[label] = lf
-			acl.MetricsMeta[label] = LabelFilterData{
-				Fullaccess: isFullAccess(lf),
-				RawACL:     lf.Value,
-			}
-			continue
+		acl.Metrics[label] = lf
+		acl.MetricsMeta[label] = metadata
+	}
+
+	return acl, nil
+}
+
+// newLabelFilter returns a label filter along with its metadata based on an ACL definition for a single label (e.g. "minio, kube.*").
+func newLabelFilter(label, value string) (metricsql.LabelFilter, LabelFilterData, error) {
+	buffer, err := toSlice(value)
+	lf := metricsql.LabelFilter{
+		Label:      label,
+		Value:      value,
+		IsRegexp:   strings.ContainsAny(value, RegexpSymbols),
+		IsNegative: false,
+	}
+
+	if err != nil {
+		return metricsql.LabelFilter{}, LabelFilterData{}, err
+	}
+	fullaccess := false
+	// If .* is in the slice, then we can omit any other value
+	for _, v := range buffer {
+		// TODO: move to a helper?
+		if v == ".*" {
+			// Note: with this approach, we intentionally omit other values in the resulting ACL
+			lf.Value = v
+			fullaccess = true
 		}
-		if len(buffer) == 1 {
-			// TODO: move to a helper?
-			if strings.ContainsAny(buffer[0], RegexpSymbols) {
-				lf.IsRegexp = true
-				// Trim anchors as they're not needed for Prometheus, and not expected in the app.shouldBeModified function
-				buffer[0] = strings.TrimLeft(buffer[0], "^")
-				buffer[0] = strings.TrimLeft(buffer[0], "(")
-				buffer[0] = strings.TrimRight(buffer[0], "$")
-				buffer[0] = strings.TrimRight(buffer[0], ")")
-			}
-			lf.Value = buffer[0]
-		} else {
-			// "Regex matches are fully anchored. A match of env=~"foo" is treated as env=~"^foo$"." https://prometheus.io/docs/prometheus/latest/querying/basics/
-			lf.Value = strings.Join(buffer, "|")
+	}
+	if fullaccess {
+		return lf, LabelFilterData{
+			Fullaccess: isFullAccess(lf),
+			RawACL:     lf.Value,
+		}, nil
+	}
+	if len(buffer) == 1 {
+		// TODO: move to a helper?
+		if strings.ContainsAny(buffer[0], RegexpSymbols) {
 			lf.IsRegexp = true
+			// Trim anchors as they're not needed for Prometheus, and not expected in the app.shouldBeModified function
+			buffer[0] = strings.TrimLeft(buffer[0], "^")
+			buffer[0] = strings.TrimLeft(buffer[0], "(")
+			buffer[0] = strings.TrimRight(buffer[0], "$")
+			buffer[0] = strings.TrimRight(buffer[0], ")")
 		}
+		lf.Value = buffer[0]
+	} else {
+		// "Regex matches are fully anchored. A match of env=~"foo" is treated as env=~"^foo$"." https://prometheus.io/docs/prometheus/latest/querying/basics/
+		lf.Value = strings.Join(buffer, "|")
+		lf.IsRegexp = true
+	}
 
-		if lf.IsRegexp {
-			// Trim anchors as they're not needed for Prometheus
-			lf.Value = strings.TrimPrefix(lf.Value, "^")
-			lf.Value = strings.TrimPrefix(lf.Value, "(")
-			lf.Value = strings.TrimSuffix(lf.Value, "$")
-			lf.Value = strings.TrimSuffix(lf.Value, ")")
+	if lf.IsRegexp {
+		// Trim anchors as they're not needed for Prometheus
+		lf.Value = strings.TrimPrefix(lf.Value, "^")
+		lf.Value = strings.TrimPrefix(lf.Value, "(")
+		lf.Value = strings.TrimSuffix(lf.Value, "$")
+		lf.Value = strings.TrimSuffix(lf.Value, ")")
 
-			_, err := regexp.Compile(lf.Value)
-			if err != nil {
-				return ACL{}, fmt.Errorf("invalid regex for label %s: %w", label, err)
-			}
-		}
-		acl.Metrics[label] = lf
-		acl.MetricsMeta[label] = LabelFilterData{
-			Fullaccess: isFullAccess(lf),
-			RawACL:     strings.Join(buffer, ","),
+		_, err := regexp.Compile(lf.Value)
+		if err != nil {
+			return metricsql.LabelFilter{}, LabelFilterData{}, fmt.Errorf("invalid regex for label %s: %w", label, err)
 		}
 	}
 
-	return acl, nil
+	return lf, LabelFilterData{
+		Fullaccess: isFullAccess(lf),
+		RawACL:     strings.Join(buffer, ","),
+	}, nil
 }
 
 // isFullAccess checks if the ACL grants full access
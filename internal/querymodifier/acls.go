@@ -4,34 +4,51 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/VictoriaMetrics/metricsql"
-	"gopkg.in/yaml.v3"
 )
 
 // ACLs stores a parsed YAML with role definitions
 type ACLs map[string]ACL
 
-// rolesToRawACL returns a comma-separated list of ACL definitions for all specified roles. Basically, it lets you dynamically generate a raw ACL as if it was supplied through acl.yaml. To support Assumed Roles, unknown roles are treated as ACL definitions.
-func (a ACLs) rolesToRawACL(roles []string, label string, assumedRolesEnabled bool) (string, error) {
+// rolesToRawACL returns a comma-separated list of ACL definitions for all specified roles. Basically, it lets you dynamically generate a raw ACL as if it was supplied through acl.yaml. To support Assumed Roles, unknown roles are looked up in assumedACLs. Definitions from extra ACLs are appended at the end.
+func (a ACLs) rolesToRawACL(roles []string, label string, assumedACLs map[string]ACL, extra []ACL) (string, error) {
 	rawACLs := make([]string, 0, len(roles))
 
 	// FIXME: implement this code for multiple labels per ACL
 	for _, role := range roles {
 		acl, exists := a[role]
-		if exists {
-			// NOTE: You should never see an empty definitions in .RawACL as those should be removed by toSlice further down the process. The error check below is not necessary, is left as an additional safeguard for now and might get removed in the future.
-			if acl.MetricsMeta[label].RawACL == "" {
-				return "", fmt.Errorf("%s role contains empty rawACL", role)
-			}
-			if acl.MetricsMeta[label].RawACL == ".*" {
-				return ".*", nil
-			}
-			rawACLs = append(rawACLs, acl.MetricsMeta[label].RawACL)
-		} else if assumedRolesEnabled {
-			// NOTE: Role names are not linted, so they may contain regular expressions, including the admin definition: .*
-			rawACLs = append(rawACLs, role)
+		if !exists {
+			acl, exists = assumedACLs[role]
+		}
+		if !exists {
+			continue
+		}
+
+		// Roles consisting of time-limited grants only don't have own definitions, the grants are passed as extra ACLs. Roles consisting of rules are dropped, if they're combined with a role granting full access
+		if len(acl.Metrics) == 0 && (len(acl.Grants) > 0 || len(acl.Rules) > 0) {
+			continue
+		}
+
+		// NOTE: You should never see an empty definitions in .RawACL as those should be removed by toSlice further down the process. The error check below is not necessary, is left as an additional safeguard for now and might get removed in the future.
+		if acl.MetricsMeta[label].RawACL == "" {
+			return "", fmt.Errorf("%s role contains empty rawACL", role)
+		}
+		if acl.MetricsMeta[label].RawACL == ".*" {
+			return ".*", nil
 		}
+		rawACLs = append(rawACLs, acl.MetricsMeta[label].RawACL)
+	}
+
+	for _, acl := range extra {
+		if acl.MetricsMeta[label].RawACL == "" {
+			return "", fmt.Errorf("extra ACL contains empty rawACL")
+		}
+		if acl.MetricsMeta[label].RawACL == ".*" {
+			return ".*", nil
+		}
+		rawACLs = append(rawACLs, acl.MetricsMeta[label].RawACL)
 	}
 
 	rawACL := strings.Join(rawACLs, ", ")
@@ -42,7 +59,7 @@ func (a ACLs) rolesToRawACL(roles []string, label string, assumedRolesEnabled bo
 	return rawACL, nil
 }
 
-// NewACLsFromFile loads ACL from a file or returns an empty ACLs instance if path is empty
+// NewACLsFromFile loads ACL from a file or returns an empty ACLs instance if path is empty. Role inheritance and references to sets are flattened, so the resulting ACLs look as if all definitions were written out by hand.
 func NewACLsFromFile(path string) (ACLs, error) {
 	acls := make(ACLs)
 
@@ -56,23 +73,41 @@ func NewACLsFromFile(path string) (ACLs, error) {
 		return ACLs{}, err
 	}
 
-	var aclYaml map[string]map[string]map[string]string
-
-	err = yaml.Unmarshal(yamlFile, &aclYaml)
+	defs, err := parseACLFile(yamlFile)
 	if err != nil {
 		return ACLs{}, err
 	}
 
-	for role, roleData := range aclYaml {
-		rawACL, err := yaml.Marshal(roleData)
+	for role, def := range defs {
+		acl, err := newACLFromDefinitions(def.Metrics)
 		if err != nil {
-			return ACLs{}, fmt.Errorf("failed to marshal role data for %s: %w", role, err)
+			return ACLs{}, fmt.Errorf("failed to create ACL for role %s: %w", role, err)
 		}
-
-		acl, err := NewACL(string(rawACL))
+		acl.Rules, err = newRules(def.Rules)
 		if err != nil {
 			return ACLs{}, fmt.Errorf("failed to create ACL for role %s: %w", role, err)
 		}
+		acl.Validity = def.Validity
+		acl.TimeLimits = def.timeLimits()
+		acl.QueryLimits = def.QueryLimits
+		acl.Functions = def.Functions
+		acl.RequiredLabels = def.RequiredLabels
+		acl.Aggregation = def.Aggregation
+		acl.ExemptMetrics = def.ExemptMetrics
+
+		for i, grant := range def.Grants {
+			grantACL, err := newACLFromDefinitions(grant.Metrics)
+			if err != nil {
+				return ACLs{}, fmt.Errorf("failed to create ACL for role %s, grant #%d: %w", role, i, err)
+			}
+
+			// Grants are merged after templates are rendered, so they have to be static
+			if len(grantACL.Templates) > 0 {
+				return ACLs{}, fmt.Errorf("failed to create ACL for role %s, grant #%d: time-limited grants cannot reference token claims", role, i)
+			}
+
+			acl.Grants = append(acl.Grants, Grant{Validity: grant.Validity, ACL: grantACL})
+		}
 
 		acls[role] = acl
 	}
@@ -83,41 +118,96 @@ func NewACLsFromFile(path string) (ACLs, error) {
 // GetUserACL takes a list of roles found in an OIDC claim and constructs an ACL based on them.
 // If assumed roles are disabled, then only known roles (present in app.ACLs) are considered.
 func (a ACLs) GetUserACL(oidcRoles []string, assumedRolesEnabled bool) (ACL, error) {
+	var assumedRoles AssumedRolesTemplate
+	if assumedRolesEnabled {
+		assumedRoles = DefaultAssumedRolesTemplate
+	}
+
+	return a.GetUserACLWithExtra(oidcRoles, assumedRoles)
+}
+
+// GetUserACLWithExtra works the same way as GetUserACL, though ACLs for unknown roles are constructed through the supplied template (assumed roles are disabled if the template is nil), and ACLs that don't come from roles (e.g. derived from token claims) are merged in as well, exactly as assumed roles are.
+func (a ACLs) GetUserACLWithExtra(oidcRoles []string, assumedRoles AssumedRolesTemplate, extra ...ACL) (ACL, error) {
+	return a.getUserACLAt(time.Now(), oidcRoles, assumedRoles, extra...)
+}
+
+// getUserACLAt constructs a user ACL with time-limited roles and grants evaluated at the given moment. Roles outside of their validity period are ignored, active grants are merged in as extra ACLs.
+func (a ACLs) getUserACLAt(now time.Time, oidcRoles []string, assumedRoles AssumedRolesTemplate, extra ...ACL) (ACL, error) {
+	oidcRoles, grants := a.activeRoles(oidcRoles, now)
+	if len(grants) > 0 {
+		extra = append(grants, extra...)
+	}
+
 	var combinedACL ACL
 	combinedACL.Metrics = make(map[string]metricsql.LabelFilter)
 	combinedACL.MetricsMeta = make(map[string]LabelFilterData)
 
+	assumedACLs := make(map[string]ACL)
+	// sources keeps ACLs of all roles apart, since they have to be turned into separate rules if any of them defines rules
+	var sources []ACL
+
 	for _, role := range oidcRoles {
 		acl, exists := a[role]
-		if exists {
-			for label, lf := range acl.Metrics {
-				if existingLF, ok := combinedACL.Metrics[label]; ok {
-					combinedACL.Metrics[label] = mergeLabelFilters(existingLF, lf)
-				} else {
-					combinedACL.Metrics[label] = lf
-				}
+		if !exists {
+			if assumedRoles == nil {
+				continue
 			}
-		} else if assumedRolesEnabled {
-			assumedACL, err := NewACL(fmt.Sprintf("metrics:\n  namespace: %s", role))
+
+			var err error
+			acl, err = assumedRoles.NewACL(role)
 			if err != nil {
 				return ACL{}, fmt.Errorf("failed to create assumed ACL for role %s: %w", role, err)
 			}
-			for label, lf := range assumedACL.Metrics {
-				if existingLF, ok := combinedACL.Metrics[label]; ok {
-					combinedACL.Metrics[label] = mergeLabelFilters(existingLF, lf)
-				} else {
-					combinedACL.Metrics[label] = lf
-				}
+			assumedACLs[role] = acl
+		}
+
+		// Otherwise, the label filters defined through templates would be silently dropped
+		if len(acl.Templates) > 0 {
+			return ACL{}, fmt.Errorf("%s role contains templates, which have to be rendered first", role)
+		}
+
+		// Roles without limits don't lift the limits of other roles
+		combinedACL.TimeLimits = combinedACL.TimeLimits.merge(acl.TimeLimits)
+		combinedACL.QueryLimits = combinedACL.QueryLimits.Merge(acl.QueryLimits)
+		combinedACL.Functions = combinedACL.Functions.Merge(acl.Functions)
+		combinedACL.RequiredLabels = combinedACL.RequiredLabels.Merge(acl.RequiredLabels)
+		combinedACL.Aggregation = combinedACL.Aggregation.Merge(acl.Aggregation)
+		// Exemptions widen access, so exemptions of all roles are combined
+		combinedACL.ExemptMetrics = combinedACL.ExemptMetrics.Merge(acl.ExemptMetrics)
+		sources = append(sources, acl)
+
+		for label, lf := range acl.Metrics {
+			if existingLF, ok := combinedACL.Metrics[label]; ok {
+				combinedACL.Metrics[label] = mergeLabelFilters(existingLF, lf)
+			} else {
+				combinedACL.Metrics[label] = lf
+			}
+		}
+	}
+
+	for _, acl := range extra {
+		sources = append(sources, acl)
+		for label, lf := range acl.Metrics {
+			if existingLF, ok := combinedACL.Metrics[label]; ok {
+				combinedACL.Metrics[label] = mergeLabelFilters(existingLF, lf)
+			} else {
+				combinedACL.Metrics[label] = lf
 			}
 		}
 	}
 
+	if rules := combineRules(sources); len(rules) > 0 {
+		combinedACL.Metrics = make(map[string]metricsql.LabelFilter)
+		combinedACL.Rules = rules
+		return combinedACL, nil
+	}
+
 	if len(combinedACL.Metrics) == 0 {
 		return ACL{}, fmt.Errorf("no matching roles found")
 	}
 
 	for label, lf := range combinedACL.Metrics {
-		RawACL, err := a.rolesToRawACL(oidcRoles, label, assumedRolesEnabled)
+		RawACL, err := a.rolesToRawACL(oidcRoles, label, assumedACLs, extra)
 		if err != nil {
 			return ACL{}, err
 		}
@@ -130,6 +220,38 @@ func (a ACLs) GetUserACL(oidcRoles []string, assumedRolesEnabled bool) (ACL, err
 	return combinedACL, nil
 }
 
+// combineRules returns rules of all ACLs along with metrics of ACLs without rules turned into one rule each. Nil is returned if none of the ACLs defines rules or if any of them grants full access, so that the ACLs are combined through metrics as usual.
+func combineRules(acls []ACL) []Rule {
+	var rules []Rule
+
+	for _, acl := range acls {
+		rules = append(rules, acl.Rules...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	for _, acl := range acls {
+		if len(acl.Metrics) == 0 {
+			continue
+		}
+
+		fullaccess := true
+		for _, lf := range acl.Metrics {
+			if !isFullAccess(lf) {
+				fullaccess = false
+			}
+		}
+		if fullaccess {
+			return nil
+		}
+
+		rules = append(rules, ruleFromMetrics(acl.Metrics))
+	}
+
+	return rules
+}
+
 // mergeLabelFilters combines two LabelFilters
 func mergeLabelFilters(lf1, lf2 metricsql.LabelFilter) metricsql.LabelFilter {
 	if lf1.Value == ".*" || lf2.Value == ".*" {
@@ -62,7 +62,7 @@ func TestACL_rolesToRawACL(t *testing.T) {
 
 	t.Run("0 roles", func(t *testing.T) {
 		roles := []string{}
-		_, err := a.rolesToRawACL(roles, "namespace", true)
+		_, err := a.rolesToRawACL(roles, "namespace", nil, nil)
 		assert.NotNil(t, err)
 	})
 
@@ -70,7 +70,7 @@ func TestACL_rolesToRawACL(t *testing.T) {
 		roles := []string{"multiple-values"}
 		want := "ku.*, min.*"
 
-		got, err := a.rolesToRawACL(roles, "namespace", true)
+		got, err := a.rolesToRawACL(roles, "namespace", nil, nil)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
 	})
@@ -79,7 +79,7 @@ func TestACL_rolesToRawACL(t *testing.T) {
 		roles := []string{"multiple-values", "single-value"}
 		want := "ku.*, min.*, default"
 
-		got, err := a.rolesToRawACL(roles, "namespace", true)
+		got, err := a.rolesToRawACL(roles, "namespace", nil, nil)
 		assert.Nil(t, err)
 		assert.Equal(t, want, got)
 	})
@@ -91,7 +91,7 @@ func TestACL_rolesToRawACL(t *testing.T) {
 
 		roles := []string{"empty-acl"}
 
-		_, err := a.rolesToRawACL(roles, "namespace", true)
+		_, err := a.rolesToRawACL(roles, "namespace", nil, nil)
 		assert.NotNil(t, err)
 	})
 }
@@ -181,7 +181,7 @@ func TestACL_GetUserACL(t *testing.T) {
 		roles := []string{"single-value", "multiple-values", "unknown-role"}
 		knownRoles := []string{"single-value", "multiple-values"}
 
-		rawACL, err := a.rolesToRawACL(knownRoles, "namespace", true)
+		rawACL, err := a.rolesToRawACL(knownRoles, "namespace", nil, nil)
 		assert.Nil(t, err)
 
 		want := ACL{
@@ -0,0 +1,257 @@
+package querymodifier
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// reducingAggregations lists aggregations, which return a single series per group, so labels not included into the group are removed from the result. Others (e.g. topk, limitk, any) return original series along with all of their labels.
+var reducingAggregations = map[string]bool{
+	"avg":          true,
+	"count":        true,
+	"count_values": true,
+	"distinct":     true,
+	"geomean":      true,
+	"group":        true,
+	"histogram":    true,
+	"mad":          true,
+	"max":          true,
+	"median":       true,
+	"min":          true,
+	"mode":         true,
+	"quantile":     true,
+	"quantiles":    true,
+	"stddev":       true,
+	"stdvar":       true,
+	"sum":          true,
+	"sum2":         true,
+}
+
+// labelManipulationFunctions lists functions, which change or filter series based on label values. Below an aggregation, they would make it possible to move hidden labels into the result or to single out individual series.
+var labelManipulationFunctions = map[string]bool{
+	"label_copy":           true,
+	"label_del":            true,
+	"label_graphite_group": true,
+	"label_join":           true,
+	"label_keep":           true,
+	"label_lowercase":      true,
+	"label_map":            true,
+	"label_match":          true,
+	"label_mismatch":       true,
+	"label_move":           true,
+	"label_replace":        true,
+	"label_set":            true,
+	"label_transform":      true,
+	"label_uppercase":      true,
+	"label_value":          true,
+	"labels_equal":         true,
+}
+
+// AggregationPolicy restricts queries to aggregated data: every series selector has to be placed under an aggregation, which removes Labels from the result (e.g. sum by (namespace) (...) or sum without (pod) (...)). If Wrap is set, queries without any aggregation are wrapped into sum without (Labels) (...) instead of being rejected.
+type AggregationPolicy struct {
+	Labels []string `yaml:"labels"`
+	Wrap   bool     `yaml:"wrap"`
+}
+
+// IsZero returns true if the policy doesn't restrict anything.
+func (ap AggregationPolicy) IsZero() bool {
+	return len(ap.Labels) == 0
+}
+
+// Merge returns the strictest combination of both policies: labels of both have to be removed, and queries are wrapped only if both policies allow it.
+func (ap AggregationPolicy) Merge(other AggregationPolicy) AggregationPolicy {
+	if ap.IsZero() {
+		return other
+	}
+	if other.IsZero() {
+		return ap
+	}
+
+	res := AggregationPolicy{
+		Labels: slices.Clone(ap.Labels),
+		Wrap:   ap.Wrap && other.Wrap,
+	}
+
+	for _, label := range other.Labels {
+		if !slices.Contains(res.Labels, label) {
+			res.Labels = append(res.Labels, label)
+		}
+	}
+	sort.Strings(res.Labels)
+
+	return res
+}
+
+// normalize validates the policy and sorts labels.
+func (ap AggregationPolicy) normalize() (AggregationPolicy, error) {
+	var res AggregationPolicy
+
+	for _, label := range ap.Labels {
+		label = strings.TrimSpace(label)
+		if label == "" || label == "__name__" {
+			return AggregationPolicy{}, fmt.Errorf("invalid label %q in aggregation_only", label)
+		}
+		if !slices.Contains(res.Labels, label) {
+			res.Labels = append(res.Labels, label)
+		}
+	}
+	sort.Strings(res.Labels)
+
+	if ap.Wrap && len(res.Labels) == 0 {
+		return AggregationPolicy{}, fmt.Errorf("aggregation_only.wrap requires labels")
+	}
+	res.Wrap = ap.Wrap
+
+	return res, nil
+}
+
+// IsHiddenLabel returns true if values of the label cannot be seen according to the policy.
+func (ap AggregationPolicy) IsHiddenLabel(label string) bool {
+	return slices.Contains(ap.Labels, label)
+}
+
+// removesLabels returns true if the aggregation removes all labels of the policy from its result.
+func (ap AggregationPolicy) removesLabels(ae *metricsql.AggrFuncExpr) bool {
+	if !reducingAggregations[strings.ToLower(ae.Name)] {
+		return false
+	}
+
+	switch strings.ToLower(ae.Modifier.Op) {
+	case "":
+		return true
+	case "by":
+		for _, label := range ap.Labels {
+			if slices.Contains(ae.Modifier.Args, label) {
+				return false
+			}
+		}
+		return true
+	case "without":
+		for _, label := range ap.Labels {
+			if !slices.Contains(ae.Modifier.Args, label) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// checkExpr returns an error if any series selector is not placed under an aggregation removing the labels of the policy. Below such an aggregation, selectors cannot match hidden labels and label manipulation functions are not allowed, as both would make it possible to single out individual series.
+func (ap AggregationPolicy) checkExpr(expr metricsql.Expr, aggregated bool) error {
+	labels := strings.Join(ap.Labels, ", ")
+
+	switch e := expr.(type) {
+	case *metricsql.MetricExpr:
+		if !aggregated {
+			return fmt.Errorf("the selector %s has to be aggregated without labels %s", e.AppendString(nil), labels)
+		}
+		for _, lf := range e.LabelFilters {
+			if ap.IsHiddenLabel(lf.Label) {
+				return fmt.Errorf("the selector %s cannot match the label %s", e.AppendString(nil), lf.Label)
+			}
+		}
+		return nil
+	case *metricsql.RollupExpr:
+		return ap.checkExprs([]metricsql.Expr{e.Expr, e.At}, aggregated)
+	case *metricsql.FuncExpr:
+		if aggregated && labelManipulationFunctions[strings.ToLower(e.Name)] {
+			return fmt.Errorf("the function %s cannot be used with aggregated data", strings.ToLower(e.Name))
+		}
+		return ap.checkExprs(e.Args, aggregated)
+	case *metricsql.AggrFuncExpr:
+		return ap.checkExprs(e.Args, aggregated || ap.removesLabels(e))
+	case *metricsql.BinaryOpExpr:
+		return ap.checkExprs([]metricsql.Expr{e.Left, e.Right}, aggregated)
+	default:
+		return nil
+	}
+}
+
+// checkExprs calls checkExpr for every expression.
+func (ap AggregationPolicy) checkExprs(exprs []metricsql.Expr, aggregated bool) error {
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		if err := ap.checkExpr(expr, aggregated); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasAggregation returns true if the expression contains any aggregation.
+func hasAggregation(expr metricsql.Expr) bool {
+	found := false
+	metricsql.VisitAll(expr, func(expr metricsql.Expr) {
+		if _, ok := expr.(*metricsql.AggrFuncExpr); ok {
+			found = true
+		}
+	})
+
+	return found
+}
+
+// applyExpr checks an expression against the policy. If wrapping is allowed, a non-compliant expression without any aggregation is wrapped into sum without (...) (...), since its meaning is then clear, otherwise an error is returned.
+func (ap AggregationPolicy) applyExpr(expr metricsql.Expr) (metricsql.Expr, error) {
+	err := ap.checkExpr(expr, false)
+	if err == nil || !ap.Wrap || hasAggregation(expr) {
+		return expr, err
+	}
+
+	wrapped := &metricsql.AggrFuncExpr{
+		Name: "sum",
+		Args: []metricsql.Expr{expr},
+		Modifier: metricsql.ModifierExpr{
+			Op:   "without",
+			Args: slices.Clone(ap.Labels),
+		},
+	}
+
+	// Selectors matching hidden labels and label manipulation functions are still rejected
+	if err := ap.checkExpr(wrapped, false); err != nil {
+		return nil, err
+	}
+
+	return wrapped, nil
+}
+
+// ApplyAggregationPolicy checks GET/POST "query" parameters against the aggregation policy and wraps them if allowed, parameters are modified in place. "match[]" parameters are rejected, since selectors cannot be aggregated.
+func (qm *QueryModifier) ApplyAggregationPolicy(getParams, postParams url.Values) error {
+	ap := qm.Aggregation
+	if ap.IsZero() {
+		return nil
+	}
+
+	for _, params := range []url.Values{getParams, postParams} {
+		if len(params["match[]"]) > 0 {
+			return fmt.Errorf("series selectors (match[]) are not allowed, only aggregated data can be queried")
+		}
+
+		for i, v := range params["query"] {
+			expr, err := metricsql.Parse(v)
+			if err != nil {
+				return err
+			}
+
+			newExpr, err := ap.applyExpr(expr)
+			if err != nil {
+				return err
+			}
+
+			if newExpr != expr {
+				params["query"][i] = string(newExpr.AppendString(nil))
+			}
+		}
+	}
+
+	return nil
+}
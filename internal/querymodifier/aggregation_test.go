@@ -0,0 +1,235 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregationPolicy_applyExpr(t *testing.T) {
+	reject := AggregationPolicy{Labels: []string{"pod", "user_id"}}
+	wrap := AggregationPolicy{Labels: []string{"pod", "user_id"}, Wrap: true}
+
+	tests := []struct {
+		name    string
+		policy  AggregationPolicy
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Aggregation by other labels",
+			policy: reject,
+			query:  `sum(rate(container_cpu_usage_seconds_total[5m])) by (namespace)`,
+			want:   `sum(rate(container_cpu_usage_seconds_total[5m])) by (namespace)`,
+		},
+		{
+			name:   "Aggregation without any grouping",
+			policy: reject,
+			query:  `count(kube_pod_info)`,
+			want:   `count(kube_pod_info)`,
+		},
+		{
+			name:   "Aggregation without hidden labels",
+			policy: reject,
+			query:  `sum without (pod, user_id, instance) (requests_total)`,
+			want:   `sum(requests_total) without (pod, user_id, instance)`,
+		},
+		{
+			name:    "Aggregation without some of the hidden labels",
+			policy:  reject,
+			query:   `sum without (pod) (requests_total)`,
+			wantErr: true,
+		},
+		{
+			name:    "Aggregation by a hidden label",
+			policy:  reject,
+			query:   `sum by (namespace, pod) (requests_total)`,
+			wantErr: true,
+		},
+		{
+			name:    "Aggregation keeping original series",
+			policy:  reject,
+			query:   `topk(5, requests_total)`,
+			wantErr: true,
+		},
+		{
+			name:   "Aggregation keeping original series on top of an aggregation",
+			policy: reject,
+			query:  `topk(5, sum by (namespace) (requests_total))`,
+			want:   `topk(5, sum(requests_total) by (namespace))`,
+		},
+		{
+			name:    "Selector without aggregation",
+			policy:  reject,
+			query:   `rate(requests_total[5m])`,
+			wantErr: true,
+		},
+		{
+			name:    "Binary operation with a selector without aggregation",
+			policy:  reject,
+			query:   `sum by (namespace) (requests_total) / requests_limit`,
+			wantErr: true,
+		},
+		{
+			name:   "Binary operation between aggregations",
+			policy: reject,
+			query:  `sum by (namespace) (requests_total) / on (namespace) group_left sum by (namespace) (requests_limit)`,
+			want:   `sum(requests_total) by (namespace) / on (namespace) group_left () sum(requests_limit) by (namespace)`,
+		},
+		{
+			name:   "Subquery over an aggregation",
+			policy: reject,
+			query:  `max_over_time(sum by (namespace) (rate(requests_total[5m]))[1h:])`,
+			want:   `max_over_time((sum(rate(requests_total[5m])) by (namespace))[1h:])`,
+		},
+		{
+			name:    "Selector matching a hidden label",
+			policy:  reject,
+			query:   `sum(requests_total{user_id="42"})`,
+			wantErr: true,
+		},
+		{
+			name:    "Selector excluding a hidden label",
+			policy:  reject,
+			query:   `sum(requests_total{user_id!="42"})`,
+			wantErr: true,
+		},
+		{
+			name:    "Label manipulation below an aggregation",
+			policy:  reject,
+			query:   `sum by (namespace) (label_replace(requests_total, "namespace", "$1", "pod", "(.*)"))`,
+			wantErr: true,
+		},
+		{
+			name:    "Label filtering below an aggregation",
+			policy:  reject,
+			query:   `sum by (namespace) (labels_equal(requests_total, "pod", "namespace"))`,
+			wantErr: true,
+		},
+		{
+			name:   "Sorting by a label below an aggregation",
+			policy: reject,
+			query:  `sum by (namespace) (sort_by_label(requests_total, "namespace"))`,
+			want:   `sum(sort_by_label(requests_total, "namespace")) by (namespace)`,
+		},
+		{
+			name:   "Label manipulation above an aggregation",
+			policy: reject,
+			query:  `label_replace(sum by (namespace) (requests_total), "ns", "$1", "namespace", "(.*)")`,
+			want:   `label_replace(sum(requests_total) by (namespace), "ns", "$1", "namespace", "(.*)")`,
+		},
+		{
+			name:   "Query without selectors",
+			policy: reject,
+			query:  `vector(1)`,
+			want:   `vector(1)`,
+		},
+		{
+			name:   "Query without aggregation is wrapped",
+			policy: wrap,
+			query:  `rate(requests_total{namespace="default"}[5m])`,
+			want:   `sum(rate(requests_total{namespace="default"}[5m])) without (pod, user_id)`,
+		},
+		{
+			name:   "Binary operation without aggregation is wrapped",
+			policy: wrap,
+			query:  `requests_total / requests_limit`,
+			want:   `sum(requests_total / requests_limit) without (pod, user_id)`,
+		},
+		{
+			name:    "Query with a non-compliant aggregation is not wrapped",
+			policy:  wrap,
+			query:   `sum by (pod) (requests_total)`,
+			wantErr: true,
+		},
+		{
+			name:    "Query matching a hidden label is not wrapped",
+			policy:  wrap,
+			query:   `requests_total{pod="a"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Query with label manipulation is not wrapped",
+			policy:  wrap,
+			query:   `label_join(requests_total, "namespace", ",", "pod")`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.policy.applyExpr(expr)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(got.AppendString(nil)))
+		})
+	}
+}
+
+func TestQueryModifier_ApplyAggregationPolicy(t *testing.T) {
+	qm := QueryModifier{Aggregation: AggregationPolicy{Labels: []string{"pod"}, Wrap: true}}
+
+	getParams := url.Values{"query": {`requests_total`}, "step": {"60"}}
+	postParams := url.Values{"query": {`sum(requests_total)`}}
+	err := qm.ApplyAggregationPolicy(getParams, postParams)
+	assert.Nil(t, err)
+	assert.Equal(t, url.Values{"query": {`sum(requests_total) without (pod)`}, "step": {"60"}}, getParams)
+	assert.Equal(t, url.Values{"query": {`sum(requests_total)`}}, postParams)
+
+	err = qm.ApplyAggregationPolicy(url.Values{"match[]": {`requests_total`}}, url.Values{})
+	assert.NotNil(t, err)
+}
+
+func TestAggregationPolicy_Merge(t *testing.T) {
+	a := AggregationPolicy{Labels: []string{"user_id"}, Wrap: true}
+	b := AggregationPolicy{Labels: []string{"pod", "user_id"}}
+
+	want := AggregationPolicy{Labels: []string{"pod", "user_id"}}
+	assert.Equal(t, want, a.Merge(b))
+	assert.Equal(t, want, b.Merge(a))
+	assert.Equal(t, a, a.Merge(AggregationPolicy{}))
+	assert.Equal(t, a, AggregationPolicy{}.Merge(a))
+}
+
+func Test_parseACLFile_aggregation(t *testing.T) {
+	content := `
+management:
+  aggregation_only:
+    labels: [pod]
+    wrap: true
+  metrics:
+    namespace: '.*'
+finance:
+  inherits: [management]
+  aggregation_only:
+    labels: [user_id, pod]
+    wrap: true
+  metrics:
+    namespace: billing
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, AggregationPolicy{Labels: []string{"pod", "user_id"}, Wrap: true}, got["finance"].Aggregation)
+
+	acl, err := NewACL("metrics: { namespace: a }\naggregation_only: { labels: [pod] }")
+	assert.Nil(t, err)
+	assert.Equal(t, AggregationPolicy{Labels: []string{"pod"}}, acl.Aggregation)
+
+	_, err = parseACLFile([]byte("a: { aggregation_only: { wrap: true }, metrics: { namespace: a }}"))
+	assert.NotNil(t, err)
+
+	_, err = NewACL("metrics: { namespace: a }\naggregation_only: { labels: [__name__] }")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,118 @@
+package querymodifier
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// labelNameRe matches valid Prometheus label names
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// AssumedRolesTemplate describes how ACLs are constructed for assumed roles: each label gets a value rendered from a template, in which {{.Role}} refers to the role name.
+type AssumedRolesTemplate map[string]*template.Template
+
+// DefaultAssumedRolesTemplate treats a role name as a namespace definition.
+var DefaultAssumedRolesTemplate = AssumedRolesTemplate{
+	"namespace": template.Must(template.New("namespace").Option("missingkey=error").Parse("{{.Role}}")),
+}
+
+// assumedRoleData is passed to value templates.
+type assumedRoleData struct {
+	Role string
+}
+
+// NewAssumedRolesTemplate returns an AssumedRolesTemplate built from definitions in the form of <label>=<value template>, e.g. tenant={{.Role}}.
+func NewAssumedRolesTemplate(defs []string) (AssumedRolesTemplate, error) {
+	t := make(AssumedRolesTemplate, len(defs))
+
+	for _, def := range defs {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		label, value, ok := strings.Cut(def, "=")
+		label = strings.TrimSpace(label)
+		if !ok || !labelNameRe.MatchString(label) {
+			return nil, fmt.Errorf("invalid assumed roles template %q, expected <label>=<value template>", def)
+		}
+
+		if _, exists := t[label]; exists {
+			return nil, fmt.Errorf("invalid assumed roles template %q, label %s is defined more than once", def, label)
+		}
+
+		tmpl, err := template.New(label).Option("missingkey=error").Parse(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid assumed roles template %q: %w", def, err)
+		}
+
+		t[label] = tmpl
+	}
+
+	if len(t) == 0 {
+		return nil, fmt.Errorf("assumed roles template has to contain at least one label")
+	}
+
+	return t, nil
+}
+
+// Labels returns a sorted list of labels defined in the template.
+func (t AssumedRolesTemplate) Labels() []string {
+	labels := make([]string, 0, len(t))
+	for label := range t {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	return labels
+}
+
+// Render returns ACL definitions for every label of the template.
+func (t AssumedRolesTemplate) Render(role string) (map[string]string, error) {
+	values := make(map[string]string, len(t))
+
+	for label, tmpl := range t {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, assumedRoleData{Role: role}); err != nil {
+			return nil, fmt.Errorf("failed to render template for label %s: %w", label, err)
+		}
+		values[label] = b.String()
+	}
+
+	return values, nil
+}
+
+// NewACL returns an ACL for an assumed role. The ACL is constructed directly, so a role name cannot alter the structure of the definition.
+func (t AssumedRolesTemplate) NewACL(role string) (ACL, error) {
+	values, err := t.Render(role)
+	if err != nil {
+		return ACL{}, err
+	}
+
+	acl := ACL{
+		Metrics:     make(map[string]metricsql.LabelFilter, len(values)),
+		MetricsMeta: make(map[string]LabelFilterData, len(values)),
+	}
+
+	for label, value := range values {
+		lf, metadata, err := newLabelFilter(label, value)
+		if err != nil {
+			return ACL{}, err
+		}
+
+		// Keep the rendered definition as is (e.g. "team-a, team-b"), the same way it used to be taken from role names
+		if !metadata.Fullaccess {
+			metadata.RawACL = value
+		}
+
+		acl.Metrics[label] = lf
+		acl.MetricsMeta[label] = metadata
+	}
+
+	return acl, nil
+}
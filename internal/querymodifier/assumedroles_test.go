@@ -0,0 +1,180 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAssumedRolesTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		defs       []string
+		wantLabels []string
+		wantErr    bool
+	}{
+		{
+			name:       "Single label",
+			defs:       []string{"tenant={{.Role}}"},
+			wantLabels: []string{"tenant"},
+		},
+		{
+			name:       "Multiple labels",
+			defs:       []string{"tenant={{.Role}}", " team = team-{{.Role}} "},
+			wantLabels: []string{"team", "tenant"},
+		},
+		{
+			name:    "No labels",
+			defs:    []string{""},
+			wantErr: true,
+		},
+		{
+			name:    "No value",
+			defs:    []string{"tenant"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid label name",
+			defs:    []string{"ten-ant={{.Role}}"},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate label",
+			defs:    []string{"tenant={{.Role}}", "tenant=x"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid template",
+			defs:    []string{"tenant={{.Role"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewAssumedRolesTemplate(tt.defs)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantLabels, got.Labels())
+		})
+	}
+}
+
+func TestAssumedRolesTemplate_NewACL(t *testing.T) {
+	tmpl, err := NewAssumedRolesTemplate([]string{"tenant={{.Role}}", "team=team-{{.Role}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Multiple labels", func(t *testing.T) {
+		want := ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"tenant": {
+					Label:      "tenant",
+					Value:      "a",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+				"team": {
+					Label:      "team",
+					Value:      "team-a",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"tenant": {
+					Fullaccess: false,
+					RawACL:     "a",
+				},
+				"team": {
+					Fullaccess: false,
+					RawACL:     "team-a",
+				},
+			},
+		}
+
+		got, err := tmpl.NewACL("a")
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Role name cannot inject YAML", func(t *testing.T) {
+		_, err := tmpl.NewACL("a\n  cluster: .*")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("YAML syntax is treated as a value", func(t *testing.T) {
+		got, err := tmpl.NewACL("{cluster:prod}")
+		assert.Nil(t, err)
+		assert.Equal(t, "{cluster:prod}", got.Metrics["tenant"].Value)
+		assert.Len(t, got.Metrics, 2)
+	})
+
+	t.Run("Invalid regex", func(t *testing.T) {
+		_, err := tmpl.NewACL("a(")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestACLs_GetUserACLWithExtra_assumedRoles(t *testing.T) {
+	tmpl, err := NewAssumedRolesTemplate([]string{"tenant={{.Role}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := ACLs{
+		"single-value": ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"tenant": {
+					Label:      "tenant",
+					Value:      "default",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"tenant": {
+					Fullaccess: false,
+					RawACL:     "default",
+				},
+			},
+		},
+	}
+
+	t.Run("Known and assumed roles are merged", func(t *testing.T) {
+		roles := []string{"single-value", "tenant-a"}
+
+		want := ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"tenant": {
+					Label:      "tenant",
+					Value:      "default|tenant-a",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"tenant": {
+					Fullaccess: false,
+					RawACL:     "default, tenant-a",
+				},
+			},
+		}
+
+		got, err := a.GetUserACLWithExtra(roles, tmpl)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Assumed roles are disabled", func(t *testing.T) {
+		roles := []string{"tenant-a"}
+		_, err := a.GetUserACLWithExtra(roles, nil)
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,281 @@
+package querymodifier
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"gopkg.in/yaml.v3"
+)
+
+// MetricExemption exempts series selectors naming a metric, which matches Pattern, from the ACL (e.g. node-level metrics without the namespace label). If Filters are set, they're applied instead of the ACL, otherwise such selectors are not modified.
+type MetricExemption struct {
+	// Pattern is a regexp matched against the whole metric name.
+	Pattern string
+	Filters []metricsql.LabelFilter
+	re      *regexp.Regexp
+}
+
+// MetricExemptions holds exemptions in the order of their precedence.
+type MetricExemptions []MetricExemption
+
+// NewMetricExemptions returns MetricExemptions based on definitions in the form of "<pattern>" (e.g. node_.*) or "<pattern>{<label filters>}" (e.g. up{job="kubelet"}).
+func NewMetricExemptions(defs []string) (MetricExemptions, error) {
+	var exemptions MetricExemptions
+
+	for _, def := range defs {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		exemption, err := newMetricExemption(def)
+		if err != nil {
+			return nil, err
+		}
+
+		exemptions = append(exemptions, exemption)
+	}
+
+	return exemptions, nil
+}
+
+// quantifierRe matches regexp quantifiers (e.g. {1,3}), which might end a pattern without filters (e.g. node_.{1,3}).
+var quantifierRe = regexp.MustCompile(`^\{\d+(,\d*)?\}$`)
+
+// SplitMetricExemptions splits a list of exemption definitions separated by commas or newlines. Separators inside braces, brackets, parentheses or quoted strings are ignored, so label filters with several matchers (e.g. up{job="kubelet",instance="x"}) and regexps with quantifiers (e.g. node_.{1,3}) are kept intact.
+func SplitMetricExemptions(s string) []string {
+	var defs []string
+	var quote rune
+	depth, start := 0, 0
+	escaped := false
+
+	for i, ch := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case depth > 0 && (ch == '"' || ch == '\'' || ch == '`'):
+			quote = ch
+		case ch == '{' || ch == '[' || ch == '(':
+			depth++
+		case ch == '}' || ch == ']' || ch == ')':
+			depth--
+		case depth == 0 && (ch == ',' || ch == '\n'):
+			defs = append(defs, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(defs, s[start:])
+}
+
+// cutFilters splits an exemption definition into a pattern and label filters (the trailing {...} group, unless it's a regexp quantifier). An error is returned if braces are not balanced.
+func cutFilters(def string) (string, string, error) {
+	var quote rune
+	depth, groupStart := 0, -1
+	escaped := false
+
+	for i, ch := range def {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case depth > 0 && (ch == '"' || ch == '\'' || ch == '`'):
+			quote = ch
+		case ch == '{':
+			if depth == 0 {
+				groupStart = i
+			}
+			depth++
+		case ch == '}':
+			depth--
+			if depth < 0 {
+				return "", "", fmt.Errorf("unexpected } in exempt metric %q", def)
+			}
+		}
+	}
+
+	if depth != 0 || quote != 0 {
+		return "", "", fmt.Errorf("missing } in exempt metric %q", def)
+	}
+
+	if groupStart < 0 || !strings.HasSuffix(def, "}") || quantifierRe.MatchString(def[groupStart:]) {
+		return def, "", nil
+	}
+
+	return strings.TrimSpace(def[:groupStart]), def[groupStart:], nil
+}
+
+// newMetricExemption parses a single exemption definition.
+func newMetricExemption(def string) (MetricExemption, error) {
+	pattern, rawFilters, err := cutFilters(def)
+	if err != nil {
+		return MetricExemption{}, err
+	}
+
+	var filters []metricsql.LabelFilter
+
+	if rawFilters != "" {
+		expr, err := metricsql.Parse(rawFilters)
+		if err != nil {
+			return MetricExemption{}, fmt.Errorf("invalid filters of exempt metric %q: %w", def, err)
+		}
+
+		me, ok := expr.(*metricsql.MetricExpr)
+		if !ok {
+			return MetricExemption{}, fmt.Errorf("invalid filters of exempt metric %q", def)
+		}
+
+		for _, lf := range me.LabelFilters {
+			if lf.Label == "__name__" {
+				return MetricExemption{}, fmt.Errorf("filters of exempt metric %q cannot match the metric name", def)
+			}
+		}
+		filters = me.LabelFilters
+	}
+
+	if pattern == "" {
+		return MetricExemption{}, fmt.Errorf("pattern of exempt metric %q cannot be empty", def)
+	}
+
+	re, err := metricsql.CompileRegexpAnchored(pattern)
+	if err != nil {
+		return MetricExemption{}, fmt.Errorf("invalid pattern of exempt metric %q: %w", def, err)
+	}
+
+	return MetricExemption{
+		Pattern: pattern,
+		Filters: filters,
+		re:      re,
+	}, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Exemptions might be defined either as a YAML list or as a single string.
+func (exs *MetricExemptions) UnmarshalYAML(node *yaml.Node) error {
+	var defs []string
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		defs = []string{node.Value}
+	case yaml.SequenceNode:
+		if err := node.Decode(&defs); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: exempt metrics have to be either a string or a list", node.Line)
+	}
+
+	parsed, err := NewMetricExemptions(defs)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	*exs = parsed
+
+	return nil
+}
+
+// String returns the definition of the exemption.
+func (ex MetricExemption) String() string {
+	if len(ex.Filters) == 0 {
+		return ex.Pattern
+	}
+
+	return ex.Pattern + string((&metricsql.MetricExpr{LabelFilters: ex.Filters}).AppendString(nil))
+}
+
+// Merge returns exemptions of both lists, those of the receiver take precedence. Repeated definitions are dropped.
+func (exs MetricExemptions) Merge(other MetricExemptions) MetricExemptions {
+	if len(exs) == 0 {
+		return other
+	}
+	if len(other) == 0 {
+		return exs
+	}
+
+	res := make(MetricExemptions, 0, len(exs)+len(other))
+	seen := make(map[string]bool, len(exs)+len(other))
+
+	for _, exemption := range append(append(MetricExemptions{}, exs...), other...) {
+		def := exemption.String()
+		if seen[def] {
+			continue
+		}
+		seen[def] = true
+		res = append(res, exemption)
+	}
+
+	return res
+}
+
+// metricName returns the metric name of a series selector, if it's defined through an exact matcher (e.g. up or {__name__="up"}). Regexps are not considered, so that a selector cannot claim an exemption for metrics it doesn't name explicitly.
+func metricName(me *metricsql.MetricExpr) (string, bool) {
+	for _, lf := range me.LabelFilters {
+		if lf.Label == "__name__" && !lf.IsRegexp && !lf.IsNegative && lf.Value != "" {
+			return lf.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// find returns the exemption applicable to a series selector. An exemption without filters takes precedence, since it's the most permissive one, otherwise the first matching exemption is returned.
+func (exs MetricExemptions) find(me *metricsql.MetricExpr) (MetricExemption, bool) {
+	if me == nil {
+		return MetricExemption{}, false
+	}
+
+	name, ok := metricName(me)
+	if !ok {
+		return MetricExemption{}, false
+	}
+
+	var found MetricExemption
+	ok = false
+
+	for _, exemption := range exs {
+		if exemption.re == nil || !exemption.re.MatchString(name) {
+			continue
+		}
+
+		if len(exemption.Filters) == 0 {
+			return exemption, true
+		}
+
+		if !ok {
+			found, ok = exemption, true
+		}
+	}
+
+	return found, ok
+}
+
+// isExempt returns true if an exemption is applicable to the series selector.
+func (qm *QueryModifier) isExempt(me *metricsql.MetricExpr) bool {
+	_, ok := qm.ExemptMetrics.find(me)
+	return ok
+}
+
+// applyMetricExemption appends filters of the exemption applicable to the series selector. False is returned if the selector is not exempt, so the ACL has to be applied.
+func (qm *QueryModifier) applyMetricExemption(me *metricsql.MetricExpr) bool {
+	exemption, ok := qm.ExemptMetrics.find(me)
+	if !ok {
+		return false
+	}
+
+	me.LabelFilters = append(me.LabelFilters, exemption.Filters...)
+
+	return true
+}
@@ -0,0 +1,356 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetricExemptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		defs    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Empty",
+		},
+		{
+			name: "Patterns with and without filters",
+			defs: []string{"node_.*", " kube_node_.* ", `up{job="kubelet"}`, `kube_state_.*{job=~"kube-state-metrics|ksm", namespace!="x"}`},
+			want: []string{"node_.*", "kube_node_.*", `up{job="kubelet"}`, `kube_state_.*{job=~"kube-state-metrics|ksm", namespace!="x"}`},
+		},
+		{
+			name: "Patterns with quantifiers",
+			defs: []string{"node_.{1,3}", `node_.{1,3}{job="node"}`, `kube_\{x\}`},
+			want: []string{"node_.{1,3}", `node_.{1,3}{job="node"}`, `kube_\{x\}`},
+		},
+		{
+			name:    "Missing closing brace",
+			defs:    []string{`up{job="kubelet"`},
+			wantErr: true,
+		},
+		{
+			name:    "Missing opening brace",
+			defs:    []string{`instance="x"}`},
+			wantErr: true,
+		},
+		{
+			name:    "Empty pattern",
+			defs:    []string{`{job="kubelet"}`},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid pattern",
+			defs:    []string{"node_(.*"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid filters",
+			defs:    []string{`up{job=}`},
+			wantErr: true,
+		},
+		{
+			name:    "Filters matching the metric name",
+			defs:    []string{`up{__name__="node_load1"}`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMetricExemptions(tt.defs)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			var defs []string
+			for _, exemption := range got {
+				defs = append(defs, exemption.String())
+			}
+			assert.Equal(t, tt.want, defs)
+		})
+	}
+}
+
+func TestSplitMetricExemptions(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{
+			name: "Commas",
+			s:    "node_.*, kube_node_.*",
+			want: []string{"node_.*", " kube_node_.*"},
+		},
+		{
+			name: "Newlines",
+			s:    "node_.*\nkube_node_.*\n",
+			want: []string{"node_.*", "kube_node_.*", ""},
+		},
+		{
+			name: "Filters with several matchers",
+			s:    `up{job="kubelet",instance="x"},node_.*`,
+			want: []string{`up{job="kubelet",instance="x"}`, "node_.*"},
+		},
+		{
+			name: "Separators in quoted values",
+			s:    `up{job="a}, b"},node_.*`,
+			want: []string{`up{job="a}, b"}`, "node_.*"},
+		},
+		{
+			name: "Quantifiers and character classes",
+			s:    "node_.{1,3},kube_[a,b]_.*",
+			want: []string{"node_.{1,3}", "kube_[a,b]_.*"},
+		},
+		{
+			name: "Missing closing brace",
+			s:    `up{job="kubelet",instance="x"`,
+			want: []string{`up{job="kubelet",instance="x"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SplitMetricExemptions(tt.s))
+		})
+	}
+
+	// Unbalanced braces are not accepted silently
+	_, err := NewMetricExemptions(SplitMetricExemptions(`up{job="kubelet",instance="x"`))
+	assert.NotNil(t, err)
+}
+
+func TestMetricExemptions_Merge(t *testing.T) {
+	a, err := NewMetricExemptions([]string{"node_.*", `up{job="kubelet"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewMetricExemptions([]string{`up{job="kubelet"}`, "kube_node_.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, exemption := range a.Merge(b) {
+		got = append(got, exemption.String())
+	}
+
+	assert.Equal(t, []string{"node_.*", `up{job="kubelet"}`, "kube_node_.*"}, got)
+	assert.Equal(t, a, a.Merge(nil))
+	assert.Equal(t, b, MetricExemptions(nil).Merge(b))
+}
+
+func TestQueryModifier_modifyMetricExpr_exemptMetrics(t *testing.T) {
+	exemptMetrics, err := NewMetricExemptions([]string{"node_.*", "kube_node_.*", `up{job="kubelet"}`, `kube_node_.*{job="kube-state-metrics"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		rawACL         string
+		requiredLabels RequiredLabels
+		query          string
+		want           string
+	}{
+		{
+			name:   "Exempt metric",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `node_memory_MemAvailable_bytes{instance="node-1"}`,
+			want:   `node_memory_MemAvailable_bytes{instance="node-1"}`,
+		},
+		{
+			name:   "Exempt metric named through __name__",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `{__name__="node_load1"}`,
+			want:   `node_load1`,
+		},
+		{
+			name:   "Exemption without filters takes precedence",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `kube_node_status_condition`,
+			want:   `kube_node_status_condition`,
+		},
+		{
+			name:   "Exempt metric gets different filters",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `up`,
+			want:   `up{job="kubelet"}`,
+		},
+		{
+			name:   "Different filters are combined with the original ones",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `up{job="node-exporter", namespace="team-b"}`,
+			want:   `up{job="node-exporter", namespace="team-b", job="kubelet"}`,
+		},
+		{
+			name:   "Pattern has to match the whole metric name",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `kube_pod_info{node="node-1"}`,
+			want:   `kube_pod_info{node="node-1", namespace="team-a"}`,
+		},
+		{
+			name:   "Regexp matching the metric name is not exempt",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `{__name__=~"node_.*"}`,
+			want:   `{__name__=~"node_.*", namespace="team-a"}`,
+		},
+		{
+			name:   "Regexp matching any metric is not exempt",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `{__name__=~".+", instance="node-1"}`,
+			want:   `{__name__=~".+", instance="node-1", namespace="team-a"}`,
+		},
+		{
+			name:   "Negative matcher of the metric name is not exempt",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `{__name__!="node_load1"}`,
+			want:   `{__name__!="node_load1", namespace="team-a"}`,
+		},
+		{
+			name:   "Fake regexp matching the metric name is not exempt",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `{__name__=~"node_load1"}`,
+			want:   `{__name__=~"node_load1", namespace="team-a"}`,
+		},
+		{
+			name:   "Metric named explicitly along with a regexp is exempt",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `node_load1{__name__=~".+"}`,
+			want:   `node_load1{__name__=~".+"}`,
+		},
+		{
+			name:   "Correlation of team metrics with node metrics",
+			rawACL: "metrics: { namespace: 'team-a, team-b' }",
+			query:  `sum by (node) (kube_pod_info) * on (node) group_left node_load1`,
+			want:   `sum(kube_pod_info{namespace=~"team-a|team-b"}) by (node) * on (node) group_left () node_load1`,
+		},
+		{
+			name:   "Rollup function over an exempt metric",
+			rawACL: "metrics: { namespace: team-a }",
+			query:  `rate(node_cpu_seconds_total{mode="idle"}[5m])`,
+			want:   `rate(node_cpu_seconds_total{mode="idle"}[5m])`,
+		},
+		{
+			name:           "Required labels still apply to exempt metrics",
+			rawACL:         "metrics: { namespace: team-a }",
+			requiredLabels: RequiredLabels{"cluster": "eu1"},
+			query:          `node_load1`,
+			want:           `node_load1{cluster="eu1"}`,
+		},
+		{
+			name:   "Exempt metric with rules",
+			rawACL: "rules: [{ namespace: team-a, cluster: eu1 }, { namespace: team-b, cluster: us2 }]",
+			query:  `sum(rate(node_cpu_seconds_total[5m])) / sum(rate(container_cpu_usage_seconds_total[5m]))`,
+			want:   `sum(rate(node_cpu_seconds_total[5m])) / sum(rate(container_cpu_usage_seconds_total{cluster="eu1", namespace="team-a"}[5m]) or rate(container_cpu_usage_seconds_total{cluster="us2", namespace="team-b"}[5m]))`,
+		},
+		{
+			name:   "Range selector of an exempt metric with rules",
+			rawACL: "rules: [{ namespace: team-a, cluster: eu1 }, { namespace: team-b, cluster: us2 }]",
+			query:  `up[5m]`,
+			want:   `up{job="kubelet"}[5m]`,
+		},
+		{
+			name:   "Regexp matching the metric name is not exempt with rules",
+			rawACL: "rules: [{ namespace: team-a, cluster: eu1 }, { namespace: team-b, cluster: us2 }]",
+			query:  `{__name__=~"node_.*"}`,
+			want:   `{__name__=~"node_.*", cluster="eu1", namespace="team-a"} or {__name__=~"node_.*", cluster="us2", namespace="team-b"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:            acl,
+				RequiredLabels: tt.requiredLabels,
+				ExemptMetrics:  exemptMetrics,
+			}
+
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			originalExpr := metricsql.Clone(expr)
+
+			newExpr, err := qm.modifyMetricExpr(expr, newRegexpBudget())
+			assert.Nil(t, err)
+			assert.Equal(t, originalExpr, expr, "The original expression got modified. Use metricsql.Clone() before modifying any expression.")
+			assert.Equal(t, tt.want, string(newExpr.AppendString(nil)))
+		})
+	}
+}
+
+func Test_parseACLFile_exemptMetrics(t *testing.T) {
+	content := `
+base:
+  exempt_metrics: [node_.*]
+  metrics:
+    namespace: a
+team-a:
+  inherits: [base]
+  exempt_metrics:
+    - up{job="kubelet"}
+    - node_.*
+  metrics:
+    namespace: b
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+
+	var defs []string
+	for _, exemption := range got["team-a"].ExemptMetrics {
+		defs = append(defs, exemption.String())
+	}
+	assert.Equal(t, []string{`up{job="kubelet"}`, "node_.*"}, defs)
+
+	acl, err := NewACL("metrics: { namespace: a }\nexempt_metrics: kube_node_.*")
+	assert.Nil(t, err)
+	if assert.Len(t, acl.ExemptMetrics, 1) {
+		assert.Equal(t, "kube_node_.*", acl.ExemptMetrics[0].String())
+	}
+
+	_, err = parseACLFile([]byte("a: { exempt_metrics: ['node_(.*'], metrics: { namespace: a }}"))
+	assert.NotNil(t, err)
+
+	_, err = parseACLFile([]byte("a: { valid_until: 2030-01-01T00:00:00Z, exempt_metrics: [node_.*], metrics: { namespace: a } }\nb: { inherits: [a], metrics: { namespace: b } }"))
+	assert.NotNil(t, err)
+}
+
+func TestACLs_GetUserACL_exemptMetrics(t *testing.T) {
+	acls := make(ACLs)
+
+	defs := map[string]string{
+		"team-a": "metrics: { namespace: a }\nexempt_metrics: [node_.*]",
+		"team-b": "metrics: { namespace: b }\nexempt_metrics: ['up{job=\"kubelet\"}']",
+	}
+
+	for role, def := range defs {
+		acl, err := NewACL(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acls[role] = acl
+	}
+
+	got, err := acls.GetUserACL([]string{"team-a", "team-b"}, false)
+	assert.Nil(t, err)
+
+	var exemptions []string
+	for _, exemption := range got.ExemptMetrics {
+		exemptions = append(exemptions, exemption.String())
+	}
+	assert.Equal(t, []string{"node_.*", `up{job="kubelet"}`}, exemptions)
+}
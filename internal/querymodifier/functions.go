@@ -0,0 +1,139 @@
+package querymodifier
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// FunctionPolicy restricts functions (including aggregations) available in queries. If Allow is not empty, only the listed functions might be used. Functions listed in Deny are never allowed. Names are case-insensitive.
+type FunctionPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// denyAll is set when allow lists of merged policies have nothing in common
+	denyAll bool
+}
+
+// IsZero returns true if the policy doesn't restrict anything.
+func (fp FunctionPolicy) IsZero() bool {
+	return len(fp.Allow) == 0 && len(fp.Deny) == 0 && !fp.denyAll
+}
+
+// Merge returns the strictest combination of both policies: only functions allowed by both are allowed, and functions denied by either are denied. A policy without an allow list doesn't lift the allow list of the other one.
+func (fp FunctionPolicy) Merge(other FunctionPolicy) FunctionPolicy {
+	res := FunctionPolicy{denyAll: fp.denyAll || other.denyAll}
+
+	switch {
+	case len(fp.Allow) == 0:
+		res.Allow = slices.Clone(other.Allow)
+	case len(other.Allow) == 0:
+		res.Allow = slices.Clone(fp.Allow)
+	default:
+		for _, name := range fp.Allow {
+			if slices.Contains(other.Allow, name) {
+				res.Allow = append(res.Allow, name)
+			}
+		}
+		// Otherwise, an empty intersection would turn into "everything is allowed"
+		if len(res.Allow) == 0 {
+			res.denyAll = true
+		}
+	}
+
+	for _, name := range append(slices.Clone(fp.Deny), other.Deny...) {
+		if !slices.Contains(res.Deny, name) {
+			res.Deny = append(res.Deny, name)
+		}
+	}
+
+	sort.Strings(res.Allow)
+	sort.Strings(res.Deny)
+
+	return res
+}
+
+// normalize validates function names and converts them to lower case.
+func (fp FunctionPolicy) normalize() (FunctionPolicy, error) {
+	var res FunctionPolicy
+
+	for _, list := range []struct {
+		names []string
+		dst   *[]string
+	}{
+		{names: fp.Allow, dst: &res.Allow},
+		{names: fp.Deny, dst: &res.Deny},
+	} {
+		for _, name := range list.names {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !isKnownFunction(name) {
+				return FunctionPolicy{}, fmt.Errorf("unknown function %q", name)
+			}
+			if !slices.Contains(*list.dst, name) {
+				*list.dst = append(*list.dst, name)
+			}
+		}
+	}
+
+	sort.Strings(res.Allow)
+	sort.Strings(res.Deny)
+
+	return res, nil
+}
+
+// isKnownFunction returns true if name is a function or an aggregation supported by MetricsQL.
+func isKnownFunction(name string) bool {
+	if metricsql.IsRollupFunc(name) || metricsql.IsTransformFunc(name) {
+		return true
+	}
+
+	// metricsql doesn't expose the list of aggregations, so let the parser tell them apart
+	expr, err := metricsql.Parse(name + "(x)")
+	if err != nil {
+		return false
+	}
+	_, ok := expr.(*metricsql.AggrFuncExpr)
+
+	return ok
+}
+
+// isAllowed returns true if the function might be used according to the policy.
+func (fp FunctionPolicy) isAllowed(name string) bool {
+	name = strings.ToLower(name)
+
+	if fp.denyAll || slices.Contains(fp.Deny, name) {
+		return false
+	}
+
+	return len(fp.Allow) == 0 || slices.Contains(fp.Allow, name)
+}
+
+// checkExpr returns an error naming the first function in the query, which is not allowed by the policy.
+func (fp FunctionPolicy) checkExpr(expr metricsql.Expr) error {
+	if fp.IsZero() {
+		return nil
+	}
+
+	var err error
+
+	metricsql.VisitAll(expr, func(expr metricsql.Expr) {
+		if err != nil {
+			return
+		}
+
+		switch e := expr.(type) {
+		case *metricsql.FuncExpr:
+			if !fp.isAllowed(e.Name) {
+				err = fmt.Errorf("the function %s is not allowed", strings.ToLower(e.Name))
+			}
+		case *metricsql.AggrFuncExpr:
+			if !fp.isAllowed(e.Name) {
+				err = fmt.Errorf("the aggregation %s is not allowed", e.Name)
+			}
+		}
+	})
+
+	return err
+}
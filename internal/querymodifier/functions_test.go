@@ -0,0 +1,162 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryModifier_CheckQueries_functions(t *testing.T) {
+	deny := FunctionPolicy{Deny: []string{"count_values", "label_join", "limit_offset"}}
+	allow := FunctionPolicy{Allow: []string{"rate", "sum"}}
+
+	tests := []struct {
+		name      string
+		functions FunctionPolicy
+		query     string
+		wantErr   string
+	}{
+		{
+			name:  "No policy",
+			query: `count_values("value", up)`,
+		},
+		{
+			name:      "Denied aggregation",
+			functions: deny,
+			query:     `count_values("value", up)`,
+			wantErr:   "the aggregation count_values is not allowed",
+		},
+		{
+			name:      "Denied function deep inside a query",
+			functions: deny,
+			query:     `sum(rate(a[5m])) / sum(label_join(b, "x", ",", "y"))`,
+			wantErr:   "the function label_join is not allowed",
+		},
+		{
+			name:      "Denied MetricsQL function",
+			functions: deny,
+			query:     `limit_offset(10, 100, up)`,
+			wantErr:   "the function limit_offset is not allowed",
+		},
+		{
+			name:      "Function names are case-insensitive",
+			functions: deny,
+			query:     `LABEL_JOIN(up, "x", ",", "y")`,
+			wantErr:   "the function label_join is not allowed",
+		},
+		{
+			name:      "Query without denied functions",
+			functions: deny,
+			query:     `sum(rate(up[5m])) by (namespace)`,
+		},
+		{
+			name:      "Allowed functions",
+			functions: allow,
+			query:     `sum(rate(up[5m])) by (namespace)`,
+		},
+		{
+			name:      "Function not in the allow list",
+			functions: allow,
+			query:     `sum(irate(up[5m]))`,
+			wantErr:   "the function irate is not allowed",
+		},
+		{
+			name:      "Aggregation not in the allow list",
+			functions: allow,
+			query:     `topk(5, rate(up[5m]))`,
+			wantErr:   "the aggregation topk is not allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := QueryModifier{Functions: tt.functions}
+
+			err := qm.CheckQueries(url.Values{"query": {tt.query}}, url.Values{})
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Equal(t, tt.wantErr, err.Error())
+				}
+				return
+			}
+
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestFunctionPolicy_Merge(t *testing.T) {
+	a := FunctionPolicy{Allow: []string{"rate", "sum", "topk"}, Deny: []string{"count_values"}}
+	b := FunctionPolicy{Allow: []string{"rate", "sum"}, Deny: []string{"label_join"}}
+
+	want := FunctionPolicy{Allow: []string{"rate", "sum"}, Deny: []string{"count_values", "label_join"}}
+	assert.Equal(t, want, a.Merge(b))
+	assert.Equal(t, want, b.Merge(a))
+
+	// A policy without an allow list doesn't lift the allow list of the other one
+	assert.Equal(t, FunctionPolicy{Allow: []string{"rate", "sum"}}, FunctionPolicy{}.Merge(FunctionPolicy{Allow: []string{"sum", "rate"}}))
+
+	// Allow lists without common functions don't turn into "everything is allowed"
+	disjoint := FunctionPolicy{Allow: []string{"rate"}}.Merge(FunctionPolicy{Allow: []string{"sum"}})
+	assert.False(t, disjoint.IsZero())
+	assert.False(t, disjoint.isAllowed("rate"))
+	assert.False(t, disjoint.isAllowed("sum"))
+}
+
+func TestFunctionPolicy_normalize(t *testing.T) {
+	got, err := FunctionPolicy{Allow: []string{"Sum", " rate", "sum"}, Deny: []string{"count_values", "limit_offset", "label_join"}}.normalize()
+	assert.Nil(t, err)
+	assert.Equal(t, FunctionPolicy{Allow: []string{"rate", "sum"}, Deny: []string{"count_values", "label_join", "limit_offset"}}, got)
+
+	_, err = FunctionPolicy{Deny: []string{"count_valeus"}}.normalize()
+	assert.NotNil(t, err)
+}
+
+func Test_parseACLFile_functions(t *testing.T) {
+	content := `
+base:
+  functions:
+    deny: [count_values]
+  metrics:
+    namespace: a
+team-a:
+  inherits: [base]
+  functions:
+    allow: [rate, sum, count_values]
+    deny: [label_join]
+  metrics:
+    namespace: b
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, FunctionPolicy{Allow: []string{"count_values", "rate", "sum"}, Deny: []string{"count_values", "label_join"}}, got["team-a"].Functions)
+
+	_, err = parseACLFile([]byte("a: { functions: { deny: [no_such_function] }, metrics: { namespace: a }}"))
+	assert.NotNil(t, err)
+}
+
+func TestACLs_GetUserACL_functions(t *testing.T) {
+	acls := make(ACLs)
+
+	defs := map[string]string{
+		"analyst":  "metrics: { namespace: a }\nfunctions: { deny: [count_values] }",
+		"viewer":   "metrics: { namespace: b }\nfunctions: { allow: [rate, sum] }",
+		"everyone": "metrics: { namespace: c }",
+	}
+
+	for role, def := range defs {
+		acl, err := NewACL(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acls[role] = acl
+	}
+
+	got, err := acls.GetUserACL([]string{"analyst", "viewer", "everyone"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, FunctionPolicy{Allow: []string{"rate", "sum"}, Deny: []string{"count_values"}}, got.Functions)
+
+	_, err = NewACL("metrics: { namespace: a }\nfunctions: { allow: [rat] }")
+	assert.NotNil(t, err)
+}
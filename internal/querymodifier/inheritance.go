@@ -0,0 +1,423 @@
+package querymodifier
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setsKey is the top-level key of acl.yaml holding named value lists
+const setsKey = "sets"
+
+// setRefPrefix marks a reference to a named value list in ACL definitions (e.g. @payments)
+const setRefPrefix = "@"
+
+// roleDefinition describes a role in acl.yaml. Once resolved, Inherits is empty, and definitions of inherited roles are merged into Metrics (or into Grants for time-limited roles). If any of the roles defines rules, inherited rules are collected into Rules instead, and metrics of every role turn into one more rule, so that their label values aren't mixed up. Time and query limits, function and aggregation policies, and required labels of inherited roles are merged too, the strictest ones win. Exempt metrics are combined.
+type roleDefinition struct {
+	Validity       `yaml:",inline"`
+	Inherits       []string            `yaml:"inherits"`
+	Metrics        map[string]string   `yaml:"metrics"`
+	Rules          []map[string]string `yaml:"rules"`
+	Grants         []grantDefinition   `yaml:"grants"`
+	MaxLookback    limitDuration       `yaml:"max_lookback"`
+	MaxRange       limitDuration       `yaml:"max_range"`
+	QueryLimits    `yaml:",inline"`
+	Functions      FunctionPolicy    `yaml:"functions"`
+	RequiredLabels RequiredLabels    `yaml:"required_labels"`
+	Aggregation    AggregationPolicy `yaml:"aggregation_only"`
+	ExemptMetrics  MetricExemptions  `yaml:"exempt_metrics"`
+}
+
+// timeLimits returns the time limits of the role.
+func (rd roleDefinition) timeLimits() TimeLimits {
+	return TimeLimits{
+		MaxLookback: time.Duration(rd.MaxLookback),
+		MaxRange:    time.Duration(rd.MaxRange),
+	}
+}
+
+// grantDefinition describes a time-limited grant of a role in acl.yaml.
+type grantDefinition struct {
+	Validity `yaml:",inline"`
+	Metrics  map[string]string `yaml:"metrics"`
+}
+
+// setValues holds a named value list, which might be defined either as a comma-separated string or as a YAML list.
+type setValues []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (sv *setValues) UnmarshalYAML(node *yaml.Node) error {
+	var items []string
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		items = strings.Split(node.Value, ",")
+	case yaml.SequenceNode:
+		if err := node.Decode(&items); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: a set has to be either a string or a list", node.Line)
+	}
+
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*sv = append(*sv, item)
+		}
+	}
+
+	return nil
+}
+
+// aclResolver flattens role inheritance and references to named value lists into plain definitions as if they were written in acl.yaml by hand.
+type aclResolver struct {
+	roles map[string]roleDefinition
+	sets  map[string]setValues
+	// resolved caches flattened definitions of roles and sets
+	resolvedRoles map[string]roleDefinition
+	resolvedSets  map[string][]string
+	// visiting holds roles and sets currently being resolved, which is used for cycle detection
+	visiting map[string]bool
+}
+
+// newACLResolver returns an aclResolver for the given roles and sets.
+func newACLResolver(roles map[string]roleDefinition, sets map[string]setValues) *aclResolver {
+	return &aclResolver{
+		roles:         roles,
+		sets:          sets,
+		resolvedRoles: make(map[string]roleDefinition),
+		resolvedSets:  make(map[string][]string),
+		visiting:      make(map[string]bool),
+	}
+}
+
+// resolveRole returns the definition of a role merged with the definitions of all inherited roles (values of the same label are combined) and with references to sets expanded. Inherited time-limited roles turn into grants, so they're applied only within their validity period.
+func (ar *aclResolver) resolveRole(role string, path []string) (roleDefinition, error) {
+	if def, ok := ar.resolvedRoles[role]; ok {
+		return def, nil
+	}
+
+	path = append(path, role)
+	if ar.visiting["role:"+role] {
+		return roleDefinition{}, fmt.Errorf("cyclic inheritance: %s", strings.Join(path, " -> "))
+	}
+
+	roleDef, ok := ar.roles[role]
+	if !ok {
+		return roleDefinition{}, fmt.Errorf("role %s inherits unknown role %s", path[len(path)-2], role)
+	}
+
+	if err := roleDef.validate(); err != nil {
+		return roleDefinition{}, fmt.Errorf("role %s: %w", role, err)
+	}
+
+	if len(roleDef.Metrics) > 0 && len(roleDef.Rules) > 0 {
+		return roleDefinition{}, fmt.Errorf("role %s: %w", role, errMetricsAndRules)
+	}
+
+	if err := roleDef.QueryLimits.Validate(); err != nil {
+		return roleDefinition{}, fmt.Errorf("role %s: %w", role, err)
+	}
+
+	functions, err := roleDef.Functions.normalize()
+	if err != nil {
+		return roleDefinition{}, fmt.Errorf("role %s: %w", role, err)
+	}
+
+	aggregation, err := roleDef.Aggregation.normalize()
+	if err != nil {
+		return roleDefinition{}, fmt.Errorf("role %s: %w", role, err)
+	}
+
+	ar.visiting["role:"+role] = true
+	defer delete(ar.visiting, "role:"+role)
+
+	values := make(map[string][]string)
+	var grants []grantDefinition
+	// Definitions of every role are kept apart as well, they're turned into rules if any of the roles defines rules
+	var rules, metricsRules []map[string]string
+	limits := roleDef.timeLimits()
+	queryLimits := roleDef.QueryLimits
+	requiredLabels := roleDef.RequiredLabels
+	exemptMetrics := roleDef.ExemptMetrics
+
+	for _, parent := range roleDef.Inherits {
+		parentDef, err := ar.resolveRole(parent, path)
+		if err != nil {
+			return roleDefinition{}, err
+		}
+
+		limits = limits.merge(parentDef.timeLimits())
+		queryLimits = queryLimits.Merge(parentDef.QueryLimits)
+		functions = functions.Merge(parentDef.Functions)
+		requiredLabels = requiredLabels.Merge(parentDef.RequiredLabels)
+		aggregation = aggregation.Merge(parentDef.Aggregation)
+
+		if !parentDef.IsLimited() {
+			exemptMetrics = exemptMetrics.Merge(parentDef.ExemptMetrics)
+			for label, def := range parentDef.Metrics {
+				values[label] = append(values[label], def)
+			}
+			if len(parentDef.Metrics) > 0 {
+				metricsRules = append(metricsRules, parentDef.Metrics)
+			}
+			rules = append(rules, parentDef.Rules...)
+			grants = append(grants, parentDef.Grants...)
+			continue
+		}
+
+		// Grants consist of metrics only
+		if len(parentDef.Rules) > 0 {
+			return roleDefinition{}, fmt.Errorf("role %s cannot inherit rules of time-limited role %s", role, parent)
+		}
+
+		// Otherwise, the exemptions would outlive the role
+		if len(parentDef.ExemptMetrics) > 0 {
+			return roleDefinition{}, fmt.Errorf("role %s cannot inherit exempt metrics of time-limited role %s", role, parent)
+		}
+
+		if len(parentDef.Metrics) > 0 {
+			grants = append(grants, grantDefinition{Validity: parentDef.Validity, Metrics: parentDef.Metrics})
+		}
+
+		for _, grant := range parentDef.Grants {
+			grant.Validity = grant.intersect(parentDef.Validity)
+			// Otherwise, the grant would never be applied anyway
+			if grant.validate() == nil {
+				grants = append(grants, grant)
+			}
+		}
+	}
+
+	ownMetrics := make(map[string]string, len(roleDef.Metrics))
+	for label, def := range roleDef.Metrics {
+		expanded, err := ar.expandSets(def, nil)
+		if err != nil {
+			return roleDefinition{}, fmt.Errorf("role %s, label %s: %w", role, label, err)
+		}
+		values[label] = append(values[label], expanded)
+		ownMetrics[label] = expanded
+	}
+	if len(ownMetrics) > 0 {
+		metricsRules = append(metricsRules, ownMetrics)
+	}
+
+	for i, rule := range roleDef.Rules {
+		if len(rule) == 0 {
+			return roleDefinition{}, fmt.Errorf("role %s, rule #%d: a rule cannot be empty", role, i)
+		}
+
+		expandedRule := make(map[string]string, len(rule))
+		for label, def := range rule {
+			expanded, err := ar.expandSets(def, nil)
+			if err != nil {
+				return roleDefinition{}, fmt.Errorf("role %s, rule #%d, label %s: %w", role, i, label, err)
+			}
+			expandedRule[label] = expanded
+		}
+		rules = append(rules, expandedRule)
+	}
+
+	for i, grant := range roleDef.Grants {
+		if err := grant.validate(); err != nil {
+			return roleDefinition{}, fmt.Errorf("role %s, grant #%d: %w", role, i, err)
+		}
+
+		if len(grant.Metrics) == 0 {
+			return roleDefinition{}, fmt.Errorf("role %s, grant #%d: metrics cannot be empty", role, i)
+		}
+
+		metrics := make(map[string]string, len(grant.Metrics))
+		for label, def := range grant.Metrics {
+			expanded, err := ar.expandSets(def, nil)
+			if err != nil {
+				return roleDefinition{}, fmt.Errorf("role %s, grant #%d, label %s: %w", role, i, label, err)
+			}
+			metrics[label] = expanded
+		}
+
+		grants = append(grants, grantDefinition{Validity: grant.Validity, Metrics: metrics})
+	}
+
+	def := roleDefinition{
+		Validity:       roleDef.Validity,
+		Metrics:        make(map[string]string, len(values)),
+		Grants:         grants,
+		MaxLookback:    limitDuration(limits.MaxLookback),
+		MaxRange:       limitDuration(limits.MaxRange),
+		QueryLimits:    queryLimits,
+		Functions:      functions,
+		RequiredLabels: requiredLabels,
+		Aggregation:    aggregation,
+		ExemptMetrics:  exemptMetrics,
+	}
+
+	// Rules are combined with OR, so a role granting full access makes them redundant
+	if len(rules) > 0 && !slices.ContainsFunc(metricsRules, isFullAccessDefinition) {
+		def.Rules = append(rules, metricsRules...)
+		values = nil
+	}
+
+	for label, v := range values {
+		def.Metrics[label] = joinDefinitions(v)
+	}
+
+	ar.resolvedRoles[role] = def
+
+	return def, nil
+}
+
+// isFullAccessDefinition returns true if definitions of all labels contain .* (e.g. namespace: "minio, .*").
+func isFullAccessDefinition(defs map[string]string) bool {
+	for _, def := range defs {
+		if isClaimTemplate(def) {
+			return false
+		}
+
+		items, err := toSlice(def)
+		if err != nil || !slices.Contains(items, ".*") {
+			return false
+		}
+	}
+
+	return len(defs) > 0
+}
+
+// expandSets replaces references to sets in a definition with their values. Templates are left as is.
+func (ar *aclResolver) expandSets(def string, path []string) (string, error) {
+	if isClaimTemplate(def) || !strings.Contains(def, setRefPrefix) {
+		return def, nil
+	}
+
+	var items []string
+
+	for _, item := range strings.Split(def, ",") {
+		item = strings.TrimSpace(item)
+
+		name, isRef := strings.CutPrefix(item, setRefPrefix)
+		if !isRef {
+			items = append(items, item)
+			continue
+		}
+
+		values, err := ar.resolveSet(name, path)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, values...)
+	}
+
+	return strings.Join(items, ", "), nil
+}
+
+// resolveSet returns the values of a set with references to other sets expanded.
+func (ar *aclResolver) resolveSet(name string, path []string) ([]string, error) {
+	if values, ok := ar.resolvedSets[name]; ok {
+		return values, nil
+	}
+
+	path = append(path, setRefPrefix+name)
+	if ar.visiting["set:"+name] {
+		return nil, fmt.Errorf("cyclic set reference: %s", strings.Join(path, " -> "))
+	}
+
+	set, ok := ar.sets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown set %s%s", setRefPrefix, name)
+	}
+
+	ar.visiting["set:"+name] = true
+	defer delete(ar.visiting, "set:"+name)
+
+	expanded, err := ar.expandSets(strings.Join(set, ", "), path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := strings.Split(expanded, ", ")
+	ar.resolvedSets[name] = values
+
+	return values, nil
+}
+
+// joinDefinitions combines several definitions of the same label, values repeated through inheritance are dropped.
+func joinDefinitions(defs []string) string {
+	// Keep a single definition intact, so that it's validated exactly as written
+	if len(defs) == 1 {
+		return defs[0]
+	}
+
+	items := make([]string, 0, len(defs))
+	seen := make(map[string]bool)
+
+	for _, def := range defs {
+		// Templates might contain commas, so they're combined as is
+		if isClaimTemplate(def) {
+			items = append(items, def)
+			continue
+		}
+
+		for _, item := range strings.Split(def, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" || seen[item] {
+				continue
+			}
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+
+	return strings.Join(items, ", ")
+}
+
+// parseACLFile parses the content of acl.yaml and returns flattened definitions of all roles.
+func parseACLFile(content []byte) (map[string]roleDefinition, error) {
+	var nodes map[string]yaml.Node
+
+	if err := yaml.Unmarshal(content, &nodes); err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string]roleDefinition, len(nodes))
+	sets := make(map[string]setValues)
+
+	for key, node := range nodes {
+		if key == setsKey {
+			if err := node.Decode(&sets); err != nil {
+				return nil, fmt.Errorf("failed to parse sets: %w", err)
+			}
+			continue
+		}
+
+		var roleDef roleDefinition
+		if err := node.Decode(&roleDef); err != nil {
+			return nil, fmt.Errorf("failed to parse role %s: %w", key, err)
+		}
+		roles[key] = roleDef
+	}
+
+	resolver := newACLResolver(roles, sets)
+
+	// Sorted for deterministic error messages
+	names := make([]string, 0, len(roles))
+	for role := range roles {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+
+	defs := make(map[string]roleDefinition, len(roles))
+	for _, role := range names {
+		def, err := resolver.resolveRole(role, nil)
+		if err != nil {
+			return nil, err
+		}
+		defs[role] = def
+	}
+
+	return defs, nil
+}
@@ -0,0 +1,204 @@
+package querymodifier
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseACLFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]map[string]string
+		wantErr string
+	}{
+		{
+			name:    "Plain roles",
+			content: "team-a: { metrics: { namespace: 'a, b' }}",
+			want: map[string]map[string]string{
+				"team-a": {"namespace": "a, b"},
+			},
+		},
+		{
+			name: "Set defined as a string",
+			content: `
+sets:
+  payments: 'billing, checkout'
+team-a:
+  metrics:
+    namespace: '@payments'
+`,
+			want: map[string]map[string]string{
+				"team-a": {"namespace": "billing, checkout"},
+			},
+		},
+		{
+			name: "Set defined as a list and mixed with plain values",
+			content: `
+sets:
+  payments: [billing, checkout]
+team-a:
+  metrics:
+    namespace: 'default, @payments, kube.*'
+`,
+			want: map[string]map[string]string{
+				"team-a": {"namespace": "default, billing, checkout, kube.*"},
+			},
+		},
+		{
+			name: "Nested sets",
+			content: `
+sets:
+  payments: [billing, checkout]
+  all: '@payments, shipping'
+team-a:
+  metrics:
+    namespace: '@all'
+`,
+			want: map[string]map[string]string{
+				"team-a": {"namespace": "billing, checkout, shipping"},
+			},
+		},
+		{
+			name: "Inherited definitions are merged",
+			content: `
+base:
+  metrics:
+    namespace: 'default'
+    cluster: 'prod'
+team-a:
+  inherits: [base]
+  metrics:
+    namespace: 'a, default'
+`,
+			want: map[string]map[string]string{
+				"base":   {"namespace": "default", "cluster": "prod"},
+				"team-a": {"namespace": "default, a", "cluster": "prod"},
+			},
+		},
+		{
+			name: "Multi-level inheritance",
+			content: `
+sets:
+  payments: [billing, checkout]
+base:
+  metrics:
+    namespace: 'default'
+payments:
+  inherits: [base]
+  metrics:
+    namespace: '@payments'
+lead:
+  inherits: [payments]
+`,
+			want: map[string]map[string]string{
+				"base":     {"namespace": "default"},
+				"payments": {"namespace": "default, billing, checkout"},
+				"lead":     {"namespace": "default, billing, checkout"},
+			},
+		},
+		{
+			name: "Templates are kept as is",
+			content: `
+base:
+  metrics:
+    namespace: '{{ .claims.team }}'
+team-a:
+  inherits: [base]
+  metrics:
+    cluster: 'prod'
+`,
+			want: map[string]map[string]string{
+				"base":   {"namespace": "{{ .claims.team }}"},
+				"team-a": {"namespace": "{{ .claims.team }}", "cluster": "prod"},
+			},
+		},
+		{
+			name: "Cyclic inheritance",
+			content: `
+a: { inherits: [b] }
+b: { inherits: [a] }
+`,
+			wantErr: "cyclic inheritance: a -> b -> a",
+		},
+		{
+			name:    "Self-inheritance",
+			content: "a: { inherits: [a] }",
+			wantErr: "cyclic inheritance: a -> a",
+		},
+		{
+			name:    "Unknown parent",
+			content: "a: { inherits: [b] }",
+			wantErr: "role a inherits unknown role b",
+		},
+		{
+			name: "Cyclic set reference",
+			content: `
+sets:
+  x: '@y'
+  y: '@x'
+a: { metrics: { namespace: '@x' }}
+`,
+			wantErr: "cyclic set reference: @x -> @y -> @x",
+		},
+		{
+			name:    "Unknown set",
+			content: "a: { metrics: { namespace: '@payments' }}",
+			wantErr: "unknown set @payments",
+		},
+		{
+			name:    "Invalid set",
+			content: "sets: { payments: { a: b } }",
+			wantErr: "failed to parse sets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseACLFile([]byte(tt.content))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			assert.Nil(t, err)
+			metrics := make(map[string]map[string]string, len(got))
+			for role, def := range got {
+				metrics[role] = def.Metrics
+			}
+			assert.Equal(t, tt.want, metrics)
+		})
+	}
+}
+
+func TestACL_NewACLsFromFile_inheritance(t *testing.T) {
+	f, err := os.CreateTemp("", "acl-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	saveACLToFile(t, f, `
+sets:
+  payments: [billing, checkout]
+base:
+  metrics:
+    namespace: 'default'
+team-a:
+  inherits: [base]
+  metrics:
+    namespace: '@payments'
+`)
+
+	got, err := NewACLsFromFile(f.Name())
+	assert.Nil(t, err)
+	assert.NotContains(t, got, "sets")
+	assert.Equal(t, "default|billing|checkout", got["team-a"].Metrics["namespace"].Value)
+	assert.Equal(t, "default,billing,checkout", got["team-a"].MetricsMeta["namespace"].RawACL)
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
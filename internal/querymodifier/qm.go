@@ -3,6 +3,7 @@ package querymodifier
 import (
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/VictoriaMetrics/metricsql"
@@ -13,34 +14,69 @@ type QueryModifier struct {
 	ACL                 ACL
 	EnableDeduplication bool
 	OptimizeExpressions bool
+	// QueryLimits restricts the complexity of queries, see CheckQueries.
+	QueryLimits QueryLimits
+	// Functions restricts functions and aggregations available in queries, see CheckQueries.
+	Functions FunctionPolicy
+	// RequiredLabels must be present as a positive matcher in every series selector, they're checked before the ACL is applied.
+	RequiredLabels RequiredLabels
+	// Aggregation restricts queries to aggregated data, see ApplyAggregationPolicy.
+	Aggregation AggregationPolicy
+	// ExemptMetrics lists metrics, which are exempt from the ACL or get different filters instead.
+	ExemptMetrics MetricExemptions
 }
 
 // GetModifiedEncodedURLValues rewrites GET/POST "query" and "match" parameters to filter out metrics.
 func (qm *QueryModifier) GetModifiedEncodedURLValues(params url.Values) (string, error) {
-	newParams := url.Values{}
-
-	if len(qm.ACL.Metrics) == 0 {
+	if len(qm.ACL.Metrics) == 0 && len(qm.ACL.Rules) == 0 {
 		return "", fmt.Errorf("ACL cannot be empty")
 	}
 
+	// The budget is shared by all parameters, so the number of selectors doesn't multiply the time spent on deduplication
+	budget := newRegexpBudget()
+
+	return rewriteEncodedURLValues(params, func(expr metricsql.Expr) (metricsql.Expr, error) {
+		expr, err := qm.modifyMetricExpr(expr, budget)
+		if err != nil {
+			return nil, err
+		}
+
+		if qm.OptimizeExpressions {
+			expr = metricsql.Optimize(expr)
+		}
+
+		return expr, nil
+	})
+}
+
+// rewriteEncodedURLValues applies modify to GET/POST "query" and "match" parameters, other parameters are kept as is.
+func rewriteEncodedURLValues(params url.Values, modify func(metricsql.Expr) (metricsql.Expr, error)) (string, error) {
+	newParams := url.Values{}
+
 	for k, vv := range params {
 		switch k {
 		case "query", "match[]":
 			for _, v := range vv {
-				{
-					expr, err := metricsql.Parse(v)
-					if err != nil {
-						return "", err
-					}
+				expr, err := metricsql.Parse(v)
+				if err != nil {
+					return "", err
+				}
 
-					expr = qm.modifyMetricExpr(expr)
-					if qm.OptimizeExpressions {
-						expr = metricsql.Optimize(expr)
-					}
+				expr, err = modify(expr)
+				if err != nil {
+					return "", err
+				}
 
-					newVal := string(expr.AppendString(nil))
-					newParams.Add(k, newVal)
+				// The API accepts only series selectors in match[], though repeated values are combined anyway, so a union (e.g. produced by rules) is split into separate values
+				if k == "match[]" {
+					for _, operand := range unionOperands(expr) {
+						newParams.Add(k, string(operand.AppendString(nil)))
+					}
+					continue
 				}
+
+				newVal := string(expr.AppendString(nil))
+				newParams.Add(k, newVal)
 			}
 		default:
 			for _, v := range vv {
@@ -52,15 +88,29 @@ func (qm *QueryModifier) GetModifiedEncodedURLValues(params url.Values) (string,
 	return newParams.Encode(), nil
 }
 
-// modifyMetricExpr walks through the query and modifies only metricsql.Expr based on the supplied acl with label filters.
-func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr) metricsql.Expr {
+// modifyMetricExpr walks through the query and modifies only metricsql.Expr based on the supplied acl with label filters. Required labels are checked (and filled in) before the ACL is applied, exempt metrics get their own filters instead of the ACL. If the ACL consists of rules, selectors are rewritten into a union of selectors narrowed down by each rule. Regexp subset checks used for deduplication share the budget.
+func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr, budget *regexpBudget) (metricsql.Expr, error) {
 	newExpr := metricsql.Clone(expr)
 
+	var err error
+
 	modifyLabelFilter := func(expr metricsql.Expr) {
 		if me, ok := expr.(*metricsql.MetricExpr); ok {
+			if err != nil {
+				return
+			}
+
+			if err = qm.applyRequiredLabels(me); err != nil {
+				return
+			}
+
+			if qm.applyMetricExemption(me) {
+				return
+			}
+
 			for label, lf := range qm.ACL.Metrics {
 				if lf.IsRegexp {
-					if !qm.EnableDeduplication || !qm.shouldNotBeModified(me.LabelFilters, label) {
+					if !qm.EnableDeduplication || !qm.shouldNotBeModified(me.LabelFilters, label, budget) {
 						me.LabelFilters = appendOrMergeRegexpLF(me.LabelFilters, lf)
 					}
 				} else {
@@ -72,12 +122,19 @@ func (qm *QueryModifier) modifyMetricExpr(expr metricsql.Expr) metricsql.Expr {
 
 	// Update label filters
 	metricsql.VisitAll(newExpr, modifyLabelFilter)
+	if err != nil {
+		return nil, err
+	}
 
-	return newExpr
+	if len(qm.ACL.Rules) > 0 {
+		return qm.applyRules(newExpr)
+	}
+
+	return newExpr, nil
 }
 
-// shouldNotBeModified helps to understand whether the original label filters have to be modified.
-func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter, label string) bool {
+// shouldNotBeModified helps to understand whether the original label filters have to be modified. Regexp subset checks are limited by the budget.
+func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter, label string, budget *regexpBudget) bool {
 	fullaccess := true
 	for _, metadata := range qm.ACL.MetricsMeta {
 		if !metadata.Fullaccess {
@@ -110,13 +167,10 @@ func (qm *QueryModifier) shouldNotBeModified(filters []metricsql.LabelFilter, la
 				}
 			}
 
-			// Target: both are positive regexps, filter is a subfilter of the newLF or has the same value
+			// Target: both are positive regexps, filter is a subfilter of the newLF (it has the same value as one of the alternatives or matches only values matched by newLF)
 			if filter.IsRegexp {
-				for _, rawSubACL := range rawSubACLs {
-					if filter.Value == rawSubACL {
-						seenUnmodified++
-						continue
-					}
+				if slices.Contains(rawSubACLs, filter.Value) || budget.isSubset(filter.Value, newLF.Value) {
+					seenUnmodified++
 				}
 			}
 		}
@@ -345,7 +345,8 @@ func TestQueryModifier_modifyMetricExpr(t *testing.T) {
 			}
 			originalExpr := metricsql.Clone(expr)
 
-			newExpr := qm.modifyMetricExpr(expr)
+			newExpr, err := qm.modifyMetricExpr(expr, newRegexpBudget())
+			assert.Nil(t, err)
 			assert.Equal(t, originalExpr, expr, "The original expression got modified. Use metricsql.Clone() before modifying any expression.")
 
 			got := string(newExpr.AppendString(nil))
@@ -509,7 +510,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 				qm.ACL.Metrics["namespace"] = filter
 			}
 
-			got := qm.shouldNotBeModified(tt.filters, "namepsace")
+			got := qm.shouldNotBeModified(tt.filters, "namepsace", newRegexpBudget())
 			assert.Equal(t, tt.want, got, tt.comment)
 		})
 	}
@@ -536,7 +537,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters, "namepsace")
+		got := qm.shouldNotBeModified(filters, "namepsace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should be modified, because the original filters contain regexp filters, which are not subfilters of the new filter")
 	})
 
@@ -562,7 +563,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should be modified, because the original filters are regexps, one of which is not a subfilter of the new filter")
 	})
 
@@ -588,7 +589,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := false
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should be modified, because amongst the original filters with the same label (regexp, non-regexp) there is a regexp, which is not a subfilter of the new filter")
 	})
 
@@ -601,7 +602,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filtersNonRegexp, "namespace")
+		got := qm.shouldNotBeModified(filtersNonRegexp, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is not a regexp and the new filter is a matching positive regexp")
 	})
 
@@ -621,7 +622,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is a fake positive regexp (it doesn't contain any special characters, should have been a non-regexp expression, e.g. namespace=~\"kube-system\") and the new filter is a matching positive regexp")
 	})
 
@@ -641,7 +642,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter is a regexp subfilter of the ACL")
 	})
 
@@ -667,10 +668,70 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filters are subfilters of the new filter")
 	})
 
+	t.Run("Original filter is a narrower regexp than one of the ACL alternatives", func(t *testing.T) {
+		filters := []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "minio-.*",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+		}
+
+		qm, err := NewQueryModifier("metrics: { namespace: 'min.*, stolon' }")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := true
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
+		assert.Equal(t, want, got, "Original expression should NOT be modified, because every value matched by the original filter is matched by the new filter")
+	})
+
+	t.Run("Regexp budget of the request is exhausted", func(t *testing.T) {
+		filters := []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "minio-.*",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+		}
+
+		qm, err := NewQueryModifier("metrics: { namespace: 'min.*, stolon' }")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := false
+		got := qm.shouldNotBeModified(filters, "namespace", &regexpBudget{})
+		assert.Equal(t, want, got, "Original expression should be modified, because there's no time left to check whether the original filter is a subfilter of the new filter")
+	})
+
+	t.Run("Original filter is a regexp spanning several ACL alternatives", func(t *testing.T) {
+		filters := []metricsql.LabelFilter{
+			{
+				Label:      "namespace",
+				Value:      "(minio|stolon)-[0-9]+",
+				IsRegexp:   true,
+				IsNegative: false,
+			},
+		}
+
+		qm, err := NewQueryModifier("metrics: { namespace: 'min.*, stolon.*' }")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := true
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
+		assert.Equal(t, want, got, "Original expression should NOT be modified, because every value matched by the original filter is matched by the new filter")
+	})
+
 	t.Run("Repeating filters, new filter matches", func(t *testing.T) {
 		filters := []metricsql.LabelFilter{
 			{
@@ -693,7 +754,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the original filter contains the same non-regexp label filter multiple times and the new filter matches")
 	})
 
@@ -719,7 +780,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because original filters contain a mix of a fake regexp and a non-regexp filters (basically, they're equal in results)")
 	})
 
@@ -739,7 +800,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filters, "namespace")
+		got := qm.shouldNotBeModified(filters, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because original filter and the new filter contain the same regexp")
 	})
 
@@ -750,7 +811,7 @@ func TestQueryModifier_shouldNotBeModified(t *testing.T) {
 		}
 
 		want := true
-		got := qm.shouldNotBeModified(filtersNoTargetLabel, "namespace")
+		got := qm.shouldNotBeModified(filtersNoTargetLabel, "namespace", newRegexpBudget())
 		assert.Equal(t, want, got, "Original expression should NOT be modified, because the new filter gives full access")
 	})
 }
@@ -0,0 +1,223 @@
+package querymodifier
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// QueryLimits restricts the complexity of queries, so that a single careless request cannot overload the upstream. Zero values mean no limit.
+type QueryLimits struct {
+	// MaxLength limits the length of every query in characters.
+	MaxLength int `yaml:"max_query_length"`
+	// MaxDepth limits the depth of the syntax tree of every query (e.g. sum(rate(up[5m])) has the depth of 4).
+	MaxDepth int `yaml:"max_query_depth"`
+	// MaxSelectors limits the number of series selectors in every query.
+	MaxSelectors int `yaml:"max_selectors"`
+	// RequireMetricName rejects series selectors without a metric name (e.g. {__name__=~".+"}).
+	RequireMetricName bool `yaml:"require_metric_name"`
+	// MaxPointsPerSeries limits the number of points per series, which is the ratio of the time range of a request to its step. The same applies to every subquery.
+	MaxPointsPerSeries int `yaml:"max_points_per_series"`
+}
+
+// IsZero returns true if no limits are set.
+func (ql QueryLimits) IsZero() bool {
+	return ql == QueryLimits{}
+}
+
+// Merge returns the strictest combination of both limits.
+func (ql QueryLimits) Merge(other QueryLimits) QueryLimits {
+	return QueryLimits{
+		MaxLength:          minIntLimit(ql.MaxLength, other.MaxLength),
+		MaxDepth:           minIntLimit(ql.MaxDepth, other.MaxDepth),
+		MaxSelectors:       minIntLimit(ql.MaxSelectors, other.MaxSelectors),
+		RequireMetricName:  ql.RequireMetricName || other.RequireMetricName,
+		MaxPointsPerSeries: minIntLimit(ql.MaxPointsPerSeries, other.MaxPointsPerSeries),
+	}
+}
+
+// Validate returns an error if any of the limits is negative.
+func (ql QueryLimits) Validate() error {
+	limits := map[string]int{
+		"max_query_length":      ql.MaxLength,
+		"max_query_depth":       ql.MaxDepth,
+		"max_selectors":         ql.MaxSelectors,
+		"max_points_per_series": ql.MaxPointsPerSeries,
+	}
+
+	for name, limit := range limits {
+		if limit < 0 {
+			return fmt.Errorf("%s cannot be negative, got %d", name, limit)
+		}
+	}
+
+	return nil
+}
+
+// minIntLimit returns the smallest of two limits, where zero stands for no limit.
+func minIntLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// exprDepth returns the depth of the syntax tree of an expression.
+func exprDepth(expr metricsql.Expr) int {
+	var children []metricsql.Expr
+
+	switch e := expr.(type) {
+	case *metricsql.RollupExpr:
+		children = []metricsql.Expr{e.Expr, e.At}
+	case *metricsql.FuncExpr:
+		children = e.Args
+	case *metricsql.AggrFuncExpr:
+		children = e.Args
+	case *metricsql.BinaryOpExpr:
+		children = []metricsql.Expr{e.Left, e.Right}
+	}
+
+	depth := 0
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if d := exprDepth(child); d > depth {
+			depth = d
+		}
+	}
+
+	return depth + 1
+}
+
+// hasMetricName returns true if a series selector matches a single metric name.
+func hasMetricName(me *metricsql.MetricExpr) bool {
+	_, ok := metricName(me)
+	return ok
+}
+
+// checkExpr checks the syntax tree of a query against the limits, step is used for subqueries without an explicit step.
+func (ql QueryLimits) checkExpr(expr metricsql.Expr, step int64) error {
+	if ql.MaxDepth > 0 {
+		if depth := exprDepth(expr); depth > ql.MaxDepth {
+			return fmt.Errorf("the query has a depth of %d, which exceeds the limit of %d", depth, ql.MaxDepth)
+		}
+	}
+
+	var err error
+	selectors := 0
+
+	metricsql.VisitAll(expr, func(expr metricsql.Expr) {
+		if err != nil {
+			return
+		}
+
+		switch e := expr.(type) {
+		case *metricsql.MetricExpr:
+			selectors++
+			if ql.RequireMetricName && !hasMetricName(e) {
+				err = fmt.Errorf("the selector %s has no metric name", e.AppendString(nil))
+			}
+		case *metricsql.RollupExpr:
+			if ql.MaxPointsPerSeries == 0 || !e.ForSubquery() {
+				return
+			}
+
+			subqueryStep := step
+			if e.Step != nil {
+				subqueryStep = e.Step.Duration(step)
+			}
+			if subqueryStep <= 0 {
+				return
+			}
+
+			if points := e.Window.Duration(step) / subqueryStep; points > int64(ql.MaxPointsPerSeries) {
+				err = fmt.Errorf("the subquery %s returns %d points per series, which exceeds the limit of %d", e.AppendString(nil), points, ql.MaxPointsPerSeries)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if ql.MaxSelectors > 0 && selectors > ql.MaxSelectors {
+		return fmt.Errorf("the query has %d selectors, which exceeds the limit of %d", selectors, ql.MaxSelectors)
+	}
+
+	return nil
+}
+
+// CheckQueries checks GET/POST "query" and "match[]" parameters against the query limits and the function policy. The number of points per series is checked for the time range of range queries as well.
+func (qm *QueryModifier) CheckQueries(getParams, postParams url.Values) error {
+	ql := qm.QueryLimits
+	if ql.IsZero() && qm.Functions.IsZero() {
+		return nil
+	}
+
+	step := defaultStep.Milliseconds()
+	rawStep, hasStep := firstValue("step", postParams, getParams)
+	if hasStep {
+		d, err := metricsql.PositiveDurationValue(rawStep, 0)
+		if err != nil {
+			return fmt.Errorf("cannot parse step %q: %w", rawStep, err)
+		}
+		if d > 0 {
+			step = d
+		}
+	}
+
+	hasQuery := false
+	for _, params := range []url.Values{getParams, postParams} {
+		for _, key := range []string{"query", "match[]"} {
+			for _, v := range params[key] {
+				hasQuery = hasQuery || key == "query"
+
+				if ql.MaxLength > 0 && len(v) > ql.MaxLength {
+					return fmt.Errorf("the query is %d characters long, which exceeds the limit of %d", len(v), ql.MaxLength)
+				}
+
+				expr, err := metricsql.Parse(v)
+				if err != nil {
+					return err
+				}
+
+				if err := ql.checkExpr(expr, step); err != nil {
+					return err
+				}
+
+				if err := qm.Functions.checkExpr(expr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Only range queries have both a time range and a step
+	rawStart, hasStart := firstValue("start", postParams, getParams)
+	if ql.MaxPointsPerSeries == 0 || !hasQuery || !hasStart || !hasStep {
+		return nil
+	}
+
+	now := time.Now()
+	start, err := parseTimestamp(rawStart, now)
+	if err != nil {
+		return err
+	}
+
+	end := now.UnixMilli()
+	if rawEnd, ok := firstValue("end", postParams, getParams); ok {
+		end, err = parseTimestamp(rawEnd, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if points := (end-start)/step + 1; points > int64(ql.MaxPointsPerSeries) {
+		return fmt.Errorf("the query returns %d points per series, which exceeds the limit of %d, consider increasing the step", points, ql.MaxPointsPerSeries)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_exprDepth(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: `up`, want: 1},
+		{query: `up[5m]`, want: 2},
+		{query: `sum(rate(up[5m]))`, want: 4},
+		{query: `sum(rate(a[5m])) / sum(b)`, want: 5},
+		{query: `max_over_time(rate(up[5m])[1h:1m])`, want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.want, exprDepth(expr))
+		})
+	}
+}
+
+func TestQueryModifier_CheckQueries(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     QueryLimits
+		getParams  url.Values
+		postParams url.Values
+		wantErr    string
+	}{
+		{
+			name:      "No limits",
+			getParams: url.Values{"query": {`count by (__name__) ({__name__=~".+"})`}},
+		},
+		{
+			name:      "Query within all limits",
+			limits:    QueryLimits{MaxLength: 100, MaxDepth: 5, MaxSelectors: 2, RequireMetricName: true, MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`sum(rate(a[5m])) / sum(b)`}, "start": {"0"}, "end": {"3600"}, "step": {"60"}},
+		},
+		{
+			name:      "Query is too long",
+			limits:    QueryLimits{MaxLength: 10},
+			getParams: url.Values{"query": {`kube_pod_info{namespace="default"}`}},
+			wantErr:   "the query is 34 characters long, which exceeds the limit of 10",
+		},
+		{
+			name:       "Query is too deep",
+			limits:     QueryLimits{MaxDepth: 3},
+			postParams: url.Values{"query": {`sum(rate(up[5m]))`}},
+			wantErr:    "the query has a depth of 4, which exceeds the limit of 3",
+		},
+		{
+			name:      "Too many selectors",
+			limits:    QueryLimits{MaxSelectors: 2},
+			getParams: url.Values{"query": {`a + b + c`}},
+			wantErr:   "the query has 3 selectors, which exceeds the limit of 2",
+		},
+		{
+			name:      "Selectors are counted per query",
+			limits:    QueryLimits{MaxSelectors: 2},
+			getParams: url.Values{"match[]": {`a`, `b`, `c`}},
+		},
+		{
+			name:      "Selector without a metric name",
+			limits:    QueryLimits{RequireMetricName: true},
+			getParams: url.Values{"query": {`count by (__name__) ({__name__=~".+"})`}},
+			wantErr:   `the selector {__name__=~".+"} has no metric name`,
+		},
+		{
+			name:      "Selector with a negative metric name",
+			limits:    QueryLimits{RequireMetricName: true},
+			getParams: url.Values{"match[]": {`{__name__!="up", namespace="default"}`}},
+			wantErr:   `the selector {__name__!="up", namespace="default"} has no metric name`,
+		},
+		{
+			name:      "Selector with a metric name in braces",
+			limits:    QueryLimits{RequireMetricName: true},
+			getParams: url.Values{"match[]": {`{__name__="up", namespace="default"}`}},
+		},
+		{
+			name:      "Too many points per series",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`up`}, "start": {"0"}, "end": {"86400"}, "step": {"60"}},
+			wantErr:   "the query returns 1441 points per series, which exceeds the limit of 1000, consider increasing the step",
+		},
+		{
+			name:       "Points per series with parameters split between GET and POST",
+			limits:     QueryLimits{MaxPointsPerSeries: 1000},
+			getParams:  url.Values{"step": {"1m"}},
+			postParams: url.Values{"query": {`up`}, "start": {"0"}, "end": {"86400"}},
+			wantErr:    "the query returns 1441 points per series, which exceeds the limit of 1000, consider increasing the step",
+		},
+		{
+			name:      "Points per series are not checked for series requests",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"match[]": {`up`}, "start": {"0"}, "end": {"86400"}, "step": {"60"}},
+		},
+		{
+			name:      "Subquery with too many points per series",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`max_over_time(rate(up[5m])[30d:1m])`}},
+			wantErr:   "the subquery rate(up[5m])[30d:1m] returns 43200 points per series, which exceeds the limit of 1000",
+		},
+		{
+			name:      "Subquery with the step of the request",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`max_over_time(rate(up[5m])[1d:])`}, "step": {"60"}},
+			wantErr:   "the subquery rate(up[5m])[1d:] returns 1440 points per series, which exceeds the limit of 1000",
+		},
+		{
+			name:      "Range selectors are not subqueries",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`rate(up[30d])`}, "step": {"60"}},
+		},
+		{
+			name:      "Invalid step",
+			limits:    QueryLimits{MaxPointsPerSeries: 1000},
+			getParams: url.Values{"query": {`up`}, "step": {"often"}},
+			wantErr:   `cannot parse step "often"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := QueryModifier{QueryLimits: tt.limits}
+
+			err := qm.CheckQueries(tt.getParams, tt.postParams)
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestQueryLimits_Merge(t *testing.T) {
+	a := QueryLimits{MaxLength: 1000, MaxDepth: 10}
+	b := QueryLimits{MaxLength: 4000, MaxSelectors: 5, RequireMetricName: true}
+
+	want := QueryLimits{MaxLength: 1000, MaxDepth: 10, MaxSelectors: 5, RequireMetricName: true}
+	assert.Equal(t, want, a.Merge(b))
+	assert.Equal(t, want, b.Merge(a))
+	assert.True(t, QueryLimits{}.Merge(QueryLimits{}).IsZero())
+}
+
+func TestACLs_GetUserACL_queryLimits(t *testing.T) {
+	acls := make(ACLs)
+
+	defs := map[string]string{
+		"analyst":           "metrics: { namespace: a }\nmax_query_depth: 5\nmax_selectors: 10",
+		"strict":            "metrics: { namespace: b }\nmax_selectors: 3\nrequire_metric_name: true",
+		"unlimited":         "metrics: { namespace: c }",
+		"negative-limit":    "metrics: { namespace: d }\nmax_selectors: -1",
+		"non-numeric-limit": "metrics: { namespace: d }\nmax_query_length: long",
+	}
+
+	for role, def := range defs {
+		acl, err := NewACL(def)
+		if role == "negative-limit" || role == "non-numeric-limit" {
+			assert.NotNil(t, err)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		acls[role] = acl
+	}
+
+	got, err := acls.GetUserACL([]string{"analyst", "strict", "unlimited"}, false)
+	assert.Nil(t, err)
+	// The strictest limits win, roles without limits don't lift them
+	assert.Equal(t, QueryLimits{MaxDepth: 5, MaxSelectors: 3, RequireMetricName: true}, got.QueryLimits)
+
+	got, err = acls.GetUserACL([]string{"unlimited"}, false)
+	assert.Nil(t, err)
+	assert.True(t, got.QueryLimits.IsZero())
+}
+
+func Test_parseACLFile_queryLimits(t *testing.T) {
+	content := `
+base:
+  max_query_length: 2048
+  require_metric_name: true
+  metrics:
+    namespace: a
+team-a:
+  inherits: [base]
+  max_query_length: 4096
+  max_points_per_series: 11000
+  metrics:
+    namespace: b
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, QueryLimits{MaxLength: 2048, RequireMetricName: true, MaxPointsPerSeries: 11000}, got["team-a"].QueryLimits)
+
+	_, err = parseACLFile([]byte("a: { max_query_depth: -1, metrics: { namespace: a }}"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,331 @@
+package querymodifier
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// regexpSubsetTimeout limits the time spent on checking whether a regexp of a label filter is covered by an ACL
+const regexpSubsetTimeout = 20 * time.Millisecond
+
+// regexpSubsetRequestBudget limits the total time spent on regexp subset checks per request, so that a query with many regexp selectors cannot consume a lot of CPU
+const regexpSubsetRequestBudget = 100 * time.Millisecond
+
+// regexpSubsetMaxStates limits the number of states explored while checking whether a regexp is covered by another one
+const regexpSubsetMaxStates = 10000
+
+// regexpSubsetMaxFoldRange limits the size of case-insensitive rune ranges, which are expanded into separate runes
+const regexpSubsetMaxFoldRange = 256
+
+// regexpBudget tracks the time left for regexp subset checks within a single request.
+type regexpBudget struct {
+	remaining time.Duration
+}
+
+// newRegexpBudget returns a regexpBudget for a single request.
+func newRegexpBudget() *regexpBudget {
+	return &regexpBudget{remaining: regexpSubsetRequestBudget}
+}
+
+// isSubset calls isRegexpSubset with the time left in the budget (but not more than regexpSubsetTimeout) and deducts the time spent. Once the budget is exhausted, false is returned right away, so label filters are appended without deduplication.
+func (b *regexpBudget) isSubset(sub, super string) bool {
+	if b.remaining <= 0 {
+		return false
+	}
+
+	start := time.Now()
+	ok := isRegexpSubset(sub, super, min(b.remaining, regexpSubsetTimeout))
+	b.remaining -= time.Since(start)
+
+	return ok
+}
+
+// isRegexpSubset returns true if every value matched by sub is matched by super as well (both are treated as anchored, the same way as in Prometheus). It explores the intersection of sub with the complement of super, which is built on the fly from their compiled programs, looking for a value accepted by sub only. False is returned if the regexps cannot be parsed, use unsupported features (e.g. word boundaries), or if the check doesn't complete within the timeout, so that label filters are modified as usual.
+func isRegexpSubset(sub, super string, timeout time.Duration) bool {
+	if sub == super {
+		return true
+	}
+
+	subProg, err := compileRegexpProg(sub)
+	if err != nil {
+		return false
+	}
+
+	superProg, err := compileRegexpProg(super)
+	if err != nil {
+		return false
+	}
+
+	alphabet, ok := regexpAlphabet(subProg, superProg)
+	if !ok {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	// Upstreams differ in whether . matches a new line (e.g. Prometheus 3.x does), so the check has to hold in both cases
+	for _, dotNL := range []bool{false, true} {
+		if !progSubset(subProg, superProg, alphabet, dotNL, deadline) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// progSubset returns true if every value matched by subProg is matched by superProg as well. False is returned if the check doesn't complete before the deadline.
+func progSubset(subProg, superProg *syntax.Prog, alphabet []rune, dotNL bool, deadline time.Time) bool {
+	type pair struct {
+		sub, super []uint32
+		atStart    bool
+	}
+
+	subStart, ok := progClosure(subProg, []uint32{uint32(subProg.Start)}, true)
+	if !ok {
+		return false
+	}
+
+	superStart, ok := progClosure(superProg, []uint32{uint32(superProg.Start)}, true)
+	if !ok {
+		return false
+	}
+
+	queue := []pair{{sub: subStart, super: superStart, atStart: true}}
+	seen := map[string]bool{pairKey(subStart, superStart, true): true}
+
+	for len(queue) > 0 {
+		if len(seen) > regexpSubsetMaxStates || time.Now().After(deadline) {
+			return false
+		}
+
+		p := queue[0]
+		queue = queue[1:]
+
+		subAccepts, ok := progAccepts(subProg, p.sub, p.atStart)
+		if !ok {
+			return false
+		}
+
+		if subAccepts {
+			superAccepts, ok := progAccepts(superProg, p.super, p.atStart)
+			if !ok || !superAccepts {
+				return false
+			}
+		}
+
+		for _, r := range alphabet {
+			nextSub, ok := progStep(subProg, p.sub, r, dotNL)
+			if !ok {
+				return false
+			}
+			// Nothing else can be matched by sub from here
+			if len(nextSub) == 0 {
+				continue
+			}
+
+			nextSuper, ok := progStep(superProg, p.super, r, dotNL)
+			if !ok {
+				return false
+			}
+
+			key := pairKey(nextSub, nextSuper, false)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			queue = append(queue, pair{sub: nextSub, super: nextSuper})
+		}
+	}
+
+	return true
+}
+
+// compileRegexpProg compiles a regexp the same way as regexp.Compile does.
+func compileRegexpProg(expr string) (*syntax.Prog, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	return syntax.Compile(re.Simplify())
+}
+
+// pairKey returns a key identifying a state of the intersection.
+func pairKey(sub, super []uint32, atStart bool) string {
+	var b strings.Builder
+
+	if atStart {
+		b.WriteString("^")
+	}
+	for _, pc := range sub {
+		b.WriteString(strconv.FormatUint(uint64(pc), 10))
+		b.WriteByte(',')
+	}
+	b.WriteByte('|')
+	for _, pc := range super {
+		b.WriteString(strconv.FormatUint(uint64(pc), 10))
+		b.WriteByte(',')
+	}
+
+	return b.String()
+}
+
+// regexpAlphabet splits all runes into intervals, within which both programs behave the same way, and returns the first rune of every interval. False is returned if case-insensitive ranges are too large to be expanded.
+func regexpAlphabet(progs ...*syntax.Prog) ([]rune, bool) {
+	bounds := map[rune]bool{0: true, '\n': true, '\n' + 1: true}
+
+	addRange := func(lo, hi rune) {
+		bounds[lo] = true
+		if hi < unicode.MaxRune {
+			bounds[hi+1] = true
+		}
+	}
+
+	for _, prog := range progs {
+		for _, inst := range prog.Inst {
+			if inst.Op != syntax.InstRune && inst.Op != syntax.InstRune1 {
+				continue
+			}
+
+			ranges := inst.Rune
+			if len(ranges) == 1 {
+				ranges = []rune{ranges[0], ranges[0]}
+			}
+
+			foldCase := syntax.Flags(inst.Arg)&syntax.FoldCase != 0
+
+			for i := 0; i+1 < len(ranges); i += 2 {
+				lo, hi := ranges[i], ranges[i+1]
+				addRange(lo, hi)
+
+				if !foldCase {
+					continue
+				}
+
+				if hi-lo > regexpSubsetMaxFoldRange {
+					return nil, false
+				}
+
+				for r := lo; r <= hi; r++ {
+					for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+						addRange(f, f)
+					}
+				}
+			}
+		}
+	}
+
+	alphabet := make([]rune, 0, len(bounds))
+	for r := range bounds {
+		if r <= unicode.MaxRune {
+			alphabet = append(alphabet, r)
+		}
+	}
+	sort.Slice(alphabet, func(i, j int) bool {
+		return alphabet[i] < alphabet[j]
+	})
+
+	return alphabet, true
+}
+
+// progClosure returns instructions reachable from pcs without consuming any runes: rune instructions, matches, and instructions asserting the end of text (they're resolved by progAccepts). False is returned if the program contains unsupported assertions (e.g. word boundaries).
+func progClosure(prog *syntax.Prog, pcs []uint32, atStart bool) ([]uint32, bool) {
+	return progClosureAt(prog, pcs, atStart, false)
+}
+
+// progClosureAt works the same way as progClosure, though assertions of the end of text hold if atEnd is set.
+func progClosureAt(prog *syntax.Prog, pcs []uint32, atStart, atEnd bool) ([]uint32, bool) {
+	visited := make(map[uint32]bool)
+	stack := append([]uint32{}, pcs...)
+	var res []uint32
+
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[pc] {
+			continue
+		}
+		visited[pc] = true
+
+		inst := prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			op := syntax.EmptyOp(inst.Arg)
+			if op&^(syntax.EmptyBeginText|syntax.EmptyEndText) != 0 {
+				return nil, false
+			}
+			if op&syntax.EmptyBeginText != 0 && !atStart {
+				continue
+			}
+			if op&syntax.EmptyEndText != 0 && !atEnd {
+				res = append(res, pc)
+				continue
+			}
+			stack = append(stack, inst.Out)
+		case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			res = append(res, pc)
+		case syntax.InstFail:
+		default:
+			return nil, false
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+
+	return res, true
+}
+
+// progAccepts returns true if the value read so far is matched by the program.
+func progAccepts(prog *syntax.Prog, pcs []uint32, atStart bool) (bool, bool) {
+	closure, ok := progClosureAt(prog, pcs, atStart, true)
+	if !ok {
+		return false, false
+	}
+
+	for _, pc := range closure {
+		if prog.Inst[pc].Op == syntax.InstMatch {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+// progStep returns instructions reachable from pcs after consuming the rune. If dotNL is set, . matches a new line even without the s flag.
+func progStep(prog *syntax.Prog, pcs []uint32, r rune, dotNL bool) ([]uint32, bool) {
+	var next []uint32
+
+	for _, pc := range pcs {
+		inst := prog.Inst[pc]
+
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1:
+			if inst.MatchRune(r) {
+				next = append(next, inst.Out)
+			}
+		case syntax.InstRuneAny:
+			next = append(next, inst.Out)
+		case syntax.InstRuneAnyNotNL:
+			if dotNL || r != '\n' {
+				next = append(next, inst.Out)
+			}
+		}
+	}
+
+	if len(next) == 0 {
+		return nil, true
+	}
+
+	return progClosure(prog, next, false)
+}
@@ -0,0 +1,139 @@
+package querymodifier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isRegexpSubset(t *testing.T) {
+	tests := []struct {
+		name    string
+		sub     string
+		super   string
+		timeout time.Duration
+		want    bool
+	}{
+		{
+			name:  "Same regexps",
+			sub:   "min.*",
+			super: "min.*",
+			want:  true,
+		},
+		{
+			name:  "Narrower regexp",
+			sub:   "minio-.*",
+			super: "min.*|stolon",
+			want:  true,
+		},
+		{
+			name:  "Wider regexp",
+			sub:   "min.*",
+			super: "mini.*",
+			want:  false,
+		},
+		{
+			name:  "Match-all regexp",
+			sub:   ".*",
+			super: "min.*",
+			want:  false,
+		},
+		{
+			name:  "Alternatives covered by different parts of the ACL",
+			sub:   "minio|stolon-[0-9]+",
+			super: "min.*|stolon-.*",
+			want:  true,
+		},
+		{
+			name:  "Empty alternative",
+			sub:   "minio|",
+			super: "min.*",
+			want:  false,
+		},
+		{
+			name:  "Equivalent character classes",
+			sub:   "minio-[0-9]+",
+			super: `minio-\d+`,
+			want:  true,
+		},
+		{
+			name:  "Character class wider than the ACL",
+			sub:   "minio-[0-9a-f]",
+			super: "minio-[0-9]",
+			want:  false,
+		},
+		{
+			name:  "Case-sensitive regexp covered by a case-insensitive one",
+			sub:   "minio",
+			super: "(?i)MINIO",
+			want:  true,
+		},
+		{
+			name:  "Case-insensitive regexp",
+			sub:   "(?i)minio",
+			super: "minio",
+			want:  false,
+		},
+		{
+			name:  "Explicit anchors",
+			sub:   "^minio$",
+			super: "min.*",
+			want:  true,
+		},
+		{
+			name:  "Regexp matching new lines",
+			sub:   "(?s)min.*",
+			super: "min.*",
+			want:  false,
+		},
+		{
+			name:  "ACL matching new lines",
+			sub:   "min.*",
+			super: "(?s)min.*",
+			want:  true,
+		},
+		{
+			name:  "Unsupported assertions",
+			sub:   `\bminio`,
+			super: "min.*",
+			want:  false,
+		},
+		{
+			name:  "Invalid regexp",
+			sub:   "min(.*",
+			super: "min.*",
+			want:  false,
+		},
+		{
+			name:    "Timeout",
+			sub:     "minio-.*",
+			super:   "min.*",
+			timeout: -1,
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = regexpSubsetTimeout
+			}
+
+			got := isRegexpSubset(tt.sub, tt.super, timeout)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_regexpBudget_isSubset(t *testing.T) {
+	budget := newRegexpBudget()
+	assert.True(t, budget.isSubset("minio-.*", "min.*"))
+	assert.Less(t, budget.remaining, regexpSubsetRequestBudget)
+
+	// Once the budget is exhausted, checks fail right away
+	budget.remaining = 0
+	assert.False(t, budget.isSubset("minio-.*", "min.*"))
+	assert.Equal(t, time.Duration(0), budget.remaining)
+}
@@ -0,0 +1,153 @@
+package querymodifier
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"gopkg.in/yaml.v3"
+)
+
+// RequiredLabels holds labels, which must be present as a positive matcher in every series selector, along with their default values. A selector missing a label with a default value gets label="default", a selector missing a label without a default value is rejected.
+type RequiredLabels map[string]string
+
+// NewRequiredLabels returns RequiredLabels based on definitions in the form of "label" (rejected if missing) or "label=default" (filled in if missing).
+func NewRequiredLabels(defs []string) (RequiredLabels, error) {
+	rl := make(RequiredLabels, len(defs))
+
+	for _, def := range defs {
+		label, value, hasDefault := strings.Cut(strings.TrimSpace(def), "=")
+		label = strings.TrimSpace(label)
+		value = strings.TrimSpace(value)
+
+		if label == "" {
+			return nil, fmt.Errorf("required label cannot be empty, got %q", def)
+		}
+
+		if hasDefault && value == "" {
+			return nil, fmt.Errorf("default value of required label %s cannot be empty", label)
+		}
+
+		if existing, ok := rl[label]; ok && existing != value {
+			return nil, fmt.Errorf("required label %s is defined more than once", label)
+		}
+
+		rl[label] = value
+	}
+
+	if len(rl) == 0 {
+		return nil, nil
+	}
+
+	return rl, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Required labels might be defined either as a comma-separated string or as a YAML list.
+func (rl *RequiredLabels) UnmarshalYAML(node *yaml.Node) error {
+	var defs setValues
+	if err := node.Decode(&defs); err != nil {
+		return err
+	}
+
+	parsed, err := NewRequiredLabels(defs)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	*rl = parsed
+
+	return nil
+}
+
+// Merge returns the strictest combination of both sets of required labels. If a label is required by both with different default values, the default value is dropped, so selectors without the label are rejected.
+func (rl RequiredLabels) Merge(other RequiredLabels) RequiredLabels {
+	if len(rl) == 0 && len(other) == 0 {
+		return nil
+	}
+
+	res := make(RequiredLabels, len(rl)+len(other))
+	for label, value := range rl {
+		res[label] = value
+	}
+
+	for label, value := range other {
+		if existing, ok := res[label]; ok && existing != value {
+			value = ""
+		}
+		res[label] = value
+	}
+
+	return res
+}
+
+// hasPositiveMatcher returns true if filters contain a matcher for the label, which doesn't match an empty value (e.g. cluster="a" or cluster=~"a|b", but neither cluster!="a" nor cluster=~".*").
+func hasPositiveMatcher(filters []metricsql.LabelFilter, label string) bool {
+	for _, filter := range filters {
+		if filter.Label != label || filter.IsNegative {
+			continue
+		}
+
+		if !filter.IsRegexp {
+			if filter.Value != "" {
+				return true
+			}
+			continue
+		}
+
+		re, err := metricsql.CompileRegexpAnchored(filter.Value)
+		if err == nil && !re.MatchString("") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyRequiredLabels fills in default values of required labels missing in a series selector, or returns an error if a required label without a default value is missing. Labels are processed in a sorted order, so that the results are stable.
+func (qm *QueryModifier) applyRequiredLabels(me *metricsql.MetricExpr) error {
+	labels := make([]string, 0, len(qm.RequiredLabels))
+	for label := range qm.RequiredLabels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var missing []string
+	for _, label := range labels {
+		if hasPositiveMatcher(me.LabelFilters, label) {
+			continue
+		}
+
+		// The selector is checked as a whole before it's modified, so that errors show it as it was written
+		if qm.RequiredLabels[label] == "" {
+			return fmt.Errorf("the selector %s has to contain a positive matcher for the label %s", me.AppendString(nil), label)
+		}
+		missing = append(missing, label)
+	}
+
+	for _, label := range missing {
+		me.LabelFilters = append(me.LabelFilters, metricsql.LabelFilter{
+			Label: label,
+			Value: qm.RequiredLabels[label],
+		})
+	}
+
+	return nil
+}
+
+// AddRequiredLabels rewrites GET/POST "query" and "match" parameters, so that they satisfy required labels. It's meant for users with full access, whose requests are not modified otherwise.
+func (qm *QueryModifier) AddRequiredLabels(params url.Values) (string, error) {
+	return rewriteEncodedURLValues(params, func(expr metricsql.Expr) (metricsql.Expr, error) {
+		newExpr := metricsql.Clone(expr)
+
+		var err error
+		metricsql.VisitAll(newExpr, func(expr metricsql.Expr) {
+			if me, ok := expr.(*metricsql.MetricExpr); ok && err == nil {
+				err = qm.applyRequiredLabels(me)
+			}
+		})
+
+		return newExpr, err
+	})
+}
@@ -0,0 +1,222 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRequiredLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		defs    []string
+		want    RequiredLabels
+		wantErr bool
+	}{
+		{
+			name: "Empty",
+		},
+		{
+			name: "With and without defaults",
+			defs: []string{"cluster=eu-west-1", " env "},
+			want: RequiredLabels{"cluster": "eu-west-1", "env": ""},
+		},
+		{
+			name:    "Empty label",
+			defs:    []string{"=eu-west-1"},
+			wantErr: true,
+		},
+		{
+			name:    "Empty default",
+			defs:    []string{"cluster="},
+			wantErr: true,
+		},
+		{
+			name:    "Conflicting definitions",
+			defs:    []string{"cluster=eu-west-1", "cluster"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewRequiredLabels(tt.defs)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRequiredLabels_Merge(t *testing.T) {
+	a := RequiredLabels{"cluster": "eu-west-1", "env": "prod"}
+	b := RequiredLabels{"cluster": "us-east-1", "env": "prod", "region": ""}
+
+	// Conflicting defaults are dropped, so that queries without the label are rejected
+	want := RequiredLabels{"cluster": "", "env": "prod", "region": ""}
+	assert.Equal(t, want, a.Merge(b))
+	assert.Equal(t, want, b.Merge(a))
+	assert.Nil(t, RequiredLabels(nil).Merge(nil))
+}
+
+func TestQueryModifier_modifyMetricExpr_requiredLabels(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawACL         string
+		requiredLabels RequiredLabels
+		query          string
+		want           string
+		wantErr        bool
+	}{
+		{
+			name:           "Required label is present",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration{cluster="eu-west-1"}`,
+			want:           `request_duration{cluster="eu-west-1", namespace="minio"}`,
+		},
+		{
+			name:           "Required label as a regexp",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration{cluster=~"eu-.+"}`,
+			want:           `request_duration{cluster=~"eu-.+", namespace="minio"}`,
+		},
+		{
+			name:           "Required label is missing",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration`,
+			wantErr:        true,
+		},
+		{
+			name:           "Required label is missing in one of the selectors",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `sum(rate(a{cluster="eu-west-1"}[5m])) / sum(rate(b[5m]))`,
+			wantErr:        true,
+		},
+		{
+			name:           "Negative matcher doesn't count",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration{cluster!="eu-west-1"}`,
+			wantErr:        true,
+		},
+		{
+			name:           "Regexp matching an empty value doesn't count",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration{cluster=~".*"}`,
+			wantErr:        true,
+		},
+		{
+			name:           "Empty value doesn't count",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration{cluster=""}`,
+			wantErr:        true,
+		},
+		{
+			name:           "Default value is filled in",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": "eu-west-1"},
+			query:          `sum(rate(a{cluster="us-east-1"}[5m])) / sum(rate(b[5m]))`,
+			want:           `sum(rate(a{cluster="us-east-1", namespace="minio"}[5m])) / sum(rate(b{cluster="eu-west-1", namespace="minio"}[5m]))`,
+		},
+		{
+			name:           "Default value is filled in next to a negative matcher",
+			rawACL:         "metrics: { namespace: minio }",
+			requiredLabels: RequiredLabels{"cluster": "eu-west-1"},
+			query:          `request_duration{cluster!="us-east-1"}`,
+			want:           `request_duration{cluster!="us-east-1", cluster="eu-west-1", namespace="minio"}`,
+		},
+		{
+			name:           "Required labels are checked before the ACL is applied",
+			rawACL:         "metrics: { cluster: eu-west-1 }",
+			requiredLabels: RequiredLabels{"cluster": ""},
+			query:          `request_duration`,
+			wantErr:        true,
+		},
+		{
+			name:           "Series matchers",
+			rawACL:         "metrics: { namespace: 'minio, stolon' }",
+			requiredLabels: RequiredLabels{"cluster": "eu-west-1", "env": "prod"},
+			query:          `{__name__="request_duration", env="dev"}`,
+			want:           `request_duration{env="dev", cluster="eu-west-1", namespace=~"minio|stolon"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:            acl,
+				RequiredLabels: tt.requiredLabels,
+			}
+
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			originalExpr := metricsql.Clone(expr)
+
+			newExpr, err := qm.modifyMetricExpr(expr, newRegexpBudget())
+			assert.Equal(t, originalExpr, expr, "The original expression got modified. Use metricsql.Clone() before modifying any expression.")
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(newExpr.AppendString(nil)))
+		})
+	}
+}
+
+func TestQueryModifier_AddRequiredLabels(t *testing.T) {
+	qm := QueryModifier{RequiredLabels: RequiredLabels{"cluster": "eu-west-1"}}
+
+	got, err := qm.AddRequiredLabels(url.Values{"query": {`sum(up) by (namespace)`}, "step": {"60"}})
+	assert.Nil(t, err)
+	assert.Equal(t, url.Values{"query": {`sum(up{cluster="eu-west-1"}) by (namespace)`}, "step": {"60"}}.Encode(), got)
+
+	qm = QueryModifier{RequiredLabels: RequiredLabels{"cluster": ""}}
+
+	_, err = qm.AddRequiredLabels(url.Values{"match[]": {`up{cluster="eu-west-1"}`, `up`}})
+	assert.NotNil(t, err)
+}
+
+func Test_parseACLFile_requiredLabels(t *testing.T) {
+	content := `
+base:
+  required_labels: [cluster]
+  metrics:
+    namespace: a
+team-a:
+  inherits: [base]
+  required_labels: cluster=eu-west-1, env=prod
+  metrics:
+    namespace: b
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, RequiredLabels{"cluster": "", "env": "prod"}, got["team-a"].RequiredLabels)
+
+	acl, err := NewACL("metrics: { namespace: a }\nrequired_labels: [cluster=eu-west-1]")
+	assert.Nil(t, err)
+	assert.Equal(t, RequiredLabels{"cluster": "eu-west-1"}, acl.RequiredLabels)
+
+	_, err = parseACLFile([]byte("a: { required_labels: [cluster=], metrics: { namespace: a }}"))
+	assert.NotNil(t, err)
+}
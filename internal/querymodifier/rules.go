@@ -0,0 +1,303 @@
+package querymodifier
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// errMetricsAndRules is returned for definitions containing both metrics and rules, since it's not obvious whether they should be combined with AND or OR
+var errMetricsAndRules = errors.New("metrics and rules cannot be defined together, metrics can be added as one more rule instead")
+
+// Rule is a tuple of label filters, which have to match all together (e.g. namespace="payments" and cluster="eu1"). Unlike metrics, where values of every label are allowed independently of each other, rules are combined with OR, so a series is visible if it matches at least one of them.
+type Rule []metricsql.LabelFilter
+
+// newRule returns a Rule based on definitions of label values (e.g. namespace: payments, cluster: eu1), which follow the same syntax as metrics. Filters are sorted by label, so that rewritten queries are stable.
+func newRule(defs map[string]string) (Rule, error) {
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("a rule cannot be empty")
+	}
+
+	rule := make(Rule, 0, len(defs))
+	fullaccess := true
+
+	for label, value := range defs {
+		// Rules are not merged with rendered templates, so they have to be static
+		if isClaimTemplate(value) {
+			return nil, fmt.Errorf("rules cannot reference token claims (label %s)", label)
+		}
+
+		lf, metadata, err := newLabelFilter(label, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if !metadata.Fullaccess {
+			fullaccess = false
+		}
+		rule = append(rule, lf)
+	}
+
+	if fullaccess {
+		return nil, fmt.Errorf("the rule %s grants full access, use metrics instead", rule)
+	}
+
+	sort.Slice(rule, func(i, j int) bool {
+		return rule[i].Label < rule[j].Label
+	})
+
+	return rule, nil
+}
+
+// newRules returns rules based on a list of definitions.
+func newRules(defs []map[string]string) ([]Rule, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]Rule, 0, len(defs))
+	for i, def := range defs {
+		rule, err := newRule(def)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ruleFromMetrics turns label filters of an ACL into a single rule, which is used whenever an ACL defined through metrics is combined with rules.
+func ruleFromMetrics(metrics map[string]metricsql.LabelFilter) Rule {
+	rule := make(Rule, 0, len(metrics))
+	for _, lf := range metrics {
+		rule = append(rule, lf)
+	}
+
+	sort.Slice(rule, func(i, j int) bool {
+		return rule[i].Label < rule[j].Label
+	})
+
+	return rule
+}
+
+// String returns the rule in the form of a series selector, e.g. {cluster="eu1", namespace="payments"}.
+func (r Rule) String() string {
+	filters := make([]string, 0, len(r))
+	for _, lf := range r {
+		filters = append(filters, string(lf.AppendString(nil)))
+	}
+
+	return "{" + strings.Join(filters, ", ") + "}"
+}
+
+// narrowFilters returns the label filters of a selector combined with the filters of a rule. Filters implied by an exact matcher of the selector (e.g. namespace="payments" for the rule namespace=~"pay.*") are not added. The second value is false if an exact matcher contradicts the rule, so the resulting selector cannot match anything.
+func narrowFilters(filters []metricsql.LabelFilter, rule Rule) ([]metricsql.LabelFilter, bool) {
+	newFilters := make([]metricsql.LabelFilter, 0, len(filters)+len(rule))
+	newFilters = append(newFilters, filters...)
+	possible := true
+
+	for _, lf := range rule {
+		if isFullAccess(lf) {
+			continue
+		}
+
+		implied := false
+		for _, filter := range filters {
+			if filter.Label != lf.Label || filter.IsNegative || (filter.IsRegexp && !isFakePositiveRegexp(filter)) {
+				continue
+			}
+
+			if matchesLabelFilter(lf, filter.Value) {
+				implied = true
+			} else {
+				possible = false
+			}
+		}
+
+		if !implied {
+			newFilters = append(newFilters, lf)
+		}
+	}
+
+	return newFilters, possible
+}
+
+// matchesLabelFilter returns true if a positive label filter matches the value. Invalid regexps never match.
+func matchesLabelFilter(lf metricsql.LabelFilter, value string) bool {
+	if !lf.IsRegexp {
+		return lf.Value == value
+	}
+
+	// Prometheus treats all regexp queries as anchored
+	re, err := metricsql.CompileRegexpAnchored(lf.Value)
+	return err == nil && re.MatchString(value)
+}
+
+// ruleSelector returns the series selector, which has to be narrowed down by rules in order to rewrite the expression: either the selector itself, the selector of a range / offset expression, or the selector passed to a rollup function. Nil is returned for other expressions, including subqueries.
+func ruleSelector(expr metricsql.Expr) *metricsql.MetricExpr {
+	switch e := expr.(type) {
+	case *metricsql.MetricExpr:
+		return e
+	case *metricsql.RollupExpr:
+		if e.ForSubquery() {
+			return nil
+		}
+		me, _ := e.Expr.(*metricsql.MetricExpr)
+		return me
+	case *metricsql.FuncExpr:
+		idx := metricsql.GetRollupArgIdx(e)
+		if idx < 0 || idx >= len(e.Args) {
+			return nil
+		}
+		if _, ok := e.Args[idx].(*metricsql.FuncExpr); ok {
+			return nil
+		}
+		return ruleSelector(e.Args[idx])
+	default:
+		return nil
+	}
+}
+
+// applyRules rewrites the expression, so that every series selector is replaced with a union (or) of copies narrowed down by each of the rules. The union is built around the nearest expression returning an instant vector (a selector, an offset expression or a rollup function over a selector), so aggregations and binary operations on top of it see exactly the series allowed by the rules. The expression is modified in place, it has to be cloned beforehand.
+func (qm *QueryModifier) applyRules(expr metricsql.Expr) (metricsql.Expr, error) {
+	var err error
+
+	switch e := expr.(type) {
+	case *metricsql.MetricExpr:
+		return qm.unionOfRules(e), nil
+	case *metricsql.RollupExpr:
+		if e.At != nil {
+			if e.At, err = qm.applyRules(e.At); err != nil {
+				return nil, err
+			}
+		}
+
+		if ruleSelector(e) == nil {
+			e.Expr, err = qm.applyRules(e.Expr)
+			return e, err
+		}
+
+		if qm.isExempt(ruleSelector(e)) {
+			return e, nil
+		}
+
+		// Range vectors cannot be combined through or, so they have to be passed to a rollup function first
+		if e.Window != nil && len(qm.ACL.Rules) > 1 {
+			return nil, fmt.Errorf("the range selector %s has to be passed to a rollup function (e.g. rate, max_over_time)", e.AppendString(nil))
+		}
+
+		return qm.unionOfRules(e), nil
+	case *metricsql.FuncExpr:
+		idx := -1
+		if ruleSelector(e) != nil {
+			idx = metricsql.GetRollupArgIdx(e)
+		}
+
+		for i, arg := range e.Args {
+			if i == idx {
+				continue
+			}
+			if e.Args[i], err = qm.applyRules(arg); err != nil {
+				return nil, err
+			}
+		}
+
+		if idx < 0 {
+			return e, nil
+		}
+
+		if re, ok := e.Args[idx].(*metricsql.RollupExpr); ok && re.At != nil {
+			if re.At, err = qm.applyRules(re.At); err != nil {
+				return nil, err
+			}
+		}
+
+		return qm.unionOfRules(e), nil
+	case *metricsql.AggrFuncExpr:
+		for i, arg := range e.Args {
+			if e.Args[i], err = qm.applyRules(arg); err != nil {
+				return nil, err
+			}
+		}
+		return e, nil
+	case *metricsql.BinaryOpExpr:
+		if e.Left, err = qm.applyRules(e.Left); err != nil {
+			return nil, err
+		}
+		if e.Right, err = qm.applyRules(e.Right); err != nil {
+			return nil, err
+		}
+		return e, nil
+	default:
+		return expr, nil
+	}
+}
+
+// unionOperands returns operands of a union built through or without modifiers (e.g. a or b or c), other expressions are returned as is.
+func unionOperands(expr metricsql.Expr) []metricsql.Expr {
+	be, ok := expr.(*metricsql.BinaryOpExpr)
+	if !ok || strings.ToLower(be.Op) != "or" || be.GroupModifier.Op != "" || be.JoinModifier.Op != "" {
+		return []metricsql.Expr{expr}
+	}
+
+	return append(unionOperands(be.Left), unionOperands(be.Right)...)
+}
+
+// unionOfRules returns a union of copies of the expression, in which the selector returned by ruleSelector is narrowed down by each of the rules. Copies that cannot match anything or repeat previous ones are skipped. If no copy can match anything, the one narrowed down by the first rule is returned, so the result stays empty.
+func (qm *QueryModifier) unionOfRules(expr metricsql.Expr) metricsql.Expr {
+	// Exempt selectors already got their own filters
+	if qm.isExempt(ruleSelector(expr)) {
+		return expr
+	}
+
+	var branches []metricsql.Expr
+	var fallback metricsql.Expr
+	seen := make(map[string]bool)
+
+	for _, rule := range qm.ACL.Rules {
+		branch := metricsql.Clone(expr)
+		me := ruleSelector(branch)
+
+		var possible bool
+		me.LabelFilters, possible = narrowFilters(me.LabelFilters, rule)
+
+		if fallback == nil {
+			fallback = branch
+		}
+
+		key := string(branch.AppendString(nil))
+		if !possible || seen[key] {
+			continue
+		}
+		seen[key] = true
+		branches = append(branches, branch)
+	}
+
+	if len(branches) == 0 {
+		return fallback
+	}
+
+	// absent_over_time returns a series only if nothing matches the selector, so it has to hold true for all rules at once
+	op := "or"
+	var groupModifier metricsql.ModifierExpr
+	if fe, ok := expr.(*metricsql.FuncExpr); ok && strings.ToLower(fe.Name) == "absent_over_time" {
+		op = "and"
+		groupModifier = metricsql.ModifierExpr{Op: "on"}
+	}
+
+	union := branches[0]
+	for _, branch := range branches[1:] {
+		union = &metricsql.BinaryOpExpr{
+			Op:            op,
+			GroupModifier: groupModifier,
+			Left:          union,
+			Right:         branch,
+		}
+	}
+
+	return union
+}
@@ -0,0 +1,517 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		defs    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Exact values",
+			defs: map[string]string{"namespace": "payments", "cluster": "eu1"},
+			want: `{cluster="eu1", namespace="payments"}`,
+		},
+		{
+			name: "Lists and regexps",
+			defs: map[string]string{"namespace": "payments, billing", "cluster": "eu.*"},
+			want: `{cluster=~"eu.*", namespace=~"payments|billing"}`,
+		},
+		{
+			name: "Full access to one of the labels",
+			defs: map[string]string{"namespace": ".*", "cluster": "eu1"},
+			want: `{cluster="eu1", namespace=~".*"}`,
+		},
+		{
+			name:    "Empty",
+			defs:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:    "Full access",
+			defs:    map[string]string{"namespace": ".*", "cluster": ".*"},
+			wantErr: true,
+		},
+		{
+			name:    "Template",
+			defs:    map[string]string{"namespace": "{{ .claims.team }}"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid regexp",
+			defs:    map[string]string{"namespace": "payments-(.*"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newRule(tt.defs)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestQueryModifier_modifyMetricExpr_rules(t *testing.T) {
+	twoRules := `
+rules:
+  - namespace: payments
+    cluster: eu1
+  - namespace: billing
+    cluster: us2
+`
+
+	tests := []struct {
+		name    string
+		rawACL  string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Single rule is applied as is",
+			rawACL: "rules: [{ namespace: payments, cluster: eu1 }]",
+			query:  `request_duration{job="demo"}`,
+			want:   `request_duration{job="demo", cluster="eu1", namespace="payments"}`,
+		},
+		{
+			name:   "Single rule with a range selector",
+			rawACL: "rules: [{ namespace: payments, cluster: eu1 }]",
+			query:  `request_duration[5m]`,
+			want:   `request_duration{cluster="eu1", namespace="payments"}[5m]`,
+		},
+		{
+			name:   "Selector",
+			rawACL: twoRules,
+			query:  `request_duration{job="demo"}`,
+			want:   `request_duration{job="demo", cluster="eu1", namespace="payments"} or request_duration{job="demo", cluster="us2", namespace="billing"}`,
+		},
+		{
+			name:   "Series selector without a metric name",
+			rawACL: twoRules,
+			query:  `{__name__=~"request_.*"}`,
+			want:   `{__name__=~"request_.*", cluster="eu1", namespace="payments"} or {__name__=~"request_.*", cluster="us2", namespace="billing"}`,
+		},
+		{
+			name:   "Three rules",
+			rawACL: "rules: [{ namespace: a }, { namespace: b }, { namespace: c }]",
+			query:  `up`,
+			want:   `(up{namespace="a"} or up{namespace="b"}) or up{namespace="c"}`,
+		},
+		{
+			name:   "Rules with regexps and lists",
+			rawACL: "rules: [{ namespace: 'payments, billing', cluster: eu.* }, { namespace: kube-.*, cluster: us2 }]",
+			query:  `up`,
+			want:   `up{cluster=~"eu.*", namespace=~"payments|billing"} or up{cluster="us2", namespace=~"kube-.*"}`,
+		},
+		{
+			name:   "Rule with full access to one of the labels",
+			rawACL: "rules: [{ namespace: .*, cluster: eu1 }, { namespace: billing, cluster: us2 }]",
+			query:  `up`,
+			want:   `up{cluster="eu1"} or up{cluster="us2", namespace="billing"}`,
+		},
+		{
+			name:   "Exact matcher selects a single rule",
+			rawACL: twoRules,
+			query:  `up{namespace="payments"}`,
+			want:   `up{namespace="payments", cluster="eu1"}`,
+		},
+		{
+			name:   "Exact matchers satisfying a rule are not repeated",
+			rawACL: twoRules,
+			query:  `up{namespace="billing", cluster="us2"}`,
+			want:   `up{namespace="billing", cluster="us2"}`,
+		},
+		{
+			name:   "Fake regexp selects a single rule",
+			rawACL: twoRules,
+			query:  `up{cluster=~"us2"}`,
+			want:   `up{cluster=~"us2", namespace="billing"}`,
+		},
+		{
+			name:   "Exact matcher satisfying a regexp rule",
+			rawACL: "rules: [{ namespace: pay.*, cluster: eu1 }, { namespace: billing, cluster: us2 }]",
+			query:  `up{namespace="payments"}`,
+			want:   `up{namespace="payments", cluster="eu1"}`,
+		},
+		{
+			name:   "Combination of exact matchers not allowed by any rule",
+			rawACL: twoRules,
+			query:  `up{namespace="payments", cluster="us2"}`,
+			want:   `up{namespace="payments", cluster="us2", cluster="eu1"}`,
+		},
+		{
+			name:   "Value not allowed by any rule",
+			rawACL: twoRules,
+			query:  `up{namespace="kube-system"}`,
+			want:   `up{namespace="kube-system", cluster="eu1", namespace="payments"}`,
+		},
+		{
+			name:   "Regexp matchers are kept along with rules",
+			rawACL: twoRules,
+			query:  `up{namespace=~".*"}`,
+			want:   `up{namespace=~".*", cluster="eu1", namespace="payments"} or up{namespace=~".*", cluster="us2", namespace="billing"}`,
+		},
+		{
+			name:   "Negative matchers are kept along with rules",
+			rawACL: twoRules,
+			query:  `up{namespace!="payments"}`,
+			want:   `up{namespace!="payments", cluster="eu1", namespace="payments"} or up{namespace!="payments", cluster="us2", namespace="billing"}`,
+		},
+		{
+			name:   "Rules narrowing down to the same selector",
+			rawACL: "rules: [{ namespace: payments, cluster: eu1 }, { namespace: payments, cluster: eu1 }]",
+			query:  `up`,
+			want:   `up{cluster="eu1", namespace="payments"}`,
+		},
+		{
+			name:   "Rollup function",
+			rawACL: twoRules,
+			query:  `rate(http_requests_total[5m])`,
+			want:   `rate(http_requests_total{cluster="eu1", namespace="payments"}[5m]) or rate(http_requests_total{cluster="us2", namespace="billing"}[5m])`,
+		},
+		{
+			name:   "Rollup function with an implicit window",
+			rawACL: twoRules,
+			query:  `rate(http_requests_total)`,
+			want:   `rate(http_requests_total{cluster="eu1", namespace="payments"}) or rate(http_requests_total{cluster="us2", namespace="billing"})`,
+		},
+		{
+			name:   "Rollup function with the selector not being the first argument",
+			rawACL: twoRules,
+			query:  `quantile_over_time(0.9, request_duration[5m])`,
+			want:   `quantile_over_time(0.9, request_duration{cluster="eu1", namespace="payments"}[5m]) or quantile_over_time(0.9, request_duration{cluster="us2", namespace="billing"}[5m])`,
+		},
+		{
+			name:   "Rollup function with offset",
+			rawACL: twoRules,
+			query:  `increase(http_requests_total[1h] offset 1d)`,
+			want:   `increase(http_requests_total{cluster="eu1", namespace="payments"}[1h] offset 1d) or increase(http_requests_total{cluster="us2", namespace="billing"}[1h] offset 1d)`,
+		},
+		{
+			name:   "Selector with offset",
+			rawACL: twoRules,
+			query:  `up offset 1h`,
+			want:   `up{cluster="eu1", namespace="payments"} offset 1h or up{cluster="us2", namespace="billing"} offset 1h`,
+		},
+		{
+			name:   "Absent selector",
+			rawACL: twoRules,
+			query:  `absent(up{job="demo"})`,
+			want:   `absent(up{job="demo", cluster="eu1", namespace="payments"} or up{job="demo", cluster="us2", namespace="billing"})`,
+		},
+		{
+			name:   "Absent over time has to hold true for all rules",
+			rawACL: twoRules,
+			query:  `absent_over_time(up{job="demo"}[5m])`,
+			want:   `absent_over_time(up{job="demo", cluster="eu1", namespace="payments"}[5m]) and on () absent_over_time(up{job="demo", cluster="us2", namespace="billing"}[5m])`,
+		},
+		{
+			name:   "Aggregation",
+			rawACL: twoRules,
+			query:  `sum(up) by (namespace)`,
+			want:   `sum(up{cluster="eu1", namespace="payments"} or up{cluster="us2", namespace="billing"}) by (namespace)`,
+		},
+		{
+			name:   "Count is not affected by rules overlapping each other",
+			rawACL: "rules: [{ namespace: payments }, { cluster: eu1 }]",
+			query:  `count(up)`,
+			want:   `count(up{namespace="payments"} or up{cluster="eu1"})`,
+		},
+		{
+			name:   "Aggregation over a rollup function",
+			rawACL: twoRules,
+			query:  `sum by (namespace) (rate(http_requests_total{code=~"5.."}[5m]))`,
+			want:   `sum(rate(http_requests_total{code=~"5..", cluster="eu1", namespace="payments"}[5m]) or rate(http_requests_total{code=~"5..", cluster="us2", namespace="billing"}[5m])) by (namespace)`,
+		},
+		{
+			name:   "Histogram quantile",
+			rawACL: twoRules,
+			query:  `histogram_quantile(0.99, sum by (le) (rate(request_duration_bucket[5m])))`,
+			want:   `histogram_quantile(0.99, sum(rate(request_duration_bucket{cluster="eu1", namespace="payments"}[5m]) or rate(request_duration_bucket{cluster="us2", namespace="billing"}[5m])) by (le))`,
+		},
+		{
+			name:   "Topk",
+			rawACL: twoRules,
+			query:  `topk(5, rate(http_requests_total[5m]))`,
+			want:   `topk(5, rate(http_requests_total{cluster="eu1", namespace="payments"}[5m]) or rate(http_requests_total{cluster="us2", namespace="billing"}[5m]))`,
+		},
+		{
+			name:   "Binary operation",
+			rawACL: twoRules,
+			query:  `sum(rate(errors_total[5m])) / sum(rate(requests_total[5m]))`,
+			want:   `sum(rate(errors_total{cluster="eu1", namespace="payments"}[5m]) or rate(errors_total{cluster="us2", namespace="billing"}[5m])) / sum(rate(requests_total{cluster="eu1", namespace="payments"}[5m]) or rate(requests_total{cluster="us2", namespace="billing"}[5m]))`,
+		},
+		{
+			name:   "Binary operation between selectors",
+			rawACL: twoRules,
+			query:  `container_memory_usage_bytes / on (namespace, pod) group_left kube_pod_container_resource_limits`,
+			want:   `(container_memory_usage_bytes{cluster="eu1", namespace="payments"} or container_memory_usage_bytes{cluster="us2", namespace="billing"}) / on (namespace, pod) group_left () (kube_pod_container_resource_limits{cluster="eu1", namespace="payments"} or kube_pod_container_resource_limits{cluster="us2", namespace="billing"})`,
+		},
+		{
+			name:   "Binary operation with a scalar",
+			rawACL: twoRules,
+			query:  `up == 0`,
+			want:   `(up{cluster="eu1", namespace="payments"} or up{cluster="us2", namespace="billing"}) == 0`,
+		},
+		{
+			name:   "Subquery",
+			rawACL: twoRules,
+			query:  `max_over_time(rate(http_requests_total[5m])[1h:1m])`,
+			want:   `max_over_time((rate(http_requests_total{cluster="eu1", namespace="payments"}[5m]) or rate(http_requests_total{cluster="us2", namespace="billing"}[5m]))[1h:1m])`,
+		},
+		{
+			name:   "Subquery over an aggregation",
+			rawACL: twoRules,
+			query:  `max_over_time(sum(up)[1h:])`,
+			want:   `max_over_time(sum(up{cluster="eu1", namespace="payments"} or up{cluster="us2", namespace="billing"})[1h:])`,
+		},
+		{
+			name:   "Label manipulation",
+			rawACL: twoRules,
+			query:  `label_replace(up, "ns", "$1", "namespace", "(.*)")`,
+			want:   `label_replace(up{cluster="eu1", namespace="payments"} or up{cluster="us2", namespace="billing"}, "ns", "$1", "namespace", "(.*)")`,
+		},
+		{
+			name:   "Query without selectors",
+			rawACL: twoRules,
+			query:  `vector(1)`,
+			want:   `vector(1)`,
+		},
+		{
+			name:    "Range selector outside of a rollup function",
+			rawACL:  twoRules,
+			query:   `request_duration[5m]`,
+			wantErr: true,
+		},
+		{
+			name:    "Range selector passed to a transform function",
+			rawACL:  twoRules,
+			query:   `abs(request_duration[5m])`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.rawACL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			qm := QueryModifier{
+				ACL:                 acl,
+				EnableDeduplication: true,
+			}
+
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			originalExpr := metricsql.Clone(expr)
+
+			newExpr, err := qm.modifyMetricExpr(expr, newRegexpBudget())
+			assert.Equal(t, originalExpr, expr, "The original expression got modified. Use metricsql.Clone() before modifying any expression.")
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(newExpr.AppendString(nil)))
+
+			// The rewritten query has to stay valid
+			_, err = metricsql.Parse(tt.want)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestQueryModifier_GetModifiedEncodedURLValues_rules(t *testing.T) {
+	acl, err := NewACL("rules: [{ namespace: payments, cluster: eu1 }, { namespace: billing, cluster: us2 }]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qm := QueryModifier{
+		ACL:                 acl,
+		OptimizeExpressions: true,
+		RequiredLabels:      RequiredLabels{"env": "prod"},
+	}
+
+	params := url.Values{
+		"query":   {`sum(rate(http_requests_total{job="api"}[5m])) by (namespace)`},
+		"match[]": {`up`},
+	}
+
+	want := url.Values{
+		"query":   {`sum(rate(http_requests_total{cluster="eu1", env="prod", job="api", namespace="payments"}[5m]) or rate(http_requests_total{cluster="us2", env="prod", job="api", namespace="billing"}[5m])) by (namespace)`},
+		"match[]": {`up{cluster="eu1", env="prod", namespace="payments"}`, `up{cluster="us2", env="prod", namespace="billing"}`},
+	}
+
+	got, err := qm.GetModifiedEncodedURLValues(params)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Encode(), got)
+}
+
+func Test_parseACLFile_rules(t *testing.T) {
+	content := `
+sets:
+  eu-clusters: eu1, eu2
+payments:
+  rules:
+    - namespace: payments
+      cluster: '@eu-clusters'
+billing:
+  rules:
+    - namespace: billing
+      cluster: us2
+finance:
+  inherits: [payments, billing]
+monitoring:
+  inherits: [payments]
+  metrics:
+    namespace: monitoring
+admin:
+  inherits: [payments]
+  metrics:
+    namespace: .*
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []map[string]string{
+		{"namespace": "payments", "cluster": "eu1, eu2"},
+		{"namespace": "billing", "cluster": "us2"},
+	}, got["finance"].Rules)
+	assert.Empty(t, got["finance"].Metrics)
+
+	// Metrics turn into one more rule, so they're not mixed up with values of the rules
+	assert.Equal(t, []map[string]string{
+		{"namespace": "payments", "cluster": "eu1, eu2"},
+		{"namespace": "monitoring"},
+	}, got["monitoring"].Rules)
+	assert.Empty(t, got["monitoring"].Metrics)
+
+	// Full access makes rules redundant
+	assert.Empty(t, got["admin"].Rules)
+	assert.Equal(t, map[string]string{"namespace": ".*"}, got["admin"].Metrics)
+
+	invalid := map[string]string{
+		"Metrics and rules":            "a: { metrics: { namespace: a }, rules: [{ namespace: b }] }",
+		"Empty rule":                   "a: { rules: [{}] }",
+		"Unknown set":                  "a: { rules: [{ namespace: '@unknown' }] }",
+		"Rules of a time-limited role": "a: { valid_until: 2030-01-01T00:00:00Z, rules: [{ namespace: a }] }\nb: { inherits: [a], metrics: { namespace: b } }",
+	}
+
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseACLFile([]byte(content))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestNewACL_rules(t *testing.T) {
+	acl, err := NewACL("rules: [{ namespace: payments, cluster: eu1 }, { namespace: billing }]")
+	assert.Nil(t, err)
+	assert.Empty(t, acl.Metrics)
+	assert.Equal(t, []Rule{
+		{
+			{Label: "cluster", Value: "eu1"},
+			{Label: "namespace", Value: "payments"},
+		},
+		{
+			{Label: "namespace", Value: "billing"},
+		},
+	}, acl.Rules)
+
+	_, err = NewACL("metrics: { namespace: a }\nrules: [{ namespace: b }]")
+	assert.NotNil(t, err)
+
+	_, err = NewACL("rules: [{ namespace: .* }]")
+	assert.NotNil(t, err)
+}
+
+func TestACLs_GetUserACL_rules(t *testing.T) {
+	acls := make(ACLs)
+
+	defs := map[string]string{
+		"payments":   "rules: [{ namespace: payments, cluster: eu1 }]",
+		"billing":    "rules: [{ namespace: billing, cluster: us2 }]",
+		"monitoring": "metrics: { namespace: monitoring }",
+		"kube":       "metrics: { namespace: kube-system }",
+		"admin":      "metrics: { namespace: .* }",
+	}
+
+	for role, def := range defs {
+		acl, err := NewACL(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acls[role] = acl
+	}
+
+	t.Run("Rules of several roles", func(t *testing.T) {
+		got, err := acls.GetUserACL([]string{"payments", "billing"}, false)
+		assert.Nil(t, err)
+		assert.Empty(t, got.Metrics)
+		assert.Equal(t, []string{`{cluster="eu1", namespace="payments"}`, `{cluster="us2", namespace="billing"}`}, rulesToStrings(got.Rules))
+	})
+
+	t.Run("Metrics of other roles turn into rules", func(t *testing.T) {
+		got, err := acls.GetUserACL([]string{"payments", "monitoring"}, false)
+		assert.Nil(t, err)
+		assert.Empty(t, got.Metrics)
+		assert.Equal(t, []string{`{cluster="eu1", namespace="payments"}`, `{namespace="monitoring"}`}, rulesToStrings(got.Rules))
+	})
+
+	t.Run("Extra ACLs turn into rules", func(t *testing.T) {
+		claimACL, err := NewClaimACL("namespace", []string{"team-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := acls.GetUserACLWithExtra([]string{"payments"}, nil, claimACL)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{`{cluster="eu1", namespace="payments"}`, `{namespace="team-a"}`}, rulesToStrings(got.Rules))
+	})
+
+	t.Run("Roles without rules", func(t *testing.T) {
+		got, err := acls.GetUserACL([]string{"monitoring", "kube"}, false)
+		assert.Nil(t, err)
+		assert.Empty(t, got.Rules)
+		assert.Equal(t, "monitoring|kube-system", got.Metrics["namespace"].Value)
+	})
+
+	t.Run("Full access", func(t *testing.T) {
+		got, err := acls.GetUserACL([]string{"payments", "admin"}, false)
+		assert.Nil(t, err)
+		assert.Empty(t, got.Rules)
+		assert.True(t, got.MetricsMeta["namespace"].Fullaccess)
+	})
+}
+
+// rulesToStrings returns string representations of rules.
+func rulesToStrings(rules []Rule) []string {
+	res := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, rule.String())
+	}
+
+	return res
+}
@@ -0,0 +1,187 @@
+package querymodifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/VictoriaMetrics/metricsql"
+)
+
+// claimTemplateFuncs lists functions available in ACL value templates
+var claimTemplateFuncs = template.FuncMap{
+	"join": joinClaim,
+}
+
+// isClaimTemplate returns true if an ACL definition references token claims, e.g. "{{ .claims.team }}-.*".
+func isClaimTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// newClaimTemplate parses an ACL definition referencing token claims. Missing claims result in an error during execution.
+func newClaimTemplate(label, value string) (*template.Template, error) {
+	tmpl, err := template.New(label).Option("missingkey=error").Funcs(claimTemplateFuncs).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for label %s: %w", label, err)
+	}
+
+	return tmpl, nil
+}
+
+// joinClaim joins the elements of an array claim, e.g. {{ join .claims.teams "|" }}.
+func joinClaim(values []interface{}, sep string) string {
+	elems := make([]string, 0, len(values))
+	for _, v := range values {
+		elems = append(elems, fmt.Sprint(v))
+	}
+
+	return strings.Join(elems, sep)
+}
+
+// escapeClaimValue makes a claim value safe to be used in an ACL definition: regex metacharacters are escaped, so the value is always matched literally, and separators of ACL definitions (commas, spaces) are replaced with hex escapes.
+func escapeClaimValue(value string) string {
+	var b strings.Builder
+
+	for _, ch := range regexp.QuoteMeta(value) {
+		if ch == ',' || unicode.IsSpace(ch) {
+			fmt.Fprintf(&b, `\x{%x}`, ch)
+			continue
+		}
+		b.WriteRune(ch)
+	}
+
+	return b.String()
+}
+
+// escapeClaims returns a copy of claims with all scalar values turned into strings escaped through escapeClaimValue. Numbers are formatted without an exponent (e.g. 1234567 instead of 1.234567e+06). Values of other types (e.g. null) are dropped, so that templates referencing them fail to render.
+func escapeClaims(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string:
+		return escapeClaimValue(v), true
+	case float64:
+		return escapeClaimValue(strconv.FormatFloat(v, 'f', -1, 64)), true
+	case json.Number:
+		return escapeClaimValue(v.String()), true
+	case bool:
+		return escapeClaimValue(strconv.FormatBool(v)), true
+	case []interface{}:
+		escaped := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			if elem, ok := escapeClaims(elem); ok {
+				escaped = append(escaped, elem)
+			}
+		}
+		return escaped, true
+	case map[string]interface{}:
+		escaped := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			if elem, ok := escapeClaims(elem); ok {
+				escaped[key] = elem
+			}
+		}
+		return escaped, true
+	default:
+		return nil, false
+	}
+}
+
+// NewClaimACL returns an ACL for a single label built from a list of values, such as an array claim (e.g. ["a", "b"] turns into label=~"a|b"). Values are escaped, so they're always matched literally.
+func NewClaimACL(label string, values []string) (ACL, error) {
+	escaped := make([]string, 0, len(values))
+	for _, value := range values {
+		escaped = append(escaped, escapeClaimValue(value))
+	}
+
+	lf, metadata, err := newLabelFilter(label, strings.Join(escaped, ", "))
+	if err != nil {
+		return ACL{}, err
+	}
+
+	return ACL{
+		Metrics:     map[string]metricsql.LabelFilter{label: lf},
+		MetricsMeta: map[string]LabelFilterData{label: metadata},
+	}, nil
+}
+
+// Render returns a copy of the ACL, in which value templates are rendered against token claims (available as .claims). Values taken from claims are escaped, so they're always matched literally. A missing claim results in an error.
+func (acl ACL) Render(claims map[string]interface{}) (ACL, error) {
+	if len(acl.Templates) == 0 {
+		return acl, nil
+	}
+
+	rendered := ACL{
+		Metrics:        make(map[string]metricsql.LabelFilter, len(acl.Metrics)+len(acl.Templates)),
+		MetricsMeta:    make(map[string]LabelFilterData, len(acl.MetricsMeta)),
+		Rules:          acl.Rules,
+		Validity:       acl.Validity,
+		Grants:         acl.Grants,
+		TimeLimits:     acl.TimeLimits,
+		QueryLimits:    acl.QueryLimits,
+		Functions:      acl.Functions,
+		RequiredLabels: acl.RequiredLabels,
+		Aggregation:    acl.Aggregation,
+		ExemptMetrics:  acl.ExemptMetrics,
+	}
+
+	for label, lf := range acl.Metrics {
+		rendered.Metrics[label] = lf
+		rendered.MetricsMeta[label] = acl.MetricsMeta[label]
+	}
+
+	escaped, _ := escapeClaims(claims)
+	data := map[string]interface{}{
+		"claims": escaped,
+	}
+
+	for label, tmpl := range acl.Templates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return ACL{}, fmt.Errorf("failed to render template for label %s: %w", label, err)
+		}
+
+		lf, metadata, err := newLabelFilter(label, b.String())
+		if err != nil {
+			return ACL{}, fmt.Errorf("failed to render template for label %s: %w", label, err)
+		}
+
+		rendered.Metrics[label] = lf
+		rendered.MetricsMeta[label] = metadata
+	}
+
+	return rendered, nil
+}
+
+// RenderTemplates returns ACLs, in which the definitions of the given roles are rendered against token claims. Any error results in a hard deny, so that a role is never applied partially.
+func (a ACLs) RenderTemplates(roles []string, claims map[string]interface{}) (ACLs, error) {
+	var rendered ACLs
+
+	for _, role := range roles {
+		acl, exists := a[role]
+		if !exists || len(acl.Templates) == 0 {
+			continue
+		}
+
+		if rendered == nil {
+			rendered = make(ACLs, len(a))
+			for r, acl := range a {
+				rendered[r] = acl
+			}
+		}
+
+		renderedACL, err := acl.Render(claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ACL for role %s: %w", role, err)
+		}
+		rendered[role] = renderedACL
+	}
+
+	if rendered == nil {
+		return a, nil
+	}
+
+	return rendered, nil
+}
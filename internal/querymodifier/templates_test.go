@@ -0,0 +1,330 @@
+package querymodifier
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_escapeClaimValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "Plain value",
+			value: "team-a",
+			want:  "team-a",
+		},
+		{
+			name:  "Regex metacharacters",
+			value: ".*|a",
+			want:  `\.\*\|a`,
+		},
+		{
+			name:  "Separators",
+			value: "a, b",
+			want:  `a\x{2c}\x{20}b`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := escapeClaimValue(tt.value)
+			assert.Equal(t, tt.want, got)
+
+			// Escaped values are always matched literally
+			re, err := metricsql.CompileRegexpAnchored(got)
+			assert.Nil(t, err)
+			assert.True(t, re.MatchString(tt.value))
+		})
+	}
+}
+
+func TestACL_Render(t *testing.T) {
+	acl, err := NewACL("metrics:\n  namespace: '{{ .claims.team }}-.*'\n  tenant: '{{ .claims.org_id }}'\n  cluster: 'prod'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Templates are not turned into label filters until rendered", func(t *testing.T) {
+		assert.Len(t, acl.Metrics, 1)
+		assert.Len(t, acl.Templates, 2)
+	})
+
+	t.Run("Claims are substituted", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team":   "payments",
+			"org_id": "42",
+		}
+
+		want := ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"namespace": {
+					Label:      "namespace",
+					Value:      "payments-.*",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+				"tenant": {
+					Label:      "tenant",
+					Value:      "42",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+				"cluster": {
+					Label:      "cluster",
+					Value:      "prod",
+					IsRegexp:   false,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"namespace": {
+					Fullaccess: false,
+					RawACL:     "payments-.*",
+				},
+				"tenant": {
+					Fullaccess: false,
+					RawACL:     "42",
+				},
+				"cluster": {
+					Fullaccess: false,
+					RawACL:     "prod",
+				},
+			},
+		}
+
+		got, err := acl.Render(claims)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Substituted values are escaped", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team":   ".*",
+			"org_id": "1|2",
+		}
+
+		got, err := acl.Render(claims)
+		assert.Nil(t, err)
+		assert.Equal(t, `\.\*-.*`, got.Metrics["namespace"].Value)
+		assert.Equal(t, `1\|2`, got.Metrics["tenant"].Value)
+		assert.False(t, got.MetricsMeta["namespace"].Fullaccess)
+	})
+
+	t.Run("Substituted values cannot add elements", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team":   "a,.*",
+			"org_id": "42",
+		}
+
+		got, err := acl.Render(claims)
+		assert.Nil(t, err)
+		assert.Equal(t, `a\x{2c}\.\*-.*`, got.Metrics["namespace"].Value)
+	})
+
+	t.Run("Numeric claims", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team":   1.5,
+			"org_id": float64(1234567),
+		}
+
+		got, err := acl.Render(claims)
+		assert.Nil(t, err)
+		assert.Equal(t, `1\.5-.*`, got.Metrics["namespace"].Value)
+		assert.Equal(t, "1234567", got.Metrics["tenant"].Value)
+		assert.False(t, got.Metrics["tenant"].IsRegexp)
+	})
+
+	t.Run("Null claim", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team":   "payments",
+			"org_id": nil,
+		}
+
+		_, err := acl.Render(claims)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Missing claim", func(t *testing.T) {
+		claims := map[string]interface{}{
+			"team": "payments",
+		}
+
+		_, err := acl.Render(claims)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("No claims", func(t *testing.T) {
+		_, err := acl.Render(nil)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Empty claim", func(t *testing.T) {
+		acl, err := NewACL("metrics:\n  tenant: '{{ .claims.org_id }}'\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = acl.Render(map[string]interface{}{"org_id": ""})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Array claim", func(t *testing.T) {
+		acl, err := NewACL("metrics:\n  namespace: '{{ join .claims.teams \"|\" }}'\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := acl.Render(map[string]interface{}{"teams": []interface{}{"a", "b.c"}})
+		assert.Nil(t, err)
+		assert.Equal(t, `a|b\.c`, got.Metrics["namespace"].Value)
+		assert.True(t, got.Metrics["namespace"].IsRegexp)
+
+		got, err = acl.Render(map[string]interface{}{"teams": []interface{}{float64(1000000), nil, "b"}})
+		assert.Nil(t, err)
+		assert.Equal(t, `1000000|b`, got.Metrics["namespace"].Value)
+	})
+
+	t.Run("Invalid template", func(t *testing.T) {
+		_, err := NewACL("metrics:\n  namespace: '{{ .claims.team '\n")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestACLs_RenderTemplates(t *testing.T) {
+	templated, err := NewACL("metrics:\n  namespace: '{{ .claims.team }}'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	static, err := NewACL("metrics:\n  namespace: 'default'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := ACLs{
+		"templated": templated,
+		"static":    static,
+	}
+
+	t.Run("Templates have to be rendered", func(t *testing.T) {
+		_, err := a.GetUserACL([]string{"templated"}, false)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Rendered roles are merged", func(t *testing.T) {
+		roles := []string{"templated", "static"}
+
+		rendered, err := a.RenderTemplates(roles, map[string]interface{}{"team": "payments"})
+		assert.Nil(t, err)
+
+		got, err := rendered.GetUserACL(roles, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "payments|default", got.Metrics["namespace"].Value)
+
+		// The original ACLs are left intact
+		assert.Len(t, a["templated"].Templates, 1)
+	})
+
+	t.Run("Missing claim is a hard deny", func(t *testing.T) {
+		_, err := a.RenderTemplates([]string{"static", "templated"}, map[string]interface{}{})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Roles without templates", func(t *testing.T) {
+		rendered, err := a.RenderTemplates([]string{"static"}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, a, rendered)
+	})
+}
+
+func TestNewClaimACL(t *testing.T) {
+	t.Run("Multiple values", func(t *testing.T) {
+		want := ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"namespace": {
+					Label:      "namespace",
+					Value:      "a|b",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"namespace": {
+					Fullaccess: false,
+					RawACL:     "a,b",
+				},
+			},
+		}
+
+		got, err := NewClaimACL("namespace", []string{"a", "b"})
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Values are escaped", func(t *testing.T) {
+		got, err := NewClaimACL("namespace", []string{".*", "a"})
+		assert.Nil(t, err)
+		assert.Equal(t, `\.\*|a`, got.Metrics["namespace"].Value)
+		assert.False(t, got.MetricsMeta["namespace"].Fullaccess)
+	})
+
+	t.Run("No values", func(t *testing.T) {
+		_, err := NewClaimACL("namespace", []string{})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestACLs_GetUserACLWithExtra(t *testing.T) {
+	static, err := NewACL("metrics:\n  namespace: 'default'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := ACLs{
+		"static": static,
+	}
+
+	claimACL, err := NewClaimACL("namespace", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Extra ACLs are merged with roles", func(t *testing.T) {
+		want := ACL{
+			Metrics: map[string]metricsql.LabelFilter{
+				"namespace": {
+					Label:      "namespace",
+					Value:      "default|a|b",
+					IsRegexp:   true,
+					IsNegative: false,
+				},
+			},
+			MetricsMeta: map[string]LabelFilterData{
+				"namespace": {
+					Fullaccess: false,
+					RawACL:     "default, a,b",
+				},
+			},
+		}
+
+		got, err := a.GetUserACLWithExtra([]string{"static"}, nil, claimACL)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Extra ACLs without roles", func(t *testing.T) {
+		got, err := a.GetUserACLWithExtra([]string{"unknown-role"}, nil, claimACL)
+		assert.Nil(t, err)
+		assert.Equal(t, "a|b", got.Metrics["namespace"].Value)
+	})
+
+	t.Run("No roles and no extra ACLs", func(t *testing.T) {
+		_, err := a.GetUserACLWithExtra([]string{"unknown-role"}, nil)
+		assert.NotNil(t, err)
+	})
+}
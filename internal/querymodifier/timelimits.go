@@ -0,0 +1,328 @@
+package querymodifier
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultStep is used for durations expressed in steps (e.g. [5i]) if a request doesn't specify a step. It matches the default of VictoriaMetrics for instant queries.
+const defaultStep = 5 * time.Minute
+
+// TimeLimits restricts how far back in time and over how long a period a user may query data. Zero values mean no limit.
+type TimeLimits struct {
+	// MaxLookback limits how far back from now the data can be requested.
+	MaxLookback time.Duration
+	// MaxRange limits the period between start and end of a request, as well as the range covered by range selectors and subqueries.
+	MaxRange time.Duration
+}
+
+// IsZero returns true if no limits are set.
+func (tl TimeLimits) IsZero() bool {
+	return tl.MaxLookback == 0 && tl.MaxRange == 0
+}
+
+// merge returns the strictest combination of both limits.
+func (tl TimeLimits) merge(other TimeLimits) TimeLimits {
+	return TimeLimits{
+		MaxLookback: minLimit(tl.MaxLookback, other.MaxLookback),
+		MaxRange:    minLimit(tl.MaxRange, other.MaxRange),
+	}
+}
+
+// minLimit returns the smallest of two limits, where zero stands for no limit.
+func minLimit(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// limitDuration is a duration in acl.yaml, which might be expressed in the Prometheus format (e.g. 30d, 1y).
+type limitDuration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *limitDuration) UnmarshalYAML(node *yaml.Node) error {
+	ms, err := metricsql.PositiveDurationValue(node.Value, 0)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	if ms == 0 {
+		return fmt.Errorf("line %d: duration has to be positive, got %q", node.Line, node.Value)
+	}
+
+	*d = limitDuration(time.Duration(ms) * time.Millisecond)
+
+	return nil
+}
+
+// exprRange returns how far back from its evaluation time an expression reaches (range windows with offsets) and the longest range of data it covers (range windows only), both in milliseconds. Selectors without a window (e.g. x or rate(x)) are treated as if their window was equal to step, since VictoriaMetrics uses max(step, scrape interval) for them. Subtrees pinned to a timestamp through the @ modifier are checked against minTimestamp (if not zero) and don't count towards the lookback.
+func exprRange(expr metricsql.Expr, step, minTimestamp int64) (int64, int64, error) {
+	switch e := expr.(type) {
+	case *metricsql.MetricExpr:
+		return step, step, nil
+	case *metricsql.RollupExpr:
+		var lookback, span int64
+
+		// The window of a selector is accounted for below, inner expressions of subqueries are evaluated with their own step
+		if _, ok := e.Expr.(*metricsql.MetricExpr); !ok || e.ForSubquery() {
+			innerStep := step
+			if d := e.Step.Duration(step); d > 0 {
+				innerStep = d
+			}
+
+			var err error
+			lookback, span, err = exprRange(e.Expr, innerStep, minTimestamp)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		window := step
+		if e.Window != nil {
+			window = e.Window.Duration(step)
+		}
+		lookback += window + e.Offset.Duration(step)
+		span += window
+
+		// Negative offsets point to the future
+		if lookback < 0 {
+			lookback = 0
+		}
+
+		switch at := e.At.(type) {
+		case nil:
+		case *metricsql.NumberExpr:
+			if minTimestamp != 0 && int64(at.N*1000)-lookback < minTimestamp {
+				return 0, 0, fmt.Errorf("%s reaches beyond the allowed lookback", e.AppendString(nil))
+			}
+			return 0, span, nil
+		case *metricsql.FuncExpr:
+			// Both are within the time range of the request, which is checked separately
+			if at.Name != "start" && at.Name != "end" {
+				return 0, 0, fmt.Errorf("only timestamps, start(), and end() are allowed in @ modifiers, got %s", at.AppendString(nil))
+			}
+		default:
+			return 0, 0, fmt.Errorf("only timestamps, start(), and end() are allowed in @ modifiers, got %s", at.AppendString(nil))
+		}
+
+		return lookback, span, nil
+	case *metricsql.FuncExpr:
+		return maxExprRange(e.Args, step, minTimestamp)
+	case *metricsql.AggrFuncExpr:
+		return maxExprRange(e.Args, step, minTimestamp)
+	case *metricsql.BinaryOpExpr:
+		return maxExprRange([]metricsql.Expr{e.Left, e.Right}, step, minTimestamp)
+	default:
+		return 0, 0, nil
+	}
+}
+
+// maxExprRange returns the maximum values returned by exprRange for all expressions.
+func maxExprRange(exprs []metricsql.Expr, step, minTimestamp int64) (int64, int64, error) {
+	var maxLookback, maxSpan int64
+
+	for _, expr := range exprs {
+		lookback, span, err := exprRange(expr, step, minTimestamp)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if lookback > maxLookback {
+			maxLookback = lookback
+		}
+		if span > maxSpan {
+			maxSpan = span
+		}
+	}
+
+	return maxLookback, maxSpan, nil
+}
+
+// firstValue returns the first value of a parameter found in any of the sets.
+func firstValue(key string, sets ...url.Values) (string, bool) {
+	for _, params := range sets {
+		if vv, ok := params[key]; ok && len(vv) > 0 {
+			return vv[0], true
+		}
+	}
+
+	return "", false
+}
+
+// parseTimestamp parses a timestamp in one of the formats supported by Prometheus (Unix time in seconds or RFC 3339) or a relative one supported by VictoriaMetrics (e.g. -1h). It returns Unix time in milliseconds.
+func parseTimestamp(s string, now time.Time) (int64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return int64(f * 1000), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixMilli(), nil
+	}
+
+	if d, err := metricsql.DurationValue(s, 0); err == nil && d <= 0 {
+		return now.UnixMilli() + d, nil
+	}
+
+	return 0, fmt.Errorf("cannot parse timestamp %q", s)
+}
+
+// formatTimestamp formats Unix time in milliseconds the way Prometheus expects it in parameters.
+func formatTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
+
+// formatLimit formats a duration in milliseconds in a human-readable way, whole days are shown as days.
+func formatLimit(ms int64) string {
+	d := time.Duration(ms) * time.Millisecond
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+
+	return d.String()
+}
+
+// ApplyTimeLimits checks a request against time limits. Instant queries are checked as is. For all other requests, "start" is clamped to the allowed lookback (or set if omitted), so that a request is narrowed down rather than rejected whenever possible. Parameters are modified in place, other violations result in an error.
+func ApplyTimeLimits(tl TimeLimits, getParams, postParams url.Values, now time.Time) error {
+	if tl.IsZero() {
+		return nil
+	}
+
+	step := defaultStep.Milliseconds()
+	if s, ok := firstValue("step", postParams, getParams); ok {
+		d, err := metricsql.PositiveDurationValue(s, 0)
+		if err != nil {
+			return fmt.Errorf("cannot parse step %q: %w", s, err)
+		}
+		if d > 0 {
+			step = d
+		}
+	}
+
+	var minTimestamp int64
+	if tl.MaxLookback > 0 {
+		minTimestamp = now.UnixMilli() - tl.MaxLookback.Milliseconds()
+	}
+
+	var lookback, span int64
+	for _, key := range []string{"query", "match[]"} {
+		var exprs []metricsql.Expr
+		for _, params := range []url.Values{getParams, postParams} {
+			for _, v := range params[key] {
+				expr, err := metricsql.Parse(v)
+				if err != nil {
+					return err
+				}
+				exprs = append(exprs, expr)
+			}
+		}
+
+		// Series selectors in match[] are not evaluated with any step
+		keyStep := step
+		if key == "match[]" {
+			keyStep = 0
+		}
+
+		keyLookback, keySpan, err := maxExprRange(exprs, keyStep, minTimestamp)
+		if err != nil {
+			return err
+		}
+
+		lookback = max(lookback, keyLookback)
+		span = max(span, keySpan)
+	}
+
+	var err error
+
+	if tl.MaxLookback > 0 && lookback > tl.MaxLookback.Milliseconds() {
+		return fmt.Errorf("the query looks back %s, which exceeds the allowed lookback of %s", formatLimit(lookback), formatLimit(tl.MaxLookback.Milliseconds()))
+	}
+
+	if tl.MaxRange > 0 && span > tl.MaxRange.Milliseconds() {
+		return fmt.Errorf("the query covers a range of %s, which exceeds the allowed range of %s", formatLimit(span), formatLimit(tl.MaxRange.Milliseconds()))
+	}
+
+	rawStart, hasStart := firstValue("start", postParams, getParams)
+	rawEnd, hasEnd := firstValue("end", postParams, getParams)
+	_, hasQuery := firstValue("query", postParams, getParams)
+
+	// Instant queries
+	if hasQuery && !hasStart && !hasEnd {
+		ts := now.UnixMilli()
+		if rawTime, ok := firstValue("time", postParams, getParams); ok {
+			ts, err = parseTimestamp(rawTime, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		if minTimestamp != 0 && ts-lookback < minTimestamp {
+			return fmt.Errorf("data older than %s cannot be queried", formatLimit(tl.MaxLookback.Milliseconds()))
+		}
+
+		return nil
+	}
+
+	end := now.UnixMilli()
+	if hasEnd {
+		end, err = parseTimestamp(rawEnd, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	var start int64
+	if hasStart {
+		start, err = parseTimestamp(rawStart, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	clamped := false
+
+	if minTimestamp != 0 {
+		// Range selectors and subqueries reach further back than start
+		minStart := minTimestamp + lookback
+		if end < minStart {
+			return fmt.Errorf("data older than %s cannot be queried", formatLimit(tl.MaxLookback.Milliseconds()))
+		}
+
+		if !hasStart || start < minStart {
+			start = minStart
+			clamped = true
+		}
+	}
+
+	if tl.MaxRange > 0 && end-start > tl.MaxRange.Milliseconds() {
+		if hasStart {
+			return fmt.Errorf("the requested time range of %s exceeds the allowed range of %s", formatLimit(end-start), formatLimit(tl.MaxRange.Milliseconds()))
+		}
+
+		start = end - tl.MaxRange.Milliseconds()
+		clamped = true
+	}
+
+	if clamped {
+		newStart := formatTimestamp(start)
+		set := false
+		for _, params := range []url.Values{getParams, postParams} {
+			if _, ok := params["start"]; ok {
+				params.Set("start", newStart)
+				set = true
+			}
+		}
+		if !set {
+			getParams.Set("start", newStart)
+		}
+	}
+
+	return nil
+}
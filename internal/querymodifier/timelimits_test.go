@@ -0,0 +1,337 @@
+package querymodifier
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_exprRange(t *testing.T) {
+	minTimestamp := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	tests := []struct {
+		name         string
+		query        string
+		wantLookback time.Duration
+		wantSpan     time.Duration
+		wantErr      bool
+	}{
+		{
+			name:         "Instant selector",
+			query:        `up{namespace="a"}`,
+			wantLookback: time.Minute,
+			wantSpan:     time.Minute,
+		},
+		{
+			name:         "Rollup function without a window",
+			query:        `rate(http_requests_total)`,
+			wantLookback: time.Minute,
+			wantSpan:     time.Minute,
+		},
+		{
+			name:         "Range selector",
+			query:        `rate(http_requests_total[5m])`,
+			wantLookback: 5 * time.Minute,
+			wantSpan:     5 * time.Minute,
+		},
+		{
+			name:         "Offset",
+			query:        `rate(http_requests_total[5m] offset 1d)`,
+			wantLookback: 24*time.Hour + 5*time.Minute,
+			wantSpan:     5 * time.Minute,
+		},
+		{
+			name:     "Negative offset",
+			query:    `up offset -1h`,
+			wantSpan: time.Minute,
+		},
+		{
+			name:         "Subquery",
+			query:        `max_over_time(rate(http_requests_total[5m])[30d:1h])`,
+			wantLookback: 30*24*time.Hour + 5*time.Minute,
+			wantSpan:     30*24*time.Hour + 5*time.Minute,
+		},
+		{
+			name:         "Subquery over a rollup function without a window",
+			query:        `max_over_time(rate(http_requests_total)[1d:10m])`,
+			wantLookback: 24*time.Hour + 10*time.Minute,
+			wantSpan:     24*time.Hour + 10*time.Minute,
+		},
+		{
+			name:         "Binary operation and aggregation",
+			query:        `sum(rate(a[1h])) / sum(rate(b[2h] offset 1h))`,
+			wantLookback: 3 * time.Hour,
+			wantSpan:     2 * time.Hour,
+		},
+		{
+			name:         "Window in steps",
+			query:        `rate(a[3i])`,
+			wantLookback: 3 * time.Minute,
+			wantSpan:     3 * time.Minute,
+		},
+		{
+			name:         "@ end()",
+			query:        `rate(a[1h] @ end())`,
+			wantLookback: time.Hour,
+			wantSpan:     time.Hour,
+		},
+		{
+			name:     "@ timestamp within the lookback",
+			query:    `rate(a[1h] @ 1791000000)`,
+			wantSpan: time.Hour,
+		},
+		{
+			name:    "@ timestamp beyond the lookback",
+			query:   `rate(a[1h] @ 1700000000)`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := metricsql.Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lookback, span, err := exprRange(expr, time.Minute.Milliseconds(), minTimestamp)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantLookback.Milliseconds(), lookback)
+			assert.Equal(t, tt.wantSpan.Milliseconds(), span)
+		})
+	}
+}
+
+func TestApplyTimeLimits(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	ts := func(d time.Duration) string {
+		return formatTimestamp(now.Add(-d).UnixMilli())
+	}
+
+	limits := TimeLimits{MaxLookback: 30 * day, MaxRange: 7 * day}
+
+	tests := []struct {
+		name       string
+		limits     TimeLimits
+		getParams  url.Values
+		postParams url.Values
+		want       url.Values
+		wantErr    bool
+	}{
+		{
+			name:      "No limits",
+			getParams: url.Values{"query": {"up"}, "time": {ts(365 * day)}},
+			want:      url.Values{"query": {"up"}, "time": {ts(365 * day)}},
+		},
+		{
+			name:      "Instant query within the lookback",
+			limits:    limits,
+			getParams: url.Values{"query": {"rate(up[1d])"}, "time": {ts(28 * day)}},
+			want:      url.Values{"query": {"rate(up[1d])"}, "time": {ts(28 * day)}},
+		},
+		{
+			name:      "Instant query without time",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}},
+			want:      url.Values{"query": {"up"}},
+		},
+		{
+			name:      "Instant query beyond the lookback",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "time": {ts(31 * day)}},
+			wantErr:   true,
+		},
+		{
+			name:      "Instant query reaching beyond the lookback through a range selector",
+			limits:    limits,
+			getParams: url.Values{"query": {"rate(up[3d])"}, "time": {ts(28 * day)}},
+			wantErr:   true,
+		},
+		{
+			name:      "Range selector longer than the lookback",
+			limits:    TimeLimits{MaxLookback: 30 * day},
+			getParams: url.Values{"query": {"rate(up[31d])"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Offset beyond the lookback",
+			limits:    limits,
+			getParams: url.Values{"query": {"up offset 31d"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Instant query reaching beyond the lookback through a step of a rollup function without a window",
+			limits:    limits,
+			getParams: url.Values{"query": {"rate(up)"}, "step": {"1000d"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Range query reaching beyond the lookback through a step of a selector without a window",
+			limits:    TimeLimits{MaxLookback: 30 * day},
+			getParams: url.Values{"query": {"up"}, "start": {ts(day)}, "end": {ts(0)}, "step": {"31d"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Subquery longer than the allowed range",
+			limits:    limits,
+			getParams: url.Values{"query": {"max_over_time(up[8d:1h])"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Unsupported @ modifier",
+			limits:    limits,
+			getParams: url.Values{"query": {"up @ time()"}},
+			wantErr:   true,
+		},
+		{
+			name:      "Range query within limits",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "start": {ts(3 * day)}, "end": {ts(0)}, "step": {"60"}},
+			want:      url.Values{"query": {"up"}, "start": {ts(3 * day)}, "end": {ts(0)}, "step": {"60"}},
+		},
+		{
+			name:      "Start is clamped to the lookback",
+			limits:    TimeLimits{MaxLookback: 30 * day},
+			getParams: url.Values{"query": {"up"}, "start": {ts(60 * day)}, "end": {ts(0)}},
+			want:      url.Values{"query": {"up"}, "start": {ts(30*day - defaultStep)}, "end": {ts(0)}},
+		},
+		{
+			name:       "Start is clamped in the POST body",
+			limits:     TimeLimits{MaxLookback: 30 * day},
+			postParams: url.Values{"query": {"rate(up[1d])"}, "start": {now.Add(-60 * day).Format(time.RFC3339)}},
+			want:       url.Values{"query": {"rate(up[1d])"}, "start": {ts(29 * day)}},
+		},
+		{
+			name:      "Relative start is clamped",
+			limits:    TimeLimits{MaxLookback: 30 * day},
+			getParams: url.Values{"query": {"up"}, "start": {"-60d"}},
+			want:      url.Values{"query": {"up"}, "start": {ts(30*day - defaultStep)}},
+		},
+		{
+			name:      "Missing start is set",
+			limits:    TimeLimits{MaxLookback: 30 * day},
+			getParams: url.Values{"match[]": {"up"}},
+			want:      url.Values{"match[]": {"up"}, "start": {ts(30 * day)}},
+		},
+		{
+			name:      "Missing start is set to the allowed range",
+			limits:    TimeLimits{MaxRange: 7 * day},
+			getParams: url.Values{"match[]": {"up"}, "end": {ts(day)}},
+			want:      url.Values{"match[]": {"up"}, "end": {ts(day)}, "start": {ts(8 * day)}},
+		},
+		{
+			name:      "End beyond the lookback",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "start": {ts(40 * day)}, "end": {ts(35 * day)}},
+			wantErr:   true,
+		},
+		{
+			name:      "Time range exceeds the allowed range",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "start": {ts(10 * day)}, "end": {ts(0)}},
+			wantErr:   true,
+		},
+		{
+			name:      "Time range exceeds the allowed range after clamping",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "start": {ts(60 * day)}, "end": {ts(0)}},
+			wantErr:   true,
+		},
+		{
+			name:      "Invalid timestamp",
+			limits:    limits,
+			getParams: url.Values{"query": {"up"}, "start": {"yesterday"}},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getParams := url.Values{}
+			for k, v := range tt.getParams {
+				getParams[k] = v
+			}
+			postParams := url.Values{}
+			for k, v := range tt.postParams {
+				postParams[k] = v
+			}
+
+			err := ApplyTimeLimits(tt.limits, getParams, postParams, now)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			got := url.Values{}
+			for _, params := range []url.Values{getParams, postParams} {
+				for k, v := range params {
+					got[k] = append(got[k], v...)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestACLs_GetUserACL_timeLimits(t *testing.T) {
+	acls := make(ACLs)
+
+	defs := map[string]string{
+		"contractor":    "metrics: { namespace: a }\nmax_lookback: 30d\nmax_range: 1y",
+		"short-range":   "metrics: { namespace: b }\nmax_range: 7d",
+		"unlimited":     "metrics: { namespace: c }",
+		"invalid-limit": "metrics: { namespace: d }\nmax_lookback: -1d",
+	}
+
+	for role, def := range defs {
+		acl, err := NewACL(def)
+		if role == "invalid-limit" {
+			assert.NotNil(t, err)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		acls[role] = acl
+	}
+
+	assert.Equal(t, TimeLimits{MaxLookback: 30 * 24 * time.Hour, MaxRange: 365 * 24 * time.Hour}, acls["contractor"].TimeLimits)
+
+	got, err := acls.GetUserACL([]string{"contractor", "short-range", "unlimited"}, false)
+	assert.Nil(t, err)
+	// The strictest limits win, roles without limits don't lift them
+	assert.Equal(t, TimeLimits{MaxLookback: 30 * 24 * time.Hour, MaxRange: 7 * 24 * time.Hour}, got.TimeLimits)
+
+	got, err = acls.GetUserACL([]string{"unlimited"}, false)
+	assert.Nil(t, err)
+	assert.True(t, got.TimeLimits.IsZero())
+}
+
+func Test_parseACLFile_timeLimits(t *testing.T) {
+	content := `
+contractor:
+  max_lookback: 30d
+  metrics:
+    namespace: a
+team-a:
+  inherits: [contractor]
+  max_range: 1w
+  max_lookback: 60d
+  metrics:
+    namespace: b
+`
+	got, err := parseACLFile([]byte(content))
+	assert.Nil(t, err)
+	assert.Equal(t, TimeLimits{MaxLookback: 30 * 24 * time.Hour, MaxRange: 7 * 24 * time.Hour}, got["team-a"].timeLimits())
+}
@@ -0,0 +1,164 @@
+package querymodifier
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// States of time-limited roles and grants
+const (
+	ValidityStatePending  = "pending"
+	ValidityStateActive   = "active"
+	ValidityStateExpiring = "expiring"
+	ValidityStateExpired  = "expired"
+)
+
+// Validity limits the period, during which a role or a grant is applied. Zero values mean no limit.
+type Validity struct {
+	ValidFrom  time.Time `yaml:"valid_from"`
+	ValidUntil time.Time `yaml:"valid_until"`
+}
+
+// IsLimited returns true if at least one of the boundaries is set.
+func (v Validity) IsLimited() bool {
+	return !v.ValidFrom.IsZero() || !v.ValidUntil.IsZero()
+}
+
+// IsActive returns true if the moment belongs to the period [ValidFrom, ValidUntil).
+func (v Validity) IsActive(now time.Time) bool {
+	if !v.ValidFrom.IsZero() && now.Before(v.ValidFrom) {
+		return false
+	}
+
+	if !v.ValidUntil.IsZero() && !now.Before(v.ValidUntil) {
+		return false
+	}
+
+	return true
+}
+
+// State returns one of the ValidityState* constants. An active period is considered expiring if it ends within warning.
+func (v Validity) State(now time.Time, warning time.Duration) string {
+	switch {
+	case !v.ValidFrom.IsZero() && now.Before(v.ValidFrom):
+		return ValidityStatePending
+	case !v.ValidUntil.IsZero() && !now.Before(v.ValidUntil):
+		return ValidityStateExpired
+	case !v.ValidUntil.IsZero() && v.ValidUntil.Sub(now) <= warning:
+		return ValidityStateExpiring
+	default:
+		return ValidityStateActive
+	}
+}
+
+// Period returns a human-readable representation of the period. It's not called String on purpose, since Validity is embedded into ACL.
+func (v Validity) Period() string {
+	from, until := "-", "-"
+	if !v.ValidFrom.IsZero() {
+		from = v.ValidFrom.Format(time.RFC3339)
+	}
+	if !v.ValidUntil.IsZero() {
+		until = v.ValidUntil.Format(time.RFC3339)
+	}
+
+	return fmt.Sprintf("[%s, %s)", from, until)
+}
+
+// validate returns an error if the period is empty.
+func (v Validity) validate() error {
+	if !v.ValidFrom.IsZero() && !v.ValidUntil.IsZero() && !v.ValidFrom.Before(v.ValidUntil) {
+		return fmt.Errorf("valid_from (%s) has to be before valid_until (%s)", v.ValidFrom.Format(time.RFC3339), v.ValidUntil.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// intersect returns the period, during which both v and other are active. The result might be empty.
+func (v Validity) intersect(other Validity) Validity {
+	res := v
+
+	if other.ValidFrom.After(res.ValidFrom) {
+		res.ValidFrom = other.ValidFrom
+	}
+
+	if !other.ValidUntil.IsZero() && (res.ValidUntil.IsZero() || other.ValidUntil.Before(res.ValidUntil)) {
+		res.ValidUntil = other.ValidUntil
+	}
+
+	return res
+}
+
+// Grant is a time-limited ACL, which is merged into the ACL of a role while it's valid.
+type Grant struct {
+	Validity
+	ACL ACL
+}
+
+// TimeLimitedGrant describes a time-limited role or grant, it's used for reporting.
+type TimeLimitedGrant struct {
+	Validity
+	Role string
+	// Grant is the index of a grant within the role, -1 stands for the role itself.
+	Grant int
+}
+
+// String returns a human-readable name of the grant.
+func (g TimeLimitedGrant) String() string {
+	if g.Grant < 0 {
+		return fmt.Sprintf("role %s", g.Role)
+	}
+
+	return fmt.Sprintf("grant #%d of role %s", g.Grant, g.Role)
+}
+
+// TimeLimitedGrants returns all time-limited roles and grants sorted by role names.
+func (a ACLs) TimeLimitedGrants() []TimeLimitedGrant {
+	var grants []TimeLimitedGrant
+
+	for role, acl := range a {
+		if acl.IsLimited() {
+			grants = append(grants, TimeLimitedGrant{Validity: acl.Validity, Role: role, Grant: -1})
+		}
+
+		for i, grant := range acl.Grants {
+			grants = append(grants, TimeLimitedGrant{Validity: grant.Validity, Role: role, Grant: i})
+		}
+	}
+
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Role != grants[j].Role {
+			return grants[i].Role < grants[j].Role
+		}
+		return grants[i].Grant < grants[j].Grant
+	})
+
+	return grants
+}
+
+// activeRoles returns the roles, which are active at the given moment, along with their active grants. Inactive roles are dropped, so they're never treated as assumed roles.
+func (a ACLs) activeRoles(roles []string, now time.Time) ([]string, []ACL) {
+	active := make([]string, 0, len(roles))
+	var grants []ACL
+
+	for _, role := range roles {
+		acl, exists := a[role]
+		if !exists {
+			active = append(active, role)
+			continue
+		}
+
+		if !acl.IsActive(now) {
+			continue
+		}
+		active = append(active, role)
+
+		for _, grant := range acl.Grants {
+			if grant.IsActive(now) {
+				grants = append(grants, grant.ACL)
+			}
+		}
+	}
+
+	return active, grants
+}
@@ -0,0 +1,293 @@
+package querymodifier
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidity_State(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		validity   Validity
+		wantActive bool
+		wantState  string
+	}{
+		{
+			name:       "Not limited",
+			validity:   Validity{},
+			wantActive: true,
+			wantState:  ValidityStateActive,
+		},
+		{
+			name:       "Pending",
+			validity:   Validity{ValidFrom: now.Add(time.Hour)},
+			wantActive: false,
+			wantState:  ValidityStatePending,
+		},
+		{
+			name:       "Starts now",
+			validity:   Validity{ValidFrom: now},
+			wantActive: true,
+			wantState:  ValidityStateActive,
+		},
+		{
+			name:       "Active",
+			validity:   Validity{ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(48 * time.Hour)},
+			wantActive: true,
+			wantState:  ValidityStateActive,
+		},
+		{
+			name:       "Expiring",
+			validity:   Validity{ValidUntil: now.Add(time.Hour)},
+			wantActive: true,
+			wantState:  ValidityStateExpiring,
+		},
+		{
+			name:       "Ends now",
+			validity:   Validity{ValidUntil: now},
+			wantActive: false,
+			wantState:  ValidityStateExpired,
+		},
+		{
+			name:       "Expired",
+			validity:   Validity{ValidUntil: now.Add(-time.Hour)},
+			wantActive: false,
+			wantState:  ValidityStateExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantActive, tt.validity.IsActive(now))
+			assert.Equal(t, tt.wantState, tt.validity.State(now, 24*time.Hour))
+		})
+	}
+}
+
+func TestValidity_intersect(t *testing.T) {
+	t1 := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+	t3 := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, Validity{ValidFrom: t2, ValidUntil: t3}, Validity{ValidFrom: t1, ValidUntil: t3}.intersect(Validity{ValidFrom: t2}))
+	assert.Equal(t, Validity{ValidFrom: t1, ValidUntil: t2}, Validity{ValidFrom: t1}.intersect(Validity{ValidUntil: t2}))
+	assert.NotNil(t, Validity{ValidUntil: t1}.intersect(Validity{ValidFrom: t2}).validate())
+}
+
+func Test_parseACLFile_validity(t *testing.T) {
+	t.Run("Grants and inherited time-limited roles", func(t *testing.T) {
+		content := `
+incident:
+  valid_until: 2026-10-20T00:00:00Z
+  metrics:
+    namespace: 'payments'
+  grants:
+    - valid_from: 2026-10-15T00:00:00Z
+      valid_until: 2026-10-25T00:00:00Z
+      metrics:
+        namespace: 'billing'
+team-a:
+  inherits: [incident]
+  metrics:
+    namespace: 'a'
+`
+		got, err := parseACLFile([]byte(content))
+		assert.Nil(t, err)
+
+		want := roleDefinition{
+			Metrics: map[string]string{"namespace": "a"},
+			Grants: []grantDefinition{
+				{
+					Validity: Validity{ValidUntil: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+					Metrics:  map[string]string{"namespace": "payments"},
+				},
+				{
+					// The grant cannot outlive the role it belongs to
+					Validity: Validity{ValidFrom: time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), ValidUntil: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+					Metrics:  map[string]string{"namespace": "billing"},
+				},
+			},
+		}
+		assert.Equal(t, want, got["team-a"])
+	})
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "Empty role period",
+			content: "a: { valid_from: 2026-10-20T00:00:00Z, valid_until: 2026-10-10T00:00:00Z, metrics: { namespace: a }}",
+		},
+		{
+			name:    "Empty grant period",
+			content: "a: { grants: [{ valid_from: 2026-10-20T00:00:00Z, valid_until: 2026-10-20T00:00:00Z, metrics: { namespace: a }}]}",
+		},
+		{
+			name:    "Grant without metrics",
+			content: "a: { grants: [{ valid_until: 2026-10-20T00:00:00Z }]}",
+		},
+		{
+			name:    "Invalid timestamp",
+			content: "a: { valid_until: tomorrow, metrics: { namespace: a }}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACLFile([]byte(tt.content))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestACLs_getUserACLAt(t *testing.T) {
+	f, err := os.CreateTemp("", "acl-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	saveACLToFile(t, f, `
+team-a:
+  metrics:
+    namespace: 'a'
+  grants:
+    - valid_until: 2026-10-20T00:00:00Z
+      metrics:
+        namespace: 'payments'
+incident:
+  valid_from: 2026-10-10T00:00:00Z
+  valid_until: 2026-10-20T00:00:00Z
+  metrics:
+    namespace: 'billing'
+on-call:
+  grants:
+    - valid_until: 2026-10-20T00:00:00Z
+      metrics:
+        namespace: 'shipping'
+`)
+
+	acls, err := NewACLsFromFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	during := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	after := time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		roles        []string
+		assumedRoles AssumedRolesTemplate
+		want         string
+		wantRawACL   string
+		wantErr      bool
+	}{
+		{
+			name:       "Active grant is merged",
+			now:        during,
+			roles:      []string{"team-a"},
+			want:       `namespace=~"a|payments"`,
+			wantRawACL: "a, payments",
+		},
+		{
+			name:       "Expired grant is ignored",
+			now:        after,
+			roles:      []string{"team-a"},
+			want:       `namespace="a"`,
+			wantRawACL: "a",
+		},
+		{
+			name:       "Active role",
+			now:        during,
+			roles:      []string{"team-a", "incident"},
+			want:       `namespace=~"a|billing|payments"`,
+			wantRawACL: "a, billing, payments",
+		},
+		{
+			name:    "Pending role",
+			now:     before,
+			roles:   []string{"incident"},
+			wantErr: true,
+		},
+		{
+			name:       "Expired role is ignored",
+			now:        after,
+			roles:      []string{"team-a", "incident"},
+			want:       `namespace="a"`,
+			wantRawACL: "a",
+		},
+		{
+			name:         "Expired role is not treated as an assumed role",
+			now:          after,
+			roles:        []string{"incident"},
+			assumedRoles: DefaultAssumedRolesTemplate,
+			wantErr:      true,
+		},
+		{
+			name:       "Role with grants only",
+			now:        during,
+			roles:      []string{"on-call", "team-a"},
+			want:       `namespace=~"a|shipping|payments"`,
+			wantRawACL: "a, shipping, payments",
+		},
+		{
+			name:    "Role with expired grants only",
+			now:     after,
+			roles:   []string{"on-call"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := acls.getUserACLAt(tt.now, tt.roles, tt.assumedRoles)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			lf := got.Metrics["namespace"]
+			assert.Equal(t, tt.want, string(lf.AppendString(nil)))
+			assert.Equal(t, tt.wantRawACL, got.MetricsMeta["namespace"].RawACL)
+		})
+	}
+
+	t.Run("Time-limited grants are listed", func(t *testing.T) {
+		got := acls.TimeLimitedGrants()
+		assert.Len(t, got, 3)
+		assert.Equal(t, "role incident", got[0].String())
+		assert.Equal(t, "grant #0 of role on-call", got[1].String())
+		assert.Equal(t, "grant #0 of role team-a", got[2].String())
+	})
+}
+
+func TestACL_NewACLsFromFile_grantTemplates(t *testing.T) {
+	f, err := os.CreateTemp("", "acl-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	saveACLToFile(t, f, "a: { grants: [{ valid_until: 2026-10-20T00:00:00Z, metrics: { namespace: '{{ .claims.team }}' }}]}")
+
+	_, err = NewACLsFromFile(f.Name())
+	assert.NotNil(t, err)
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}